@@ -2,18 +2,30 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/iotstudio/iotstudio/internal/config"
+	"github.com/iotstudio/iotstudio/internal/connections"
+	"github.com/iotstudio/iotstudio/internal/ingest"
+	"github.com/iotstudio/iotstudio/internal/opcua"
+	"github.com/iotstudio/iotstudio/internal/protocols/modbus"
+	"github.com/iotstudio/iotstudio/internal/protocols/mqtt"
 	"github.com/iotstudio/iotstudio/internal/server"
+	"github.com/iotstudio/iotstudio/internal/storage"
+	"github.com/iotstudio/iotstudio/internal/storage/postgres"
 	"github.com/iotstudio/iotstudio/internal/storage/sqlite"
 
 	"github.com/rs/zerolog/log"
 )
 
 func main() {
+	migrateTo := flag.Int("migrate-to", -1, "migrate the database to this schema version and exit")
+	flag.Parse()
+
 	log.Info().Msg("Starting IoTStudio Backend")
 
 	cfg, err := config.Load()
@@ -21,9 +33,34 @@ func main() {
 		log.Fatal().Err(err).Msg("Failed to load configuration")
 	}
 
-	log.Info().Str("db_path", cfg.Database.Path).Msg("Database path")
+	if cfg.Database.Driver == "sqlite" {
+		log.Info().Str("db_path", cfg.Database.Path).Msg("Database path")
+	} else {
+		log.Info().Str("db_driver", cfg.Database.Driver).Msg("Database driver")
+	}
+
+	if *migrateTo >= 0 {
+		if err := migrateDatabase(cfg.Database, *migrateTo); err != nil {
+			log.Fatal().Err(err).Msg("Failed to migrate database")
+		}
+		log.Info().Int("version", *migrateTo).Msg("Database migrated")
+		return
+	}
+
+	ingestConfig := ingest.Config{
+		QueueSize:     cfg.Ingest.QueueSize,
+		BatchSize:     cfg.Ingest.BatchSize,
+		FlushInterval: cfg.Ingest.FlushInterval,
+		Policy:        cfg.Ingest.Policy,
+		BlockTimeout:  cfg.Ingest.BlockTimeout,
+		Retries:       cfg.Ingest.Retries,
+		RetryDelay:    cfg.Ingest.RetryDelay,
+	}
+	if err := ingestConfig.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid ingest configuration")
+	}
 
-	storage, err := sqlite.NewSQLiteStorage(cfg.Database.Path)
+	storage, err := openStorage(cfg.Database)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create storage")
 	}
@@ -32,18 +69,104 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	var bridge *mqtt.Publisher
+
+	if cfg.MQTT.Enabled {
+		bridge = mqtt.NewPublisher(mqtt.PublisherConfig{
+			Broker:        cfg.MQTT.Broker,
+			ClientID:      cfg.MQTT.ClientID,
+			Username:      cfg.MQTT.Username,
+			Password:      cfg.MQTT.Password,
+			TopicTemplate: cfg.MQTT.TopicTemplate,
+			QoS:           cfg.MQTT.QoS,
+			Retain:        cfg.MQTT.Retain,
+			Format:        cfg.MQTT.Format,
+			Timeout:       cfg.MQTT.Timeout,
+		})
+		if err := bridge.Connect(ctx); err != nil {
+			log.Fatal().Err(err).Msg("Failed to start MQTT bridge")
+		}
+		defer bridge.Close()
+	}
+
 	srv := server.NewServer(server.ServerConfig{
 		Addr:    cfg.Server.Addr,
 		Storage: storage,
+		Ingest:  ingestConfig,
+		Recordings: connections.RecordingsConfig{
+			Dir:     cfg.Replay.Dir,
+			MaxSize: cfg.Replay.MaxSize,
+		},
 	})
+	// Runs before the storage and the bridge close, writing the data points
+	// still queued
+	defer srv.GetConnectionManager().Close()
+
+	if bridge != nil {
+		srv.GetConnectionManager().AddSink(bridge)
+	}
 
 	errChan := make(chan error, 1)
+
+	if cfg.OPCUA.Enabled {
+		opcuaServer := opcua.NewServer(opcua.Config{
+			Addr:           cfg.OPCUA.Addr,
+			EndpointURL:    cfg.OPCUA.EndpointURL,
+			ApplicationURI: cfg.OPCUA.ApplicationURI,
+			NamespaceURI:   cfg.OPCUA.NamespaceURI,
+			SessionTimeout: cfg.OPCUA.SessionTimeout,
+			MaxSessions:    cfg.OPCUA.MaxSessions,
+			AllowWrites:    cfg.OPCUA.AllowWrites,
+			Directory:      storage,
+			Handlers:       srv.GetConnectionManager().GetConnection,
+		})
+		if err := opcuaServer.Listen(); err != nil {
+			log.Fatal().Err(err).Msg("Failed to start OPC UA server")
+		}
+
+		srv.GetConnectionManager().AddSink(opcuaServer)
+		go func() {
+			if err := opcuaServer.Serve(ctx); err != nil {
+				errChan <- err
+			}
+		}()
+	}
+
 	go func() {
 		if err := srv.Start(ctx, cfg.Server.Addr); err != nil {
 			errChan <- err
 		}
 	}()
 
+	if cfg.Gateway.Enabled {
+		routes := make([]modbus.GatewayRoute, 0, len(cfg.Gateway.Routes))
+		for _, route := range cfg.Gateway.Routes {
+			routes = append(routes, modbus.GatewayRoute{
+				UnitID:       route.UnitID,
+				ConnectionID: route.ConnectionID,
+				TargetUnitID: route.TargetUnitID,
+			})
+		}
+
+		gateway := modbus.NewGateway(modbus.GatewayConfig{
+			Addr:      cfg.Gateway.Addr,
+			Routes:    routes,
+			Handlers:  srv.GetConnectionManager().GetConnection,
+			QueueSize: cfg.Gateway.QueueSize,
+			Timeout:   cfg.Gateway.Timeout,
+		})
+		if err := gateway.Listen(); err != nil {
+			log.Fatal().Err(err).Msg("Failed to start Modbus gateway")
+		}
+
+		srv.SetGateway(gateway)
+		go func() {
+			if err := gateway.Serve(ctx); err != nil {
+				errChan <- err
+			}
+		}()
+	}
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
@@ -56,3 +179,26 @@ func main() {
 		cancel()
 	}
 }
+
+// openStorage opens the backend selected by the database configuration
+func openStorage(cfg config.DatabaseConfig) (storage.Storage, error) {
+	switch cfg.Driver {
+	case "sqlite":
+		return sqlite.NewSQLiteStorage(cfg.Path)
+	case "postgres":
+		return postgres.NewPostgresStorage(cfg.URL, postgres.Options{TimescaleDB: cfg.TimescaleDB})
+	default:
+		return nil, fmt.Errorf("unknown database driver: %s", cfg.Driver)
+	}
+}
+
+func migrateDatabase(cfg config.DatabaseConfig, version int) error {
+	switch cfg.Driver {
+	case "sqlite":
+		return sqlite.Migrate(cfg.Path, version)
+	case "postgres":
+		return postgres.Migrate(cfg.URL, version)
+	default:
+		return fmt.Errorf("unknown database driver: %s", cfg.Driver)
+	}
+}
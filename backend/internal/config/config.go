@@ -9,7 +9,12 @@ import (
 type Config struct {
 	Server   ServerConfig   `mapstructure:"server"`
 	Database DatabaseConfig `mapstructure:"database"`
+	Ingest   IngestConfig   `mapstructure:"ingest"`
 	Pool     PoolConfig     `mapstructure:"pool"`
+	MQTT     MQTTConfig     `mapstructure:"mqtt_bridge"`
+	OPCUA    OPCUAConfig    `mapstructure:"opcua"`
+	Gateway  GatewayConfig  `mapstructure:"modbus_gateway"`
+	Replay   ReplayConfig   `mapstructure:"replay"`
 }
 
 type ServerConfig struct {
@@ -19,8 +24,26 @@ type ServerConfig struct {
 	IdleTimeout  time.Duration `mapstructure:"idle_timeout"`
 }
 
+// DatabaseConfig selects the storage backend: "sqlite", a file at Path, or
+// "postgres", the server at URL
 type DatabaseConfig struct {
-	Path string `mapstructure:"path"`
+	Driver      string `mapstructure:"driver"`
+	Path        string `mapstructure:"path"`
+	URL         string `mapstructure:"url"`
+	TimescaleDB bool   `mapstructure:"timescaledb"`
+}
+
+// IngestConfig sizes the queue that batches data points and raw frames
+// between reads and storage. Policy is what happens when it is full: "block", "drop_newest" or
+// "drop_oldest".
+type IngestConfig struct {
+	QueueSize     int           `mapstructure:"queue_size"`
+	BatchSize     int           `mapstructure:"batch_size"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	Policy        string        `mapstructure:"policy"`
+	BlockTimeout  time.Duration `mapstructure:"block_timeout"`
+	Retries       int           `mapstructure:"retries"`     // for a batch the database was too busy for
+	RetryDelay    time.Duration `mapstructure:"retry_delay"` // doubling with each retry
 }
 
 type PoolConfig struct {
@@ -30,6 +53,52 @@ type PoolConfig struct {
 	MaxIdleTime    time.Duration `mapstructure:"max_idle_time"`
 }
 
+// MQTTConfig configures the northbound bridge that publishes parsed data
+type MQTTConfig struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	Broker        string        `mapstructure:"broker"`
+	ClientID      string        `mapstructure:"client_id"`
+	Username      string        `mapstructure:"username"`
+	Password      string        `mapstructure:"password"`
+	TopicTemplate string        `mapstructure:"topic_template"`
+	QoS           byte          `mapstructure:"qos"`
+	Retain        bool          `mapstructure:"retain"`
+	Format        string        `mapstructure:"format"`
+	Timeout       time.Duration `mapstructure:"timeout"`
+}
+
+type OPCUAConfig struct {
+	Enabled        bool          `mapstructure:"enabled"`
+	Addr           string        `mapstructure:"addr"`
+	EndpointURL    string        `mapstructure:"endpoint_url"`
+	ApplicationURI string        `mapstructure:"application_uri"`
+	NamespaceURI   string        `mapstructure:"namespace_uri"`
+	AllowWrites    bool          `mapstructure:"allow_writes"`
+	SessionTimeout time.Duration `mapstructure:"session_timeout"`
+	MaxSessions    int           `mapstructure:"max_sessions"`
+}
+
+// ReplayConfig limits the recordings replay connections play back to files
+// in Dir of at most MaxSize bytes
+type ReplayConfig struct {
+	Dir     string `mapstructure:"dir"`
+	MaxSize int64  `mapstructure:"max_size"`
+}
+
+type GatewayConfig struct {
+	Enabled   bool           `mapstructure:"enabled"`
+	Addr      string         `mapstructure:"addr"`
+	QueueSize int            `mapstructure:"queue_size"`
+	Timeout   time.Duration  `mapstructure:"timeout"`
+	Routes    []GatewayRoute `mapstructure:"routes"`
+}
+
+type GatewayRoute struct {
+	UnitID       uint8  `mapstructure:"unit_id"`
+	ConnectionID string `mapstructure:"connection_id"`
+	TargetUnitID uint8  `mapstructure:"target_unit_id"`
+}
+
 func Load() (*Config, error) {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
@@ -42,16 +111,51 @@ func Load() (*Config, error) {
 	viper.SetDefault("server.write_timeout", 10*time.Second)
 	viper.SetDefault("server.idle_timeout", 60*time.Second)
 
+	viper.SetDefault("database.driver", "sqlite")
 	viper.SetDefault("database.path", "./data/iotstudio.db")
+	viper.SetDefault("database.timescaledb", false)
+
+	viper.SetDefault("ingest.queue_size", 10000)
+	viper.SetDefault("ingest.batch_size", 500)
+	viper.SetDefault("ingest.flush_interval", 1*time.Second)
+	viper.SetDefault("ingest.policy", "drop_oldest")
+	viper.SetDefault("ingest.block_timeout", 100*time.Millisecond)
+	viper.SetDefault("ingest.retries", 3)
+	viper.SetDefault("ingest.retry_delay", 100*time.Millisecond)
 
 	viper.SetDefault("pool.max_connections", 100)
 	viper.SetDefault("pool.max_pool_size", 10)
 	viper.SetDefault("pool.max_lifetime", 5*time.Minute)
 	viper.SetDefault("pool.max_idle_time", 1*time.Minute)
 
+	viper.SetDefault("mqtt_bridge.enabled", false)
+	viper.SetDefault("mqtt_bridge.client_id", "iotstudio-bridge")
+	viper.SetDefault("mqtt_bridge.topic_template", "iotstudio/{session}/{device}/{field}")
+	viper.SetDefault("mqtt_bridge.qos", 0)
+	viper.SetDefault("mqtt_bridge.retain", false)
+	viper.SetDefault("mqtt_bridge.format", "json")
+	viper.SetDefault("mqtt_bridge.timeout", 10*time.Second)
+	viper.SetDefault("opcua.enabled", false)
+	viper.SetDefault("opcua.addr", ":4840")
+	viper.SetDefault("opcua.application_uri", "urn:iotstudio:server")
+	viper.SetDefault("opcua.namespace_uri", "urn:iotstudio")
+	viper.SetDefault("opcua.allow_writes", false)
+	viper.SetDefault("opcua.session_timeout", 60*time.Minute)
+	viper.SetDefault("opcua.max_sessions", 100)
+	viper.SetDefault("modbus_gateway.enabled", false)
+	viper.SetDefault("modbus_gateway.addr", ":5020")
+	viper.SetDefault("modbus_gateway.queue_size", 32)
+	viper.SetDefault("modbus_gateway.timeout", 5*time.Second)
+	viper.SetDefault("replay.dir", "./data/recordings")
+	viper.SetDefault("replay.max_size", 64<<20)
+
 	viper.AutomaticEnv()
+	viper.BindEnv("database.driver", "DB_DRIVER")
 	viper.BindEnv("database.path", "DB_PATH")
+	viper.BindEnv("database.url", "DB_URL")
 	viper.BindEnv("server.addr", "SERVER_ADDR")
+	viper.BindEnv("mqtt_bridge.broker", "MQTT_BRIDGE_BROKER")
+	viper.BindEnv("opcua.addr", "OPCUA_ADDR")
 
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
@@ -3,16 +3,25 @@ package connections
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
+	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/iotstudio/iotstudio/internal/ingest"
 	"github.com/iotstudio/iotstudio/internal/models"
 	"github.com/iotstudio/iotstudio/internal/parser"
 	protocol "github.com/iotstudio/iotstudio/internal/protocols"
 	"github.com/iotstudio/iotstudio/internal/protocols/modbus"
+	"github.com/iotstudio/iotstudio/internal/protocols/mqtt"
+	"github.com/iotstudio/iotstudio/internal/protocols/replay"
+	"github.com/iotstudio/iotstudio/internal/protocols/tcp"
 	"github.com/iotstudio/iotstudio/internal/storage"
 	"github.com/iotstudio/iotstudio/pkg/api"
 	"github.com/rs/zerolog/log"
@@ -25,6 +34,25 @@ const (
 	maxPoolSize         = 100
 	maxIdleTime         = 10 * time.Minute
 	poolCleanupInterval = 5 * time.Minute
+
+	defaultReadBufferSize = 4096
+
+	acquisitionRetryDelay = time.Second      // after a failed read
+	deviceRefreshInterval = 30 * time.Second // least time between device reloads for unknown keys
+)
+
+// streamingTypes are the connection types whose devices send data unasked,
+// which are read in a loop once started. Modbus connections only answer
+// requests from the gateway and OPC UA writes; reading them in a loop would
+// take those responses away.
+var streamingTypes = map[string]bool{"tcp": true, "mqtt": true, "replay": true}
+
+var (
+	// errRead marks failures to read, as opposed to frames that failed to parse
+	errRead = errors.New("read failed")
+	// errUnknownDevice is returned for messages from devices not attached to
+	// the connection
+	errUnknownDevice = errors.New("unknown device")
 )
 
 type managedConnection struct {
@@ -35,21 +63,110 @@ type managedConnection struct {
 	retries      int
 	backoff      time.Duration
 	lastActive   time.Time
+
+	// Frames rejected by the parser's checksum validation
+	checksumErrors atomic.Int64
+
+	// Device IDs by address and by ID, for attributing messages. Loaded on
+	// first use and reloaded for keys it lacks, at most once per
+	// deviceRefreshInterval; InvalidateDevices forces a reload.
+	devicesMu      sync.Mutex
+	devices        map[string]string
+	devicesLoaded  time.Time
+	unknownDevices atomic.Int64 // messages dropped for their device key
+
+	// Set when the handler reports its frames to capture itself
+	observesFrames bool
+
+	// Cancels the acquisition loop of a started streaming connection, and
+	// closed once it has returned
+	acquisitionMu   sync.Mutex
+	stopAcquisition context.CancelFunc
+	acquisitionDone chan struct{}
+
+	// Last good value per device and field, repeated as stale when the
+	// field fails to decode
+	lastValues   map[string]map[string]interface{}
+	lastValuesMu sync.Mutex
+}
+
+// acquiring reports whether the connection is being read in a loop, in which
+// case it is not idle however long its devices stay quiet
+func (mc *managedConnection) acquiring() bool {
+	mc.acquisitionMu.Lock()
+	defer mc.acquisitionMu.Unlock()
+	return mc.stopAcquisition != nil
+}
+
+// fillStale replaces bad fields of the result with their last good values
+// and remembers the values of this frame for the next one.
+func (mc *managedConnection) fillStale(result *parser.ParserResult) {
+	mc.lastValuesMu.Lock()
+	defer mc.lastValuesMu.Unlock()
+
+	if mc.lastValues == nil {
+		mc.lastValues = make(map[string]map[string]interface{})
+	}
+
+	for deviceID, fields := range result.Quality {
+		last := mc.lastValues[deviceID]
+		for name, quality := range fields {
+			value, ok := last[name]
+			if quality.Quality != models.QualityBad || !ok {
+				continue
+			}
+			if result.DeviceData[deviceID] == nil {
+				result.DeviceData[deviceID] = make(map[string]interface{})
+			}
+			result.DeviceData[deviceID][name] = value
+			quality.Quality = models.QualityStale
+			fields[name] = quality
+		}
+	}
+
+	for deviceID, values := range result.DeviceData {
+		if mc.lastValues[deviceID] == nil {
+			mc.lastValues[deviceID] = make(map[string]interface{})
+		}
+		for name, value := range values {
+			mc.lastValues[deviceID][name] = value
+		}
+	}
+}
+
+// DataSink receives every batch of data points written to storage, e.g. to
+// forward parsed values to an MQTT broker. Each sink is called from its own
+// goroutine, one batch at a time.
+type DataSink interface {
+	WriteDataPoints(ctx context.Context, points []models.DataPoint) error
 }
 
 type ConnectionManager struct {
 	connections     map[string]*managedConnection
 	storage         storage.Storage
+	ingest          *ingest.Pipeline
+	sinks           []*sinkQueue
 	parserEngine    *parser.Engine
 	protocolFactory map[string]protocol.ProtocolFactory
 	mu              sync.RWMutex
+	monitors        map[string]*modbus.TrafficMonitor
+	monitorsMu      sync.Mutex
+	recordings      RecordingsConfig
 	ctx             context.Context
 	cancel          context.CancelFunc
 }
 
 type Config struct {
-	Storage  storage.Storage
-	PoolSize int
+	Storage    storage.Storage
+	PoolSize   int
+	Ingest     ingest.Config // queue between reads and data point storage
+	Recordings RecordingsConfig
+}
+
+// RecordingsConfig limits what replay connections may play back
+type RecordingsConfig struct {
+	Dir     string // recording paths are relative to it and cannot leave it
+	MaxSize int64  // in bytes; 0 means the replay default
 }
 
 func NewConnectionManager(config Config) *ConnectionManager {
@@ -58,8 +175,11 @@ func NewConnectionManager(config Config) *ConnectionManager {
 	cm := &ConnectionManager{
 		connections:     make(map[string]*managedConnection),
 		storage:         config.Storage,
+		ingest:          ingest.NewPipeline(config.Storage, config.Ingest),
 		parserEngine:    parser.NewEngine(),
 		protocolFactory: make(map[string]protocol.ProtocolFactory),
+		monitors:        make(map[string]*modbus.TrafficMonitor),
+		recordings:      config.Recordings,
 		ctx:             ctx,
 		cancel:          cancel,
 	}
@@ -75,7 +195,7 @@ func NewConnectionManager(config Config) *ConnectionManager {
 			Host:    modbusConfig.Host,
 			Port:    modbusConfig.Port,
 			Timeout: time.Duration(modbusConfig.Timeout) * time.Second,
-			Logger:  modbus.NewModbusLogger(log.Logger),
+			Logger:  cm.modbusLogger(config.ID),
 		}), nil
 	})
 
@@ -91,7 +211,73 @@ func NewConnectionManager(config Config) *ConnectionManager {
 			Parity:   modbusConfig.Parity,
 			StopBits: modbusConfig.StopBits,
 			Timeout:  time.Duration(modbusConfig.Timeout) * time.Millisecond,
-			Logger:   modbus.NewModbusLogger(log.Logger),
+			Logger:   cm.modbusLogger(config.ID),
+		}), nil
+	})
+
+	cm.RegisterProtocol("tcp", func(ctx context.Context, config api.ConnectionConfig) (protocol.ProtocolHandler, error) {
+		var tcpConfig api.TCPConfig
+		if err := json.Unmarshal([]byte(config.ConfigJSON), &tcpConfig); err != nil {
+			return nil, fmt.Errorf("failed to parse TCP config: %w", err)
+		}
+
+		readBufferSize := tcpConfig.ReadBufferSize
+		if readBufferSize <= 0 {
+			readBufferSize = defaultReadBufferSize
+		}
+
+		return tcp.NewTCPHandler(tcp.TCPConfig{
+			Address:        net.JoinHostPort(tcpConfig.Host, strconv.Itoa(tcpConfig.Port)),
+			Timeout:        time.Duration(tcpConfig.Timeout) * time.Second,
+			ReadBufferSize: readBufferSize,
+		}), nil
+	})
+
+	cm.RegisterProtocol("replay", func(ctx context.Context, config api.ConnectionConfig) (protocol.ProtocolHandler, error) {
+		var replayConfig api.ReplayConfig
+		if err := json.Unmarshal([]byte(config.ConfigJSON), &replayConfig); err != nil {
+			return nil, fmt.Errorf("failed to parse replay config: %w", err)
+		}
+		return replay.NewReplayHandler(replay.ReplayConfig{
+			Path:    replayConfig.Path,
+			Speed:   replayConfig.Speed,
+			Loop:    replayConfig.Loop,
+			Dir:     cm.recordings.Dir,
+			MaxSize: cm.recordings.MaxSize,
+		}), nil
+	})
+
+	cm.RegisterProtocol("mqtt", func(ctx context.Context, config api.ConnectionConfig) (protocol.ProtocolHandler, error) {
+		var mqttConfig api.MQTTConfig
+		if err := json.Unmarshal([]byte(config.ConfigJSON), &mqttConfig); err != nil {
+			return nil, fmt.Errorf("failed to parse MQTT config: %w", err)
+		}
+
+		clientID := mqttConfig.ClientID
+		if clientID == "" {
+			clientID = "iotstudio-" + config.ID
+		}
+
+		subscriptions := make([]mqtt.Subscription, 0, len(mqttConfig.Subscriptions))
+		for _, sub := range mqttConfig.Subscriptions {
+			subscriptions = append(subscriptions, mqtt.Subscription{
+				Topic:         sub.Topic,
+				QoS:           sub.QoS,
+				DeviceSegment: sub.DeviceSegment,
+			})
+		}
+
+		return mqtt.NewMQTTHandler(mqtt.MQTTConfig{
+			Broker:        mqttConfig.Broker,
+			ClientID:      clientID,
+			Username:      mqttConfig.Username,
+			Password:      mqttConfig.Password,
+			CleanSession:  mqttConfig.CleanSession,
+			KeepAlive:     time.Duration(mqttConfig.KeepAlive) * time.Second,
+			Timeout:       time.Duration(mqttConfig.Timeout) * time.Second,
+			Subscriptions: subscriptions,
+			PublishTopic:  mqttConfig.PublishTopic,
+			QueueSize:     mqttConfig.QueueSize,
 		}), nil
 	})
 
@@ -105,10 +291,24 @@ func (cm *ConnectionManager) RegisterProtocol(protocolType string, factory proto
 	log.Info().Str("protocol", protocolType).Msg("Protocol registered")
 }
 
+// AddSink registers a sink that is fed the same data points as storage.
+// Batches are queued for it, so a slow sink holds up neither reads nor the
+// other sinks; when its queue is full, batches are dropped.
+func (cm *ConnectionManager) AddSink(sink DataSink) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.sinks = append(cm.sinks, newSinkQueue(sink, defaultSinkQueueSize))
+}
+
 func (cm *ConnectionManager) CreateConnection(ctx context.Context, conn *models.Connection) error {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
+	factory, ok := cm.protocolFactory[conn.Type]
+	if !ok {
+		return fmt.Errorf("unknown connection type: %s", conn.Type)
+	}
+
 	connID := uuid.New().String()
 	conn.ID = connID
 
@@ -133,7 +333,7 @@ func (cm *ConnectionManager) CreateConnection(ctx context.Context, conn *models.
 		ConfigJSON: conn.Config,
 	}
 
-	handler, err := cm.protocolFactory[conn.Type](ctx, config)
+	handler, err := factory(ctx, config)
 	if err != nil {
 		return fmt.Errorf("failed to create protocol handler: %w", err)
 	}
@@ -146,6 +346,20 @@ func (cm *ConnectionManager) CreateConnection(ctx context.Context, conn *models.
 		lastActive:   time.Now(),
 	}
 
+	// Handlers that see their frames on the wire capture both directions;
+	// for the others only what Read returns is captured
+	if capturer, ok := handler.(protocol.FrameCapturer); ok && conn.Capture != nil {
+		managedConn.observesFrames = true
+		capturer.SetFrameObserver(func(ctx context.Context, direction string, data []byte) {
+			frame := newRawFrame(managedConn, direction, data)
+			if slot, ok := ctx.Value(readFrameKey{}).(**models.RawFrame); ok && direction == models.FrameReceived {
+				*slot = frame // queued by the read with its points
+				return
+			}
+			cm.queueFrame(ctx, frame)
+		})
+	}
+
 	cm.connections[connID] = managedConn
 
 	log.Info().Str("connID", connID).Msg("Connection created")
@@ -167,6 +381,7 @@ func (cm *ConnectionManager) StartConnection(ctx context.Context, connID string)
 		err = managedConn.handler.Connect(ctx, api.ConnectionConfig{})
 		if err == nil {
 			managedConn.lastActive = time.Now()
+			cm.startAcquisition(connID, managedConn)
 			log.Info().Str("connID", connID).Msg("Connection started")
 			return nil
 		}
@@ -193,7 +408,7 @@ func (cm *ConnectionManager) StopConnection(ctx context.Context, connID string)
 		return nil
 	}
 
-	if err := managedConn.handler.Disconnect(); err != nil {
+	if err := cm.stopAcquisition(managedConn); err != nil {
 		log.Error().Str("connID", connID).Err(err).Msg("Error disconnecting")
 		return err
 	}
@@ -206,21 +421,30 @@ func (cm *ConnectionManager) StopConnection(ctx context.Context, connID string)
 }
 
 func (cm *ConnectionManager) RemoveConnection(ctx context.Context, connID string) error {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-
+	cm.mu.RLock()
 	managedConn, exists := cm.connections[connID]
+	cm.mu.RUnlock()
+
 	if !exists {
-		return nil
+		// Stored by an earlier run of the server
+		return cm.storage.DeleteConnection(ctx, connID)
 	}
 
-	if err := managedConn.handler.Disconnect(); err != nil {
+	// Without the lock, which the acquisition loop takes for every read
+	if err := cm.stopAcquisition(managedConn); err != nil {
 		log.Error().Str("connID", connID).Err(err).Msg("Error disconnecting")
 		return err
 	}
 
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
 	delete(cm.connections, connID)
 
+	cm.monitorsMu.Lock()
+	delete(cm.monitors, connID)
+	cm.monitorsMu.Unlock()
+
 	if err := cm.storage.DeleteConnection(ctx, connID); err != nil {
 		return fmt.Errorf("failed to delete connection from storage: %w", err)
 	}
@@ -230,33 +454,355 @@ func (cm *ConnectionManager) RemoveConnection(ctx context.Context, connID string
 	return nil
 }
 
-func (cm *ConnectionManager) ReadAndParse(ctx context.Context, connID string) (map[string]map[string]interface{}, error) {
+// readFrameKey marks the context of a read in readAndParse. Its value points
+// at the raw frame the observer fills in for the frame the read received.
+type readFrameKey struct{}
+
+// ReadAndParse reads and parses one frame. Fields that fail to decode are
+// reported in the result's quality and carry their last good value, if
+// any, as stale.
+func (cm *ConnectionManager) ReadAndParse(ctx context.Context, connID string) (*parser.ParserResult, error) {
+	result, frame, err := cm.readAndParse(ctx, connID)
+	cm.queueFrame(ctx, frame)
+	return result, err
+}
+
+// readAndParse is ReadAndParse that returns the captured raw frame, if the
+// connection captures frames, for the caller to queue; it is returned with
+// parse errors too
+func (cm *ConnectionManager) readAndParse(ctx context.Context, connID string) (*parser.ParserResult, *models.RawFrame, error) {
 	cm.mu.RLock()
 	managedConn, exists := cm.connections[connID]
 	cm.mu.RUnlock()
 
 	if !exists {
-		return nil, fmt.Errorf("connection not found: %s", connID)
+		return nil, nil, fmt.Errorf("connection not found: %s", connID)
 	}
 
-	data, err := managedConn.handler.Read(ctx)
-	if err != nil {
-		return nil, err
+	var data []byte
+	var sourceDevice string
+	var frame *models.RawFrame
+
+	if reader, ok := managedConn.handler.(protocol.MessageReader); ok {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", errRead, err)
+		}
+		data = msg.Payload
+		var known bool
+		sourceDevice, known = cm.resolveDevice(ctx, managedConn, msg.DeviceKey)
+		if !known {
+			managedConn.unknownDevices.Add(1)
+			return nil, newRawFrame(managedConn, models.FrameReceived, data), fmt.Errorf("%w: %s", errUnknownDevice, msg.DeviceKey)
+		}
+	} else {
+		// Reads on other connections, and the requests of this one, are
+		// observed concurrently; only the frame seen under this read's
+		// context is the one it returns
+		readCtx := context.WithValue(ctx, readFrameKey{}, &frame)
+		var err error
+		data, err = managedConn.handler.Read(readCtx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", errRead, err)
+		}
 	}
 
 	managedConn.lastActive = time.Now()
+	if !managedConn.observesFrames {
+		frame = newRawFrame(managedConn, models.FrameReceived, data)
+	}
 
 	if managedConn.parser != nil {
 		result, err := managedConn.parserEngine.Parse(ctx, managedConn.parser, data)
 		if err != nil {
-			return nil, err
+			var checksumErr *parser.ChecksumError
+			if errors.As(err, &checksumErr) {
+				managedConn.checksumErrors.Add(1)
+			}
+			return nil, frame, err
+		}
+
+		// Fields without a device ID belong to the device the message came from
+		if unassigned, ok := result.DeviceData[""]; ok && sourceDevice != "" {
+			delete(result.DeviceData, "")
+			if result.DeviceData[sourceDevice] == nil {
+				result.DeviceData[sourceDevice] = make(map[string]interface{})
+			}
+			for name, value := range unassigned {
+				result.DeviceData[sourceDevice][name] = value
+			}
+		}
+		if unassigned, ok := result.Quality[""]; ok && sourceDevice != "" {
+			delete(result.Quality, "")
+			if result.Quality[sourceDevice] == nil {
+				result.Quality[sourceDevice] = make(map[string]models.FieldQuality)
+			}
+			for name, quality := range unassigned {
+				result.Quality[sourceDevice][name] = quality
+			}
+		}
+
+		managedConn.fillStale(result)
+		return result, frame, nil
+	}
+
+	deviceID := "raw"
+	if sourceDevice != "" {
+		deviceID = sourceDevice
+	}
+	return &parser.ParserResult{
+		DeviceData: map[string]map[string]interface{}{
+			deviceID: {"data": string(data)},
+		},
+	}, frame, nil
+}
+
+// ReadAndStore reads and parses one frame, queues the resulting data points
+// for storage together with the captured frame, and queues them for every
+// registered sink. Points are stored with the frame's ID, but those returned
+// do not carry it since the frame is not stored yet. Points dropped by a
+// full queue are counted in the ingest metrics.
+func (cm *ConnectionManager) ReadAndStore(ctx context.Context, connID string) ([]models.DataPoint, error) {
+	result, frame, err := cm.readAndParse(ctx, connID)
+	if err != nil {
+		cm.queueFrame(ctx, frame)
+		return nil, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	managedConn := cm.connections[connID]
+	if managedConn == nil {
+		return nil, fmt.Errorf("connection not found: %s", connID)
+	}
+
+	timestamp := time.Now().UnixMilli()
+	points := make([]models.DataPoint, 0, len(result.DeviceData))
+	for deviceID, values := range result.DeviceData {
+		data, err := json.Marshal(values)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode data for device %s: %w", deviceID, err)
+		}
+		point := models.DataPoint{
+			SessionID: managedConn.connection.SessionID,
+			DeviceID:  deviceID,
+			Timestamp: timestamp,
+			Data:      string(data),
+		}
+		if managedConn.parser != nil {
+			point.ParserID = managedConn.parser.ID
+			point.ParserVersion = managedConn.parser.Version
+		}
+		if quality := result.Quality[deviceID]; len(quality) > 0 {
+			encoded, err := json.Marshal(quality)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode quality for device %s: %w", deviceID, err)
+			}
+			point.Quality = string(encoded)
+		}
+		points = append(points, point)
+	}
+
+	if err := cm.ingest.WriteFrame(ctx, frame, points); err != nil && !errors.Is(err, ingest.ErrQueueFull) {
+		return nil, fmt.Errorf("failed to queue data points: %w", err)
+	}
+
+	for _, sink := range cm.sinks {
+		sink.push(points)
+	}
+
+	return points, nil
+}
+
+// newRawFrame copies data into a raw frame if the connection has capture
+// enabled, and returns nil otherwise
+func newRawFrame(managedConn *managedConnection, direction string, data []byte) *models.RawFrame {
+	if managedConn.connection.Capture == nil {
+		return nil
+	}
+	return &models.RawFrame{
+		ConnectionID: managedConn.connection.ID,
+		Timestamp:    time.Now().UnixMilli(),
+		Direction:    direction,
+		Data:         append([]byte(nil), data...),
+	}
+}
+
+// queueFrame queues a captured frame, if any, for storage. Failures are
+// logged rather than failing the read.
+func (cm *ConnectionManager) queueFrame(ctx context.Context, frame *models.RawFrame) {
+	if frame == nil {
+		return
+	}
+	if err := cm.ingest.WriteFrame(ctx, frame, nil); err != nil && !errors.Is(err, ingest.ErrQueueFull) {
+		log.Warn().Err(err).Str("connID", frame.ConnectionID).Msg("Failed to queue raw frame")
+	}
+}
+
+// startAcquisition reads a started streaming connection in the background,
+// storing what it decodes, until stopAcquisition
+func (cm *ConnectionManager) startAcquisition(connID string, managedConn *managedConnection) {
+	if !streamingTypes[managedConn.connection.Type] {
+		return
+	}
+
+	managedConn.acquisitionMu.Lock()
+	defer managedConn.acquisitionMu.Unlock()
+
+	if managedConn.stopAcquisition != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(cm.ctx)
+	done := make(chan struct{})
+	managedConn.stopAcquisition = cancel
+	managedConn.acquisitionDone = done
+
+	go func() {
+		defer close(done)
+		cm.acquire(ctx, connID, managedConn)
+
+		// Ended by itself, e.g. at the end of a replay
+		managedConn.acquisitionMu.Lock()
+		if managedConn.acquisitionDone == done {
+			managedConn.stopAcquisition, managedConn.acquisitionDone = nil, nil
+		}
+		managedConn.acquisitionMu.Unlock()
+		cancel()
+	}()
+}
+
+// stopAcquisition disconnects the handler, which also unblocks a pending
+// read, and waits for the acquisition loop to return, if one is running
+func (cm *ConnectionManager) stopAcquisition(managedConn *managedConnection) error {
+	managedConn.acquisitionMu.Lock()
+	cancel, done := managedConn.stopAcquisition, managedConn.acquisitionDone
+	managedConn.stopAcquisition, managedConn.acquisitionDone = nil, nil
+	managedConn.acquisitionMu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	err := managedConn.handler.Disconnect()
+	if done != nil {
+		<-done
+	}
+	return err
+}
+
+// acquire calls ReadAndStore until ctx ends, the recording being replayed
+// ends or the connection drops. Frames that fail to parse are skipped; after
+// a failed read it waits before trying again.
+func (cm *ConnectionManager) acquire(ctx context.Context, connID string, managedConn *managedConnection) {
+	for ctx.Err() == nil {
+		_, err := cm.ReadAndStore(ctx, connID)
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			return
+		case errors.Is(err, io.EOF):
+			log.Info().Str("connID", connID).Msg("Connection reached the end of its data")
+			return
+		case !errors.Is(err, errRead):
+			log.Debug().Err(err).Str("connID", connID).Msg("Failed to parse frame")
+		case !managedConn.handler.IsConnected():
+			log.Warn().Err(err).Str("connID", connID).Msg("Connection lost, stopping acquisition")
+			return
+		default:
+			log.Warn().Err(err).Str("connID", connID).Msg("Read failed")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(acquisitionRetryDelay):
+			}
+		}
+	}
+}
+
+// pruneCaptures applies the retention limits of every capturing connection
+func (cm *ConnectionManager) pruneCaptures() {
+	cm.mu.RLock()
+	var conns []*models.Connection
+	for _, mc := range cm.connections {
+		if mc.connection.Capture != nil {
+			conns = append(conns, mc.connection)
+		}
+	}
+	cm.mu.RUnlock()
+
+	for _, conn := range conns {
+		var before int64
+		if conn.Capture.MaxAge > 0 {
+			before = time.Now().Add(-time.Duration(conn.Capture.MaxAge) * time.Second).UnixMilli()
+		}
+		if before == 0 && conn.Capture.MaxBytes == 0 {
+			continue
+		}
+		deleted, err := cm.storage.PruneRawFrames(cm.ctx, conn.ID, before, conn.Capture.MaxBytes)
+		if err != nil {
+			log.Warn().Err(err).Str("connID", conn.ID).Msg("Failed to prune raw frames")
+			continue
+		}
+		if deleted > 0 {
+			log.Debug().Str("connID", conn.ID).Int64("frames", deleted).Msg("Pruned raw frames")
 		}
-		return result.DeviceData, nil
 	}
+}
 
-	return map[string]map[string]interface{}{
-		"raw": {"data": string(data)},
-	}, nil
+// resolveDevice maps a protocol-level device key onto the ID of a device
+// attached to the connection, matching on address first and then on ID. A
+// connection without devices uses the keys as device IDs; otherwise it
+// reports keys that match no device as unknown.
+func (cm *ConnectionManager) resolveDevice(ctx context.Context, managedConn *managedConnection, key string) (string, bool) {
+	if key == "" {
+		return "", true
+	}
+
+	managedConn.devicesMu.Lock()
+	defer managedConn.devicesMu.Unlock()
+
+	id, ok := managedConn.devices[key]
+	if !ok && time.Since(managedConn.devicesLoaded) >= deviceRefreshInterval {
+		connID := managedConn.connection.ID
+		devices, err := cm.storage.ListDevicesByConnection(ctx, connID)
+		if err != nil {
+			log.Warn().Err(err).Str("connID", connID).Msg("Failed to list devices for connection")
+		} else {
+			managedConn.devices = make(map[string]string, 2*len(devices))
+			for _, device := range devices {
+				managedConn.devices[device.ID] = device.ID
+			}
+			for _, device := range devices {
+				if device.Address != "" {
+					managedConn.devices[device.Address] = device.ID
+				}
+			}
+		}
+		managedConn.devicesLoaded = time.Now()
+		id, ok = managedConn.devices[key]
+	}
+
+	if !ok && len(managedConn.devices) == 0 {
+		return key, true
+	}
+	return id, ok
+}
+
+// InvalidateDevices makes the connection reload its devices for the next
+// message, after one was added or changed
+func (cm *ConnectionManager) InvalidateDevices(connID string) {
+	cm.mu.RLock()
+	managedConn, exists := cm.connections[connID]
+	cm.mu.RUnlock()
+
+	if !exists {
+		return
+	}
+
+	managedConn.devicesMu.Lock()
+	managedConn.devicesLoaded = time.Time{}
+	managedConn.devices = nil
+	managedConn.devicesMu.Unlock()
 }
 
 func (cm *ConnectionManager) GetConnection(connID string) (protocol.ProtocolHandler, error) {
@@ -280,7 +826,38 @@ func (cm *ConnectionManager) GetMetrics(connID string) (api.ConnectionMetrics, e
 		return api.ConnectionMetrics{}, fmt.Errorf("connection not found: %s", connID)
 	}
 
-	return managedConn.handler.GetMetrics(), nil
+	metrics := managedConn.handler.GetMetrics()
+	metrics.ChecksumErrors = managedConn.checksumErrors.Load()
+	metrics.UnknownDevices = managedConn.unknownDevices.Load()
+	return metrics, nil
+}
+
+// modbusLogger returns a logger that records the connection's traffic in
+// its monitor
+func (cm *ConnectionManager) modbusLogger(connID string) *modbus.ModbusLogger {
+	monitor := modbus.NewTrafficMonitor(modbus.DefaultTrafficBufferSize)
+
+	cm.monitorsMu.Lock()
+	cm.monitors[connID] = monitor
+	cm.monitorsMu.Unlock()
+
+	logger := modbus.NewModbusLogger(log.Logger)
+	logger.SetMonitor(monitor)
+	return logger
+}
+
+// TrafficMonitor returns the monitor holding the recent Modbus transactions
+// of a connection
+func (cm *ConnectionManager) TrafficMonitor(connID string) (*modbus.TrafficMonitor, error) {
+	cm.monitorsMu.Lock()
+	monitor, exists := cm.monitors[connID]
+	cm.monitorsMu.Unlock()
+
+	if !exists {
+		return nil, fmt.Errorf("no traffic monitor for connection: %s", connID)
+	}
+
+	return monitor, nil
 }
 
 func (cm *ConnectionManager) ListConnections() []models.Connection {
@@ -305,6 +882,7 @@ func (cm *ConnectionManager) cleanupRoutine() {
 			return
 		case <-ticker.C:
 			cm.cleanupIdleConnections()
+			cm.pruneCaptures()
 		}
 	}
 }
@@ -316,6 +894,9 @@ func (cm *ConnectionManager) cleanupIdleConnections() {
 	now := time.Now()
 
 	for connID, managedConn := range cm.connections {
+		if managedConn.acquiring() {
+			continue
+		}
 		idleTime := now.Sub(managedConn.lastActive)
 		if idleTime > maxIdleTime {
 			log.Info().Str("connID", connID).Dur("idleTime", idleTime).
@@ -326,19 +907,50 @@ func (cm *ConnectionManager) cleanupIdleConnections() {
 	}
 }
 
+// IngestMetrics reports the queue between reads and data point storage, and
+// the points the sink queues dropped
+func (cm *ConnectionManager) IngestMetrics() api.IngestMetrics {
+	metrics := cm.ingest.GetMetrics()
+
+	cm.mu.RLock()
+	for _, sink := range cm.sinks {
+		metrics.SinkDropped += sink.dropped.Load()
+	}
+	cm.mu.RUnlock()
+
+	return metrics
+}
+
+// Close disconnects every connection, then writes the data points and frames
+// still queued and delivers those queued for sinks, so it must be called
+// before the storage and the sinks are closed
 func (cm *ConnectionManager) Close() error {
 	cm.cancel()
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
+
+	cm.mu.RLock()
+	conns := make(map[string]*managedConnection, len(cm.connections))
+	for connID, managedConn := range cm.connections {
+		conns[connID] = managedConn
+	}
+	cm.mu.RUnlock()
 
 	var errs []error
 
-	for connID, managedConn := range cm.connections {
-		if err := managedConn.handler.Disconnect(); err != nil {
+	for connID, managedConn := range conns {
+		if err := cm.stopAcquisition(managedConn); err != nil {
 			errs = append(errs, fmt.Errorf("connection '%s': %w", connID, err))
 		}
 	}
 
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.ingest.Close()
+	for _, sink := range cm.sinks {
+		sink.close()
+	}
+	cm.sinks = nil
+
 	if len(errs) > 0 {
 		return fmt.Errorf("errors during shutdown: %v", errs)
 	}
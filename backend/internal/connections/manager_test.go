@@ -0,0 +1,375 @@
+package connections
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/iotstudio/iotstudio/internal/parser"
+	"github.com/iotstudio/iotstudio/internal/storage/sqlite"
+	"github.com/iotstudio/iotstudio/pkg/api"
+)
+
+// sinkRecorder keeps the points forwarded to it
+type sinkRecorder struct {
+	mu     sync.Mutex
+	points []models.DataPoint
+}
+
+func (r *sinkRecorder) WriteDataPoints(ctx context.Context, points []models.DataPoint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.points = append(r.points, points...)
+	return nil
+}
+
+func (r *sinkRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.points)
+}
+
+func newManager(t *testing.T) (*ConnectionManager, *sqlite.SQLiteStorage) {
+	t.Helper()
+
+	store, err := sqlite.NewSQLiteStorage(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage() error = %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	session := &models.Session{ID: "s1", Name: "Session s1", Status: "idle", CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := store.CreateSession(context.Background(), session); err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	cm := NewConnectionManager(Config{Storage: store, Recordings: RecordingsConfig{Dir: t.TempDir()}})
+	t.Cleanup(func() { cm.Close() })
+	return cm, store
+}
+
+// newReplay creates a capturing connection that replays the payloads through
+// the parser, if any
+func newReplay(t *testing.T, cm *ConnectionManager, parserID string, payloads ...string) *models.Connection {
+	t.Helper()
+
+	frames := make([]models.RawFrame, len(payloads))
+	for i, payload := range payloads {
+		frames[i] = models.RawFrame{Timestamp: int64(1000 + i), Direction: models.FrameReceived, Data: []byte(payload)}
+	}
+	data, err := json.Marshal(frames)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	file, err := os.CreateTemp(cm.recordings.Dir, "capture-*.json")
+	if err != nil {
+		t.Fatalf("CreateTemp() error = %v", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	file.Close()
+
+	config, _ := json.Marshal(map[string]interface{}{"path": filepath.Base(file.Name()), "speed": 1000})
+	conn := &models.Connection{
+		SessionID: "s1",
+		ParserID:  parserID,
+		Type:      "replay",
+		Name:      "Replay",
+		Config:    string(config),
+		Capture:   &models.Capture{},
+	}
+	if err := cm.CreateConnection(context.Background(), conn); err != nil {
+		t.Fatalf("CreateConnection() error = %v", err)
+	}
+	return conn
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStartConnectionAcquires(t *testing.T) {
+	cm, store := newManager(t)
+	sink := &sinkRecorder{}
+	cm.AddSink(sink)
+	conn := newReplay(t, cm, "", "a", "b", "c")
+
+	if err := cm.StartConnection(context.Background(), conn.ID); err != nil {
+		t.Fatalf("StartConnection() error = %v", err)
+	}
+
+	// The replay ends by itself, which ends the loop
+	waitFor(t, "the loop to end", func() bool {
+		cm.mu.RLock()
+		defer cm.mu.RUnlock()
+		return !cm.connections[conn.ID].acquiring()
+	})
+	if err := cm.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if got := sink.count(); got != 3 {
+		t.Errorf("sink received %d points, want 3", got)
+	}
+	points, err := store.QueryData(context.Background(), "s1", "raw", 0, time.Now().Add(time.Hour).UnixMilli())
+	if err != nil {
+		t.Fatalf("QueryData() error = %v", err)
+	}
+	if len(points) != 3 {
+		t.Fatalf("QueryData() returned %d points, want 3", len(points))
+	}
+	for _, point := range points {
+		frame, err := store.GetRawFrame(context.Background(), point.FrameID)
+		if err != nil {
+			t.Fatalf("GetRawFrame(%d) error = %v", point.FrameID, err)
+		}
+		var data map[string]string
+		json.Unmarshal([]byte(point.Data), &data)
+		if string(frame.Data) != data["data"] {
+			t.Errorf("point %s links frame %q", point.Data, frame.Data)
+		}
+	}
+}
+
+// countingStore counts device lookups
+type countingStore struct {
+	*sqlite.SQLiteStorage
+	lookups atomic.Int64
+}
+
+func (s *countingStore) ListDevicesByConnection(ctx context.Context, connectionID string) ([]*models.Device, error) {
+	s.lookups.Add(1)
+	return s.SQLiteStorage.ListDevicesByConnection(ctx, connectionID)
+}
+
+func TestResolveDevice(t *testing.T) {
+	cm, store := newManager(t)
+	counting := &countingStore{SQLiteStorage: store}
+	cm.storage = counting
+	ctx := context.Background()
+
+	conn := newReplay(t, cm, "")
+	managedConn := cm.connections[conn.ID]
+
+	// Without devices the key names the device
+	if id, ok := cm.resolveDevice(ctx, managedConn, "boiler-1"); !ok || id != "boiler-1" {
+		t.Errorf("resolveDevice() without devices = %q, %v, want the key", id, ok)
+	}
+
+	for _, device := range []*models.Device{
+		{ID: "d1", SessionID: "s1", ConnectionID: conn.ID, Name: "Boiler", Address: "boiler-1"},
+		{ID: "d2", SessionID: "s1", ConnectionID: conn.ID, Name: "Pump", Address: "d1"},
+	} {
+		if err := store.CreateDevice(ctx, device); err != nil {
+			t.Fatalf("CreateDevice() error = %v", err)
+		}
+	}
+	cm.InvalidateDevices(conn.ID)
+
+	tests := []struct {
+		key    string
+		wantID string
+		wantOK bool
+	}{
+		{"boiler-1", "d1", true},
+		{"d2", "d2", true},
+		{"d1", "d2", true}, // addresses come first
+		{"", "", true},
+		{"boiler-2", "", false},
+	}
+	for _, tt := range tests {
+		if id, ok := cm.resolveDevice(ctx, managedConn, tt.key); id != tt.wantID || ok != tt.wantOK {
+			t.Errorf("resolveDevice(%q) = %q, %v, want %q, %v", tt.key, id, ok, tt.wantID, tt.wantOK)
+		}
+	}
+
+	// One load after the invalidation; the unknown key does not reload
+	// within the refresh interval
+	if lookups := counting.lookups.Load(); lookups != 2 {
+		t.Errorf("ListDevicesByConnection() called %d times, want 2", lookups)
+	}
+}
+
+// blockingSink fails every write, after waiting for release
+type blockingSink struct {
+	release chan struct{}
+	calls   atomic.Int64
+}
+
+func (s *blockingSink) WriteDataPoints(ctx context.Context, points []models.DataPoint) error {
+	<-s.release
+	s.calls.Add(1)
+	return errors.New("broker unreachable")
+}
+
+func TestSinkQueueDropsWhenFull(t *testing.T) {
+	cm, _ := newManager(t)
+	stalled := &blockingSink{release: make(chan struct{})}
+	queue := newSinkQueue(stalled, 1)
+	cm.sinks = append(cm.sinks, queue)
+
+	batch := []models.DataPoint{{DeviceID: "d1"}, {DeviceID: "d2"}}
+	queue.push(batch)
+	waitFor(t, "the sink to take the first batch", func() bool { return len(queue.batches) == 0 })
+	queue.push(batch) // waits in the queue
+	queue.push(batch) // dropped
+
+	if dropped := cm.IngestMetrics().SinkDropped; dropped != 2 {
+		t.Errorf("SinkDropped = %d, want 2", dropped)
+	}
+	close(stalled.release)
+}
+
+func TestReadAndStore(t *testing.T) {
+	cm, store := newManager(t)
+	ctx := context.Background()
+
+	jsonParser := &models.Parser{
+		ID:          "p1",
+		Name:        "Boiler",
+		BuiltInType: parser.BuiltInJSON,
+		Fields:      []models.ParserField{{Name: "temperature", DeviceID: "boiler"}, {Name: "pressure", DeviceID: "boiler"}},
+	}
+	if err := store.CreateParser(ctx, jsonParser); err != nil {
+		t.Fatalf("CreateParser() error = %v", err)
+	}
+
+	// A sink that fails, and stalls until the end, holds up neither the
+	// reads nor the other sink
+	stalled := &blockingSink{release: make(chan struct{})}
+	cm.AddSink(stalled)
+	sink := &sinkRecorder{}
+	cm.AddSink(sink)
+
+	conn := newReplay(t, cm, "p1",
+		`{"temperature": 20, "pressure": 1.5}`,
+		`{"temperature": 21}`,
+		`not json`,
+		`{"pressure": 1.6}`,
+	)
+	if err := cm.connections[conn.ID].handler.Connect(ctx, api.ConnectionConfig{}); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+
+	read := func() []models.DataPoint {
+		t.Helper()
+		points, err := cm.ReadAndStore(ctx, conn.ID)
+		if err != nil {
+			t.Fatalf("ReadAndStore() error = %v", err)
+		}
+		if len(points) != 1 || points[0].DeviceID != "boiler" || points[0].ParserID != "p1" || points[0].ParserVersion != 1 {
+			t.Fatalf("ReadAndStore() = %+v, want one point for boiler from p1 v1", points)
+		}
+		return points
+	}
+
+	if points := read(); points[0].Data != `{"pressure":1.5,"temperature":20}` || points[0].Quality != "" {
+		t.Errorf("first point = %+v", points[0])
+	}
+
+	// The missing pressure repeats its last value as stale
+	points := read()
+	if points[0].Data != `{"pressure":1.5,"temperature":21}` {
+		t.Errorf("second point data = %s, want the last pressure", points[0].Data)
+	}
+	var quality map[string]models.FieldQuality
+	if err := json.Unmarshal([]byte(points[0].Quality), &quality); err != nil {
+		t.Fatalf("invalid quality %q: %v", points[0].Quality, err)
+	}
+	if quality["pressure"].Quality != models.QualityStale || len(quality) != 1 {
+		t.Errorf("second point quality = %+v, want pressure stale", quality)
+	}
+
+	// A frame that does not parse fails the read but is still captured
+	if _, err := cm.ReadAndStore(ctx, conn.ID); err == nil {
+		t.Error("ReadAndStore() accepted a frame the parser rejected")
+	}
+
+	if points := read(); points[0].Data != `{"pressure":1.6,"temperature":21}` {
+		t.Errorf("fourth point data = %s, want the last temperature", points[0].Data)
+	}
+
+	waitFor(t, "the sink", func() bool { return sink.count() == 3 })
+	close(stalled.release)
+	if err := cm.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if calls := stalled.calls.Load(); calls != 3 {
+		t.Errorf("stalled sink got %d batches by Close, want 3", calls)
+	}
+
+	stored, err := store.QueryData(ctx, "s1", "boiler", 0, time.Now().Add(time.Hour).UnixMilli())
+	if err != nil {
+		t.Fatalf("QueryData() error = %v", err)
+	}
+	if len(stored) != 3 {
+		t.Fatalf("QueryData() returned %d points, want 3", len(stored))
+	}
+	frames, err := store.QueryRawFrames(ctx, conn.ID, 0, time.Now().Add(time.Hour).UnixMilli())
+	if err != nil {
+		t.Fatalf("QueryRawFrames() error = %v", err)
+	}
+	if len(frames) != 4 {
+		t.Errorf("QueryRawFrames() returned %d frames, want all 4", len(frames))
+	}
+	for i, point := range stored {
+		if point.FrameID == 0 {
+			t.Errorf("stored point %d has no frame", i)
+		}
+	}
+	if metrics := cm.IngestMetrics(); metrics.Written != 3 || metrics.FramesWritten != 4 {
+		t.Errorf("ingest metrics = %+v, want 3 points and 4 frames written", metrics)
+	}
+}
+
+func TestFillStale(t *testing.T) {
+	mc := &managedConnection{}
+	bad := models.FieldQuality{Quality: models.QualityBad, Error: "out of range"}
+
+	// Nothing to repeat yet: the bad field stays missing
+	first := &parser.ParserResult{
+		DeviceData: map[string]map[string]interface{}{"d1": {"a": 1.0}},
+		Quality:    map[string]map[string]models.FieldQuality{"d1": {"b": bad}},
+	}
+	mc.fillStale(first)
+	if _, ok := first.DeviceData["d1"]["b"]; ok || first.Quality["d1"]["b"].Quality != models.QualityBad {
+		t.Errorf("first result = %+v, want b bad and missing", first)
+	}
+
+	second := &parser.ParserResult{
+		DeviceData: map[string]map[string]interface{}{"d1": {"b": 2.0}},
+		Quality:    map[string]map[string]models.FieldQuality{"d1": {"a": bad}},
+	}
+	mc.fillStale(second)
+	if second.DeviceData["d1"]["a"] != 1.0 || second.Quality["d1"]["a"].Quality != models.QualityStale {
+		t.Errorf("second result = %+v, want a stale at 1", second)
+	}
+
+	// Devices are kept apart, and a device without values gets its own map
+	third := &parser.ParserResult{
+		DeviceData: map[string]map[string]interface{}{},
+		Quality:    map[string]map[string]models.FieldQuality{"d1": {"b": bad}, "d2": {"a": bad}},
+	}
+	mc.fillStale(third)
+	if third.DeviceData["d1"]["b"] != 2.0 || third.Quality["d1"]["b"].Quality != models.QualityStale {
+		t.Errorf("third result d1 = %+v, want b stale at 2", third.DeviceData["d1"])
+	}
+	if _, ok := third.DeviceData["d2"]["a"]; ok || third.Quality["d2"]["a"].Quality != models.QualityBad {
+		t.Errorf("third result d2 = %+v, want a bad and missing", third.DeviceData["d2"])
+	}
+}
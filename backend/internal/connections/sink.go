@@ -0,0 +1,58 @@
+package connections
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultSinkQueueSize = 256 // batches
+
+// sinkQueue delivers batches of data points to one sink from its own
+// goroutine, so reads do not wait for the sink
+type sinkQueue struct {
+	sink    DataSink
+	batches chan []models.DataPoint
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+func newSinkQueue(sink DataSink, size int) *sinkQueue {
+	q := &sinkQueue{
+		sink:    sink,
+		batches: make(chan []models.DataPoint, size),
+		done:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// push queues a batch, or drops it if the sink is too far behind. The points
+// are shared with storage and other sinks and must not be modified.
+func (q *sinkQueue) push(points []models.DataPoint) {
+	select {
+	case q.batches <- points:
+	default:
+		dropped := q.dropped.Add(int64(len(points)))
+		log.Warn().Int("points", len(points)).Int64("dropped", dropped).Msg("Sink queue full, dropping data points")
+	}
+}
+
+// close delivers the batches still queued and stops the goroutine; push must
+// not be called after it
+func (q *sinkQueue) close() {
+	close(q.batches)
+	<-q.done
+}
+
+func (q *sinkQueue) run() {
+	defer close(q.done)
+
+	for points := range q.batches {
+		if err := q.sink.WriteDataPoints(context.Background(), points); err != nil {
+			log.Warn().Err(err).Msg("Failed to forward data points to sink")
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/iotstudio/iotstudio/pkg/api"
+	"github.com/rs/zerolog/log"
+)
+
+// What happens to points and frames written while the queue is full
+const (
+	// PolicyBlock makes the writer wait for room, up to BlockTimeout, and
+	// then drops its remaining points
+	PolicyBlock = "block"
+	// PolicyDropNewest drops the points being written
+	PolicyDropNewest = "drop_newest"
+	// PolicyDropOldest drops the longest queued points to make room
+	PolicyDropOldest = "drop_oldest"
+)
+
+const (
+	defaultQueueSize     = 10000
+	defaultBatchSize     = 500
+	defaultFlushInterval = time.Second
+	defaultBlockTimeout  = 100 * time.Millisecond
+	defaultRetries       = 3
+	defaultRetryDelay    = 100 * time.Millisecond
+)
+
+var (
+	// ErrQueueFull is returned when points were dropped instead of queued
+	ErrQueueFull = errors.New("ingest queue full")
+	// ErrClosed is returned for points written after Close
+	ErrClosed = errors.New("ingest pipeline closed")
+)
+
+// Writer stores batches of data points and raw frames; implemented by
+// storage.Storage
+type Writer interface {
+	WriteDataPoints(ctx context.Context, points []models.DataPoint) error
+	WriteRawFrames(ctx context.Context, frames []*models.RawFrame) error
+}
+
+// TransientChecker is implemented by writers that can tell failures worth
+// retrying, such as a locked database, from permanent ones. Without it no
+// write is retried.
+type TransientChecker interface {
+	IsTransient(err error) bool
+}
+
+type Config struct {
+	QueueSize     int           // points and frames held before the policy applies
+	BatchSize     int           // most points and frames per write
+	FlushInterval time.Duration // longest a point waits for a batch to fill
+	Policy        string
+	BlockTimeout  time.Duration // for PolicyBlock
+	Retries       int           // attempts after a transient failure; negative for none
+	RetryDelay    time.Duration // before the first retry, doubling for each next one
+}
+
+// entry is a queued raw frame or data point. A point decoded from a
+// captured frame refers to it and takes its ID once the frame is stored.
+type entry struct {
+	frame *models.RawFrame
+	point models.DataPoint
+	from  *models.RawFrame
+}
+
+// Validate checks the policy, so configuration errors surface at startup
+func (c Config) Validate() error {
+	switch c.Policy {
+	case "", PolicyBlock, PolicyDropNewest, PolicyDropOldest:
+		return nil
+	default:
+		return fmt.Errorf("unknown ingest policy: %s", c.Policy)
+	}
+}
+
+// Pipeline queues data points and raw frames in memory and writes them in
+// batches from a single worker, so acquisition does not wait for the disk.
+// A batch is written once BatchSize entries are queued or FlushInterval has
+// passed. Writes that fail transiently are retried with backoff; anything
+// the storage still rejects is logged and counted.
+type Pipeline struct {
+	config Config
+	writer Writer
+	ready  chan struct{} // a batch is full
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+
+	mu           sync.Mutex
+	queue        []entry
+	space        chan struct{} // closed when points leave the queue
+	closed       bool
+	metrics      api.IngestMetrics
+	totalLatency time.Duration
+}
+
+func NewPipeline(writer Writer, config Config) *Pipeline {
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultQueueSize
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.BatchSize > config.QueueSize {
+		config.BatchSize = config.QueueSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaultFlushInterval
+	}
+	if config.Policy == "" {
+		config.Policy = PolicyDropOldest
+	}
+	if config.BlockTimeout <= 0 {
+		config.BlockTimeout = defaultBlockTimeout
+	}
+	if config.Retries == 0 {
+		config.Retries = defaultRetries
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = defaultRetryDelay
+	}
+
+	p := &Pipeline{
+		config: config,
+		writer: writer,
+		ready:  make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		space:  make(chan struct{}),
+	}
+	p.metrics.QueueSize = config.QueueSize
+
+	go p.run()
+
+	return p
+}
+
+// WriteDataPoints queues the points, so the pipeline can stand in for
+// storage. It returns ErrQueueFull if any of them were dropped under
+// PolicyDropNewest or PolicyBlock; the others are still queued.
+func (p *Pipeline) WriteDataPoints(ctx context.Context, points []models.DataPoint) error {
+	return p.WriteFrame(ctx, nil, points)
+}
+
+// WriteFrame queues a captured raw frame ahead of the points decoded from
+// it, which are stored with the frame's ID. The frame may be nil, and the
+// pipeline owns it from now on. Errors are as for WriteDataPoints.
+func (p *Pipeline) WriteFrame(ctx context.Context, frame *models.RawFrame, points []models.DataPoint) error {
+	entries := make([]entry, 0, len(points)+1)
+	if frame != nil {
+		entries = append(entries, entry{frame: frame})
+	}
+	for _, point := range points {
+		entries = append(entries, entry{point: point, from: frame})
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	p.count(entries, &p.metrics.Received, &p.metrics.Frames)
+
+	var deadline <-chan time.Time
+	for i, e := range entries {
+		for len(p.queue) >= p.config.QueueSize {
+			switch p.config.Policy {
+			case PolicyDropOldest:
+				if p.dropOldest() == frame && frame != nil {
+					// The frame made room for its own points, which go with it
+					p.count(entries[i:], &p.metrics.Dropped, &p.metrics.FramesDropped)
+					p.signalBatch()
+					return nil
+				}
+				continue
+			case PolicyBlock:
+				if deadline == nil {
+					timer := time.NewTimer(p.config.BlockTimeout)
+					defer timer.Stop()
+					deadline = timer.C
+				}
+				if p.wait(ctx, deadline) {
+					continue
+				}
+			}
+			p.count(entries[i:], &p.metrics.Dropped, &p.metrics.FramesDropped)
+			return ErrQueueFull
+		}
+		p.queue = append(p.queue, e)
+	}
+
+	p.signalBatch()
+	return nil
+}
+
+// signalBatch wakes the worker if a batch is full
+func (p *Pipeline) signalBatch() {
+	if len(p.queue) >= p.config.BatchSize {
+		select {
+		case p.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// dropOldest drops the longest queued entry and returns it if it is a
+// frame. The points decoded from a frame are dropped with it, as they could
+// no longer refer to it.
+func (p *Pipeline) dropOldest() *models.RawFrame {
+	oldest := p.queue[0]
+	p.count(p.queue[:1], &p.metrics.Dropped, &p.metrics.FramesDropped)
+	p.queue = p.queue[1:]
+	if oldest.frame == nil {
+		return nil
+	}
+
+	queue := p.queue[:0]
+	for _, e := range p.queue {
+		if e.from == oldest.frame {
+			p.metrics.Dropped++
+			continue
+		}
+		queue = append(queue, e)
+	}
+	p.queue = queue
+	return oldest.frame
+}
+
+// count adds the points and the frames among entries to the two counters
+func (p *Pipeline) count(entries []entry, points, frames *int64) {
+	for _, e := range entries {
+		if e.frame != nil {
+			*frames++
+		} else {
+			*points++
+		}
+	}
+}
+
+// wait releases the lock until points leave the queue and reports whether
+// they did before the deadline, the context ending or the pipeline closing
+func (p *Pipeline) wait(ctx context.Context, deadline <-chan time.Time) bool {
+	space := p.space
+	p.mu.Unlock()
+	defer p.mu.Lock()
+
+	select {
+	case <-space:
+		return true
+	case <-deadline:
+	case <-ctx.Done():
+	case <-p.stop:
+	}
+	return false
+}
+
+// GetMetrics returns the current queue depth and totals since start
+func (p *Pipeline) GetMetrics() api.IngestMetrics {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	metrics := p.metrics
+	metrics.QueueDepth = len(p.queue)
+	if metrics.Batches > 0 {
+		entries := metrics.Written + metrics.Failed + metrics.FramesWritten + metrics.FramesFailed
+		metrics.AverageBatchSize = float64(entries) / float64(metrics.Batches)
+		metrics.AverageBatchLatency = float64(p.totalLatency.Microseconds()) / float64(metrics.Batches) / 1000
+	}
+	return metrics
+}
+
+// Close stops accepting points and frames and returns once everything queued has been
+// written
+func (p *Pipeline) Close() error {
+	p.once.Do(func() {
+		p.mu.Lock()
+		p.closed = true
+		p.mu.Unlock()
+		close(p.stop)
+	})
+	<-p.done
+	return nil
+}
+
+func (p *Pipeline) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ready:
+			p.flush(false)
+		case <-ticker.C:
+			p.flush(true)
+		case <-p.stop:
+			p.flush(true)
+			return
+		}
+	}
+}
+
+// flush writes the full batches queued, and with all the last partial one too
+func (p *Pipeline) flush(all bool) {
+	for {
+		p.mu.Lock()
+		n := min(len(p.queue), p.config.BatchSize)
+		if n == 0 || (!all && n < p.config.BatchSize) {
+			p.mu.Unlock()
+			return
+		}
+		batch := make([]entry, n)
+		copy(batch, p.queue)
+		p.queue = p.queue[n:]
+		close(p.space)
+		p.space = make(chan struct{})
+		p.mu.Unlock()
+
+		p.write(batch)
+	}
+}
+
+// write stores the frames of the batch and then its points, so points can
+// take the IDs of frames queued ahead of them
+func (p *Pipeline) write(batch []entry) {
+	var frames []*models.RawFrame
+	for _, e := range batch {
+		if e.frame != nil {
+			frames = append(frames, e.frame)
+		}
+	}
+
+	start := time.Now()
+	var framesErr error
+	if len(frames) > 0 {
+		framesErr = p.retry(func() error {
+			return p.writer.WriteRawFrames(context.Background(), frames)
+		})
+	}
+
+	points := make([]models.DataPoint, 0, len(batch)-len(frames))
+	for _, e := range batch {
+		if e.frame == nil {
+			if e.from != nil {
+				e.point.FrameID = e.from.ID // 0 if the frame failed
+			}
+			points = append(points, e.point)
+		}
+	}
+	var pointsErr error
+	if len(points) > 0 {
+		pointsErr = p.retry(func() error {
+			return p.writer.WriteDataPoints(context.Background(), points)
+		})
+	}
+	latency := time.Since(start)
+
+	p.mu.Lock()
+	p.metrics.Batches++
+	p.totalLatency += latency
+	if ms := float64(latency.Microseconds()) / 1000; ms > p.metrics.MaxBatchLatency {
+		p.metrics.MaxBatchLatency = ms
+	}
+	if framesErr != nil {
+		p.metrics.FramesFailed += int64(len(frames))
+	} else {
+		p.metrics.FramesWritten += int64(len(frames))
+	}
+	if pointsErr != nil {
+		p.metrics.Failed += int64(len(points))
+	} else {
+		p.metrics.Written += int64(len(points))
+	}
+	p.mu.Unlock()
+
+	if framesErr != nil {
+		log.Warn().Err(framesErr).Int("frames", len(frames)).Msg("Failed to store raw frames")
+	}
+	if pointsErr != nil {
+		log.Warn().Err(pointsErr).Int("points", len(points)).Msg("Failed to store data points")
+	}
+}
+
+// retry calls write until it succeeds, fails permanently or runs out of
+// retries, waiting twice as long before each next attempt
+func (p *Pipeline) retry(write func() error) error {
+	checker, _ := p.writer.(TransientChecker)
+	delay := p.config.RetryDelay
+
+	for attempt := 0; ; attempt++ {
+		err := write()
+		if err == nil || checker == nil || attempt >= p.config.Retries || !checker.IsTransient(err) {
+			return err
+		}
+
+		log.Debug().Err(err).Dur("delay", delay).Int("retry", attempt+1).Msg("Retrying ingest write")
+		p.mu.Lock()
+		p.metrics.Retries++
+		p.mu.Unlock()
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
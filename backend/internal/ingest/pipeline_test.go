@@ -0,0 +1,384 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+// recorder stores batches in memory; writes wait while it is blocked and
+// fail with err, the first busy of them transiently
+type recorder struct {
+	mu      sync.Mutex
+	batches [][]models.DataPoint
+	frames  []*models.RawFrame
+	block   chan struct{}
+	err     error
+	busy    int
+	calls   int
+}
+
+var errBusy = errors.New("database is locked")
+
+func (r *recorder) IsTransient(err error) bool {
+	return errors.Is(err, errBusy)
+}
+
+func (r *recorder) WriteRawFrames(ctx context.Context, frames []*models.RawFrame) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, frame := range frames {
+		r.frames = append(r.frames, frame)
+		frame.ID = int64(len(r.frames))
+	}
+	return nil
+}
+
+func (r *recorder) WriteDataPoints(ctx context.Context, points []models.DataPoint) error {
+	if r.block != nil {
+		<-r.block
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	if r.busy > 0 {
+		r.busy--
+		return errBusy
+	}
+	if r.err != nil {
+		return r.err
+	}
+	r.batches = append(r.batches, points)
+	return nil
+}
+
+func (r *recorder) sizes() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sizes := make([]int, len(r.batches))
+	for i, batch := range r.batches {
+		sizes[i] = len(batch)
+	}
+	return sizes
+}
+
+// timestamps returns the timestamps of every point written, in order
+func (r *recorder) timestamps() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var timestamps []int64
+	for _, batch := range r.batches {
+		for _, point := range batch {
+			timestamps = append(timestamps, point.Timestamp)
+		}
+	}
+	return timestamps
+}
+
+func points(from, n int) []models.DataPoint {
+	points := make([]models.DataPoint, n)
+	for i := range points {
+		points[i] = models.DataPoint{SessionID: "s1", DeviceID: "d1", Timestamp: int64(from + i), Data: `{"value":1}`}
+	}
+	return points
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPipelineBatchesBySize(t *testing.T) {
+	writer := &recorder{}
+	p := NewPipeline(writer, Config{BatchSize: 10, FlushInterval: time.Hour})
+	defer p.Close()
+
+	for i := 0; i < 25; i++ {
+		if err := p.WriteDataPoints(context.Background(), points(i, 1)); err != nil {
+			t.Fatalf("WriteDataPoints() error = %v", err)
+		}
+	}
+
+	waitFor(t, "two full batches", func() bool { return len(writer.sizes()) == 2 })
+	if sizes := writer.sizes(); sizes[0] != 10 || sizes[1] != 10 {
+		t.Errorf("batch sizes = %v, want [10 10]", sizes)
+	}
+	if depth := p.GetMetrics().QueueDepth; depth != 5 {
+		t.Errorf("QueueDepth = %d, want 5", depth)
+	}
+}
+
+func TestPipelineFlushesOnInterval(t *testing.T) {
+	writer := &recorder{}
+	p := NewPipeline(writer, Config{BatchSize: 100, FlushInterval: 20 * time.Millisecond})
+	defer p.Close()
+
+	if err := p.WriteDataPoints(context.Background(), points(0, 3)); err != nil {
+		t.Fatalf("WriteDataPoints() error = %v", err)
+	}
+	waitFor(t, "the partial batch", func() bool { return len(writer.sizes()) == 1 })
+	if sizes := writer.sizes(); sizes[0] != 3 {
+		t.Errorf("batch sizes = %v, want [3]", sizes)
+	}
+}
+
+func TestPipelineFlushesOnClose(t *testing.T) {
+	writer := &recorder{}
+	p := NewPipeline(writer, Config{BatchSize: 10, FlushInterval: time.Hour})
+
+	if err := p.WriteDataPoints(context.Background(), points(0, 25)); err != nil {
+		t.Fatalf("WriteDataPoints() error = %v", err)
+	}
+	p.Close()
+
+	if got := writer.timestamps(); len(got) != 25 {
+		t.Errorf("Close() left %d points written, want 25", len(got))
+	}
+	if err := p.WriteDataPoints(context.Background(), points(25, 1)); !errors.Is(err, ErrClosed) {
+		t.Errorf("WriteDataPoints() after Close() error = %v, want ErrClosed", err)
+	}
+
+	metrics := p.GetMetrics()
+	if metrics.Received != 25 || metrics.Written != 25 || metrics.QueueDepth != 0 || metrics.Batches != 3 {
+		t.Errorf("metrics = %+v, want 25 received and written in 3 batches", metrics)
+	}
+}
+
+func TestPipelinePolicies(t *testing.T) {
+	tests := []struct {
+		policy  string
+		wantErr error
+		want    []int64 // timestamps written
+	}{
+		{PolicyDropOldest, nil, []int64{0, 3, 4, 5, 6}},
+		{PolicyDropNewest, ErrQueueFull, []int64{0, 1, 2, 3, 4}},
+		{PolicyBlock, ErrQueueFull, []int64{0, 1, 2, 3, 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			writer := &recorder{block: make(chan struct{})}
+			p := NewPipeline(writer, Config{QueueSize: 4, BatchSize: 1, FlushInterval: time.Hour, Policy: tt.policy, BlockTimeout: 10 * time.Millisecond})
+
+			// The worker holds the first point while the storage is stuck
+			p.WriteDataPoints(context.Background(), points(0, 1))
+			waitFor(t, "the first write", func() bool { return p.GetMetrics().QueueDepth == 0 })
+
+			start := time.Now()
+			if err := p.WriteDataPoints(context.Background(), points(1, 6)); !errors.Is(err, tt.wantErr) {
+				t.Errorf("WriteDataPoints() error = %v, want %v", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("WriteDataPoints() blocked for %v", elapsed)
+			}
+
+			close(writer.block)
+			p.Close()
+
+			if got := writer.timestamps(); !equal(got, tt.want) {
+				t.Errorf("written = %v, want %v", got, tt.want)
+			}
+			if metrics := p.GetMetrics(); metrics.Dropped != 2 || metrics.Received != 7 {
+				t.Errorf("metrics = %+v, want 7 received and 2 dropped", metrics)
+			}
+		})
+	}
+}
+
+func TestPipelineBlockWaitsForRoom(t *testing.T) {
+	writer := &recorder{block: make(chan struct{})}
+	p := NewPipeline(writer, Config{QueueSize: 2, BatchSize: 1, FlushInterval: time.Hour, Policy: PolicyBlock, BlockTimeout: time.Minute})
+	defer p.Close()
+
+	p.WriteDataPoints(context.Background(), points(0, 1))
+	waitFor(t, "the first write", func() bool { return p.GetMetrics().QueueDepth == 0 })
+
+	result := make(chan error, 1)
+	go func() { result <- p.WriteDataPoints(context.Background(), points(1, 4)) }()
+
+	select {
+	case err := <-result:
+		t.Fatalf("WriteDataPoints() returned %v before there was room", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(writer.block)
+	if err := <-result; err != nil {
+		t.Errorf("WriteDataPoints() error = %v", err)
+	}
+	p.Close()
+	if got := writer.timestamps(); !equal(got, []int64{0, 1, 2, 3, 4}) {
+		t.Errorf("written = %v, want all five points", got)
+	}
+}
+
+func TestPipelineCountsFailedWrites(t *testing.T) {
+	writer := &recorder{err: errors.New("disk full")}
+	p := NewPipeline(writer, Config{BatchSize: 2, FlushInterval: time.Hour})
+
+	p.WriteDataPoints(context.Background(), points(0, 3))
+	p.Close()
+
+	metrics := p.GetMetrics()
+	if metrics.Failed != 3 || metrics.Written != 0 || metrics.Batches != 2 || metrics.AverageBatchSize != 1.5 {
+		t.Errorf("metrics = %+v, want 3 failed points in 2 batches", metrics)
+	}
+}
+
+func TestPipelineRetriesTransientErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		busy        int
+		wantWritten int64
+		wantFailed  int64
+		wantCalls   int
+		wantRetries int64
+	}{
+		{"recovers", 2, 3, 0, 3, 2},
+		{"gives up", 5, 0, 3, 4, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := &recorder{busy: tt.busy}
+			p := NewPipeline(writer, Config{BatchSize: 10, FlushInterval: time.Hour, Retries: 3, RetryDelay: time.Millisecond})
+
+			p.WriteDataPoints(context.Background(), points(0, 3))
+			p.Close()
+
+			metrics := p.GetMetrics()
+			if metrics.Written != tt.wantWritten || metrics.Failed != tt.wantFailed || metrics.Retries != tt.wantRetries {
+				t.Errorf("metrics = %+v, want %d written, %d failed after %d retries", metrics, tt.wantWritten, tt.wantFailed, tt.wantRetries)
+			}
+			if writer.calls != tt.wantCalls {
+				t.Errorf("WriteDataPoints() called %d times, want %d", writer.calls, tt.wantCalls)
+			}
+		})
+	}
+
+	// Permanent errors are not retried
+	writer := &recorder{err: errors.New("constraint failed")}
+	p := NewPipeline(writer, Config{BatchSize: 10, FlushInterval: time.Hour})
+	p.WriteDataPoints(context.Background(), points(0, 1))
+	p.Close()
+	if writer.calls != 1 || p.GetMetrics().Retries != 0 {
+		t.Errorf("permanent error written %d times, want once", writer.calls)
+	}
+}
+
+func TestPipelineLinksPointsToFrames(t *testing.T) {
+	writer := &recorder{}
+	p := NewPipeline(writer, Config{BatchSize: 2, FlushInterval: time.Hour})
+
+	// The frame and its points land in different batches
+	frame := &models.RawFrame{ConnectionID: "c1", Direction: models.FrameReceived, Data: []byte{0x01}}
+	if err := p.WriteFrame(context.Background(), nil, points(0, 1)); err != nil {
+		t.Fatalf("WriteFrame() error = %v", err)
+	}
+	if err := p.WriteFrame(context.Background(), frame, points(1, 2)); err != nil {
+		t.Fatalf("WriteFrame() error = %v", err)
+	}
+	if err := p.WriteFrame(context.Background(), &models.RawFrame{ConnectionID: "c1", Direction: models.FrameSent}, nil); err != nil {
+		t.Fatalf("WriteFrame() error = %v", err)
+	}
+	p.Close()
+
+	var frameIDs []int64
+	for _, batch := range writer.batches {
+		for _, point := range batch {
+			frameIDs = append(frameIDs, point.FrameID)
+		}
+	}
+	if !equal(frameIDs, []int64{0, 1, 1}) {
+		t.Errorf("point frame IDs = %v, want [0 1 1]", frameIDs)
+	}
+	metrics := p.GetMetrics()
+	if metrics.Frames != 2 || metrics.FramesWritten != 2 || metrics.Received != 3 || metrics.Written != 3 {
+		t.Errorf("metrics = %+v, want 2 frames and 3 points written", metrics)
+	}
+}
+
+func TestPipelineDropsFramesWithTheirPoints(t *testing.T) {
+	writer := &recorder{block: make(chan struct{})}
+	p := NewPipeline(writer, Config{QueueSize: 5, BatchSize: 1, FlushInterval: time.Hour, Policy: PolicyDropOldest})
+
+	p.WriteDataPoints(context.Background(), points(0, 1))
+	waitFor(t, "the first write", func() bool { return p.GetMetrics().QueueDepth == 0 })
+
+	// Making room for the second frame drops the first and its points
+	dropped := &models.RawFrame{ConnectionID: "c1", Direction: models.FrameReceived}
+	kept := &models.RawFrame{ConnectionID: "c1", Direction: models.FrameReceived}
+	p.WriteFrame(context.Background(), dropped, points(1, 2))
+	p.WriteFrame(context.Background(), nil, points(3, 1))
+	p.WriteFrame(context.Background(), kept, points(4, 2))
+
+	close(writer.block)
+	p.Close()
+
+	if got := writer.timestamps(); !equal(got, []int64{0, 3, 4, 5}) {
+		t.Errorf("written = %v, want [0 3 4 5]", got)
+	}
+	var frameIDs []int64
+	for _, batch := range writer.batches {
+		for _, point := range batch {
+			frameIDs = append(frameIDs, point.FrameID)
+		}
+	}
+	if !equal(frameIDs, []int64{0, 0, 1, 1}) {
+		t.Errorf("point frame IDs = %v, want [0 0 1 1]", frameIDs)
+	}
+	if metrics := p.GetMetrics(); metrics.Dropped != 2 || metrics.FramesDropped != 1 {
+		t.Errorf("metrics = %+v, want 2 points and 1 frame dropped", metrics)
+	}
+
+	// A frame dropped for its own points takes the rest of them along
+	writer = &recorder{block: make(chan struct{})}
+	p = NewPipeline(writer, Config{QueueSize: 2, BatchSize: 1, FlushInterval: time.Hour, Policy: PolicyDropOldest})
+	p.WriteDataPoints(context.Background(), points(0, 1))
+	waitFor(t, "the first write", func() bool { return p.GetMetrics().QueueDepth == 0 })
+	if err := p.WriteFrame(context.Background(), dropped, points(1, 3)); err != nil {
+		t.Errorf("WriteFrame() error = %v", err)
+	}
+	close(writer.block)
+	p.Close()
+
+	if got := writer.timestamps(); !equal(got, []int64{0}) {
+		t.Errorf("written = %v, want [0]", got)
+	}
+	if metrics := p.GetMetrics(); metrics.Dropped != 3 || metrics.FramesDropped != 1 {
+		t.Errorf("metrics = %+v, want 3 points and 1 frame dropped", metrics)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, policy := range []string{"", PolicyBlock, PolicyDropNewest, PolicyDropOldest} {
+		if err := (Config{Policy: policy}).Validate(); err != nil {
+			t.Errorf("Validate(%q) error = %v", policy, err)
+		}
+	}
+	if err := (Config{Policy: "drop"}).Validate(); err == nil {
+		t.Error("Validate() accepted an unknown policy")
+	}
+}
+
+func equal(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
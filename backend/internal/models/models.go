@@ -5,11 +5,37 @@ import (
 )
 
 type Session struct {
-	ID        string    `json:"id"`
-	Name      string    `json:"name"`
-	CreatedAt time.Time `json:"createdAt"`
-	UpdatedAt time.Time `json:"updatedAt"`
-	Status    string    `json:"status"`
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	Status    string     `json:"status"`
+	Retention *Retention `json:"retention,omitempty"` // nil keeps all data
+}
+
+// Retention limits how long a session's data is kept. Raw data points are
+// deleted once older than RawMaxAge and summarised by every rollup. Each
+// rollup keeps per-bucket summaries of the numeric fields for its own
+// MaxAge. Zero ages keep data forever.
+type Retention struct {
+	RawMaxAge int      `json:"rawMaxAge"` // in seconds
+	Rollups   []Rollup `json:"rollups,omitempty"`
+}
+
+// Rollup summarises numeric fields per Bucket seconds, aligned to the unix
+// epoch
+type Rollup struct {
+	Bucket int `json:"bucket"` // in seconds
+	MaxAge int `json:"maxAge"` // in seconds
+}
+
+// RetentionReport describes one run of the retention policies
+type RetentionReport struct {
+	Sessions       int   `json:"sessions"`
+	Rollups        int64 `json:"rollups"`        // rollup buckets written
+	DeletedPoints  int64 `json:"deletedPoints"`  // raw data points
+	DeletedRollups int64 `json:"deletedRollups"` // expired rollup buckets
+	ReclaimedBytes int64 `json:"reclaimedBytes"` // database pages freed for reuse
 }
 
 type Connection struct {
@@ -23,10 +49,34 @@ type Connection struct {
 	Delimiter string    `json:"delimiter"`
 	FixedSize int       `json:"fixedSize"`
 	Status    string    `json:"status"`
+	Capture   *Capture  `json:"capture,omitempty"` // raw frame capture; nil disables it
 	CreatedAt time.Time `json:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt"`
 }
 
+// Capture enables storing the raw frames of a connection. The oldest frames
+// are pruned once they are older than MaxAge or the capture exceeds
+// MaxBytes; zero disables the respective limit.
+type Capture struct {
+	MaxBytes int64 `json:"maxBytes"`
+	MaxAge   int   `json:"maxAge"` // in seconds
+}
+
+// Directions of raw frames
+const (
+	FrameReceived = "rx"
+	FrameSent     = "tx"
+)
+
+// RawFrame holds the bytes of one frame exactly as received or sent
+type RawFrame struct {
+	ID           int64  `json:"id"`
+	ConnectionID string `json:"connectionId"`
+	Timestamp    int64  `json:"timestamp"` // unix milliseconds
+	Direction    string `json:"direction"`
+	Data         []byte `json:"data"` // base64 in JSON
+}
+
 type Device struct {
 	ID           string    `json:"id"`
 	SessionID    string    `json:"sessionId"`
@@ -44,6 +94,67 @@ type DataPoint struct {
 	DeviceID  string `json:"deviceId"`
 	Timestamp int64  `json:"timestamp"`
 	Data      string `json:"data"`
+	Quality   string `json:"quality,omitempty"` // JSON map of field name to FieldQuality; absent fields are good
+
+	// Parser version that decoded the point, if any
+	ParserID      string `json:"parserId,omitempty"`
+	ParserVersion int    `json:"parserVersion,omitempty"`
+
+	// Raw frame the point was parsed from, if the connection captures frames
+	FrameID int64 `json:"frameId,omitempty"`
+}
+
+// Field qualities reported with parsed values
+const (
+	QualityGood       = "good"
+	QualityBad        = "bad"          // the field could not be decoded
+	QualityOutOfRange = "out_of_range" // decoded, but outside the field's Min/Max
+	QualityStale      = "stale"        // decoding failed, the last good value is repeated
+)
+
+// FieldQuality describes a field that was not decoded cleanly
+type FieldQuality struct {
+	Quality string `json:"quality"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Aggregations over the numeric fields of data points
+const (
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+	AggregateAvg   = "avg"
+	AggregateFirst = "first"
+	AggregateLast  = "last"
+	AggregateCount = "count"
+)
+
+// IsAggregation reports whether name is one of the Aggregate constants
+func IsAggregation(name string) bool {
+	switch name {
+	case AggregateMin, AggregateMax, AggregateAvg, AggregateFirst, AggregateLast, AggregateCount:
+		return true
+	}
+	return false
+}
+
+// AggregateQuery selects a device's data points between Start and End (unix
+// milliseconds) and summarises them per Bucket milliseconds, aligned to the
+// unix epoch
+type AggregateQuery struct {
+	SessionID    string
+	DeviceID     string
+	Start        int64
+	End          int64
+	Bucket       int64
+	Aggregations []string
+	Fields       []string // all numeric fields if empty
+}
+
+// AggregateBucket holds the aggregations of each numeric field over one
+// bucket, e.g. Values["temperature"]["avg"]
+type AggregateBucket struct {
+	Timestamp int64                         `json:"timestamp"` // start of the bucket
+	Values    map[string]map[string]float64 `json:"values"`
 }
 
 type Parser struct {
@@ -51,20 +162,83 @@ type Parser struct {
 	Name        string        `json:"name"`
 	Type        string        `json:"type"`
 	Fields      []ParserField `json:"fields"`
-	BuiltInType string        `json:"builtinType`
+	BuiltInType string        `json:"builtinType"`
+	Script      string        `json:"javascript"`
+	Checksum    *Checksum     `json:"checksum,omitempty"`
+	Version     int           `json:"version"` // incremented by every update, starting at 1
 	CreatedAt   time.Time     `json:"createdAt"`
 	UpdatedAt   time.Time     `json:"updatedAt"`
 }
 
+// ParserVersion is an immutable snapshot of a parser definition. Parser
+// holds the definition as it was saved, with Version set to this version.
+type ParserVersion struct {
+	ParserID  string    `json:"parserId"`
+	Version   int       `json:"version"`
+	Parser    Parser    `json:"parser"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
 type ParserField struct {
-	Name        string  `json:"name"`
-	DeviceID    string  `json:"deviceId"`
-	DataType    string  `json:"dataType"`
-	Offset      int     `json:"offset"`
-	BitOffset   int     `json:"bitOffset"`
-	BitWidth    int     `json:"bitWidth"`
-	Endianness  string  `json:"endianness"`
-	Scale       float64 `json:"scale"`
-	ValueOffset float64 `json:"offset"`
-	ArrayLength int     `json:"arrayLength"`
+	Name         string  `json:"name"`
+	DeviceID     string  `json:"deviceId"`
+	DataType     string  `json:"dataType"`
+	Offset       int     `json:"offset"`
+	BitOffset    int     `json:"bitOffset"`
+	BitWidth     int     `json:"bitWidth"`
+	BitOrder     string  `json:"bitOrder"` // "lsb" (default) or "msb"
+	Endianness   string  `json:"endianness"`
+	ByteOrder    string  `json:"byteOrder"`    // "ABCD", "CDAB", "BADC" or "DCBA"; overrides Endianness
+	FractionBits int     `json:"fractionBits"` // binary point position for fixed-point types
+	Scale        float64 `json:"scale"`
+	ValueOffset  float64 `json:"valueOffset"`
+	ArrayLength  int     `json:"arrayLength"`
+
+	// Plausible range; values outside it are reported as out of range
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+
+	// Arrays and repeated groups: Count elements spaced Stride bytes apart.
+	// Group members (DataType "group") have offsets relative to the element.
+	Count     int           `json:"count,omitempty"`
+	Stride    int           `json:"stride,omitempty"`
+	ArrayMode string        `json:"arrayMode,omitempty"` // "array" (default) or "indexed"
+	Fields    []ParserField `json:"fields,omitempty"`
+
+	// Variable layouts: fields may start after, or take their length or
+	// count from, a previously decoded field; "variant" fields select a
+	// sub-layout by the value of the Switch field.
+	After       string          `json:"after,omitempty"`
+	LengthField string          `json:"lengthField,omitempty"`
+	CountField  string          `json:"countField,omitempty"`
+	Switch      string          `json:"switch,omitempty"`
+	Variants    []ParserVariant `json:"variants,omitempty"`
+
+	// Computed fields (DataType "expression") evaluated after the raw
+	// fields; Lookup and Curve back the lookup() and interpolate() functions.
+	Expression string                 `json:"expression,omitempty"`
+	Lookup     map[string]interface{} `json:"lookup,omitempty"`
+	Curve      [][2]float64           `json:"curve,omitempty"`
+
+	// Write-back target used by the OPC UA server for writable fields
+	Writable     bool   `json:"writable"`
+	Register     int    `json:"register"`
+	RegisterType string `json:"registerType"` // "holding" (default) or "coil"
+}
+
+// Checksum describes the integrity check a frame must pass before its
+// fields are extracted. Negative offsets count from the end of the frame.
+type Checksum struct {
+	Algorithm  string `json:"algorithm"`        // crc16_modbus, crc16_ccitt, crc32, lrc, xor or sum8
+	Start      int    `json:"start"`            // first covered byte; a leading checksum is skipped
+	End        int    `json:"end"`              // end of the covered range (exclusive); 0 up to the checksum, or the end of the frame after a leading one
+	Offset     *int   `json:"offset,omitempty"` // checksum location, negative from the end; nil at the end of the frame
+	Endianness string `json:"endianness"`       // byte order of multi-byte checksums
+}
+
+// ParserVariant is a layout used when the discriminator matches Match; a
+// variant without Match is the default.
+type ParserVariant struct {
+	Match  string        `json:"match"`
+	Fields []ParserField `json:"fields"`
 }
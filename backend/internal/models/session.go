@@ -2,10 +2,15 @@ package models
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
 	//"time"
 )
 
+// maxUnitAddress is the highest valid Modbus unit identifier
+const maxUnitAddress = 247
+
 func (s *Session) Validate() error {
 	if strings.TrimSpace(s.ID) == "" {
 		return errors.New("session ID cannot be empty")
@@ -13,6 +18,29 @@ func (s *Session) Validate() error {
 	if strings.TrimSpace(s.Name) == "" {
 		return errors.New("session name cannot be empty")
 	}
+	if s.Retention != nil {
+		return s.Retention.Validate()
+	}
+	return nil
+}
+
+func (r *Retention) Validate() error {
+	if r.RawMaxAge < 0 {
+		return errors.New("raw data max age cannot be negative")
+	}
+	buckets := make(map[int]bool, len(r.Rollups))
+	for _, rollup := range r.Rollups {
+		if rollup.Bucket <= 0 {
+			return errors.New("rollup bucket must be positive")
+		}
+		if rollup.MaxAge < 0 {
+			return errors.New("rollup max age cannot be negative")
+		}
+		if buckets[rollup.Bucket] {
+			return fmt.Errorf("duplicate rollup bucket: %d", rollup.Bucket)
+		}
+		buckets[rollup.Bucket] = true
+	}
 	return nil
 }
 
@@ -23,5 +51,8 @@ func (d *Device) Validate() error {
 	if strings.TrimSpace(d.Name) == "" {
 		return errors.New("device name cannot be empty")
 	}
+	if n, err := strconv.Atoi(strings.TrimSpace(d.Address)); err == nil && (n < 0 || n > maxUnitAddress) {
+		return errors.New("device address must be between 0 and 247")
+	}
 	return nil
 }
@@ -44,6 +44,38 @@ func TestSessionValidation(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "Valid retention",
+			session: &Session{
+				ID:   "test-123",
+				Name: "Test Session",
+				Retention: &Retention{
+					RawMaxAge: 7 * 86400,
+					Rollups:   []Rollup{{Bucket: 60, MaxAge: 90 * 86400}, {Bucket: 3600}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "Duplicate rollup bucket",
+			session: &Session{
+				ID:   "test-123",
+				Name: "Test Session",
+				Retention: &Retention{
+					Rollups: []Rollup{{Bucket: 60, MaxAge: 86400}, {Bucket: 60}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Zero rollup bucket",
+			session: &Session{
+				ID:        "test-123",
+				Name:      "Test Session",
+				Retention: &Retention{Rollups: []Rollup{{Bucket: 0}}},
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
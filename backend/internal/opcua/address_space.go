@@ -0,0 +1,303 @@
+package opcua
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/iotstudio/iotstudio/internal/parser"
+)
+
+// namespaceIoTStudio holds the session, device and field nodes. Their string
+// identifiers mirror the hierarchy: "<session>", "<session>/<device>" and
+// "<session>/<device>/<field>".
+const namespaceIoTStudio = 1
+
+// Directory is the read-only view of the configuration the address space is
+// built from; storage.Storage satisfies it.
+type Directory interface {
+	ListSessions(ctx context.Context) ([]*models.Session, error)
+	GetSession(ctx context.Context, id string) (*models.Session, error)
+	ListDevicesBySession(ctx context.Context, sessionID string) ([]*models.Device, error)
+	GetDevice(ctx context.Context, id string) (*models.Device, error)
+	GetConnection(ctx context.Context, id string) (*models.Connection, error)
+	GetParser(ctx context.Context, id string) (*models.Parser, error)
+}
+
+type node struct {
+	id          NodeID
+	class       int32
+	browseName  QualifiedName
+	displayName string
+	description string
+	typeDef     uint32
+	parent      NodeID
+	parentRef   uint32
+
+	// Variable attributes
+	value    DataValue
+	dataType uint32
+	access   byte
+
+	// Bindings for field variables
+	device *models.Device
+	field  *models.ParserField
+}
+
+type liveValue struct {
+	value     interface{}
+	timestamp time.Time
+}
+
+type reference struct {
+	refType uint32
+	target  *node
+}
+
+func (s *Server) lookupNode(ctx context.Context, id NodeID) *node {
+	if id.Namespace == 0 && id.kind == nodeIDNumeric {
+		return s.standardNode(id.ID)
+	}
+	if id.Namespace != namespaceIoTStudio || id.kind != nodeIDString {
+		return nil
+	}
+
+	parts := strings.SplitN(id.Name, "/", 3)
+	session, err := s.config.Directory.GetSession(ctx, parts[0])
+	if err != nil {
+		return nil
+	}
+	if len(parts) == 1 {
+		return sessionNode(session)
+	}
+
+	device, err := s.config.Directory.GetDevice(ctx, parts[1])
+	if err != nil || device.SessionID != session.ID {
+		return nil
+	}
+	if len(parts) == 2 {
+		return deviceNode(device)
+	}
+
+	for _, field := range s.deviceFields(ctx, device) {
+		if field.Name == parts[2] {
+			return s.fieldNode(device, field)
+		}
+	}
+	return nil
+}
+
+func (s *Server) references(ctx context.Context, n *node) []reference {
+	var refs []reference
+
+	switch {
+	case n.id.equal(numericID(0, idRootFolder)):
+		refs = append(refs, reference{idOrganizes, s.standardNode(idObjectsFolder)})
+
+	case n.id.equal(numericID(0, idObjectsFolder)):
+		refs = append(refs, reference{idOrganizes, s.standardNode(idServer)})
+		sessions, err := s.config.Directory.ListSessions(ctx)
+		if err == nil {
+			for _, session := range sessions {
+				refs = append(refs, reference{idOrganizes, sessionNode(session)})
+			}
+		}
+
+	case n.id.equal(numericID(0, idServer)):
+		refs = append(refs,
+			reference{idHasProperty, s.standardNode(idServerArray)},
+			reference{idHasProperty, s.standardNode(idNamespaceArray)},
+		)
+
+	case n.id.Namespace == namespaceIoTStudio && n.device == nil && n.field == nil:
+		devices, err := s.config.Directory.ListDevicesBySession(ctx, n.id.Name)
+		if err == nil {
+			for _, device := range devices {
+				refs = append(refs, reference{idOrganizes, deviceNode(device)})
+			}
+		}
+
+	case n.device != nil && n.field == nil:
+		for _, field := range s.deviceFields(ctx, n.device) {
+			refs = append(refs, reference{idHasComponent, s.fieldNode(n.device, field)})
+		}
+	}
+
+	return refs
+}
+
+func (s *Server) standardNode(id uint32) *node {
+	switch id {
+	case idRootFolder:
+		return &node{id: numericID(0, id), class: nodeClassObject, browseName: QualifiedName{Name: "Root"},
+			displayName: "Root", typeDef: idFolderType}
+	case idObjectsFolder:
+		return &node{id: numericID(0, id), class: nodeClassObject, browseName: QualifiedName{Name: "Objects"},
+			displayName: "Objects", typeDef: idFolderType, parent: numericID(0, idRootFolder), parentRef: idOrganizes}
+	case idServer:
+		return &node{id: numericID(0, id), class: nodeClassObject, browseName: QualifiedName{Name: "Server"},
+			displayName: "Server", typeDef: idServerType, parent: numericID(0, idObjectsFolder), parentRef: idOrganizes}
+	case idServerArray:
+		return &node{id: numericID(0, id), class: nodeClassVariable, browseName: QualifiedName{Name: "ServerArray"},
+			displayName: "ServerArray", typeDef: idPropertyType, parent: numericID(0, idServer), parentRef: idHasProperty,
+			value: DataValue{Value: []string{s.config.ApplicationURI}, HasValue: true}, dataType: idString, access: accessLevelRead}
+	case idNamespaceArray:
+		return &node{id: numericID(0, id), class: nodeClassVariable, browseName: QualifiedName{Name: "NamespaceArray"},
+			displayName: "NamespaceArray", typeDef: idPropertyType, parent: numericID(0, idServer), parentRef: idHasProperty,
+			value:    DataValue{Value: []string{"http://opcfoundation.org/UA/", s.config.NamespaceURI}, HasValue: true},
+			dataType: idString, access: accessLevelRead}
+	default:
+		return nil
+	}
+}
+
+func sessionNode(session *models.Session) *node {
+	return &node{
+		id:          stringID(namespaceIoTStudio, session.ID),
+		class:       nodeClassObject,
+		browseName:  QualifiedName{Namespace: namespaceIoTStudio, Name: session.Name},
+		displayName: session.Name,
+		typeDef:     idFolderType,
+		parent:      numericID(0, idObjectsFolder),
+		parentRef:   idOrganizes,
+	}
+}
+
+func deviceNode(device *models.Device) *node {
+	return &node{
+		id:          stringID(namespaceIoTStudio, device.SessionID+"/"+device.ID),
+		class:       nodeClassObject,
+		browseName:  QualifiedName{Namespace: namespaceIoTStudio, Name: device.Name},
+		displayName: device.Name,
+		description: device.Description,
+		typeDef:     idBaseObjectType,
+		parent:      stringID(namespaceIoTStudio, device.SessionID),
+		parentRef:   idOrganizes,
+		device:      device,
+	}
+}
+
+func (s *Server) fieldNode(device *models.Device, field models.ParserField) *node {
+	n := &node{
+		id:          stringID(namespaceIoTStudio, device.SessionID+"/"+device.ID+"/"+field.Name),
+		class:       nodeClassVariable,
+		browseName:  QualifiedName{Namespace: namespaceIoTStudio, Name: field.Name},
+		displayName: field.Name,
+		typeDef:     idBaseDataVariableType,
+		parent:      stringID(namespaceIoTStudio, device.SessionID+"/"+device.ID),
+		parentRef:   idHasComponent,
+		dataType:    fieldDataType(field),
+		access:      accessLevelRead,
+		device:      device,
+		field:       &field,
+	}
+	if field.Writable && s.config.AllowWrites {
+		n.access |= accessLevelWrite
+	}
+
+	s.mu.RLock()
+	live, ok := s.values[device.ID][field.Name]
+	s.mu.RUnlock()
+
+	if !ok {
+		n.value = DataValue{Status: StatusBadWaitingForInitialData}
+		return n
+	}
+
+	n.value = DataValue{
+		Value:           variantValue(live.value),
+		HasValue:        true,
+		SourceTimestamp: live.timestamp,
+		ServerTimestamp: time.Now(),
+	}
+	switch live.value.(type) {
+	case float64:
+		n.dataType = idDouble
+	case bool:
+		n.dataType = idBoolean
+	case string:
+		n.dataType = idString
+	}
+	return n
+}
+
+// deviceFields returns the parser fields assigned to the device, followed by
+// any additional values received for it (e.g. from JSON payloads).
+func (s *Server) deviceFields(ctx context.Context, device *models.Device) []models.ParserField {
+	var fields []models.ParserField
+	seen := make(map[string]bool)
+
+	parserID := device.ParserID
+	if parserID == "" {
+		if conn, err := s.config.Directory.GetConnection(ctx, device.ConnectionID); err == nil {
+			parserID = conn.ParserID
+		}
+	}
+	if parserID != "" {
+		if p, err := s.config.Directory.GetParser(ctx, parserID); err == nil {
+			for _, field := range p.Fields {
+				// Indexed arrays arrive as separate name[i] values
+				if field.ArrayMode == parser.ArrayModeIndexed {
+					continue
+				}
+				if (field.DeviceID == device.ID || field.DeviceID == "") && !seen[field.Name] {
+					fields = append(fields, field)
+					seen[field.Name] = true
+				}
+			}
+		}
+	}
+
+	s.mu.RLock()
+	var extra []string
+	for name := range s.values[device.ID] {
+		if !seen[name] {
+			extra = append(extra, name)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(extra)
+	for _, name := range extra {
+		fields = append(fields, models.ParserField{Name: name, DeviceID: device.ID})
+	}
+
+	return fields
+}
+
+func fieldDataType(field models.ParserField) uint32 {
+	if field.DataType == "bool" || field.BitWidth == 1 {
+		return idBoolean
+	}
+
+	if field.Count > 0 {
+		return idString
+	}
+
+	switch field.DataType {
+	case "string", "raw_bytes", parser.DataTypeGroup:
+		return idString
+	case "":
+		return idBaseDataType
+	default:
+		return idDouble
+	}
+}
+
+// variantValue converts a decoded JSON value into something a Variant can
+// carry; nested objects and arrays are exposed as their JSON text.
+func variantValue(v interface{}) interface{} {
+	switch v.(type) {
+	case float64, bool, string, nil:
+		return v
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil
+		}
+		return string(data)
+	}
+}
@@ -0,0 +1,719 @@
+package opcua
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// OPC UA binary encoding (Part 6, section 5.2) for the subset of built-in
+// types used by the services this server implements.
+
+var errDecode = errors.New("opcua: decoding error")
+
+// Variant type identifiers
+const (
+	typeBoolean       = 1
+	typeSByte         = 2
+	typeByte          = 3
+	typeInt16         = 4
+	typeUInt16        = 5
+	typeInt32         = 6
+	typeUInt32        = 7
+	typeInt64         = 8
+	typeUInt64        = 9
+	typeFloat         = 10
+	typeDouble        = 11
+	typeString        = 12
+	typeDateTime      = 13
+	typeGUID          = 14
+	typeByteString    = 15
+	typeNodeID        = 17
+	typeStatusCode    = 19
+	typeQualifiedName = 20
+	typeLocalizedText = 21
+)
+
+// Seconds between 1601-01-01 (the OPC UA epoch) and the Unix epoch
+const epochOffset = 11644473600
+
+type nodeIDKind byte
+
+const (
+	nodeIDNumeric nodeIDKind = iota
+	nodeIDString
+	nodeIDGUID
+	nodeIDOpaque
+)
+
+// NodeID identifies a node. Numeric and string identifiers are used by the
+// address space; GUID and opaque identifiers are only round-tripped.
+type NodeID struct {
+	Namespace uint16
+	ID        uint32
+	Name      string
+	raw       []byte
+	kind      nodeIDKind
+}
+
+func numericID(ns uint16, id uint32) NodeID {
+	return NodeID{Namespace: ns, ID: id, kind: nodeIDNumeric}
+}
+
+func stringID(ns uint16, name string) NodeID {
+	return NodeID{Namespace: ns, Name: name, kind: nodeIDString}
+}
+
+func (n NodeID) String() string {
+	switch n.kind {
+	case nodeIDString:
+		return fmt.Sprintf("ns=%d;s=%s", n.Namespace, n.Name)
+	case nodeIDGUID:
+		return fmt.Sprintf("ns=%d;g=%x", n.Namespace, n.raw)
+	case nodeIDOpaque:
+		return fmt.Sprintf("ns=%d;b=%x", n.Namespace, n.raw)
+	default:
+		return fmt.Sprintf("ns=%d;i=%d", n.Namespace, n.ID)
+	}
+}
+
+func (n NodeID) equal(other NodeID) bool {
+	return n.Namespace == other.Namespace && n.kind == other.kind && n.ID == other.ID &&
+		n.Name == other.Name && string(n.raw) == string(other.raw)
+}
+
+func (n NodeID) isNull() bool {
+	return n.Namespace == 0 && n.kind == nodeIDNumeric && n.ID == 0
+}
+
+type QualifiedName struct {
+	Namespace uint16
+	Name      string
+}
+
+type LocalizedText struct {
+	Locale string
+	Text   string
+}
+
+type DataValue struct {
+	Value           interface{}
+	HasValue        bool
+	Status          uint32
+	SourceTimestamp time.Time
+	ServerTimestamp time.Time
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) bytes() []byte {
+	return e.buf.Bytes()
+}
+
+func (e *encoder) boolean(v bool) {
+	if v {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *encoder) byte(v byte) {
+	e.buf.WriteByte(v)
+}
+
+func (e *encoder) uint16(v uint16) {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) int32(v int32) {
+	e.uint32(uint32(v))
+}
+
+func (e *encoder) uint64(v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) int64(v int64) {
+	e.uint64(uint64(v))
+}
+
+func (e *encoder) float32(v float32) {
+	e.uint32(math.Float32bits(v))
+}
+
+func (e *encoder) float64(v float64) {
+	e.uint64(math.Float64bits(v))
+}
+
+// string encodes an empty string as null, which is what most stacks expect
+// for optional fields.
+func (e *encoder) string(v string) {
+	if v == "" {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(v)))
+	e.buf.WriteString(v)
+}
+
+func (e *encoder) byteString(v []byte) {
+	if v == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(v)))
+	e.buf.Write(v)
+}
+
+func (e *encoder) dateTime(t time.Time) {
+	if t.IsZero() {
+		e.int64(0)
+		return
+	}
+	e.int64((t.Unix()+epochOffset)*10000000 + int64(t.Nanosecond()/100))
+}
+
+func (e *encoder) stringArray(values []string) {
+	if values == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(values)))
+	for _, v := range values {
+		e.string(v)
+	}
+}
+
+func (e *encoder) nodeID(n NodeID) {
+	switch n.kind {
+	case nodeIDString:
+		e.byte(0x03)
+		e.uint16(n.Namespace)
+		e.string(n.Name)
+	case nodeIDGUID:
+		e.byte(0x04)
+		e.uint16(n.Namespace)
+		e.buf.Write(n.raw)
+	case nodeIDOpaque:
+		e.byte(0x05)
+		e.uint16(n.Namespace)
+		e.byteString(n.raw)
+	default:
+		switch {
+		case n.Namespace == 0 && n.ID <= 0xFF:
+			e.byte(0x00)
+			e.byte(byte(n.ID))
+		case n.Namespace <= 0xFF && n.ID <= 0xFFFF:
+			e.byte(0x01)
+			e.byte(byte(n.Namespace))
+			e.uint16(uint16(n.ID))
+		default:
+			e.byte(0x02)
+			e.uint16(n.Namespace)
+			e.uint32(n.ID)
+		}
+	}
+}
+
+// expandedNodeID encodes a local node: no namespace URI and no server index
+func (e *encoder) expandedNodeID(n NodeID) {
+	e.nodeID(n)
+}
+
+func (e *encoder) qualifiedName(q QualifiedName) {
+	e.uint16(q.Namespace)
+	e.string(q.Name)
+}
+
+func (e *encoder) localizedText(t LocalizedText) {
+	var mask byte
+	if t.Locale != "" {
+		mask |= 0x01
+	}
+	if t.Text != "" {
+		mask |= 0x02
+	}
+	e.byte(mask)
+	if t.Locale != "" {
+		e.string(t.Locale)
+	}
+	if t.Text != "" {
+		e.string(t.Text)
+	}
+}
+
+func (e *encoder) emptyExtensionObject() {
+	e.nodeID(NodeID{})
+	e.byte(0x00)
+}
+
+// extensionObject wraps a binary encoded structure
+func (e *encoder) extensionObject(typeID uint32, body []byte) {
+	e.nodeID(numericID(0, typeID))
+	e.byte(0x01)
+	e.byteString(body)
+}
+
+func (e *encoder) emptyDiagnosticInfo() {
+	e.byte(0x00)
+}
+
+func (e *encoder) variant(v interface{}) error {
+	switch value := v.(type) {
+	case nil:
+		e.byte(0)
+	case bool:
+		e.byte(typeBoolean)
+		e.boolean(value)
+	case int8:
+		e.byte(typeSByte)
+		e.byte(byte(value))
+	case uint8:
+		e.byte(typeByte)
+		e.byte(value)
+	case int16:
+		e.byte(typeInt16)
+		e.uint16(uint16(value))
+	case uint16:
+		e.byte(typeUInt16)
+		e.uint16(value)
+	case int32:
+		e.byte(typeInt32)
+		e.int32(value)
+	case uint32:
+		e.byte(typeUInt32)
+		e.uint32(value)
+	case int:
+		e.byte(typeInt64)
+		e.int64(int64(value))
+	case int64:
+		e.byte(typeInt64)
+		e.int64(value)
+	case uint64:
+		e.byte(typeUInt64)
+		e.uint64(value)
+	case float32:
+		e.byte(typeFloat)
+		e.float32(value)
+	case float64:
+		e.byte(typeDouble)
+		e.float64(value)
+	case string:
+		e.byte(typeString)
+		e.string(value)
+	case time.Time:
+		e.byte(typeDateTime)
+		e.dateTime(value)
+	case []byte:
+		e.byte(typeByteString)
+		e.byteString(value)
+	case NodeID:
+		e.byte(typeNodeID)
+		e.nodeID(value)
+	case QualifiedName:
+		e.byte(typeQualifiedName)
+		e.qualifiedName(value)
+	case LocalizedText:
+		e.byte(typeLocalizedText)
+		e.localizedText(value)
+	case []string:
+		e.byte(typeString | 0x80)
+		e.stringArray(value)
+	case []float64:
+		e.byte(typeDouble | 0x80)
+		e.int32(int32(len(value)))
+		for _, f := range value {
+			e.float64(f)
+		}
+	default:
+		return fmt.Errorf("opcua: cannot encode %T as variant", v)
+	}
+	return nil
+}
+
+func (e *encoder) dataValue(dv DataValue) error {
+	var mask byte
+	if dv.HasValue {
+		mask |= 0x01
+	}
+	if dv.Status != StatusGood {
+		mask |= 0x02
+	}
+	if !dv.SourceTimestamp.IsZero() {
+		mask |= 0x04
+	}
+	if !dv.ServerTimestamp.IsZero() {
+		mask |= 0x08
+	}
+
+	e.byte(mask)
+	if dv.HasValue {
+		if err := e.variant(dv.Value); err != nil {
+			return err
+		}
+	}
+	if dv.Status != StatusGood {
+		e.uint32(dv.Status)
+	}
+	if !dv.SourceTimestamp.IsZero() {
+		e.dateTime(dv.SourceTimestamp)
+	}
+	if !dv.ServerTimestamp.IsZero() {
+		e.dateTime(dv.ServerTimestamp)
+	}
+	return nil
+}
+
+// decoder reads OPC UA binary values. The first error is sticky: later
+// reads return zero values and err() reports it.
+type decoder struct {
+	data []byte
+	pos  int
+	fail error
+}
+
+func newDecoder(data []byte) *decoder {
+	return &decoder{data: data}
+}
+
+func (d *decoder) err() error {
+	return d.fail
+}
+
+func (d *decoder) remaining() int {
+	return len(d.data) - d.pos
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.fail != nil {
+		return nil
+	}
+	if n < 0 || d.pos+n > len(d.data) {
+		d.fail = errDecode
+		return nil
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
+
+func (d *decoder) boolean() bool {
+	return d.byte() != 0
+}
+
+func (d *decoder) byte() byte {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint16() uint16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *decoder) int32() int32 {
+	return int32(d.uint32())
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (d *decoder) int64() int64 {
+	return int64(d.uint64())
+}
+
+func (d *decoder) float32() float32 {
+	return math.Float32frombits(d.uint32())
+}
+
+func (d *decoder) float64() float64 {
+	return math.Float64frombits(d.uint64())
+}
+
+func (d *decoder) string() string {
+	return string(d.byteString())
+}
+
+func (d *decoder) byteString() []byte {
+	n := d.int32()
+	if n <= 0 {
+		return nil
+	}
+	b := d.next(int(n))
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+func (d *decoder) dateTime() time.Time {
+	ticks := d.int64()
+	if ticks <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(ticks/10000000-epochOffset, (ticks%10000000)*100).UTC()
+}
+
+func (d *decoder) arrayLength() int {
+	n := d.int32()
+	if n < 0 {
+		return 0
+	}
+	if int(n) > d.remaining() {
+		d.fail = errDecode
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) stringArray() []string {
+	n := d.arrayLength()
+	values := make([]string, 0, n)
+	for i := 0; i < n && d.fail == nil; i++ {
+		values = append(values, d.string())
+	}
+	return values
+}
+
+func (d *decoder) uint32Array() []uint32 {
+	n := d.arrayLength()
+	values := make([]uint32, 0, n)
+	for i := 0; i < n && d.fail == nil; i++ {
+		values = append(values, d.uint32())
+	}
+	return values
+}
+
+func (d *decoder) nodeID() NodeID {
+	switch d.byte() & 0x3F {
+	case 0x00:
+		return numericID(0, uint32(d.byte()))
+	case 0x01:
+		ns := uint16(d.byte())
+		return numericID(ns, uint32(d.uint16()))
+	case 0x02:
+		ns := d.uint16()
+		return numericID(ns, d.uint32())
+	case 0x03:
+		ns := d.uint16()
+		return stringID(ns, d.string())
+	case 0x04:
+		ns := d.uint16()
+		return NodeID{Namespace: ns, raw: append([]byte(nil), d.next(16)...), kind: nodeIDGUID}
+	case 0x05:
+		ns := d.uint16()
+		return NodeID{Namespace: ns, raw: d.byteString(), kind: nodeIDOpaque}
+	default:
+		d.fail = errDecode
+		return NodeID{}
+	}
+}
+
+func (d *decoder) expandedNodeID() NodeID {
+	if d.fail != nil || d.remaining() < 1 {
+		d.fail = errDecode
+		return NodeID{}
+	}
+	flags := d.data[d.pos]
+	n := d.nodeID()
+	if flags&0x80 != 0 {
+		d.string()
+	}
+	if flags&0x40 != 0 {
+		d.uint32()
+	}
+	return n
+}
+
+func (d *decoder) qualifiedName() QualifiedName {
+	ns := d.uint16()
+	return QualifiedName{Namespace: ns, Name: d.string()}
+}
+
+func (d *decoder) localizedText() LocalizedText {
+	mask := d.byte()
+	var t LocalizedText
+	if mask&0x01 != 0 {
+		t.Locale = d.string()
+	}
+	if mask&0x02 != 0 {
+		t.Text = d.string()
+	}
+	return t
+}
+
+// extensionObject skips over an extension object and returns its type ID
+func (d *decoder) extensionObject() NodeID {
+	typeID, _ := d.extensionObjectBody()
+	return typeID
+}
+
+// extensionObjectBody returns the type ID and encoded body of an extension
+// object; the body is nil if the object is empty.
+func (d *decoder) extensionObjectBody() (NodeID, []byte) {
+	typeID := d.nodeID()
+	var body []byte
+	switch d.byte() {
+	case 0x00:
+	case 0x01, 0x02:
+		body = d.byteString()
+	default:
+		d.fail = errDecode
+	}
+	return typeID, body
+}
+
+func (d *decoder) diagnosticInfo() {
+	mask := d.byte()
+	if mask&0x01 != 0 {
+		d.int32()
+	}
+	if mask&0x02 != 0 {
+		d.int32()
+	}
+	if mask&0x04 != 0 {
+		d.int32()
+	}
+	if mask&0x08 != 0 {
+		d.int32()
+	}
+	if mask&0x10 != 0 {
+		d.string()
+	}
+	if mask&0x20 != 0 {
+		d.uint32()
+	}
+	if mask&0x40 != 0 {
+		d.diagnosticInfo()
+	}
+}
+
+func (d *decoder) variant() interface{} {
+	mask := d.byte()
+	typeID := mask & 0x3F
+
+	if mask&0x80 == 0 {
+		return d.scalar(typeID)
+	}
+
+	n := d.arrayLength()
+	values := make([]interface{}, 0, n)
+	for i := 0; i < n && d.fail == nil; i++ {
+		values = append(values, d.scalar(typeID))
+	}
+	if mask&0x40 != 0 {
+		dims := d.arrayLength()
+		for i := 0; i < dims; i++ {
+			d.int32()
+		}
+	}
+	return values
+}
+
+func (d *decoder) scalar(typeID byte) interface{} {
+	switch typeID {
+	case 0:
+		return nil
+	case typeBoolean:
+		return d.boolean()
+	case typeSByte:
+		return int8(d.byte())
+	case typeByte:
+		return d.byte()
+	case typeInt16:
+		return int16(d.uint16())
+	case typeUInt16:
+		return d.uint16()
+	case typeInt32:
+		return d.int32()
+	case typeUInt32:
+		return d.uint32()
+	case typeInt64:
+		return d.int64()
+	case typeUInt64:
+		return d.uint64()
+	case typeFloat:
+		return d.float32()
+	case typeDouble:
+		return d.float64()
+	case typeString:
+		return d.string()
+	case typeDateTime:
+		return d.dateTime()
+	case typeGUID:
+		return append([]byte(nil), d.next(16)...)
+	case typeByteString:
+		return d.byteString()
+	case typeNodeID:
+		return d.nodeID()
+	case typeStatusCode:
+		return d.uint32()
+	case typeQualifiedName:
+		return d.qualifiedName()
+	case typeLocalizedText:
+		return d.localizedText()
+	default:
+		d.fail = fmt.Errorf("%w: unsupported variant type %d", errDecode, typeID)
+		return nil
+	}
+}
+
+func (d *decoder) dataValue() DataValue {
+	var dv DataValue
+	mask := d.byte()
+	if mask&0x01 != 0 {
+		dv.Value = d.variant()
+		dv.HasValue = true
+	}
+	if mask&0x02 != 0 {
+		dv.Status = d.uint32()
+	}
+	if mask&0x04 != 0 {
+		dv.SourceTimestamp = d.dateTime()
+	}
+	if mask&0x10 != 0 {
+		d.uint16()
+	}
+	if mask&0x08 != 0 {
+		dv.ServerTimestamp = d.dateTime()
+	}
+	if mask&0x20 != 0 {
+		d.uint16()
+	}
+	return dv
+}
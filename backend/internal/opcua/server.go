@@ -0,0 +1,939 @@
+package opcua
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	protocol "github.com/iotstudio/iotstudio/internal/protocols"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultBufferSize  = 65535
+	maxMessageSize     = 16 * 1024 * 1024
+	symmetricOverhead  = 24 // message, channel, token and sequence headers
+	defaultSessionTime = 60 * time.Minute
+	defaultMaxSessions = 100
+)
+
+// HandlerLookup returns the protocol handler of a running connection
+type HandlerLookup func(connID string) (protocol.ProtocolHandler, error)
+
+type Config struct {
+	Addr           string
+	EndpointURL    string
+	ApplicationURI string
+	NamespaceURI   string
+	Directory      Directory
+	Handlers       HandlerLookup
+	SessionTimeout time.Duration // longest a session may stay idle
+	MaxSessions    int
+	// AllowWrites forwards writes to writable fields. Sessions are
+	// anonymous and unencrypted, so anyone reaching the port may write.
+	AllowWrites bool
+}
+
+// Server exposes sessions, devices and parser fields over OPC UA (binary
+// transport, SecurityPolicy None, anonymous sessions). Field values are fed
+// through WriteDataPoints, which also reports them to the monitored items of
+// subscriptions; with AllowWrites, writes to writable fields are forwarded to
+// the Modbus handler of the device's connection.
+type Server struct {
+	config   Config
+	listener net.Listener
+
+	mu       sync.RWMutex
+	values   map[string]map[string]liveValue
+	watched  map[string]map[*monitoredItem]struct{} // by device ID
+	sessions map[string]*session
+	conns    map[net.Conn]struct{}
+
+	nextChannelID      uint32
+	nextSessionID      uint32
+	nextSubscriptionID uint32
+}
+
+type session struct {
+	id        NodeID
+	token     NodeID
+	activated bool
+	timeout   time.Duration
+	expires   time.Time // pushed back by every request
+
+	subscriptions map[uint32]*subscription
+	publishQueue  []*publishRequest
+}
+
+// secureChannel is read by its connection's goroutine. Responses are also
+// written by subscriptions, so mu guards the token, sequence number and
+// writes.
+type secureChannel struct {
+	mu         sync.Mutex
+	conn       net.Conn
+	id         uint32
+	tokenID    uint32
+	sendBuffer uint32
+	sequence   uint32
+	chunks     []byte
+}
+
+func NewServer(config Config) *Server {
+	if config.ApplicationURI == "" {
+		config.ApplicationURI = "urn:iotstudio:server"
+	}
+	if config.NamespaceURI == "" {
+		config.NamespaceURI = "urn:iotstudio"
+	}
+	if config.SessionTimeout <= 0 {
+		config.SessionTimeout = defaultSessionTime
+	}
+	if config.MaxSessions <= 0 {
+		config.MaxSessions = defaultMaxSessions
+	}
+
+	return &Server{
+		config:   config,
+		values:   make(map[string]map[string]liveValue),
+		watched:  make(map[string]map[*monitoredItem]struct{}),
+		sessions: make(map[string]*session),
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+// Listen binds the TCP listener; Serve must be called to accept clients
+func (s *Server) Listen() error {
+	listener, err := net.Listen("tcp", s.config.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.config.Addr, err)
+	}
+
+	s.mu.Lock()
+	s.listener = listener
+	if s.config.EndpointURL == "" {
+		s.config.EndpointURL = "opc.tcp://" + listener.Addr().String()
+	}
+	s.mu.Unlock()
+
+	log.Info().Str("endpoint", s.config.EndpointURL).Msg("OPC UA server listening")
+	return nil
+}
+
+func (s *Server) Addr() net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Serve accepts clients until the context is cancelled
+func (s *Server) Serve(ctx context.Context) error {
+	s.mu.RLock()
+	listener := s.listener
+	s.mu.RUnlock()
+
+	if listener == nil {
+		return errors.New("opcua: server is not listening")
+	}
+
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("accept failed: %w", err)
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go s.serveConn(ctx, conn)
+	}
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	for _, sess := range s.sessions {
+		s.dropSession(sess)
+	}
+	return err
+}
+
+// WriteDataPoints updates the live values and samples them for the monitored
+// items, so the server can be registered as a data sink on the connection
+// manager.
+func (s *Server) WriteDataPoints(ctx context.Context, points []models.DataPoint) error {
+	for _, point := range points {
+		var values map[string]interface{}
+		if err := json.Unmarshal([]byte(point.Data), &values); err != nil {
+			return fmt.Errorf("invalid data for device %s: %w", point.DeviceID, err)
+		}
+
+		timestamp := time.UnixMilli(point.Timestamp)
+
+		s.mu.Lock()
+		if s.values[point.DeviceID] == nil {
+			s.values[point.DeviceID] = make(map[string]liveValue)
+		}
+		for name, value := range values {
+			s.values[point.DeviceID][name] = liveValue{value: value, timestamp: timestamp}
+		}
+		s.sampleValues(point.DeviceID, values, timestamp)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	ch := &secureChannel{conn: conn, sendBuffer: defaultBufferSize}
+	defer func() {
+		conn.Close()
+		s.forgetChannel(ch)
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	header := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+
+		msgType := string(header[0:3])
+		chunkType := header[3]
+		size := binary.LittleEndian.Uint32(header[4:8])
+		if size < 8 || size > maxMessageSize {
+			s.sendError(conn, StatusBadCommunicationError, "invalid message size")
+			return
+		}
+
+		body := make([]byte, size-8)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		var err error
+		switch msgType {
+		case "HEL":
+			err = s.handleHello(ch, body)
+		case "OPN":
+			err = s.handleOpen(ch, body)
+		case "MSG":
+			err = s.handleMessage(ctx, ch, chunkType, body)
+		case "CLO":
+			return
+		default:
+			s.sendError(conn, StatusBadTCPMessageTypeInvalid, "unsupported message type "+msgType)
+			return
+		}
+
+		if err != nil {
+			log.Debug().Err(err).Str("remote", conn.RemoteAddr().String()).Msg("OPC UA connection closed")
+			return
+		}
+	}
+}
+
+func (s *Server) handleHello(ch *secureChannel, body []byte) error {
+	d := newDecoder(body)
+	version := d.uint32()
+	receiveBuffer := d.uint32()
+	sendBuffer := d.uint32()
+	d.uint32() // MaxMessageSize
+	d.uint32() // MaxChunkCount
+	d.string() // EndpointUrl
+	if d.err() != nil {
+		s.sendError(ch.conn, StatusBadDecodingError, "invalid hello")
+		return d.err()
+	}
+
+	if receiveBuffer > 0 && receiveBuffer < ch.sendBuffer {
+		ch.sendBuffer = receiveBuffer
+	}
+	if sendBuffer == 0 || sendBuffer > defaultBufferSize {
+		sendBuffer = defaultBufferSize
+	}
+
+	e := &encoder{}
+	e.uint32(version)
+	e.uint32(sendBuffer)
+	e.uint32(ch.sendBuffer)
+	e.uint32(maxMessageSize)
+	e.uint32(0)
+	return writeMessage(ch.conn, "ACK", 'F', e.bytes())
+}
+
+func (s *Server) handleOpen(ch *secureChannel, body []byte) error {
+	d := newDecoder(body)
+	d.uint32() // SecureChannelId
+	policy := d.string()
+	d.byteString() // SenderCertificate
+	d.byteString() // ReceiverCertificateThumbprint
+	d.uint32()     // SequenceNumber
+	requestID := d.uint32()
+
+	typeID := d.nodeID()
+	header := d.requestHeader()
+	d.uint32() // ClientProtocolVersion
+	d.int32()  // RequestType
+	mode := d.int32()
+	d.byteString() // ClientNonce
+	lifetime := d.uint32()
+
+	if d.err() != nil || typeID.ID != idOpenSecureChannelRequest {
+		s.sendError(ch.conn, StatusBadDecodingError, "invalid OpenSecureChannel request")
+		return errDecode
+	}
+	if policy != securityPolicyNone {
+		s.sendError(ch.conn, StatusBadSecurityPolicyRejected, "only SecurityPolicy None is supported")
+		return errors.New("security policy rejected")
+	}
+	if mode != securityModeNone {
+		s.sendError(ch.conn, StatusBadSecurityModeRejected, "only MessageSecurityMode None is supported")
+		return errors.New("security mode rejected")
+	}
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.id == 0 {
+		ch.id = atomic.AddUint32(&s.nextChannelID, 1)
+	}
+	ch.tokenID++
+
+	e := &encoder{}
+	e.uint32(ch.id)
+	e.string(securityPolicyNone)
+	e.byteString(nil)
+	e.byteString(nil)
+	ch.sequence++
+	e.uint32(ch.sequence)
+	e.uint32(requestID)
+	e.nodeID(numericID(0, idOpenSecureChannelResponse))
+	e.responseHeader(header.RequestHandle, StatusGood)
+	e.uint32(0) // ServerProtocolVersion
+	e.uint32(ch.id)
+	e.uint32(ch.tokenID)
+	e.dateTime(time.Now())
+	e.uint32(lifetime)
+	e.byteString(nil) // ServerNonce
+	return writeMessage(ch.conn, "OPN", 'F', e.bytes())
+}
+
+func (s *Server) handleMessage(ctx context.Context, ch *secureChannel, chunkType byte, body []byte) error {
+	d := newDecoder(body)
+	d.uint32() // SecureChannelId
+	d.uint32() // TokenId
+	d.uint32() // SequenceNumber
+	requestID := d.uint32()
+	if d.err() != nil {
+		return d.err()
+	}
+
+	switch chunkType {
+	case 'A':
+		ch.chunks = nil
+		return nil
+	case 'C':
+		ch.chunks = append(ch.chunks, body[16:]...)
+		if len(ch.chunks) > maxMessageSize {
+			return errors.New("message too large")
+		}
+		return nil
+	}
+
+	payload := append(ch.chunks, body[16:]...)
+	ch.chunks = nil
+
+	closing, response := s.dispatch(ctx, ch, requestID, payload)
+	switch {
+	case closing:
+		return io.EOF
+	case response == nil:
+		return nil // answered later, e.g. Publish
+	default:
+		return s.sendResponse(ch, requestID, response)
+	}
+}
+
+func (s *Server) sendResponse(ch *secureChannel, requestID uint32, payload []byte) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	maxBody := int(ch.sendBuffer) - symmetricOverhead
+	for {
+		chunk := payload
+		chunkType := byte('F')
+		if len(chunk) > maxBody {
+			chunk = payload[:maxBody]
+			chunkType = 'C'
+		}
+
+		e := &encoder{}
+		e.uint32(ch.id)
+		e.uint32(ch.tokenID)
+		ch.sequence++
+		e.uint32(ch.sequence)
+		e.uint32(requestID)
+		e.buf.Write(chunk)
+		if err := writeMessage(ch.conn, "MSG", chunkType, e.bytes()); err != nil {
+			return err
+		}
+
+		payload = payload[len(chunk):]
+		if chunkType == 'F' {
+			return nil
+		}
+	}
+}
+
+func (s *Server) sendError(conn net.Conn, status uint32, reason string) {
+	e := &encoder{}
+	e.uint32(status)
+	e.string(reason)
+	writeMessage(conn, "ERR", 'F', e.bytes())
+}
+
+func writeMessage(conn net.Conn, msgType string, chunkType byte, body []byte) error {
+	frame := make([]byte, 8+len(body))
+	copy(frame[0:3], msgType)
+	frame[3] = chunkType
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(frame)))
+	copy(frame[8:], body)
+	_, err := conn.Write(frame)
+	return err
+}
+
+// dispatch decodes a service request and returns the encoded response. It
+// reports closing=true for CloseSecureChannel, which has no response, and
+// returns no response for Publish requests, which are answered later.
+func (s *Server) dispatch(ctx context.Context, ch *secureChannel, requestID uint32, payload []byte) (closing bool, response []byte) {
+	d := newDecoder(payload)
+	typeID := d.nodeID()
+	header := d.requestHeader()
+	if d.err() != nil {
+		return false, serviceFault(header.RequestHandle, StatusBadDecodingError)
+	}
+
+	switch typeID.ID {
+	case idCloseSecureChannelRequest:
+		return true, nil
+	case idGetEndpointsRequest:
+		return false, s.getEndpoints(header)
+	case idCreateSessionRequest:
+		return false, s.createSession(header, d)
+	case idActivateSessionRequest:
+		return false, s.activateSession(header)
+	}
+
+	if status := s.checkSession(header); status != StatusGood {
+		return false, serviceFault(header.RequestHandle, status)
+	}
+
+	switch typeID.ID {
+	case idCloseSessionRequest:
+		return false, s.closeSession(header)
+	case idBrowseRequest:
+		return false, s.browse(ctx, header, d)
+	case idBrowseNextRequest:
+		return false, s.browseNext(header)
+	case idReadRequest:
+		return false, s.read(ctx, header, d)
+	case idWriteRequest:
+		return false, s.write(ctx, header, d)
+	case idCreateSubscriptionRequest:
+		return false, s.createSubscription(header, d)
+	case idModifySubscriptionRequest:
+		return false, s.modifySubscription(header, d)
+	case idSetPublishingModeRequest:
+		return false, s.setPublishingMode(header, d)
+	case idDeleteSubscriptionsRequest:
+		return false, s.deleteSubscriptions(header, d)
+	case idPublishRequest:
+		return false, s.publish(ch, requestID, header, d)
+	case idRepublishRequest:
+		return false, s.republish(header, d)
+	case idCreateMonitoredItemsRequest:
+		return false, s.createMonitoredItems(ctx, header, d)
+	case idModifyMonitoredItemsRequest:
+		return false, s.modifyMonitoredItems(header, d)
+	case idSetMonitoringModeRequest:
+		return false, s.setMonitoringMode(header, d)
+	case idDeleteMonitoredItemsRequest:
+		return false, s.deleteMonitoredItems(header, d)
+	default:
+		return false, serviceFault(header.RequestHandle, StatusBadServiceUnsupported)
+	}
+}
+
+func serviceFault(requestHandle uint32, status uint32) []byte {
+	e := &encoder{}
+	e.nodeID(numericID(0, idServiceFault))
+	e.responseHeader(requestHandle, status)
+	return e.bytes()
+}
+
+func (s *Server) checkSession(header requestHeader) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess := s.liveSession(header.AuthenticationToken, time.Now())
+	if sess == nil {
+		return StatusBadSessionIDInvalid
+	}
+	if !sess.activated {
+		return StatusBadSessionNotActivated
+	}
+	return StatusGood
+}
+
+// liveSession returns the session of the token and keeps it alive, or nil
+// if there is none or it has timed out. s.mu must be held.
+func (s *Server) liveSession(token NodeID, now time.Time) *session {
+	sess, ok := s.sessions[token.String()]
+	if !ok {
+		return nil
+	}
+	if now.After(sess.expires) {
+		s.dropSession(sess)
+		return nil
+	}
+	sess.expires = now.Add(sess.timeout)
+	return sess
+}
+
+// expireSessions forgets the sessions that have timed out. s.mu must be
+// held.
+func (s *Server) expireSessions(now time.Time) {
+	for _, sess := range s.sessions {
+		if now.After(sess.expires) {
+			s.dropSession(sess)
+		}
+	}
+}
+
+func (s *Server) encodeEndpoint(e *encoder) {
+	e.string(s.config.EndpointURL)
+	e.string(s.config.ApplicationURI)
+	e.string("urn:iotstudio")
+	e.localizedText(LocalizedText{Text: "IoTStudio"})
+	e.int32(0) // ApplicationType: Server
+	e.string("")
+	e.string("")
+	e.stringArray([]string{s.config.EndpointURL})
+	e.byteString(nil) // ServerCertificate
+	e.int32(securityModeNone)
+	e.string(securityPolicyNone)
+	e.int32(1) // UserIdentityTokens
+	e.string("anonymous")
+	e.int32(0) // UserTokenType: Anonymous
+	e.string("")
+	e.string("")
+	e.string("")
+	e.string(transportProfile)
+	e.byte(0) // SecurityLevel
+}
+
+func (s *Server) getEndpoints(header requestHeader) []byte {
+	e := &encoder{}
+	e.nodeID(numericID(0, idGetEndpointsResponse))
+	e.responseHeader(header.RequestHandle, StatusGood)
+	e.int32(1)
+	s.encodeEndpoint(e)
+	return e.bytes()
+}
+
+func (s *Server) createSession(header requestHeader, d *decoder) []byte {
+	d.string()        // ClientDescription.ApplicationUri
+	d.string()        // ClientDescription.ProductUri
+	d.localizedText() // ClientDescription.ApplicationName
+	d.int32()         // ClientDescription.ApplicationType
+	d.string()        // ClientDescription.GatewayServerUri
+	d.string()        // ClientDescription.DiscoveryProfileUri
+	d.stringArray()   // ClientDescription.DiscoveryUrls
+	d.string()        // ServerUri
+	d.string()        // EndpointUrl
+	d.string()        // SessionName
+	d.byteString()    // ClientNonce
+	d.byteString()    // ClientCertificate
+	requested := d.float64()
+	if d.err() != nil {
+		return serviceFault(header.RequestHandle, StatusBadDecodingError)
+	}
+
+	timeout := s.config.SessionTimeout
+	if requested > 0 && time.Duration(requested*float64(time.Millisecond)) < timeout {
+		timeout = time.Duration(requested * float64(time.Millisecond))
+	}
+
+	n := atomic.AddUint32(&s.nextSessionID, 1)
+	now := time.Now()
+	sess := &session{
+		id:      numericID(namespaceIoTStudio, n),
+		token:   NodeID{Namespace: namespaceIoTStudio, raw: []byte(fmt.Sprintf("session-%d-%d", n, now.UnixNano())), kind: nodeIDOpaque},
+		timeout: timeout,
+		expires: now.Add(timeout),
+
+		subscriptions: make(map[uint32]*subscription),
+	}
+
+	s.mu.Lock()
+	s.expireSessions(now)
+	if len(s.sessions) >= s.config.MaxSessions {
+		s.mu.Unlock()
+		return serviceFault(header.RequestHandle, StatusBadTooManySessions)
+	}
+	s.sessions[sess.token.String()] = sess
+	s.mu.Unlock()
+
+	e := &encoder{}
+	e.nodeID(numericID(0, idCreateSessionResponse))
+	e.responseHeader(header.RequestHandle, StatusGood)
+	e.nodeID(sess.id)
+	e.nodeID(sess.token)
+	e.float64(float64(timeout) / float64(time.Millisecond))
+	e.byteString(nil) // ServerNonce
+	e.byteString(nil) // ServerCertificate
+	e.int32(1)
+	s.encodeEndpoint(e)
+	e.int32(-1)       // ServerSoftwareCertificates
+	e.string("")      // ServerSignature.Algorithm
+	e.byteString(nil) // ServerSignature.Signature
+	e.uint32(maxMessageSize)
+	return e.bytes()
+}
+
+func (s *Server) activateSession(header requestHeader) []byte {
+	s.mu.Lock()
+	sess := s.liveSession(header.AuthenticationToken, time.Now())
+	if sess != nil {
+		sess.activated = true
+	}
+	s.mu.Unlock()
+
+	if sess == nil {
+		return serviceFault(header.RequestHandle, StatusBadSessionIDInvalid)
+	}
+
+	e := &encoder{}
+	e.nodeID(numericID(0, idActivateSessionResponse))
+	e.responseHeader(header.RequestHandle, StatusGood)
+	e.byteString(nil) // ServerNonce
+	e.int32(-1)       // Results
+	e.int32(-1)       // DiagnosticInfos
+	return e.bytes()
+}
+
+// closeSession also deletes the session's subscriptions, as they cannot be
+// transferred to another session.
+func (s *Server) closeSession(header requestHeader) []byte {
+	s.mu.Lock()
+	if sess := s.sessions[header.AuthenticationToken.String()]; sess != nil {
+		s.dropSession(sess)
+	}
+	s.mu.Unlock()
+
+	e := &encoder{}
+	e.nodeID(numericID(0, idCloseSessionResponse))
+	e.responseHeader(header.RequestHandle, StatusGood)
+	return e.bytes()
+}
+
+func (s *Server) browse(ctx context.Context, header requestHeader, d *decoder) []byte {
+	d.nodeID()   // View.ViewId
+	d.dateTime() // View.Timestamp
+	d.uint32()   // View.ViewVersion
+	d.uint32()   // RequestedMaxReferencesPerNode
+
+	n := d.arrayLength()
+	requests := make([]browseDescription, 0, n)
+	for i := 0; i < n && d.err() == nil; i++ {
+		var req browseDescription
+		req.NodeID = d.nodeID()
+		req.Direction = d.int32()
+		req.ReferenceTypeID = d.nodeID()
+		req.IncludeSubtypes = d.boolean()
+		req.NodeClassMask = d.uint32()
+		d.uint32() // ResultMask
+		requests = append(requests, req)
+	}
+	if d.err() != nil {
+		return serviceFault(header.RequestHandle, StatusBadDecodingError)
+	}
+	if len(requests) == 0 {
+		return serviceFault(header.RequestHandle, StatusBadNothingToDo)
+	}
+
+	e := &encoder{}
+	e.nodeID(numericID(0, idBrowseResponse))
+	e.responseHeader(header.RequestHandle, StatusGood)
+	e.int32(int32(len(requests)))
+	for _, req := range requests {
+		status, refs := s.browseNode(ctx, req)
+		e.uint32(status)
+		e.byteString(nil) // ContinuationPoint
+		e.int32(int32(len(refs)))
+		for _, ref := range refs {
+			e.nodeID(numericID(0, ref.ReferenceTypeID))
+			e.boolean(ref.IsForward)
+			e.expandedNodeID(ref.NodeID)
+			e.qualifiedName(ref.BrowseName)
+			e.localizedText(ref.DisplayName)
+			e.int32(ref.NodeClass)
+			e.expandedNodeID(ref.TypeDefinition)
+		}
+	}
+	e.int32(-1) // DiagnosticInfos
+	return e.bytes()
+}
+
+func (s *Server) browseNode(ctx context.Context, req browseDescription) (uint32, []referenceDescription) {
+	n := s.lookupNode(ctx, req.NodeID)
+	if n == nil {
+		return StatusBadNodeIDUnknown, nil
+	}
+
+	matches := func(refType uint32, class int32) bool {
+		if !req.ReferenceTypeID.isNull() {
+			if req.IncludeSubtypes {
+				if !isReferenceSubtype(refType, req.ReferenceTypeID.ID) {
+					return false
+				}
+			} else if refType != req.ReferenceTypeID.ID {
+				return false
+			}
+		}
+		return req.NodeClassMask == 0 || req.NodeClassMask&uint32(class) != 0
+	}
+
+	var refs []referenceDescription
+	if req.Direction == browseForward || req.Direction == browseBoth {
+		for _, ref := range s.references(ctx, n) {
+			if matches(ref.refType, ref.target.class) {
+				refs = append(refs, describe(ref.refType, true, ref.target))
+			}
+		}
+		if n.typeDef != 0 && matches(idHasTypeDefinition, nodeClassObject) {
+			refs = append(refs, referenceDescription{
+				ReferenceTypeID: idHasTypeDefinition,
+				IsForward:       true,
+				NodeID:          numericID(0, n.typeDef),
+				BrowseName:      QualifiedName{Name: "TypeDefinition"},
+				DisplayName:     LocalizedText{Text: "TypeDefinition"},
+				NodeClass:       8, // ObjectType or VariableType
+			})
+		}
+	}
+	if req.Direction == browseInverse || req.Direction == browseBoth {
+		if parent := s.lookupNode(ctx, n.parent); parent != nil && !n.parent.isNull() && matches(n.parentRef, parent.class) {
+			refs = append(refs, describe(n.parentRef, false, parent))
+		}
+	}
+
+	return StatusGood, refs
+}
+
+func describe(refType uint32, forward bool, target *node) referenceDescription {
+	return referenceDescription{
+		ReferenceTypeID: refType,
+		IsForward:       forward,
+		NodeID:          target.id,
+		BrowseName:      target.browseName,
+		DisplayName:     LocalizedText{Text: target.displayName},
+		NodeClass:       target.class,
+		TypeDefinition:  numericID(0, target.typeDef),
+	}
+}
+
+// browseNext is only reached with continuation points the server never
+// hands out, so every node is reported as finished.
+func (s *Server) browseNext(header requestHeader) []byte {
+	e := &encoder{}
+	e.nodeID(numericID(0, idBrowseNextResponse))
+	e.responseHeader(header.RequestHandle, StatusGood)
+	e.int32(0)
+	e.int32(-1)
+	return e.bytes()
+}
+
+func (s *Server) read(ctx context.Context, header requestHeader, d *decoder) []byte {
+	d.float64() // MaxAge
+	d.int32()   // TimestampsToReturn
+
+	n := d.arrayLength()
+	requests := make([]readValueID, 0, n)
+	for i := 0; i < n && d.err() == nil; i++ {
+		var req readValueID
+		req.NodeID = d.nodeID()
+		req.AttributeID = d.uint32()
+		d.string()        // IndexRange
+		d.qualifiedName() // DataEncoding
+		requests = append(requests, req)
+	}
+	if d.err() != nil {
+		return serviceFault(header.RequestHandle, StatusBadDecodingError)
+	}
+	if len(requests) == 0 {
+		return serviceFault(header.RequestHandle, StatusBadNothingToDo)
+	}
+
+	e := &encoder{}
+	e.nodeID(numericID(0, idReadResponse))
+	e.responseHeader(header.RequestHandle, StatusGood)
+	e.int32(int32(len(requests)))
+	for _, req := range requests {
+		if err := e.dataValue(s.readAttribute(ctx, req)); err != nil {
+			e.dataValue(DataValue{Status: StatusBadInternalError})
+		}
+	}
+	e.int32(-1)
+	return e.bytes()
+}
+
+func (s *Server) readAttribute(ctx context.Context, req readValueID) DataValue {
+	n := s.lookupNode(ctx, req.NodeID)
+	if n == nil {
+		return DataValue{Status: StatusBadNodeIDUnknown}
+	}
+
+	value := func(v interface{}) DataValue {
+		return DataValue{Value: v, HasValue: true}
+	}
+
+	switch req.AttributeID {
+	case attrNodeID:
+		return value(n.id)
+	case attrNodeClass:
+		return value(n.class)
+	case attrBrowseName:
+		return value(n.browseName)
+	case attrDisplayName:
+		return value(LocalizedText{Text: n.displayName})
+	case attrDescription:
+		return value(LocalizedText{Text: n.description})
+	case attrWriteMask, attrUserWriteMask:
+		return value(uint32(0))
+	}
+
+	if n.class == nodeClassObject {
+		if req.AttributeID == attrEventNotifier {
+			return value(byte(0))
+		}
+		return DataValue{Status: StatusBadAttributeIDInvalid}
+	}
+
+	switch req.AttributeID {
+	case attrValue:
+		return n.value
+	case attrDataType:
+		return value(numericID(0, n.dataType))
+	case attrValueRank:
+		if _, ok := n.value.Value.([]string); ok {
+			return value(int32(1))
+		}
+		return value(int32(-1))
+	case attrArrayDimensions:
+		return DataValue{}
+	case attrAccessLevel, attrUserAccessLevel:
+		return value(n.access)
+	case attrMinimumSamplingInterval:
+		return value(float64(0))
+	case attrHistorizing:
+		return value(false)
+	default:
+		return DataValue{Status: StatusBadAttributeIDInvalid}
+	}
+}
+
+func (s *Server) write(ctx context.Context, header requestHeader, d *decoder) []byte {
+	n := d.arrayLength()
+	requests := make([]writeValue, 0, n)
+	for i := 0; i < n && d.err() == nil; i++ {
+		var req writeValue
+		req.NodeID = d.nodeID()
+		req.AttributeID = d.uint32()
+		d.string() // IndexRange
+		req.Value = d.dataValue()
+		requests = append(requests, req)
+	}
+	if d.err() != nil {
+		return serviceFault(header.RequestHandle, StatusBadDecodingError)
+	}
+	if len(requests) == 0 {
+		return serviceFault(header.RequestHandle, StatusBadNothingToDo)
+	}
+
+	e := &encoder{}
+	e.nodeID(numericID(0, idWriteResponse))
+	e.responseHeader(header.RequestHandle, StatusGood)
+	e.int32(int32(len(requests)))
+	for _, req := range requests {
+		e.uint32(s.writeAttribute(ctx, req))
+	}
+	e.int32(-1)
+	return e.bytes()
+}
+
+func (s *Server) writeAttribute(ctx context.Context, req writeValue) uint32 {
+	n := s.lookupNode(ctx, req.NodeID)
+	if n == nil {
+		return StatusBadNodeIDUnknown
+	}
+	if req.AttributeID != attrValue || n.field == nil || !n.field.Writable {
+		return StatusBadNotWritable
+	}
+	if !s.config.AllowWrites {
+		return StatusBadUserAccessDenied
+	}
+	if !req.Value.HasValue {
+		return StatusBadTypeMismatch
+	}
+	if s.config.Handlers == nil {
+		return StatusBadNoCommunication
+	}
+
+	handler, err := s.config.Handlers(n.device.ConnectionID)
+	if err != nil || !handler.IsConnected() {
+		return StatusBadNoCommunication
+	}
+
+	writer, ok := handler.(RegisterWriter)
+	if !ok {
+		return StatusBadNotWritable
+	}
+
+	status := writeField(ctx, writer, n.device, *n.field, req.Value.Value)
+	log.Info().
+		Str("node", req.NodeID.String()).
+		Str("status", fmt.Sprintf("0x%08X", status)).
+		Msg("OPC UA write")
+	return status
+}
@@ -0,0 +1,650 @@
+package opcua
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	protocol "github.com/iotstudio/iotstudio/internal/protocols"
+	"github.com/iotstudio/iotstudio/pkg/api"
+)
+
+var errNotFound = errors.New("not found")
+
+type fakeDirectory struct {
+	session *models.Session
+	device  *models.Device
+	parser  *models.Parser
+}
+
+func (f *fakeDirectory) ListSessions(ctx context.Context) ([]*models.Session, error) {
+	return []*models.Session{f.session}, nil
+}
+
+func (f *fakeDirectory) GetSession(ctx context.Context, id string) (*models.Session, error) {
+	if id != f.session.ID {
+		return nil, errNotFound
+	}
+	return f.session, nil
+}
+
+func (f *fakeDirectory) ListDevicesBySession(ctx context.Context, sessionID string) ([]*models.Device, error) {
+	return []*models.Device{f.device}, nil
+}
+
+func (f *fakeDirectory) GetDevice(ctx context.Context, id string) (*models.Device, error) {
+	if id != f.device.ID {
+		return nil, errNotFound
+	}
+	return f.device, nil
+}
+
+func (f *fakeDirectory) GetConnection(ctx context.Context, id string) (*models.Connection, error) {
+	return &models.Connection{ID: id}, nil
+}
+
+func (f *fakeDirectory) GetParser(ctx context.Context, id string) (*models.Parser, error) {
+	if id != f.parser.ID {
+		return nil, errNotFound
+	}
+	return f.parser, nil
+}
+
+type registerWrite struct {
+	unitID  uint8
+	address uint16
+	values  []uint16
+}
+
+// fakeModbus records register writes in place of a Modbus handler
+type fakeModbus struct {
+	writes []registerWrite
+}
+
+func (f *fakeModbus) Connect(ctx context.Context, config api.ConnectionConfig) error { return nil }
+func (f *fakeModbus) Disconnect() error                                              { return nil }
+func (f *fakeModbus) Read(ctx context.Context) ([]byte, error)                       { return nil, nil }
+func (f *fakeModbus) Write(ctx context.Context, data []byte) error                   { return nil }
+func (f *fakeModbus) IsConnected() bool                                              { return true }
+func (f *fakeModbus) GetMetrics() api.ConnectionMetrics                              { return api.ConnectionMetrics{} }
+
+func (f *fakeModbus) WriteSingleCoil(ctx context.Context, unitID uint8, address uint16, outputValue bool) error {
+	var value uint16
+	if outputValue {
+		value = 0xFF00
+	}
+	f.writes = append(f.writes, registerWrite{unitID, address, []uint16{value}})
+	return nil
+}
+
+func (f *fakeModbus) WriteSingleRegister(ctx context.Context, unitID uint8, address, value uint16) error {
+	f.writes = append(f.writes, registerWrite{unitID, address, []uint16{value}})
+	return nil
+}
+
+func (f *fakeModbus) WriteMultipleRegisters(ctx context.Context, unitID uint8, address uint16, values []uint16) error {
+	f.writes = append(f.writes, registerWrite{unitID, address, values})
+	return nil
+}
+
+// MaskWriteRegister records the AND and OR masks as the written values
+func (f *fakeModbus) MaskWriteRegister(ctx context.Context, unitID uint8, address, andMask, orMask uint16) error {
+	f.writes = append(f.writes, registerWrite{unitID, address, []uint16{andMask, orMask}})
+	return nil
+}
+
+// testClient speaks just enough of the OPC UA binary protocol to drive the server
+type testClient struct {
+	t         *testing.T
+	conn      net.Conn
+	channelID uint32
+	tokenID   uint32
+	sequence  uint32
+	handle    uint32
+	token     NodeID
+}
+
+func startServer(t *testing.T, options ...func(*Config)) (*Server, *fakeModbus) {
+	t.Helper()
+
+	dir := &fakeDirectory{
+		session: &models.Session{ID: "s1", Name: "Line 1"},
+		device:  &models.Device{ID: "d1", SessionID: "s1", ConnectionID: "c1", Address: "3", Name: "Boiler", ParserID: "p1"},
+		parser: &models.Parser{ID: "p1", Fields: []models.ParserField{
+			{Name: "temperature", DataType: "int16", Scale: 0.1, Writable: true, Register: 10},
+			{Name: "running", DataType: "uint16"},
+		}},
+	}
+	modbus := &fakeModbus{}
+
+	config := Config{
+		Addr:      "127.0.0.1:0",
+		Directory: dir,
+		Handlers: func(connID string) (protocol.ProtocolHandler, error) {
+			if connID != "c1" {
+				return nil, errNotFound
+			}
+			return modbus, nil
+		},
+	}
+	for _, option := range options {
+		option(&config)
+	}
+	srv := NewServer(config)
+	if err := srv.Listen(); err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go srv.Serve(ctx)
+	t.Cleanup(cancel)
+
+	return srv, modbus
+}
+
+func dial(t *testing.T, srv *Server) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+
+	c := &testClient{t: t, conn: conn}
+
+	e := &encoder{}
+	e.uint32(0)
+	e.uint32(defaultBufferSize)
+	e.uint32(defaultBufferSize)
+	e.uint32(0)
+	e.uint32(0)
+	e.string("opc.tcp://" + srv.Addr().String())
+	c.send("HEL", e.bytes())
+	if msgType, _ := c.receive(); msgType != "ACK" {
+		t.Fatalf("expected ACK, got %s", msgType)
+	}
+
+	e = &encoder{}
+	e.uint32(0)
+	e.string(securityPolicyNone)
+	e.byteString(nil)
+	e.byteString(nil)
+	e.uint32(1)
+	e.uint32(1)
+	e.nodeID(numericID(0, idOpenSecureChannelRequest))
+	c.requestHeader(e)
+	e.uint32(0)
+	e.int32(0)
+	e.int32(securityModeNone)
+	e.byteString(nil)
+	e.uint32(3600000)
+	c.send("OPN", e.bytes())
+
+	msgType, body := c.receive()
+	if msgType != "OPN" {
+		t.Fatalf("expected OPN, got %s", msgType)
+	}
+	d := newDecoder(body)
+	d.uint32()
+	d.string()
+	d.byteString()
+	d.byteString()
+	d.uint32()
+	d.uint32()
+	d.nodeID()
+	c.responseHeader(d)
+	d.uint32()
+	c.channelID = d.uint32()
+	c.tokenID = d.uint32()
+	if d.err() != nil {
+		t.Fatalf("invalid OpenSecureChannel response: %v", d.err())
+	}
+
+	return c
+}
+
+func (c *testClient) send(msgType string, body []byte) {
+	c.t.Helper()
+	if err := writeMessage(c.conn, msgType, 'F', body); err != nil {
+		c.t.Fatalf("write %s: %v", msgType, err)
+	}
+}
+
+func (c *testClient) receive() (string, []byte) {
+	c.t.Helper()
+	msgType, _, body := c.receiveChunk()
+	return msgType, body
+}
+
+func (c *testClient) receiveChunk() (string, byte, []byte) {
+	c.t.Helper()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		c.t.Fatalf("read header: %v", err)
+	}
+	body := make([]byte, binary.LittleEndian.Uint32(header[4:8])-8)
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		c.t.Fatalf("read body: %v", err)
+	}
+	return string(header[0:3]), header[3], body
+}
+
+func (c *testClient) requestHeader(e *encoder) {
+	c.handle++
+	e.nodeID(c.token)
+	e.dateTime(time.Now())
+	e.uint32(c.handle)
+	e.uint32(0)
+	e.string("")
+	e.uint32(10000)
+	e.emptyExtensionObject()
+}
+
+func (c *testClient) responseHeader(d *decoder) uint32 {
+	d.dateTime()
+	d.uint32()
+	status := d.uint32()
+	d.diagnosticInfo()
+	d.stringArray()
+	d.extensionObject()
+	return status
+}
+
+// call sends a service request and returns the response type, service
+// result and a decoder positioned at the response body.
+func (c *testClient) call(requestID uint32, body func(e *encoder)) (uint32, uint32, *decoder) {
+	c.t.Helper()
+	c.request(requestID, body)
+	return c.response()
+}
+
+// request sends a service request without waiting for its response
+func (c *testClient) request(requestID uint32, body func(e *encoder)) {
+	c.t.Helper()
+
+	e := &encoder{}
+	e.uint32(c.channelID)
+	e.uint32(c.tokenID)
+	c.sequence++
+	e.uint32(c.sequence)
+	e.uint32(c.handle + 1)
+	e.nodeID(numericID(0, requestID))
+	c.requestHeader(e)
+	if body != nil {
+		body(e)
+	}
+	c.send("MSG", e.bytes())
+}
+
+// response reads the next service response
+func (c *testClient) response() (uint32, uint32, *decoder) {
+	c.t.Helper()
+
+	var payload []byte
+	for {
+		msgType, chunkType, chunk := c.receiveChunk()
+		if msgType != "MSG" {
+			c.t.Fatalf("expected MSG, got %s", msgType)
+		}
+		payload = append(payload, chunk[16:]...)
+		if chunkType == 'F' {
+			break
+		}
+	}
+
+	d := newDecoder(payload)
+	typeID := d.nodeID()
+	status := c.responseHeader(d)
+	if d.err() != nil {
+		c.t.Fatalf("invalid response: %v", d.err())
+	}
+	return typeID.ID, status, d
+}
+
+func (c *testClient) openSession(activate bool) {
+	c.t.Helper()
+
+	if typeID, status := c.createSession(); typeID != idCreateSessionResponse || status != StatusGood {
+		c.t.Fatalf("CreateSession = %d/0x%08X", typeID, status)
+	}
+	if !activate {
+		return
+	}
+	typeID, status, _ := c.call(idActivateSessionRequest, func(e *encoder) {
+		e.string("")
+		e.byteString(nil)
+		e.int32(-1)
+		e.int32(-1)
+		e.nodeID(numericID(0, 321)) // AnonymousIdentityToken
+		e.byte(0x01)
+		e.uint32(0)
+		e.string("")
+		e.byteString(nil)
+	})
+	if typeID != idActivateSessionResponse || status != StatusGood {
+		c.t.Fatalf("ActivateSession = %d/0x%08X", typeID, status)
+	}
+}
+
+// createSession asks for a session and keeps its token if one was granted
+func (c *testClient) createSession() (uint32, uint32) {
+	c.t.Helper()
+
+	typeID, status, d := c.call(idCreateSessionRequest, func(e *encoder) {
+		e.string("urn:test")
+		e.string("")
+		e.localizedText(LocalizedText{Text: "test"})
+		e.int32(1)
+		e.string("")
+		e.string("")
+		e.stringArray(nil)
+		e.string("")
+		e.string("")
+		e.string("test session")
+		e.byteString(nil)
+		e.byteString(nil)
+		e.float64(60000)
+		e.uint32(0)
+	})
+	if typeID == idCreateSessionResponse && status == StatusGood {
+		d.nodeID()
+		c.token = d.nodeID()
+	}
+	return typeID, status
+}
+
+func (c *testClient) browse(id NodeID) []string {
+	c.t.Helper()
+
+	_, status, d := c.call(idBrowseRequest, func(e *encoder) {
+		e.nodeID(NodeID{})
+		e.dateTime(time.Time{})
+		e.uint32(0)
+		e.uint32(0)
+		e.int32(1)
+		e.nodeID(id)
+		e.int32(browseForward)
+		e.nodeID(numericID(0, idHierarchicalReferences))
+		e.boolean(true)
+		e.uint32(0)
+		e.uint32(0x3F)
+	})
+	if status != StatusGood {
+		c.t.Fatalf("Browse(%s) status = 0x%08X", id, status)
+	}
+
+	var names []string
+	d.arrayLength()
+	if result := d.uint32(); result != StatusGood {
+		c.t.Fatalf("Browse(%s) result = 0x%08X", id, result)
+	}
+	d.byteString()
+	n := d.arrayLength()
+	for i := 0; i < n; i++ {
+		d.nodeID()
+		d.boolean()
+		target := d.expandedNodeID()
+		d.qualifiedName()
+		d.localizedText()
+		d.int32()
+		d.expandedNodeID()
+		names = append(names, target.String())
+	}
+	if d.err() != nil {
+		c.t.Fatalf("invalid Browse response: %v", d.err())
+	}
+	return names
+}
+
+func (c *testClient) read(id NodeID) DataValue {
+	c.t.Helper()
+
+	_, status, d := c.call(idReadRequest, func(e *encoder) {
+		e.float64(0)
+		e.int32(2)
+		e.int32(1)
+		e.nodeID(id)
+		e.uint32(attrValue)
+		e.string("")
+		e.qualifiedName(QualifiedName{})
+	})
+	if status != StatusGood {
+		c.t.Fatalf("Read(%s) status = 0x%08X", id, status)
+	}
+	d.arrayLength()
+	return d.dataValue()
+}
+
+func (c *testClient) write(id NodeID, value interface{}) uint32 {
+	c.t.Helper()
+
+	_, status, d := c.call(idWriteRequest, func(e *encoder) {
+		e.int32(1)
+		e.nodeID(id)
+		e.uint32(attrValue)
+		e.string("")
+		e.dataValue(DataValue{Value: value, HasValue: true})
+	})
+	if status != StatusGood {
+		c.t.Fatalf("Write(%s) status = 0x%08X", id, status)
+	}
+	d.arrayLength()
+	return d.uint32()
+}
+
+func allowWrites(config *Config) { config.AllowWrites = true }
+
+func TestServerBrowseReadWrite(t *testing.T) {
+	srv, modbus := startServer(t, allowWrites)
+	c := dial(t, srv)
+	c.openSession(true)
+
+	tests := []struct {
+		node NodeID
+		want []string
+	}{
+		{numericID(0, idObjectsFolder), []string{"ns=0;i=2253", "ns=1;s=s1"}},
+		{stringID(namespaceIoTStudio, "s1"), []string{"ns=1;s=s1/d1"}},
+		{stringID(namespaceIoTStudio, "s1/d1"), []string{"ns=1;s=s1/d1/temperature", "ns=1;s=s1/d1/running"}},
+	}
+	for _, tt := range tests {
+		if got := c.browse(tt.node); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Browse(%s) = %v, want %v", tt.node, got, tt.want)
+		}
+	}
+
+	temperature := stringID(namespaceIoTStudio, "s1/d1/temperature")
+	if dv := c.read(temperature); dv.Status != StatusBadWaitingForInitialData {
+		t.Errorf("Read() before data status = 0x%08X, want BadWaitingForInitialData", dv.Status)
+	}
+
+	err := srv.WriteDataPoints(context.Background(), []models.DataPoint{{
+		SessionID: "s1",
+		DeviceID:  "d1",
+		Timestamp: 1700000000000,
+		Data:      `{"temperature": 21.5, "running": 1}`,
+	}})
+	if err != nil {
+		t.Fatalf("WriteDataPoints() error = %v", err)
+	}
+
+	dv := c.read(temperature)
+	if dv.Status != StatusGood || dv.Value != 21.5 {
+		t.Errorf("Read() = %v (0x%08X), want 21.5", dv.Value, dv.Status)
+	}
+	if !dv.SourceTimestamp.Equal(time.UnixMilli(1700000000000)) {
+		t.Errorf("SourceTimestamp = %v", dv.SourceTimestamp)
+	}
+
+	if status := c.write(temperature, -12.5); status != StatusGood {
+		t.Fatalf("Write() status = 0x%08X", status)
+	}
+	want := []registerWrite{{unitID: 3, address: 10, values: []uint16{0xFF83}}}
+	if !reflect.DeepEqual(modbus.writes, want) {
+		t.Errorf("register writes = %+v, want %+v", modbus.writes, want)
+	}
+
+	if status := c.write(stringID(namespaceIoTStudio, "s1/d1/running"), 0.0); status != StatusBadNotWritable {
+		t.Errorf("Write(running) status = 0x%08X, want BadNotWritable", status)
+	}
+	if status := c.write(temperature, 5000.0); status != StatusBadOutOfRange {
+		t.Errorf("Write(out of range) status = 0x%08X, want BadOutOfRange", status)
+	}
+}
+
+func TestServerRequiresActivatedSession(t *testing.T) {
+	srv, _ := startServer(t)
+	c := dial(t, srv)
+	c.openSession(false)
+
+	typeID, status, _ := c.call(idReadRequest, func(e *encoder) {
+		e.float64(0)
+		e.int32(2)
+		e.int32(0)
+	})
+	if typeID != idServiceFault || status != StatusBadSessionNotActivated {
+		t.Errorf("Read() = %d/0x%08X, want ServiceFault/BadSessionNotActivated", typeID, status)
+	}
+}
+
+func TestServerRefusesWritesByDefault(t *testing.T) {
+	srv, modbus := startServer(t)
+	c := dial(t, srv)
+	c.openSession(true)
+
+	if status := c.write(stringID(namespaceIoTStudio, "s1/d1/temperature"), 20.0); status != StatusBadUserAccessDenied {
+		t.Errorf("Write() status = 0x%08X, want BadUserAccessDenied", status)
+	}
+	if len(modbus.writes) != 0 {
+		t.Errorf("register writes = %+v, want none", modbus.writes)
+	}
+}
+
+func TestServerSessionLimits(t *testing.T) {
+	srv, _ := startServer(t, func(config *Config) {
+		config.MaxSessions = 2
+		config.SessionTimeout = 50 * time.Millisecond
+	})
+	c := dial(t, srv)
+
+	c.openSession(true)
+	first := c.token
+	c.openSession(false)
+	if typeID, status := c.createSession(); typeID != idServiceFault || status != StatusBadTooManySessions {
+		t.Errorf("CreateSession() beyond the limit = %d/0x%08X, want ServiceFault/BadTooManySessions", typeID, status)
+	}
+
+	// Idle sessions time out and make room
+	time.Sleep(100 * time.Millisecond)
+	c.openSession(true)
+	c.token = first
+	typeID, status, _ := c.call(idReadRequest, func(e *encoder) {
+		e.float64(0)
+		e.int32(2)
+		e.int32(0)
+	})
+	if typeID != idServiceFault || status != StatusBadSessionIDInvalid {
+		t.Errorf("Read() with an expired session = %d/0x%08X, want ServiceFault/BadSessionIdInvalid", typeID, status)
+	}
+}
+
+func TestWriteFieldNeedsUnitID(t *testing.T) {
+	field := models.ParserField{Name: "setpoint", DataType: "uint16", Writable: true, Register: 1}
+	for _, address := range []string{"", "boiler", "-1", "300"} {
+		modbus := &fakeModbus{}
+		device := &models.Device{ID: "d1", Address: address}
+		if status := writeField(context.Background(), modbus, device, field, 1.0); status != StatusBadConfigurationError {
+			t.Errorf("writeField() with address %q status = 0x%08X, want BadConfigurationError", address, status)
+		}
+		if len(modbus.writes) != 0 {
+			t.Errorf("writeField() with address %q wrote %+v", address, modbus.writes)
+		}
+	}
+}
+
+func TestEncodeRegisters(t *testing.T) {
+	tests := []struct {
+		name    string
+		field   models.ParserField
+		value   interface{}
+		want    []uint16
+		wantErr error
+	}{
+		{"scaled uint16", models.ParserField{DataType: "uint16", Scale: 0.1, ValueOffset: -40}, 10.0, []uint16{500}, nil},
+		{"negative int16", models.ParserField{DataType: "int16"}, -2.0, []uint16{0xFFFE}, nil},
+		{"int32 big endian", models.ParserField{DataType: "int32"}, 65537.0, []uint16{0x0001, 0x0001}, nil},
+		{"float32 little endian", models.ParserField{DataType: "float32", Endianness: "little"}, 1.0, []uint16{0x0000, 0x803F}, nil},
+		{"float32 word swapped", models.ParserField{DataType: "float32", ByteOrder: "CDAB"}, 1.0, []uint16{0x0000, 0x3F80}, nil},
+		{"int64 byte swapped", models.ParserField{DataType: "int64", ByteOrder: "BADC"}, -2.0, []uint16{0xFFFF, 0xFFFF, 0xFFFF, 0xFEFF}, nil},
+		{"uint16 overflow", models.ParserField{DataType: "uint16"}, 70000.0, nil, errOutOfRange},
+		{"string value", models.ParserField{DataType: "uint16"}, "on", nil, errTypeMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encodeRegisters(tt.field, tt.value)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("encodeRegisters() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("encodeRegisters() = %#04x, want %#04x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeBitField(t *testing.T) {
+	tests := []struct {
+		name    string
+		field   models.ParserField
+		value   interface{}
+		and, or uint16
+		wantErr bool
+	}{
+		{"bit 3 on", models.ParserField{DataType: "uint16", BitOffset: 3, BitWidth: 1}, true, 0xFFF7, 0x0008, false},
+		{"bit 3 off", models.ParserField{DataType: "uint16", BitOffset: 3, BitWidth: 1}, false, 0xFFF7, 0x0000, false},
+		{"mode bits", models.ParserField{DataType: "uint16", BitOffset: 4, BitWidth: 3}, 5.0, 0xFF8F, 0x0050, false},
+		{"signed trim", models.ParserField{DataType: "int16", BitOffset: 8, BitWidth: 4}, -1.0, 0xF0FF, 0x0F00, false},
+		{"msb order", models.ParserField{DataType: "uint16", BitOffset: 0, BitWidth: 1, BitOrder: "msb"}, true, 0x7FFF, 0x8000, false},
+		{"little endian", models.ParserField{DataType: "uint16", BitOffset: 0, BitWidth: 4, Endianness: "little"}, 0xA * 1.0, 0xF0FF, 0x0A00, false},
+		{"bool in high byte", models.ParserField{DataType: "bool", Offset: 0, BitOffset: 1}, true, 0xFDFF, 0x0200, false},
+		{"bool in low byte", models.ParserField{DataType: "bool", Offset: 1, BitOffset: 1}, true, 0xFFFD, 0x0002, false},
+		{"too wide value", models.ParserField{DataType: "uint16", BitOffset: 4, BitWidth: 3}, 8.0, 0, 0, true},
+		{"across registers", models.ParserField{DataType: "uint32", BitOffset: 12, BitWidth: 8}, 1.0, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			and, or, err := encodeBitField(tt.field, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("encodeBitField() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (and != tt.and || or != tt.or) {
+				t.Errorf("encodeBitField() = %#04x, %#04x, want %#04x, %#04x", and, or, tt.and, tt.or)
+			}
+		})
+	}
+}
+
+func TestWriteFieldMasksBitFields(t *testing.T) {
+	field := models.ParserField{Name: "pump", DataType: "uint16", BitOffset: 2, BitWidth: 1, Writable: true, Register: 40}
+	modbus := &fakeModbus{}
+	device := &models.Device{ID: "d1", Address: "3"}
+
+	if status := writeField(context.Background(), modbus, device, field, true); status != StatusGood {
+		t.Fatalf("writeField() status = 0x%08X, want Good", status)
+	}
+	want := []registerWrite{{3, 40, []uint16{0xFFFB, 0x0004}}}
+	if !reflect.DeepEqual(modbus.writes, want) {
+		t.Errorf("writes = %+v, want one mask write %+v", modbus.writes, want)
+	}
+}
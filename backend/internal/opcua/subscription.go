@@ -0,0 +1,1012 @@
+package opcua
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	minPublishingInterval = 50 * time.Millisecond
+	maxPublishingInterval = time.Hour
+	defaultKeepAliveCount = 10
+	maxKeepAliveCount     = 1000
+	maxSubscriptions      = 100 // per session
+	maxPublishRequests    = 10  // queued per session
+	maxQueueSize          = 100 // values queued per monitored item
+	retransmitQueueSize   = 10  // sent messages kept for Republish
+)
+
+// Monitoring modes
+const (
+	monitoringDisabled  = 0
+	monitoringSampling  = 1
+	monitoringReporting = 2
+)
+
+// TimestampsToReturn
+const (
+	timestampsSource  = 0
+	timestampsServer  = 1
+	timestampsBoth    = 2
+	timestampsNeither = 3
+)
+
+// DataChangeFilter triggers and deadband types
+const (
+	triggerStatus               = 0
+	triggerStatusValue          = 1
+	triggerStatusValueTimestamp = 2
+
+	deadbandNone     = 0
+	deadbandAbsolute = 1
+)
+
+// infoOverflow is set on the value next to the ones discarded from a full
+// queue (InfoType DataValue, Overflow bit).
+const infoOverflow uint32 = 0x0480
+
+// subscription reports the changes of its monitored items in the responses
+// to the Publish requests queued on its session, at most once per publishing
+// interval. After keepAlive intervals without changes it sends a keep-alive,
+// and after lifetime intervals without Publish requests it is deleted.
+type subscription struct {
+	id               uint32
+	session          *session
+	interval         time.Duration
+	lifetime         uint32
+	keepAlive        uint32
+	maxNotifications uint32
+	enabled          bool
+
+	items      map[uint32]*monitoredItem
+	nextItemID uint32
+
+	sequence   uint32                // of the last notification message
+	sent       []notificationMessage // kept for Republish until acknowledged
+	idle       uint32                // intervals since the last message
+	unanswered uint32                // intervals without a queued Publish request
+	late       bool                  // a message is due but no Publish request was queued
+
+	ticker *time.Ticker
+	stop   chan struct{}
+}
+
+// monitoredItem queues the values of one attribute. Values of field
+// variables arrive through WriteDataPoints; other attributes are static, so
+// only their initial value is reported.
+type monitoredItem struct {
+	id           uint32
+	clientHandle uint32
+	node         NodeID
+	attributeID  uint32
+	deviceID     string
+	field        string
+
+	mode          int32
+	timestamps    int32
+	filter        dataChangeFilter
+	queueSize     uint32
+	discardOldest bool
+	queue         []DataValue
+	last          *DataValue // last value sampled, for the filter
+}
+
+type dataChangeFilter struct {
+	trigger  int32
+	deadband float64 // absolute deadband for numeric values
+}
+
+type itemNotification struct {
+	clientHandle uint32
+	value        DataValue
+}
+
+type notificationMessage struct {
+	sequence    uint32
+	publishTime time.Time
+	items       []itemNotification // none for a keep-alive
+}
+
+// publishRequest is a Publish request waiting for a notification message
+type publishRequest struct {
+	ch        *secureChannel
+	requestID uint32
+	handle    uint32
+	results   []uint32 // of the acknowledgements it carried
+}
+
+// reply is a response sent outside the service dispatch, once s.mu has been
+// released.
+type reply struct {
+	ch        *secureChannel
+	requestID uint32
+	payload   []byte
+}
+
+func (s *Server) sendReplies(replies []reply) {
+	for _, r := range replies {
+		if err := s.sendResponse(r.ch, r.requestID, r.payload); err != nil {
+			log.Debug().Err(err).Msg("OPC UA publish response not sent")
+		}
+	}
+}
+
+// revise applies the requested publishing parameters within the server's
+// limits.
+func (sub *subscription) revise(interval float64, lifetime, keepAlive uint32) {
+	requested := interval * float64(time.Millisecond)
+	switch {
+	case !(requested >= float64(minPublishingInterval)): // also catches NaN
+		sub.interval = minPublishingInterval
+	case requested > float64(maxPublishingInterval):
+		sub.interval = maxPublishingInterval
+	default:
+		sub.interval = time.Duration(requested)
+	}
+
+	if keepAlive == 0 {
+		keepAlive = defaultKeepAliveCount
+	}
+	if keepAlive > maxKeepAliveCount {
+		keepAlive = maxKeepAliveCount
+	}
+	// The lifetime must cover at least three keep-alive periods
+	if lifetime < 3*keepAlive {
+		lifetime = 3 * keepAlive
+	}
+	sub.keepAlive = keepAlive
+	sub.lifetime = lifetime
+}
+
+func (sub *subscription) closed() bool {
+	select {
+	case <-sub.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sub *subscription) sortedItems() []*monitoredItem {
+	items := make([]*monitoredItem, 0, len(sub.items))
+	for _, item := range sub.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].id < items[j].id })
+	return items
+}
+
+func (sub *subscription) hasNotifications() bool {
+	if !sub.enabled {
+		return false
+	}
+	for _, item := range sub.items {
+		if item.mode == monitoringReporting && len(item.queue) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// nextMessage takes the queued values of the reporting items, up to
+// maxNotifications, and reports whether more are left. Without values it
+// returns a keep-alive, which carries the next sequence number.
+func (sub *subscription) nextMessage() (notificationMessage, bool) {
+	msg := notificationMessage{publishTime: time.Now()}
+	more := false
+
+	if sub.enabled {
+	items:
+		for _, item := range sub.sortedItems() {
+			if item.mode != monitoringReporting {
+				continue
+			}
+			for len(item.queue) > 0 {
+				if sub.maxNotifications > 0 && len(msg.items) >= int(sub.maxNotifications) {
+					more = true
+					break items
+				}
+				msg.items = append(msg.items, itemNotification{clientHandle: item.clientHandle, value: item.queue[0]})
+				item.queue = item.queue[1:]
+			}
+		}
+	}
+
+	next := sub.sequence + 1
+	if next == 0 {
+		next = 1 // sequence numbers skip 0 when they wrap
+	}
+	msg.sequence = next
+	if len(msg.items) == 0 {
+		return msg, false
+	}
+
+	sub.sequence = next
+	sub.sent = append(sub.sent, msg)
+	if len(sub.sent) > retransmitQueueSize {
+		sub.sent = sub.sent[1:]
+	}
+	return msg, more
+}
+
+func (s *Server) runSubscription(sub *subscription) {
+	defer sub.ticker.Stop()
+
+	for {
+		select {
+		case <-sub.stop:
+			return
+		case <-sub.ticker.C:
+			s.mu.Lock()
+			replies := s.publishTick(sub)
+			s.mu.Unlock()
+			s.sendReplies(replies)
+		}
+	}
+}
+
+// publishTick runs one publishing interval of the subscription. s.mu must
+// be held.
+func (s *Server) publishTick(sub *subscription) []reply {
+	if sub.closed() {
+		return nil
+	}
+
+	sess := sub.session
+	if time.Now().After(sess.expires) {
+		s.dropSession(sess)
+		return nil
+	}
+	if len(sess.publishQueue) == 0 {
+		sub.unanswered++
+		if sub.unanswered >= sub.lifetime {
+			log.Debug().Uint32("subscription", sub.id).Msg("OPC UA subscription expired")
+			return s.deleteSubscription(sub)
+		}
+	}
+
+	sub.idle++
+	if !sub.late && !sub.hasNotifications() && sub.idle < sub.keepAlive {
+		return nil
+	}
+	return s.publishSubscription(sub)
+}
+
+// publishSubscription answers the oldest queued Publish request with the
+// subscription's next message, or marks it late if none is queued. s.mu
+// must be held.
+func (s *Server) publishSubscription(sub *subscription) []reply {
+	sess := sub.session
+	if len(sess.publishQueue) == 0 {
+		sub.late = true
+		return nil
+	}
+
+	req := sess.publishQueue[0]
+	sess.publishQueue = sess.publishQueue[1:]
+
+	msg, more := sub.nextMessage()
+	sub.late = more
+	sub.idle = 0
+	sub.unanswered = 0
+
+	e := &encoder{}
+	e.nodeID(numericID(0, idPublishResponse))
+	e.responseHeader(req.handle, StatusGood)
+	e.uint32(sub.id)
+	e.int32(int32(len(sub.sent))) // AvailableSequenceNumbers
+	for _, sent := range sub.sent {
+		e.uint32(sent.sequence)
+	}
+	e.boolean(more)
+	e.notificationMessage(msg)
+	e.int32(int32(len(req.results)))
+	for _, result := range req.results {
+		e.uint32(result)
+	}
+	e.int32(-1) // DiagnosticInfos
+
+	return []reply{{ch: req.ch, requestID: req.requestID, payload: e.bytes()}}
+}
+
+func (e *encoder) notificationMessage(msg notificationMessage) {
+	e.uint32(msg.sequence)
+	e.dateTime(msg.publishTime)
+	if len(msg.items) == 0 {
+		e.int32(0)
+		return
+	}
+
+	body := &encoder{}
+	body.int32(int32(len(msg.items)))
+	for _, n := range msg.items {
+		body.uint32(n.clientHandle)
+		if err := body.dataValue(n.value); err != nil {
+			body.dataValue(DataValue{Status: StatusBadInternalError})
+		}
+	}
+	body.int32(-1) // DiagnosticInfos
+
+	e.int32(1)
+	e.extensionObject(idDataChangeNotification, body.bytes())
+}
+
+// deleteSubscription stops the subscription and fails the session's queued
+// Publish requests if it was the last one. s.mu must be held.
+func (s *Server) deleteSubscription(sub *subscription) []reply {
+	close(sub.stop)
+	for _, item := range sub.items {
+		s.unwatch(item)
+	}
+
+	sess := sub.session
+	delete(sess.subscriptions, sub.id)
+	if len(sess.subscriptions) > 0 {
+		return nil
+	}
+
+	var replies []reply
+	for _, req := range sess.publishQueue {
+		replies = append(replies, reply{req.ch, req.requestID, serviceFault(req.handle, StatusBadNoSubscription)})
+	}
+	sess.publishQueue = nil
+	return replies
+}
+
+// dropSession forgets the session and stops its subscriptions. s.mu must be
+// held.
+func (s *Server) dropSession(sess *session) {
+	delete(s.sessions, sess.token.String())
+	for _, sub := range sess.subscriptions {
+		close(sub.stop)
+		for _, item := range sub.items {
+			s.unwatch(item)
+		}
+	}
+	sess.subscriptions = nil
+	sess.publishQueue = nil
+}
+
+// forgetChannel drops the Publish requests queued on a closed channel
+func (s *Server) forgetChannel(ch *secureChannel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sess := range s.sessions {
+		queue := sess.publishQueue[:0]
+		for _, req := range sess.publishQueue {
+			if req.ch != ch {
+				queue = append(queue, req)
+			}
+		}
+		sess.publishQueue = queue
+	}
+}
+
+// subscriptionOf returns a subscription of the request's session. s.mu must
+// be held.
+func (s *Server) subscriptionOf(header requestHeader, id uint32) *subscription {
+	sess := s.sessions[header.AuthenticationToken.String()]
+	if sess == nil {
+		return nil
+	}
+	return sess.subscriptions[id]
+}
+
+func (s *Server) watch(item *monitoredItem) {
+	if item.deviceID == "" {
+		return
+	}
+	if s.watched[item.deviceID] == nil {
+		s.watched[item.deviceID] = make(map[*monitoredItem]struct{})
+	}
+	s.watched[item.deviceID][item] = struct{}{}
+}
+
+func (s *Server) unwatch(item *monitoredItem) {
+	delete(s.watched[item.deviceID], item)
+	if len(s.watched[item.deviceID]) == 0 {
+		delete(s.watched, item.deviceID)
+	}
+}
+
+// sampleValues queues the device's new values on the items monitoring them.
+// s.mu must be held.
+func (s *Server) sampleValues(deviceID string, values map[string]interface{}, timestamp time.Time) {
+	now := time.Now()
+	for item := range s.watched[deviceID] {
+		value, ok := values[item.field]
+		if !ok {
+			continue
+		}
+		item.sample(DataValue{
+			Value:           variantValue(value),
+			HasValue:        true,
+			SourceTimestamp: timestamp,
+			ServerTimestamp: now,
+		})
+	}
+}
+
+func (item *monitoredItem) configure(params monitoringParameters, filter dataChangeFilter, timestamps int32) {
+	item.clientHandle = params.ClientHandle
+	item.filter = filter
+	item.timestamps = timestamps
+	item.discardOldest = params.DiscardOldest
+
+	item.queueSize = params.QueueSize
+	if item.queueSize == 0 {
+		item.queueSize = 1
+	}
+	if item.queueSize > maxQueueSize {
+		item.queueSize = maxQueueSize
+	}
+	if excess := len(item.queue) - int(item.queueSize); excess > 0 {
+		item.queue = item.queue[excess:]
+	}
+}
+
+func (item *monitoredItem) setMode(mode int32) {
+	item.mode = mode
+	if mode == monitoringDisabled {
+		item.queue = nil
+		item.last = nil
+	}
+}
+
+// sample queues a value if the filter reports it as a change. A full queue
+// discards its oldest or newest value and flags the overflow.
+func (item *monitoredItem) sample(value DataValue) {
+	if item.mode == monitoringDisabled {
+		return
+	}
+	if item.last != nil && !item.filter.changed(*item.last, value) {
+		return
+	}
+	item.last = &value
+
+	switch item.timestamps {
+	case timestampsSource:
+		value.ServerTimestamp = time.Time{}
+	case timestampsServer:
+		value.SourceTimestamp = time.Time{}
+	case timestampsNeither:
+		value.SourceTimestamp = time.Time{}
+		value.ServerTimestamp = time.Time{}
+	}
+
+	if uint32(len(item.queue)) >= item.queueSize {
+		if item.discardOldest {
+			item.queue = item.queue[1:]
+			if len(item.queue) > 0 {
+				item.queue[0].Status |= infoOverflow
+			}
+		} else {
+			item.queue = item.queue[:len(item.queue)-1]
+			if item.queueSize > 1 {
+				value.Status |= infoOverflow
+			}
+		}
+	}
+	item.queue = append(item.queue, value)
+}
+
+func (f dataChangeFilter) changed(last, next DataValue) bool {
+	switch {
+	case last.Status != next.Status:
+		return true
+	case f.trigger == triggerStatus:
+		return false
+	case f.valueChanged(last.Value, next.Value):
+		return true
+	default:
+		return f.trigger == triggerStatusValueTimestamp && !last.SourceTimestamp.Equal(next.SourceTimestamp)
+	}
+}
+
+func (f dataChangeFilter) valueChanged(last, next interface{}) bool {
+	a, aok := last.(float64)
+	b, bok := next.(float64)
+	if aok && bok {
+		return math.Abs(a-b) > f.deadband
+	}
+	return !reflect.DeepEqual(last, next)
+}
+
+// parseFilter decodes the DataChangeFilter of a monitored item. Without one
+// changes of status or value are reported.
+func parseFilter(params monitoringParameters, attributeID uint32) (dataChangeFilter, uint32) {
+	filter := dataChangeFilter{trigger: triggerStatusValue}
+	if params.FilterType.isNull() {
+		return filter, StatusGood
+	}
+	if attributeID != attrValue {
+		return filter, StatusBadFilterNotAllowed
+	}
+	if !params.FilterType.equal(numericID(0, idDataChangeFilter)) {
+		return filter, StatusBadMonitoredItemFilterUnsupported
+	}
+
+	d := newDecoder(params.Filter)
+	filter.trigger = d.int32()
+	deadbandType := d.uint32()
+	deadband := d.float64()
+	if d.err() != nil || filter.trigger < triggerStatus || filter.trigger > triggerStatusValueTimestamp {
+		return filter, StatusBadMonitoredItemFilterInvalid
+	}
+
+	switch deadbandType {
+	case deadbandNone:
+	case deadbandAbsolute:
+		if !(deadband >= 0) {
+			return filter, StatusBadMonitoredItemFilterInvalid
+		}
+		filter.deadband = deadband
+	default:
+		// Percent deadbands need an EURange, which fields do not have
+		return filter, StatusBadMonitoredItemFilterUnsupported
+	}
+	return filter, StatusGood
+}
+
+func (s *Server) createSubscription(header requestHeader, d *decoder) []byte {
+	interval := d.float64()
+	lifetime := d.uint32()
+	keepAlive := d.uint32()
+	maxNotifications := d.uint32()
+	enabled := d.boolean()
+	d.byte() // Priority
+	if d.err() != nil {
+		return serviceFault(header.RequestHandle, StatusBadDecodingError)
+	}
+
+	sub := &subscription{
+		id:               atomic.AddUint32(&s.nextSubscriptionID, 1),
+		maxNotifications: maxNotifications,
+		enabled:          enabled,
+		items:            make(map[uint32]*monitoredItem),
+		stop:             make(chan struct{}),
+	}
+	sub.revise(interval, lifetime, keepAlive)
+
+	s.mu.Lock()
+	sess := s.sessions[header.AuthenticationToken.String()]
+	if sess == nil {
+		s.mu.Unlock()
+		return serviceFault(header.RequestHandle, StatusBadSessionIDInvalid)
+	}
+	if len(sess.subscriptions) >= maxSubscriptions {
+		s.mu.Unlock()
+		return serviceFault(header.RequestHandle, StatusBadTooManySubscriptions)
+	}
+	sub.session = sess
+	sub.ticker = time.NewTicker(sub.interval)
+	sess.subscriptions[sub.id] = sub
+	s.mu.Unlock()
+
+	go s.runSubscription(sub)
+
+	e := &encoder{}
+	e.nodeID(numericID(0, idCreateSubscriptionResponse))
+	e.responseHeader(header.RequestHandle, StatusGood)
+	e.uint32(sub.id)
+	e.float64(float64(sub.interval) / float64(time.Millisecond))
+	e.uint32(sub.lifetime)
+	e.uint32(sub.keepAlive)
+	return e.bytes()
+}
+
+func (s *Server) modifySubscription(header requestHeader, d *decoder) []byte {
+	id := d.uint32()
+	interval := d.float64()
+	lifetime := d.uint32()
+	keepAlive := d.uint32()
+	maxNotifications := d.uint32()
+	d.byte() // Priority
+	if d.err() != nil {
+		return serviceFault(header.RequestHandle, StatusBadDecodingError)
+	}
+
+	s.mu.Lock()
+	sub := s.subscriptionOf(header, id)
+	if sub == nil {
+		s.mu.Unlock()
+		return serviceFault(header.RequestHandle, StatusBadSubscriptionIDInvalid)
+	}
+	sub.revise(interval, lifetime, keepAlive)
+	sub.maxNotifications = maxNotifications
+	sub.ticker.Reset(sub.interval)
+
+	e := &encoder{}
+	e.nodeID(numericID(0, idModifySubscriptionResponse))
+	e.responseHeader(header.RequestHandle, StatusGood)
+	e.float64(float64(sub.interval) / float64(time.Millisecond))
+	e.uint32(sub.lifetime)
+	e.uint32(sub.keepAlive)
+	s.mu.Unlock()
+	return e.bytes()
+}
+
+func (s *Server) setPublishingMode(header requestHeader, d *decoder) []byte {
+	enabled := d.boolean()
+	ids := d.uint32Array()
+	if d.err() != nil {
+		return serviceFault(header.RequestHandle, StatusBadDecodingError)
+	}
+	if len(ids) == 0 {
+		return serviceFault(header.RequestHandle, StatusBadNothingToDo)
+	}
+
+	s.mu.Lock()
+	results := make([]uint32, len(ids))
+	for i, id := range ids {
+		sub := s.subscriptionOf(header, id)
+		if sub == nil {
+			results[i] = StatusBadSubscriptionIDInvalid
+			continue
+		}
+		sub.enabled = enabled
+	}
+	s.mu.Unlock()
+
+	return statusResults(idSetPublishingModeResponse, header, results)
+}
+
+func (s *Server) deleteSubscriptions(header requestHeader, d *decoder) []byte {
+	ids := d.uint32Array()
+	if d.err() != nil {
+		return serviceFault(header.RequestHandle, StatusBadDecodingError)
+	}
+	if len(ids) == 0 {
+		return serviceFault(header.RequestHandle, StatusBadNothingToDo)
+	}
+
+	s.mu.Lock()
+	var replies []reply
+	results := make([]uint32, len(ids))
+	for i, id := range ids {
+		sub := s.subscriptionOf(header, id)
+		if sub == nil {
+			results[i] = StatusBadSubscriptionIDInvalid
+			continue
+		}
+		replies = append(replies, s.deleteSubscription(sub)...)
+	}
+	s.mu.Unlock()
+
+	s.sendReplies(replies)
+	return statusResults(idDeleteSubscriptionsResponse, header, results)
+}
+
+// publish queues a Publish request. It is answered by the first of the
+// session's subscriptions with a message due, so publish returns no
+// response of its own.
+func (s *Server) publish(ch *secureChannel, requestID uint32, header requestHeader, d *decoder) []byte {
+	n := d.arrayLength()
+	type acknowledgement struct{ subscription, sequence uint32 }
+	acks := make([]acknowledgement, 0, n)
+	for i := 0; i < n && d.err() == nil; i++ {
+		acks = append(acks, acknowledgement{d.uint32(), d.uint32()})
+	}
+	if d.err() != nil {
+		return serviceFault(header.RequestHandle, StatusBadDecodingError)
+	}
+
+	s.mu.Lock()
+	sess := s.sessions[header.AuthenticationToken.String()]
+	if sess == nil {
+		s.mu.Unlock()
+		return serviceFault(header.RequestHandle, StatusBadSessionIDInvalid)
+	}
+	if len(sess.subscriptions) == 0 {
+		s.mu.Unlock()
+		return serviceFault(header.RequestHandle, StatusBadNoSubscription)
+	}
+
+	req := &publishRequest{ch: ch, requestID: requestID, handle: header.RequestHandle, results: make([]uint32, len(acks))}
+	for i, ack := range acks {
+		req.results[i] = sess.acknowledge(ack.subscription, ack.sequence)
+	}
+
+	var replies []reply
+	sess.publishQueue = append(sess.publishQueue, req)
+	if len(sess.publishQueue) > maxPublishRequests {
+		oldest := sess.publishQueue[0]
+		sess.publishQueue = sess.publishQueue[1:]
+		replies = append(replies, reply{oldest.ch, oldest.requestID, serviceFault(oldest.handle, StatusBadTooManyPublishRequests)})
+	}
+
+	subs := make([]*subscription, 0, len(sess.subscriptions))
+	for _, sub := range sess.subscriptions {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].id < subs[j].id })
+	for _, sub := range subs {
+		sub.unanswered = 0
+		if sub.late {
+			replies = append(replies, s.publishSubscription(sub)...)
+		}
+	}
+	s.mu.Unlock()
+
+	s.sendReplies(replies)
+	return nil
+}
+
+// acknowledge removes an acknowledged message from the retransmission queue
+func (sess *session) acknowledge(subscriptionID, sequence uint32) uint32 {
+	sub, ok := sess.subscriptions[subscriptionID]
+	if !ok {
+		return StatusBadSubscriptionIDInvalid
+	}
+	for i, msg := range sub.sent {
+		if msg.sequence == sequence {
+			sub.sent = append(sub.sent[:i:i], sub.sent[i+1:]...)
+			return StatusGood
+		}
+	}
+	return StatusBadSequenceNumberUnknown
+}
+
+func (s *Server) republish(header requestHeader, d *decoder) []byte {
+	id := d.uint32()
+	sequence := d.uint32()
+	if d.err() != nil {
+		return serviceFault(header.RequestHandle, StatusBadDecodingError)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub := s.subscriptionOf(header, id)
+	if sub == nil {
+		return serviceFault(header.RequestHandle, StatusBadSubscriptionIDInvalid)
+	}
+	for _, msg := range sub.sent {
+		if msg.sequence == sequence {
+			e := &encoder{}
+			e.nodeID(numericID(0, idRepublishResponse))
+			e.responseHeader(header.RequestHandle, StatusGood)
+			e.notificationMessage(msg)
+			return e.bytes()
+		}
+	}
+	return serviceFault(header.RequestHandle, StatusBadMessageNotAvailable)
+}
+
+func (s *Server) createMonitoredItems(ctx context.Context, header requestHeader, d *decoder) []byte {
+	id := d.uint32()
+	timestamps := d.int32()
+	n := d.arrayLength()
+	requests := make([]monitoredItemCreateRequest, 0, n)
+	for i := 0; i < n && d.err() == nil; i++ {
+		var req monitoredItemCreateRequest
+		req.NodeID = d.nodeID()
+		req.AttributeID = d.uint32()
+		d.string()        // IndexRange
+		d.qualifiedName() // DataEncoding
+		req.Mode = d.int32()
+		req.Parameters = d.monitoringParameters()
+		requests = append(requests, req)
+	}
+	if d.err() != nil {
+		return serviceFault(header.RequestHandle, StatusBadDecodingError)
+	}
+	if len(requests) == 0 {
+		return serviceFault(header.RequestHandle, StatusBadNothingToDo)
+	}
+	if timestamps < timestampsSource || timestamps > timestampsNeither {
+		return serviceFault(header.RequestHandle, StatusBadTimestampsToReturnInvalid)
+	}
+
+	// Resolve the nodes before taking the lock, as the lookups take it too
+	nodes := make([]*node, len(requests))
+	initial := make([]DataValue, len(requests))
+	for i, req := range requests {
+		nodes[i] = s.lookupNode(ctx, req.NodeID)
+		initial[i] = s.readAttribute(ctx, readValueID{NodeID: req.NodeID, AttributeID: req.AttributeID})
+	}
+
+	s.mu.Lock()
+	sub := s.subscriptionOf(header, id)
+	if sub == nil {
+		s.mu.Unlock()
+		return serviceFault(header.RequestHandle, StatusBadSubscriptionIDInvalid)
+	}
+
+	e := &encoder{}
+	e.nodeID(numericID(0, idCreateMonitoredItemsResponse))
+	e.responseHeader(header.RequestHandle, StatusGood)
+	e.int32(int32(len(requests)))
+	for i, req := range requests {
+		item, status := s.createMonitoredItem(sub, req, nodes[i], initial[i], timestamps)
+		e.uint32(status)
+		if item == nil {
+			e.uint32(0)
+			e.float64(0)
+			e.uint32(0)
+		} else {
+			e.uint32(item.id)
+			e.float64(0) // values are reported as they arrive
+			e.uint32(item.queueSize)
+		}
+		e.emptyExtensionObject() // FilterResult
+	}
+	e.int32(-1)
+	s.mu.Unlock()
+	return e.bytes()
+}
+
+// createMonitoredItem adds an item to the subscription and queues its
+// initial value. s.mu must be held.
+func (s *Server) createMonitoredItem(sub *subscription, req monitoredItemCreateRequest, n *node, initial DataValue, timestamps int32) (*monitoredItem, uint32) {
+	switch {
+	case n == nil:
+		return nil, StatusBadNodeIDUnknown
+	case initial.Status == StatusBadAttributeIDInvalid:
+		return nil, StatusBadAttributeIDInvalid
+	case req.Mode < monitoringDisabled || req.Mode > monitoringReporting:
+		return nil, StatusBadMonitoringModeInvalid
+	}
+
+	filter, status := parseFilter(req.Parameters, req.AttributeID)
+	if status != StatusGood {
+		return nil, status
+	}
+
+	sub.nextItemID++
+	item := &monitoredItem{
+		id:          sub.nextItemID,
+		node:        req.NodeID,
+		attributeID: req.AttributeID,
+	}
+	if n.field != nil && req.AttributeID == attrValue {
+		item.deviceID = n.device.ID
+		item.field = n.field.Name
+	}
+	item.configure(req.Parameters, filter, timestamps)
+	item.setMode(req.Mode)
+	item.sample(initial)
+
+	sub.items[item.id] = item
+	s.watch(item)
+	return item, StatusGood
+}
+
+func (s *Server) modifyMonitoredItems(header requestHeader, d *decoder) []byte {
+	id := d.uint32()
+	timestamps := d.int32()
+	n := d.arrayLength()
+	type modifyRequest struct {
+		id     uint32
+		params monitoringParameters
+	}
+	requests := make([]modifyRequest, 0, n)
+	for i := 0; i < n && d.err() == nil; i++ {
+		requests = append(requests, modifyRequest{d.uint32(), d.monitoringParameters()})
+	}
+	if d.err() != nil {
+		return serviceFault(header.RequestHandle, StatusBadDecodingError)
+	}
+	if len(requests) == 0 {
+		return serviceFault(header.RequestHandle, StatusBadNothingToDo)
+	}
+	if timestamps < timestampsSource || timestamps > timestampsNeither {
+		return serviceFault(header.RequestHandle, StatusBadTimestampsToReturnInvalid)
+	}
+
+	s.mu.Lock()
+	sub := s.subscriptionOf(header, id)
+	if sub == nil {
+		s.mu.Unlock()
+		return serviceFault(header.RequestHandle, StatusBadSubscriptionIDInvalid)
+	}
+
+	e := &encoder{}
+	e.nodeID(numericID(0, idModifyMonitoredItemsResponse))
+	e.responseHeader(header.RequestHandle, StatusGood)
+	e.int32(int32(len(requests)))
+	for _, req := range requests {
+		item := sub.items[req.id]
+		status := StatusBadMonitoredItemIDInvalid
+		var queueSize uint32
+		if item != nil {
+			var filter dataChangeFilter
+			if filter, status = parseFilter(req.params, item.attributeID); status == StatusGood {
+				item.configure(req.params, filter, timestamps)
+				queueSize = item.queueSize
+			}
+		}
+		e.uint32(status)
+		e.float64(0)
+		e.uint32(queueSize)
+		e.emptyExtensionObject()
+	}
+	e.int32(-1)
+	s.mu.Unlock()
+	return e.bytes()
+}
+
+func (s *Server) setMonitoringMode(header requestHeader, d *decoder) []byte {
+	id := d.uint32()
+	mode := d.int32()
+	ids := d.uint32Array()
+	if d.err() != nil {
+		return serviceFault(header.RequestHandle, StatusBadDecodingError)
+	}
+	if len(ids) == 0 {
+		return serviceFault(header.RequestHandle, StatusBadNothingToDo)
+	}
+	if mode < monitoringDisabled || mode > monitoringReporting {
+		return serviceFault(header.RequestHandle, StatusBadMonitoringModeInvalid)
+	}
+
+	s.mu.Lock()
+	sub := s.subscriptionOf(header, id)
+	if sub == nil {
+		s.mu.Unlock()
+		return serviceFault(header.RequestHandle, StatusBadSubscriptionIDInvalid)
+	}
+	results := make([]uint32, len(ids))
+	for i, itemID := range ids {
+		item := sub.items[itemID]
+		if item == nil {
+			results[i] = StatusBadMonitoredItemIDInvalid
+			continue
+		}
+		item.setMode(mode)
+	}
+	s.mu.Unlock()
+
+	return statusResults(idSetMonitoringModeResponse, header, results)
+}
+
+func (s *Server) deleteMonitoredItems(header requestHeader, d *decoder) []byte {
+	id := d.uint32()
+	ids := d.uint32Array()
+	if d.err() != nil {
+		return serviceFault(header.RequestHandle, StatusBadDecodingError)
+	}
+	if len(ids) == 0 {
+		return serviceFault(header.RequestHandle, StatusBadNothingToDo)
+	}
+
+	s.mu.Lock()
+	sub := s.subscriptionOf(header, id)
+	if sub == nil {
+		s.mu.Unlock()
+		return serviceFault(header.RequestHandle, StatusBadSubscriptionIDInvalid)
+	}
+	results := make([]uint32, len(ids))
+	for i, itemID := range ids {
+		item := sub.items[itemID]
+		if item == nil {
+			results[i] = StatusBadMonitoredItemIDInvalid
+			continue
+		}
+		delete(sub.items, itemID)
+		s.unwatch(item)
+	}
+	s.mu.Unlock()
+
+	return statusResults(idDeleteMonitoredItemsResponse, header, results)
+}
+
+// statusResults encodes the responses that only carry a status per item
+func statusResults(typeID uint32, header requestHeader, results []uint32) []byte {
+	e := &encoder{}
+	e.nodeID(numericID(0, typeID))
+	e.responseHeader(header.RequestHandle, StatusGood)
+	e.int32(int32(len(results)))
+	for _, result := range results {
+		e.uint32(result)
+	}
+	e.int32(-1) // DiagnosticInfos
+	return e.bytes()
+}
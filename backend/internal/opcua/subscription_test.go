@@ -0,0 +1,334 @@
+package opcua
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+func (c *testClient) createSubscription(interval float64, keepAlive uint32) uint32 {
+	c.t.Helper()
+
+	typeID, status, d := c.call(idCreateSubscriptionRequest, func(e *encoder) {
+		e.float64(interval)
+		e.uint32(0)
+		e.uint32(keepAlive)
+		e.uint32(0)
+		e.boolean(true)
+		e.byte(0)
+	})
+	if typeID != idCreateSubscriptionResponse || status != StatusGood {
+		c.t.Fatalf("CreateSubscription = %d/0x%08X", typeID, status)
+	}
+	return d.uint32()
+}
+
+// monitor creates a monitored item reporting the value of each node and
+// returns the result status of each.
+func (c *testClient) monitor(subscription uint32, nodes ...NodeID) []uint32 {
+	c.t.Helper()
+
+	_, status, d := c.call(idCreateMonitoredItemsRequest, func(e *encoder) {
+		e.uint32(subscription)
+		e.int32(timestampsBoth)
+		e.int32(int32(len(nodes)))
+		for i, id := range nodes {
+			e.nodeID(id)
+			e.uint32(attrValue)
+			e.string("")
+			e.qualifiedName(QualifiedName{})
+			e.int32(monitoringReporting)
+			e.uint32(uint32(i + 1)) // ClientHandle
+			e.float64(-1)
+			e.emptyExtensionObject()
+			e.uint32(1)
+			e.boolean(true)
+		}
+	})
+	if status != StatusGood {
+		c.t.Fatalf("CreateMonitoredItems status = 0x%08X", status)
+	}
+
+	results := make([]uint32, d.arrayLength())
+	for i := range results {
+		results[i] = d.uint32()
+		d.uint32()
+		d.float64()
+		d.uint32()
+		d.extensionObject()
+	}
+	if d.err() != nil {
+		c.t.Fatalf("invalid CreateMonitoredItems response: %v", d.err())
+	}
+	return results
+}
+
+type publishResult struct {
+	subscription uint32
+	sequence     uint32
+	available    []uint32
+	values       map[uint32]DataValue // by client handle
+	results      []uint32
+}
+
+func (c *testClient) publish(subscription uint32, acknowledge ...uint32) (uint32, publishResult) {
+	c.t.Helper()
+
+	typeID, status, d := c.call(idPublishRequest, func(e *encoder) {
+		e.int32(int32(len(acknowledge)))
+		for _, sequence := range acknowledge {
+			e.uint32(subscription)
+			e.uint32(sequence)
+		}
+	})
+	if typeID != idPublishResponse || status != StatusGood {
+		return status, publishResult{}
+	}
+
+	r := publishResult{values: make(map[uint32]DataValue)}
+	r.subscription = d.uint32()
+	r.available = d.uint32Array()
+	d.boolean() // MoreNotifications
+	r.sequence = d.uint32()
+	d.dateTime()
+	for i, n := 0, d.arrayLength(); i < n; i++ {
+		typeID, body := d.extensionObjectBody()
+		if typeID.ID != idDataChangeNotification {
+			c.t.Fatalf("notification type = %s", typeID)
+		}
+		nd := newDecoder(body)
+		for j, items := 0, nd.arrayLength(); j < items; j++ {
+			handle := nd.uint32()
+			r.values[handle] = nd.dataValue()
+		}
+		if nd.err() != nil {
+			c.t.Fatalf("invalid DataChangeNotification: %v", nd.err())
+		}
+	}
+	r.results = d.uint32Array()
+	if d.err() != nil {
+		c.t.Fatalf("invalid Publish response: %v", d.err())
+	}
+	return StatusGood, r
+}
+
+func TestServerSubscription(t *testing.T) {
+	srv, _ := startServer(t)
+	c := dial(t, srv)
+	c.openSession(true)
+
+	if status, _ := c.publish(1); status != StatusBadNoSubscription {
+		t.Fatalf("Publish() without subscriptions = 0x%08X, want BadNoSubscription", status)
+	}
+
+	sub := c.createSubscription(50, 2)
+	temperature := stringID(namespaceIoTStudio, "s1/d1/temperature")
+	results := c.monitor(sub, temperature, stringID(namespaceIoTStudio, "s1/d1/missing"))
+	if want := []uint32{StatusGood, StatusBadNodeIDUnknown}; !reflect.DeepEqual(results, want) {
+		t.Fatalf("CreateMonitoredItems results = %#x, want %#x", results, want)
+	}
+
+	// The initial value is reported first
+	_, r := c.publish(sub)
+	if r.subscription != sub || r.sequence != 1 || r.values[1].Status != StatusBadWaitingForInitialData {
+		t.Fatalf("first Publish() = %+v", r)
+	}
+
+	write := func(data string) {
+		err := srv.WriteDataPoints(context.Background(), []models.DataPoint{{
+			SessionID: "s1",
+			DeviceID:  "d1",
+			Timestamp: 1700000000000,
+			Data:      data,
+		}})
+		if err != nil {
+			t.Fatalf("WriteDataPoints() error = %v", err)
+		}
+	}
+
+	write(`{"temperature": 21.5}`)
+	_, r = c.publish(sub, 1)
+	if r.sequence != 2 || r.values[1].Value != 21.5 || !reflect.DeepEqual(r.results, []uint32{StatusGood}) {
+		t.Fatalf("second Publish() = %+v", r)
+	}
+	if !r.values[1].SourceTimestamp.Equal(time.UnixMilli(1700000000000)) {
+		t.Errorf("SourceTimestamp = %v", r.values[1].SourceTimestamp)
+	}
+	if !reflect.DeepEqual(r.available, []uint32{2}) {
+		t.Errorf("AvailableSequenceNumbers = %v, want [2]", r.available)
+	}
+
+	// An unchanged value is not reported, so a keep-alive follows
+	write(`{"temperature": 21.5, "running": 1}`)
+	_, r = c.publish(sub)
+	if r.sequence != 3 || len(r.values) != 0 {
+		t.Fatalf("keep-alive Publish() = %+v", r)
+	}
+
+	_, status, _ := c.call(idRepublishRequest, func(e *encoder) {
+		e.uint32(sub)
+		e.uint32(1)
+	})
+	if status != StatusBadMessageNotAvailable {
+		t.Errorf("Republish() of an acknowledged message = 0x%08X, want BadMessageNotAvailable", status)
+	}
+	typeID, status, d := c.call(idRepublishRequest, func(e *encoder) {
+		e.uint32(sub)
+		e.uint32(2)
+	})
+	if typeID != idRepublishResponse || status != StatusGood || d.uint32() != 2 {
+		t.Errorf("Republish() = %d/0x%08X", typeID, status)
+	}
+
+	deleteSubscription := func(id uint32) {
+		t.Helper()
+		c.request(idDeleteSubscriptionsRequest, func(e *encoder) {
+			e.int32(1)
+			e.uint32(id)
+		})
+	}
+	deleteSubscription(sub)
+	typeID, status, d = c.response()
+	if typeID != idDeleteSubscriptionsResponse || status != StatusGood {
+		t.Fatalf("DeleteSubscriptions() = %d/0x%08X", typeID, status)
+	}
+
+	// A queued Publish request fails once its last subscription is deleted.
+	// The slow subscription has nothing to send before then.
+	slow := c.createSubscription(60000, 0)
+	c.request(idPublishRequest, func(e *encoder) { e.int32(0) })
+	deleteSubscription(slow)
+	typeID, status, _ = c.response()
+	if typeID != idServiceFault || status != StatusBadNoSubscription {
+		t.Errorf("queued Publish() = %d/0x%08X, want BadNoSubscription", typeID, status)
+	}
+	typeID, status, d = c.response()
+	if typeID != idDeleteSubscriptionsResponse || status != StatusGood {
+		t.Fatalf("DeleteSubscriptions() = %d/0x%08X", typeID, status)
+	}
+	if d.arrayLength(); d.uint32() != StatusGood {
+		t.Errorf("DeleteSubscriptions() result is not Good")
+	}
+}
+
+func TestMonitoredItemSample(t *testing.T) {
+	at := func(ms int64) time.Time { return time.UnixMilli(ms) }
+	value := func(v interface{}, ms int64) DataValue {
+		return DataValue{Value: v, HasValue: true, SourceTimestamp: at(ms), ServerTimestamp: at(ms)}
+	}
+
+	tests := []struct {
+		name          string
+		filter        dataChangeFilter
+		queueSize     uint32
+		discardOldest bool
+		timestamps    int32
+		samples       []DataValue
+		want          []DataValue
+	}{
+		{
+			name:       "unchanged values are dropped",
+			filter:     dataChangeFilter{trigger: triggerStatusValue},
+			queueSize:  10,
+			timestamps: timestampsBoth,
+			samples:    []DataValue{value(1.0, 1), value(1.0, 2), value(2.0, 3)},
+			want:       []DataValue{value(1.0, 1), value(2.0, 3)},
+		},
+		{
+			name:       "timestamp trigger",
+			filter:     dataChangeFilter{trigger: triggerStatusValueTimestamp},
+			queueSize:  10,
+			timestamps: timestampsBoth,
+			samples:    []DataValue{value("on", 1), value("on", 2), value("on", 2)},
+			want:       []DataValue{value("on", 1), value("on", 2)},
+		},
+		{
+			name:       "absolute deadband",
+			filter:     dataChangeFilter{trigger: triggerStatusValue, deadband: 0.5},
+			queueSize:  10,
+			timestamps: timestampsBoth,
+			samples:    []DataValue{value(1.0, 1), value(1.4, 2), value(1.6, 3)},
+			want:       []DataValue{value(1.0, 1), value(1.6, 3)},
+		},
+		{
+			name:          "discard oldest",
+			filter:        dataChangeFilter{trigger: triggerStatusValue},
+			queueSize:     2,
+			discardOldest: true,
+			timestamps:    timestampsBoth,
+			samples:       []DataValue{value(1.0, 1), value(2.0, 2), value(3.0, 3)},
+			want:          []DataValue{{Value: 2.0, HasValue: true, Status: infoOverflow, SourceTimestamp: at(2), ServerTimestamp: at(2)}, value(3.0, 3)},
+		},
+		{
+			name:       "replace newest",
+			filter:     dataChangeFilter{trigger: triggerStatusValue},
+			queueSize:  1,
+			timestamps: timestampsBoth,
+			samples:    []DataValue{value(1.0, 1), value(2.0, 2)},
+			want:       []DataValue{value(2.0, 2)},
+		},
+		{
+			name:       "source timestamps only",
+			filter:     dataChangeFilter{trigger: triggerStatusValue},
+			queueSize:  1,
+			timestamps: timestampsSource,
+			samples:    []DataValue{value(true, 1)},
+			want:       []DataValue{{Value: true, HasValue: true, SourceTimestamp: at(1)}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := &monitoredItem{mode: monitoringReporting}
+			item.configure(monitoringParameters{QueueSize: tt.queueSize, DiscardOldest: tt.discardOldest}, tt.filter, tt.timestamps)
+			for _, sample := range tt.samples {
+				item.sample(sample)
+			}
+			if !reflect.DeepEqual(item.queue, tt.want) {
+				t.Errorf("queue = %+v, want %+v", item.queue, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	filter := func(trigger int32, deadbandType uint32, deadband float64) monitoringParameters {
+		e := &encoder{}
+		e.int32(trigger)
+		e.uint32(deadbandType)
+		e.float64(deadband)
+		return monitoringParameters{FilterType: numericID(0, idDataChangeFilter), Filter: e.bytes()}
+	}
+
+	tests := []struct {
+		name       string
+		params     monitoringParameters
+		attribute  uint32
+		want       dataChangeFilter
+		wantStatus uint32
+	}{
+		{"no filter", monitoringParameters{}, attrValue, dataChangeFilter{trigger: triggerStatusValue}, StatusGood},
+		{"status trigger", filter(triggerStatus, deadbandNone, 0), attrValue, dataChangeFilter{trigger: triggerStatus}, StatusGood},
+		{"absolute deadband", filter(triggerStatusValue, deadbandAbsolute, 2), attrValue, dataChangeFilter{trigger: triggerStatusValue, deadband: 2}, StatusGood},
+		{"percent deadband", filter(triggerStatusValue, 2, 10), attrValue, dataChangeFilter{}, StatusBadMonitoredItemFilterUnsupported},
+		{"negative deadband", filter(triggerStatusValue, deadbandAbsolute, -1), attrValue, dataChangeFilter{}, StatusBadMonitoredItemFilterInvalid},
+		{"invalid trigger", filter(5, deadbandNone, 0), attrValue, dataChangeFilter{}, StatusBadMonitoredItemFilterInvalid},
+		{"filter on other attribute", filter(triggerStatus, deadbandNone, 0), attrDisplayName, dataChangeFilter{}, StatusBadFilterNotAllowed},
+		{"event filter", monitoringParameters{FilterType: numericID(0, 727)}, attrValue, dataChangeFilter{}, StatusBadMonitoredItemFilterUnsupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, status := parseFilter(tt.params, tt.attribute)
+			if status != tt.wantStatus {
+				t.Fatalf("parseFilter() status = 0x%08X, want 0x%08X", status, tt.wantStatus)
+			}
+			if status == StatusGood && got != tt.want {
+				t.Errorf("parseFilter() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
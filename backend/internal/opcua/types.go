@@ -0,0 +1,265 @@
+package opcua
+
+import "time"
+
+// Status codes
+const (
+	StatusGood                              uint32 = 0x00000000
+	StatusBadInternalError                  uint32 = 0x80020000
+	StatusBadTimeout                        uint32 = 0x800A0000
+	StatusBadCommunicationError             uint32 = 0x80050000
+	StatusBadDecodingError                  uint32 = 0x80070000
+	StatusBadServiceUnsupported             uint32 = 0x800B0000
+	StatusBadNothingToDo                    uint32 = 0x800F0000
+	StatusBadUserAccessDenied               uint32 = 0x801F0000
+	StatusBadSessionIDInvalid               uint32 = 0x80250000
+	StatusBadSessionNotActivated            uint32 = 0x80270000
+	StatusBadSubscriptionIDInvalid          uint32 = 0x80280000
+	StatusBadTimestampsToReturnInvalid      uint32 = 0x802B0000
+	StatusBadNoCommunication                uint32 = 0x80310000
+	StatusBadWaitingForInitialData          uint32 = 0x80320000
+	StatusBadNodeIDUnknown                  uint32 = 0x80340000
+	StatusBadAttributeIDInvalid             uint32 = 0x80350000
+	StatusBadNotWritable                    uint32 = 0x803B0000
+	StatusBadOutOfRange                     uint32 = 0x803C0000
+	StatusBadMonitoringModeInvalid          uint32 = 0x80410000
+	StatusBadMonitoredItemIDInvalid         uint32 = 0x80420000
+	StatusBadMonitoredItemFilterInvalid     uint32 = 0x80430000
+	StatusBadMonitoredItemFilterUnsupported uint32 = 0x80440000
+	StatusBadFilterNotAllowed               uint32 = 0x80450000
+	StatusBadSecurityModeRejected           uint32 = 0x80540000
+	StatusBadSecurityPolicyRejected         uint32 = 0x80550000
+	StatusBadTooManySessions                uint32 = 0x80560000
+	StatusBadTypeMismatch                   uint32 = 0x80740000
+	StatusBadTooManySubscriptions           uint32 = 0x80770000
+	StatusBadTooManyPublishRequests         uint32 = 0x80780000
+	StatusBadNoSubscription                 uint32 = 0x80790000
+	StatusBadSequenceNumberUnknown          uint32 = 0x807A0000
+	StatusBadMessageNotAvailable            uint32 = 0x807B0000
+	StatusBadTCPMessageTypeInvalid          uint32 = 0x807E0000
+	StatusBadConfigurationError             uint32 = 0x80890000
+)
+
+// Binary encoding IDs of the service messages handled by the server
+const (
+	idServiceFault                 = 397
+	idGetEndpointsRequest          = 428
+	idGetEndpointsResponse         = 431
+	idOpenSecureChannelRequest     = 446
+	idOpenSecureChannelResponse    = 449
+	idCloseSecureChannelRequest    = 452
+	idCreateSessionRequest         = 461
+	idCreateSessionResponse        = 464
+	idActivateSessionRequest       = 467
+	idActivateSessionResponse      = 470
+	idCloseSessionRequest          = 473
+	idCloseSessionResponse         = 476
+	idBrowseRequest                = 527
+	idBrowseResponse               = 530
+	idBrowseNextRequest            = 533
+	idBrowseNextResponse           = 536
+	idReadRequest                  = 631
+	idReadResponse                 = 634
+	idWriteRequest                 = 673
+	idWriteResponse                = 676
+	idDataChangeFilter             = 724
+	idCreateMonitoredItemsRequest  = 751
+	idCreateMonitoredItemsResponse = 754
+	idModifyMonitoredItemsRequest  = 763
+	idModifyMonitoredItemsResponse = 766
+	idSetMonitoringModeRequest     = 769
+	idSetMonitoringModeResponse    = 772
+	idDeleteMonitoredItemsRequest  = 781
+	idDeleteMonitoredItemsResponse = 784
+	idCreateSubscriptionRequest    = 787
+	idCreateSubscriptionResponse   = 790
+	idModifySubscriptionRequest    = 793
+	idModifySubscriptionResponse   = 796
+	idSetPublishingModeRequest     = 799
+	idSetPublishingModeResponse    = 802
+	idDataChangeNotification       = 811
+	idPublishRequest               = 826
+	idPublishResponse              = 829
+	idRepublishRequest             = 832
+	idRepublishResponse            = 835
+	idDeleteSubscriptionsRequest   = 847
+	idDeleteSubscriptionsResponse  = 850
+)
+
+// Well-known nodes in namespace 0
+const (
+	idReferences                = 31
+	idNonHierarchicalReferences = 32
+	idHierarchicalReferences    = 33
+	idHasChild                  = 34
+	idOrganizes                 = 35
+	idHasTypeDefinition         = 40
+	idAggregates                = 44
+	idHasProperty               = 46
+	idHasComponent              = 47
+	idBaseObjectType            = 58
+	idFolderType                = 61
+	idBaseDataVariableType      = 63
+	idPropertyType              = 68
+	idRootFolder                = 84
+	idObjectsFolder             = 85
+	idServerType                = 2004
+	idServer                    = 2253
+	idServerArray               = 2254
+	idNamespaceArray            = 2255
+)
+
+// Data type nodes
+const (
+	idBoolean      = 1
+	idDouble       = 11
+	idString       = 12
+	idBaseDataType = 24
+)
+
+// Attribute IDs
+const (
+	attrNodeID                  = 1
+	attrNodeClass               = 2
+	attrBrowseName              = 3
+	attrDisplayName             = 4
+	attrDescription             = 5
+	attrWriteMask               = 6
+	attrUserWriteMask           = 7
+	attrEventNotifier           = 12
+	attrValue                   = 13
+	attrDataType                = 14
+	attrValueRank               = 15
+	attrArrayDimensions         = 16
+	attrAccessLevel             = 17
+	attrUserAccessLevel         = 18
+	attrMinimumSamplingInterval = 19
+	attrHistorizing             = 20
+)
+
+// Node classes
+const (
+	nodeClassObject   int32 = 1
+	nodeClassVariable int32 = 2
+)
+
+const (
+	accessLevelRead  byte = 0x01
+	accessLevelWrite byte = 0x02
+)
+
+const (
+	browseForward = 0
+	browseInverse = 1
+	browseBoth    = 2
+)
+
+const (
+	securityModeNone   = 1
+	securityPolicyNone = "http://opcfoundation.org/UA/SecurityPolicy#None"
+	transportProfile   = "http://opcfoundation.org/UA-Profile/Transport/uatcp-uasc-uabinary"
+)
+
+// referenceSubtypes lists the direct subtypes of the reference types used by
+// the address space, so browse requests with IncludeSubtypes can be honoured.
+var referenceSubtypes = map[uint32][]uint32{
+	idReferences:                {idHierarchicalReferences, idNonHierarchicalReferences},
+	idHierarchicalReferences:    {idHasChild, idOrganizes},
+	idHasChild:                  {idAggregates},
+	idAggregates:                {idHasProperty, idHasComponent},
+	idNonHierarchicalReferences: {idHasTypeDefinition},
+}
+
+func isReferenceSubtype(ref, parent uint32) bool {
+	if ref == parent {
+		return true
+	}
+	for _, child := range referenceSubtypes[parent] {
+		if isReferenceSubtype(ref, child) {
+			return true
+		}
+	}
+	return false
+}
+
+type requestHeader struct {
+	AuthenticationToken NodeID
+	Timestamp           time.Time
+	RequestHandle       uint32
+}
+
+func (d *decoder) requestHeader() requestHeader {
+	var h requestHeader
+	h.AuthenticationToken = d.nodeID()
+	h.Timestamp = d.dateTime()
+	h.RequestHandle = d.uint32()
+	d.uint32() // ReturnDiagnostics
+	d.string() // AuditEntryId
+	d.uint32() // TimeoutHint
+	d.extensionObject()
+	return h
+}
+
+func (e *encoder) responseHeader(requestHandle uint32, result uint32) {
+	e.dateTime(time.Now())
+	e.uint32(requestHandle)
+	e.uint32(result)
+	e.emptyDiagnosticInfo()
+	e.stringArray(nil)
+	e.emptyExtensionObject()
+}
+
+type browseDescription struct {
+	NodeID          NodeID
+	Direction       int32
+	ReferenceTypeID NodeID
+	IncludeSubtypes bool
+	NodeClassMask   uint32
+}
+
+type referenceDescription struct {
+	ReferenceTypeID uint32
+	IsForward       bool
+	NodeID          NodeID
+	BrowseName      QualifiedName
+	DisplayName     LocalizedText
+	NodeClass       int32
+	TypeDefinition  NodeID
+}
+
+type readValueID struct {
+	NodeID      NodeID
+	AttributeID uint32
+}
+
+type writeValue struct {
+	NodeID      NodeID
+	AttributeID uint32
+	Value       DataValue
+}
+
+type monitoredItemCreateRequest struct {
+	NodeID      NodeID
+	AttributeID uint32
+	Mode        int32
+	Parameters  monitoringParameters
+}
+
+type monitoringParameters struct {
+	ClientHandle     uint32
+	SamplingInterval float64
+	FilterType       NodeID
+	Filter           []byte
+	QueueSize        uint32
+	DiscardOldest    bool
+}
+
+func (d *decoder) monitoringParameters() monitoringParameters {
+	var p monitoringParameters
+	p.ClientHandle = d.uint32()
+	p.SamplingInterval = d.float64()
+	p.FilterType, p.Filter = d.extensionObjectBody()
+	p.QueueSize = d.uint32()
+	p.DiscardOldest = d.boolean()
+	return p
+}
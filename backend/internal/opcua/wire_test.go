@@ -0,0 +1,351 @@
+package opcua
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The messages in this file are laid out by hand from OPC 10000-6 (UA Binary
+// encoding and UA TCP), without the package's encoder and decoder, so the
+// server is checked against the specification rather than against itself.
+
+// wireWriter appends UA Binary built-in types (OPC 10000-6, 5.2.2)
+type wireWriter struct{ buf []byte }
+
+func (w *wireWriter) raw(b ...byte) *wireWriter { w.buf = append(w.buf, b...); return w }
+func (w *wireWriter) u16(v uint16) *wireWriter {
+	w.buf = binary.LittleEndian.AppendUint16(w.buf, v)
+	return w
+}
+func (w *wireWriter) u32(v uint32) *wireWriter {
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, v)
+	return w
+}
+func (w *wireWriter) i32(v int32) *wireWriter { return w.u32(uint32(v)) }
+func (w *wireWriter) i64(v int64) *wireWriter {
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, uint64(v))
+	return w
+}
+func (w *wireWriter) f64(v float64) *wireWriter { return w.i64(int64(math.Float64bits(v))) }
+func (w *wireWriter) null() *wireWriter         { return w.i32(-1) } // null String, ByteString or array
+
+func (w *wireWriter) str(s string) *wireWriter {
+	w.i32(int32(len(s)))
+	w.buf = append(w.buf, s...)
+	return w
+}
+
+// fourByteID writes a numeric NodeId in namespace 0 in the four byte form
+func (w *wireWriter) fourByteID(id uint16) *wireWriter { return w.raw(0x01, 0x00).u16(id) }
+
+// requestHeader writes a RequestHeader (OPC 10000-4, 7.32)
+func (w *wireWriter) requestHeader(token []byte, handle uint32) *wireWriter {
+	if token == nil {
+		token = []byte{0x00, 0x00} // null NodeId
+	}
+	w.raw(token...)
+	w.i64(0)                       // Timestamp
+	w.u32(handle)                  // RequestHandle
+	w.u32(0)                       // ReturnDiagnostics
+	w.null()                       // AuditEntryId
+	w.u32(10000)                   // TimeoutHint
+	return w.raw(0x00, 0x00, 0x00) // AdditionalHeader: null ExtensionObject
+}
+
+// wireReader consumes UA Binary built-in types and fails the test on short
+// input
+type wireReader struct {
+	t   *testing.T
+	buf []byte
+}
+
+func (r *wireReader) take(n int) []byte {
+	r.t.Helper()
+	if n < 0 || n > len(r.buf) {
+		r.t.Fatalf("message truncated: need %d bytes, have %d", n, len(r.buf))
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *wireReader) u8() byte     { return r.take(1)[0] }
+func (r *wireReader) u16() uint16  { return binary.LittleEndian.Uint16(r.take(2)) }
+func (r *wireReader) u32() uint32  { return binary.LittleEndian.Uint32(r.take(4)) }
+func (r *wireReader) i32() int32   { return int32(r.u32()) }
+func (r *wireReader) i64() int64   { return int64(binary.LittleEndian.Uint64(r.take(8))) }
+func (r *wireReader) f64() float64 { return math.Float64frombits(uint64(r.i64())) }
+
+func (r *wireReader) str() string {
+	n := r.i32()
+	if n < 0 {
+		return ""
+	}
+	return string(r.take(int(n)))
+}
+
+// nodeID returns the encoded NodeId and, for numeric ones, its identifier
+// (OPC 10000-6, 5.2.2.9)
+func (r *wireReader) nodeID() ([]byte, uint32) {
+	r.t.Helper()
+	start := r.buf
+	var id uint32
+	switch encoding := r.u8(); encoding {
+	case 0x00:
+		id = uint32(r.u8())
+	case 0x01:
+		r.u8()
+		id = uint32(r.u16())
+	case 0x02:
+		r.u16()
+		id = r.u32()
+	case 0x03, 0x05:
+		r.u16()
+		r.str()
+	case 0x04:
+		r.u16()
+		r.take(16)
+	default:
+		r.t.Fatalf("unexpected NodeId encoding %#02x", encoding)
+	}
+	return start[:len(start)-len(r.buf)], id
+}
+
+func (r *wireReader) diagnosticInfo() {
+	mask := r.u8()
+	for _, bit := range []byte{0x01, 0x02, 0x04, 0x08} {
+		if mask&bit != 0 {
+			r.i32()
+		}
+	}
+	if mask&0x10 != 0 {
+		r.str()
+	}
+	if mask&0x20 != 0 {
+		r.u32()
+	}
+	if mask&0x40 != 0 {
+		r.diagnosticInfo()
+	}
+}
+
+// responseHeader consumes a ResponseHeader (OPC 10000-4, 7.33) and returns
+// its RequestHandle and ServiceResult
+func (r *wireReader) responseHeader() (uint32, uint32) {
+	r.i64() // Timestamp
+	handle := r.u32()
+	result := r.u32()
+	r.diagnosticInfo()
+	for n := r.i32(); n > 0; n-- { // StringTable
+		r.str()
+	}
+	r.nodeID() // AdditionalHeader
+	switch r.u8() {
+	case 0x01, 0x02:
+		r.str()
+	}
+	return handle, result
+}
+
+type wireClient struct {
+	t         *testing.T
+	conn      net.Conn
+	channelID uint32
+	tokenID   uint32
+	sequence  uint32
+	token     []byte
+}
+
+// exchange sends one chunk (OPC 10000-6, 7.1.2) and reads the reply
+func (c *wireClient) exchange(msgType string, body []byte) (string, *wireReader) {
+	c.t.Helper()
+
+	frame := append([]byte(msgType+"F"), binary.LittleEndian.AppendUint32(nil, uint32(8+len(body)))...)
+	if _, err := c.conn.Write(append(frame, body...)); err != nil {
+		c.t.Fatalf("write %s: %v", msgType, err)
+	}
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		c.t.Fatalf("read reply to %s: %v", msgType, err)
+	}
+	if header[3] != 'F' {
+		c.t.Fatalf("reply to %s is chunk %q, want a final chunk", msgType, header[3])
+	}
+	reply := make([]byte, binary.LittleEndian.Uint32(header[4:8])-8)
+	if _, err := io.ReadFull(c.conn, reply); err != nil {
+		c.t.Fatalf("read reply to %s: %v", msgType, err)
+	}
+	return string(header[:3]), &wireReader{t: c.t, buf: reply}
+}
+
+// service sends a request in a MSG chunk and checks the response's type,
+// handle and service result
+func (c *wireClient) service(requestID, responseID uint16, body func(w *wireWriter)) *wireReader {
+	c.t.Helper()
+
+	c.sequence++
+	w := (&wireWriter{}).u32(c.channelID).u32(c.tokenID).u32(c.sequence).u32(c.sequence)
+	w.fourByteID(requestID).requestHeader(c.token, c.sequence)
+	body(w)
+
+	msgType, r := c.exchange("MSG", w.buf)
+	if msgType != "MSG" {
+		c.t.Fatalf("reply to request %d is %s, want MSG", requestID, msgType)
+	}
+	if channel := r.u32(); channel != c.channelID {
+		c.t.Errorf("SecureChannelId = %d, want %d", channel, c.channelID)
+	}
+	r.u32() // TokenId
+	r.u32() // SequenceNumber
+	if id := r.u32(); id != c.sequence {
+		c.t.Errorf("RequestId = %d, want %d", id, c.sequence)
+	}
+	if _, id := r.nodeID(); id != uint32(responseID) {
+		c.t.Fatalf("response to request %d has type %d, want %d", requestID, id, responseID)
+	}
+	if handle, result := r.responseHeader(); handle != c.sequence || result != StatusGood {
+		c.t.Fatalf("response to request %d: handle %d, result 0x%08X", requestID, handle, result)
+	}
+	return r
+}
+
+func TestServerWireProtocol(t *testing.T) {
+	srv, modbus := startServer(t, allowWrites)
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	c := &wireClient{t: t, conn: conn}
+	endpoint := "opc.tcp://" + srv.Addr().String()
+
+	// Hello and Acknowledge (7.1.2.3, 7.1.2.4)
+	hello := (&wireWriter{}).u32(0).u32(65536).u32(65536).u32(0).u32(0).str(endpoint)
+	msgType, r := c.exchange("HEL", hello.buf)
+	if msgType != "ACK" || len(r.buf) != 20 {
+		t.Fatalf("reply to HEL = %s with %d bytes, want ACK with 20", msgType, len(r.buf))
+	}
+	r.u32() // ProtocolVersion
+	if receive := r.u32(); receive < 8192 {
+		t.Errorf("ACK ReceiveBufferSize = %d, want at least 8192", receive)
+	}
+
+	// OpenSecureChannel with the asymmetric security header (6.7.2.3)
+	open := (&wireWriter{}).u32(0).str("http://opcfoundation.org/UA/SecurityPolicy#None").null().null().u32(1).u32(1)
+	open.fourByteID(446).requestHeader(nil, 1)
+	open.u32(0)      // ClientProtocolVersion
+	open.i32(0)      // RequestType: Issue
+	open.i32(1)      // SecurityMode: None
+	open.null()      // ClientNonce
+	open.u32(600000) // RequestedLifetime
+	msgType, r = c.exchange("OPN", open.buf)
+	if msgType != "OPN" {
+		t.Fatalf("reply to OPN = %s", msgType)
+	}
+	c.channelID = r.u32()
+	if policy := r.str(); policy != "http://opcfoundation.org/UA/SecurityPolicy#None" {
+		t.Errorf("SecurityPolicyUri = %q", policy)
+	}
+	r.str()
+	r.str()
+	r.u32()
+	if id := r.u32(); id != 1 {
+		t.Errorf("RequestId = %d, want 1", id)
+	}
+	if _, id := r.nodeID(); id != 449 {
+		t.Fatalf("OPN response type = %d, want OpenSecureChannelResponse (449)", id)
+	}
+	if _, result := r.responseHeader(); result != StatusGood {
+		t.Fatalf("OpenSecureChannel result = 0x%08X", result)
+	}
+	r.u32() // ServerProtocolVersion
+	if channel := r.u32(); channel != c.channelID || channel == 0 {
+		t.Errorf("SecurityToken.ChannelId = %d, want %d", channel, c.channelID)
+	}
+	c.tokenID = r.u32()
+	r.i64()
+	if lifetime := r.u32(); lifetime == 0 {
+		t.Error("SecurityToken.RevisedLifetime = 0")
+	}
+	c.sequence = 1
+
+	// CreateSession (OPC 10000-4, 5.6.2) asking for a 20 minute timeout
+	r = c.service(461, 464, func(w *wireWriter) {
+		w.str("urn:wire-test").null()      // ApplicationUri, ProductUri
+		w.raw(0x02).str("wire test")       // ApplicationName: LocalizedText with text
+		w.i32(1).null().null().null()      // Client, GatewayServerUri, DiscoveryProfileUri, DiscoveryUrls
+		w.null().str(endpoint).str("wire") // ServerUri, EndpointUrl, SessionName
+		w.null().null()                    // ClientNonce, ClientCertificate
+		w.f64(20 * 60 * 1000).u32(0)       // RequestedSessionTimeout, MaxResponseMessageSize
+	})
+	r.nodeID() // SessionId
+	c.token, _ = r.nodeID()
+	c.token = append([]byte(nil), c.token...)
+	if timeout := r.f64(); timeout != 20*60*1000 {
+		t.Errorf("RevisedSessionTimeout = %v ms, want the 1200000 requested", timeout)
+	}
+
+	// ActivateSession with an AnonymousIdentityToken (OPC 10000-4, 7.36.3)
+	c.service(467, 470, func(w *wireWriter) {
+		w.null().null() // ClientSignature
+		w.null()        // ClientSoftwareCertificates
+		w.null()        // LocaleIds
+		identity := (&wireWriter{}).str("anonymous")
+		w.fourByteID(321).raw(0x01).i32(int32(len(identity.buf))).raw(identity.buf...)
+		w.null().null() // UserTokenSignature
+	})
+
+	// Read the NamespaceArray (i=2255)
+	r = c.service(631, 634, func(w *wireWriter) {
+		w.f64(0).i32(3) // MaxAge, TimestampsToReturn: Neither
+		w.i32(1).fourByteID(2255).u32(13).null().u16(0).null()
+	})
+	if n := r.i32(); n != 1 {
+		t.Fatalf("Read returned %d results, want 1", n)
+	}
+	if mask := r.u8(); mask&0x01 == 0 {
+		t.Fatalf("DataValue mask = %#02x, want a value", mask)
+	}
+	if variant := r.u8(); variant != 0x8C {
+		t.Fatalf("Variant encoding = %#02x, want a String array (0x8C)", variant)
+	}
+	var namespaces []string
+	for n := r.i32(); n > 0; n-- {
+		namespaces = append(namespaces, r.str())
+	}
+	if want := []string{"http://opcfoundation.org/UA/", "urn:iotstudio"}; !reflect.DeepEqual(namespaces, want) {
+		t.Errorf("NamespaceArray = %v, want %v", namespaces, want)
+	}
+
+	// Write a Double to a string NodeId in namespace 1
+	r = c.service(673, 676, func(w *wireWriter) {
+		w.i32(1).raw(0x03).u16(1).str("s1/d1/temperature").u32(13).null()
+		w.raw(0x01, 0x0B).f64(21.5) // DataValue with a Double Variant
+	})
+	if n, status := r.i32(), r.u32(); n != 1 || status != StatusGood {
+		t.Errorf("Write results = %d, 0x%08X, want one Good", n, status)
+	}
+	if want := []registerWrite{{unitID: 3, address: 10, values: []uint16{215}}}; !reflect.DeepEqual(modbus.writes, want) {
+		t.Errorf("register writes = %+v, want %+v", modbus.writes, want)
+	}
+
+	// CloseSession, then CloseSecureChannel, after which the server hangs up
+	c.service(473, 476, func(w *wireWriter) { w.raw(0x01) })
+	c.sequence++
+	closing := (&wireWriter{}).u32(c.channelID).u32(c.tokenID).u32(c.sequence).u32(c.sequence)
+	closing.fourByteID(452).requestHeader(c.token, c.sequence)
+	frame := append([]byte("CLOF"), binary.LittleEndian.AppendUint32(nil, uint32(8+len(closing.buf)))...)
+	if _, err := conn.Write(append(frame, closing.buf...)); err != nil {
+		t.Fatalf("write CLO: %v", err)
+	}
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() after CLO = %d, %v, want EOF", n, err)
+	}
+}
@@ -0,0 +1,283 @@
+package opcua
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/iotstudio/iotstudio/internal/parser"
+	"github.com/rs/zerolog/log"
+)
+
+// RegisterWriter is implemented by ModbusTCPHandler and ModbusRTUHandler
+type RegisterWriter interface {
+	WriteSingleCoil(ctx context.Context, unitID uint8, address uint16, outputValue bool) error
+	WriteSingleRegister(ctx context.Context, unitID uint8, address, value uint16) error
+	WriteMultipleRegisters(ctx context.Context, unitID uint8, address uint16, values []uint16) error
+	MaskWriteRegister(ctx context.Context, unitID uint8, address, andMask, orMask uint16) error
+}
+
+var (
+	errTypeMismatch = errors.New("value type does not match field")
+	errOutOfRange   = errors.New("value out of range for field")
+)
+
+// writeField converts an OPC UA value into register contents for the field
+// and writes it to the device, returning the OPC UA status of the operation.
+func writeField(ctx context.Context, writer RegisterWriter, device *models.Device, field models.ParserField, value interface{}) uint32 {
+	unitID, err := strconv.Atoi(strings.TrimSpace(device.Address))
+	if err != nil || unitID < 0 || unitID > math.MaxUint8 {
+		log.Warn().Str("device", device.ID).Str("address", device.Address).Msg("device address is not a Modbus unit ID")
+		return StatusBadConfigurationError
+	}
+	if field.Register < 0 || field.Register > math.MaxUint16 {
+		return StatusBadOutOfRange
+	}
+	address := uint16(field.Register)
+
+	if field.RegisterType == "coil" {
+		on, ok := value.(bool)
+		if !ok {
+			number, isNumber := toFloat(value)
+			if !isNumber {
+				return StatusBadTypeMismatch
+			}
+			on = number != 0
+		}
+		if err := writer.WriteSingleCoil(ctx, uint8(unitID), address, on); err != nil {
+			log.Error().Err(err).Str("device", device.ID).Str("field", field.Name).Msg("coil write failed")
+			return StatusBadCommunicationError
+		}
+		return StatusGood
+	}
+
+	if parser.IsBitField(field) {
+		andMask, orMask, err := encodeBitField(field, value)
+		switch {
+		case errors.Is(err, errTypeMismatch):
+			return StatusBadTypeMismatch
+		case errors.Is(err, errOutOfRange):
+			return StatusBadOutOfRange
+		case err != nil:
+			return StatusBadNotWritable
+		}
+		// Mask Write Register changes only the field's bits, leaving the
+		// rest of the register as the device holds it
+		if err := writer.MaskWriteRegister(ctx, uint8(unitID), address, andMask, orMask); err != nil {
+			log.Error().Err(err).Str("device", device.ID).Str("field", field.Name).Msg("register mask write failed")
+			return StatusBadCommunicationError
+		}
+		return StatusGood
+	}
+
+	registers, err := encodeRegisters(field, value)
+	switch {
+	case errors.Is(err, errTypeMismatch):
+		return StatusBadTypeMismatch
+	case errors.Is(err, errOutOfRange):
+		return StatusBadOutOfRange
+	case err != nil:
+		return StatusBadNotWritable
+	}
+
+	if len(registers) == 1 {
+		err = writer.WriteSingleRegister(ctx, uint8(unitID), address, registers[0])
+	} else {
+		err = writer.WriteMultipleRegisters(ctx, uint8(unitID), address, registers)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("device", device.ID).Str("field", field.Name).Msg("register write failed")
+		return StatusBadCommunicationError
+	}
+	return StatusGood
+}
+
+// encodeRegisters reverses the field's scale and offset and lays the raw
+// value out the way the parser reads it back.
+func encodeRegisters(field models.ParserField, value interface{}) ([]uint16, error) {
+	number, ok := toFloat(value)
+	if !ok {
+		return nil, errTypeMismatch
+	}
+
+	scale := field.Scale
+	if scale == 0 {
+		scale = 1.0
+	}
+	raw := (number - field.ValueOffset) / scale
+
+	var data []byte
+	switch field.DataType {
+	case "uint16", "int16":
+		min, max := integerRange(field.DataType)
+		rounded := math.Round(raw)
+		if rounded < min || rounded > max {
+			return nil, errOutOfRange
+		}
+		data = make([]byte, 2)
+		binary.BigEndian.PutUint16(data, uint16(int64(rounded)))
+	case "uint32", "int32":
+		min, max := integerRange(field.DataType)
+		rounded := math.Round(raw)
+		if rounded < min || rounded > max {
+			return nil, errOutOfRange
+		}
+		data = make([]byte, 4)
+		binary.BigEndian.PutUint32(data, uint32(int64(rounded)))
+	case "uint64", "int64":
+		min, max := integerRange(field.DataType)
+		rounded := math.Round(raw)
+		if rounded < min || rounded >= max {
+			return nil, errOutOfRange
+		}
+		data = make([]byte, 8)
+		if field.DataType == "uint64" {
+			binary.BigEndian.PutUint64(data, uint64(rounded))
+		} else {
+			binary.BigEndian.PutUint64(data, uint64(int64(rounded)))
+		}
+	case "float32":
+		if math.Abs(raw) > math.MaxFloat32 {
+			return nil, errOutOfRange
+		}
+		data = make([]byte, 4)
+		binary.BigEndian.PutUint32(data, math.Float32bits(float32(raw)))
+	case "float64":
+		data = make([]byte, 8)
+		binary.BigEndian.PutUint64(data, math.Float64bits(raw))
+	default:
+		return nil, errors.New("unsupported data type for register write: " + field.DataType)
+	}
+
+	data, err := parser.ApplyByteOrder(field, data)
+	if err != nil {
+		return nil, err
+	}
+
+	registers := make([]uint16, len(data)/2)
+	for i := range registers {
+		registers[i] = binary.BigEndian.Uint16(data[i*2 : i*2+2])
+	}
+	return registers, nil
+}
+
+// encodeBitField returns the Mask Write Register masks that store value in
+// the field's bits of its holding register. The container must fit in the
+// register: a two-byte container is the whole register, read with the
+// field's byte order, and a one-byte container is its high byte at an even
+// Offset and its low byte at an odd one.
+func encodeBitField(field models.ParserField, value interface{}) (andMask, orMask uint16, err error) {
+	layout, err := parser.BitFieldLayoutOf(field)
+	if err != nil {
+		return 0, 0, err
+	}
+	if layout.Size > 2 {
+		return 0, 0, fmt.Errorf("%d-byte bit field container spans several registers", layout.Size)
+	}
+
+	number, ok := toFloat(value)
+	if !ok {
+		return 0, 0, errTypeMismatch
+	}
+	// Single bits decode as booleans, without scale and offset
+	raw := number
+	if layout.Width > 1 || layout.Signed {
+		scale := field.Scale
+		if scale == 0 {
+			scale = 1.0
+		}
+		raw = math.Round((number - field.ValueOffset) / scale)
+	}
+
+	min, max := 0.0, float64(uint64(1)<<layout.Width-1)
+	if layout.Signed {
+		min, max = -float64(uint64(1)<<(layout.Width-1)), float64(uint64(1)<<(layout.Width-1)-1)
+	}
+	if raw < min || raw > max {
+		return 0, 0, errOutOfRange
+	}
+
+	fieldMask := uint64(1)<<layout.Width - 1
+	bits := uint64(int64(raw)) & fieldMask
+
+	// Place the bits in the container as the parser reads them, then undo
+	// the byte order to get the register as it is on the wire
+	container := make([]byte, layout.Size)
+	mask := make([]byte, layout.Size)
+	for i := range container {
+		shift := 8 * (layout.Size - 1 - i)
+		container[i] = byte(bits << layout.Shift >> shift)
+		mask[i] = byte(fieldMask << layout.Shift >> shift)
+	}
+	if container, err = parser.ApplyByteOrder(field, container); err != nil {
+		return 0, 0, err
+	}
+	if mask, err = parser.ApplyByteOrder(field, mask); err != nil {
+		return 0, 0, err
+	}
+
+	var registerBits, registerMask uint16
+	if layout.Size == 2 {
+		registerBits, registerMask = binary.BigEndian.Uint16(container), binary.BigEndian.Uint16(mask)
+	} else {
+		registerBits, registerMask = uint16(container[0]), uint16(mask[0])
+		if field.Offset%2 == 0 {
+			registerBits, registerMask = registerBits<<8, registerMask<<8
+		}
+	}
+	return ^registerMask, registerBits, nil
+}
+
+func integerRange(dataType string) (float64, float64) {
+	switch dataType {
+	case "uint16":
+		return 0, math.MaxUint16
+	case "int16":
+		return math.MinInt16, math.MaxInt16
+	case "uint32":
+		return 0, math.MaxUint32
+	case "uint64":
+		return 0, math.MaxUint64
+	case "int64":
+		return math.MinInt64, math.MaxInt64
+	default:
+		return math.MinInt32, math.MaxInt32
+	}
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case byte:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,299 @@
+package parser
+
+import (
+	"fmt"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+// DataTypeGroup marks a field whose value is built from its sub-fields
+const DataTypeGroup = "group"
+
+// MaxArrayCount is the most elements an array field may have, whether its
+// count is fixed or read from the frame
+const MaxArrayCount = 65536
+
+// Array modes for ParserField.ArrayMode
+const (
+	ArrayModeArray   = "array"   // one value holding a JSON array (default)
+	ArrayModeIndexed = "indexed" // one value per element named name[i]
+)
+
+// isRepeated reports whether the field decodes to more than a single scalar
+func isRepeated(field models.ParserField) bool {
+	return field.Count > 0 || field.CountField != "" || field.DataType == DataTypeGroup
+}
+
+// decodeField parses the field into out and returns the offset just past
+// it. Arrays and groups either produce a single array or object value, or,
+// in indexed mode, one entry per element named name[i] (and name[i].sub for
+// group members).
+func (e *Engine) decodeField(field models.ParserField, data []byte, out map[string]interface{}, sc *scope) (int, error) {
+	resolved, err := sc.resolve(field, data)
+	if err != nil {
+		if sc.trace != nil {
+			sc.trace.add(sc, field, field.Offset, field.Offset, err)
+			return field.Offset, nil
+		}
+		return 0, err
+	}
+	field = resolved
+
+	switch field.DataType {
+	case DataTypeVariant:
+		end, err := e.decodeVariant(field, data, out, sc)
+		if err != nil && sc.trace != nil {
+			sc.trace.add(sc, field, field.Offset, field.Offset, err)
+			return field.Offset, nil
+		}
+		return end, err
+	case DataTypeExpression:
+		sc.expressions = append(sc.expressions, pendingExpression{field: field, out: out, deviceID: sc.deviceID})
+		return field.Offset, nil
+	}
+
+	if sc.trace == nil {
+		return e.decodeValue(field, data, out, sc)
+	}
+
+	// Containers are listed before their members
+	entry := sc.trace.add(sc, field, field.Offset, field.Offset, nil)
+	end, err := e.decodeValue(field, data, out, sc)
+	if err != nil {
+		sc.trace.update(entry, sc, field, field.Offset, err)
+		return field.Offset, nil
+	}
+	sc.trace.update(entry, sc, field, end, nil)
+	return end, nil
+}
+
+// decodeValue decodes a resolved field that occupies bytes of the frame
+func (e *Engine) decodeValue(field models.ParserField, data []byte, out map[string]interface{}, sc *scope) (int, error) {
+	var err error
+
+	if !isRepeated(field) {
+		var value interface{}
+		end := field.Offset
+		if field.LengthField != "" && field.ArrayLength == 0 {
+			value = emptyValue(field)
+		} else {
+			if value, err = e.parseField(field, data); err != nil {
+				return 0, err
+			}
+			end += fieldSize(field, data)
+		}
+		out[field.Name] = value
+		sc.record(field.Name, value, end)
+		return end, nil
+	}
+
+	elements, end, err := e.parseElements(field, data, sc)
+	if err != nil {
+		return 0, err
+	}
+
+	var value interface{} = elements
+	if field.Count == 0 && field.CountField == "" {
+		value = elements[0]
+	}
+	sc.record(field.Name, value, end)
+
+	switch field.ArrayMode {
+	case "", ArrayModeArray:
+		out[field.Name] = value
+	case ArrayModeIndexed:
+		for i, element := range elements {
+			name := fmt.Sprintf("%s[%d]", field.Name, i)
+			if members, ok := element.(map[string]interface{}); ok && field.DataType == DataTypeGroup {
+				for member, value := range members {
+					out[name+"."+member] = value
+				}
+				continue
+			}
+			out[name] = element
+		}
+	default:
+		return 0, fmt.Errorf("unknown array mode: %s", field.ArrayMode)
+	}
+	return end, nil
+}
+
+// parseElements decodes Count elements spaced Stride bytes apart and returns
+// them with the offset just past the last one. Without a stride, elements
+// follow each other directly, which also allows variable-length groups; bit
+// fields then advance by their bit width within the same container.
+func (e *Engine) parseElements(field models.ParserField, data []byte, sc *scope) ([]interface{}, int, error) {
+	count := field.Count
+	if count == 0 && field.CountField == "" {
+		count = 1
+	}
+
+	bitStride := 0
+	if field.Stride == 0 && field.DataType != DataTypeGroup {
+		if IsBitField(field) {
+			bitStride = max(field.BitWidth, 1)
+		} else if elementSize(field) == 0 && count > 1 {
+			return nil, 0, fmt.Errorf("stride required for %s arrays", field.DataType)
+		}
+	}
+	if err := checkCount(field, count, bitStride, data); err != nil {
+		return nil, 0, err
+	}
+
+	elements := make([]interface{}, count)
+	offset, end := field.Offset, field.Offset
+	for i := range elements {
+		element := field
+		element.Count = 0
+		element.CountField = ""
+		element.Stride = 0
+		element.Offset = offset
+		if field.Stride > 0 {
+			element.Offset = field.Offset + i*field.Stride
+		}
+		element.BitOffset = field.BitOffset + i*bitStride
+
+		var (
+			value      interface{}
+			elementEnd int
+			err        error
+		)
+		if field.DataType == DataTypeGroup {
+			if field.Count > 0 || field.CountField != "" {
+				element.Name = fmt.Sprintf("%s[%d]", field.Name, i)
+			}
+			value, elementEnd, err = e.parseGroup(element, data, sc)
+		} else {
+			value, err = e.parseField(element, data)
+			elementEnd = element.Offset + fieldSize(element, data)
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("element %d: %w", i, err)
+		}
+		elements[i] = value
+
+		if bitStride == 0 {
+			offset = elementEnd
+		}
+		end = max(end, elementEnd)
+	}
+	if field.Stride > 0 {
+		end = max(end, field.Offset+count*field.Stride)
+	}
+	return elements, end, nil
+}
+
+// checkCount rejects counts the frame cannot hold before any element is
+// allocated. Each element takes at least its stride, its size or bit width,
+// or one byte for groups.
+func checkCount(field models.ParserField, count, bitStride int, data []byte) error {
+	if count > MaxArrayCount {
+		return fmt.Errorf("count %d exceeds the limit of %d", count, MaxArrayCount)
+	}
+	if count <= 1 {
+		return nil
+	}
+
+	remaining := max(len(data)-field.Offset, 0)
+	fits := true
+	switch {
+	case field.Stride > 0:
+		fits = remaining > 0 && count-1 <= (remaining-1)/field.Stride
+	case bitStride > 0:
+		fits = count <= (remaining*8-field.BitOffset)/bitStride
+	default:
+		fits = count <= remaining/max(elementSize(field), 1)
+	}
+	if !fits {
+		return fmt.Errorf("count %d does not fit in the %d bytes left in the frame", count, remaining)
+	}
+	return nil
+}
+
+// ValidateArrays checks the fixed counts and strides of the fields and
+// their members
+func ValidateArrays(fields []models.ParserField) error {
+	for _, field := range fields {
+		if field.Count < 0 || field.Count > MaxArrayCount {
+			return fmt.Errorf("field %s: count must be between 0 and %d", field.Name, MaxArrayCount)
+		}
+		if field.Stride < 0 {
+			return fmt.Errorf("field %s: stride must not be negative", field.Name)
+		}
+		if err := ValidateArrays(field.Fields); err != nil {
+			return err
+		}
+		for _, variant := range field.Variants {
+			if err := ValidateArrays(variant.Fields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseGroup decodes the group's sub-fields, whose offsets are relative to
+// the start of the group unless they follow another field. Members are
+// decoded in their own scope, so each element can refer to its own length
+// and type fields.
+func (e *Engine) parseGroup(group models.ParserField, data []byte, parent *scope) (map[string]interface{}, int, error) {
+	sc := newScope(parent)
+	sc.prefix = parent.prefix + group.Name + "."
+	members := make(map[string]interface{}, len(group.Fields))
+	end := group.Offset
+	for _, member := range group.Fields {
+		if member.After == "" {
+			member.Offset += group.Offset
+		}
+		memberEnd, err := e.decodeField(member, data, members, sc)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", member.Name, err)
+		}
+		end = max(end, memberEnd)
+	}
+	if err := e.evaluateExpressions(sc); err != nil {
+		return nil, 0, err
+	}
+	return members, end, nil
+}
+
+// elementSize returns the number of bytes a single field occupies, or 0 if
+// it cannot be determined from the field definition.
+func elementSize(field models.ParserField) int {
+	if size := numericSize(field.DataType); size > 0 {
+		return size
+	}
+	switch field.DataType {
+	case "ascii_int":
+		if field.ArrayLength == 0 {
+			return 4
+		}
+	case "ascii_decimal":
+		if field.ArrayLength == 0 {
+			return 8
+		}
+	}
+	return field.ArrayLength
+}
+
+// fieldSize returns the number of bytes a decoded scalar field consumed.
+// Strings and raw bytes without a length run to the end of the frame.
+func fieldSize(field models.ParserField, data []byte) int {
+	if IsBitField(field) {
+		if size, _ := bitContainer(field.DataType); size > 0 {
+			return size
+		}
+		return (field.BitOffset + max(field.BitWidth, 1) + 7) / 8
+	}
+	if size := elementSize(field); size > 0 {
+		return size
+	}
+	return max(len(data)-field.Offset, 0)
+}
+
+func emptyValue(field models.ParserField) interface{} {
+	if field.DataType == "raw_bytes" {
+		return []byte{}
+	}
+	return ""
+}
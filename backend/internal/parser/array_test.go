@@ -0,0 +1,199 @@
+package parser
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+func TestParseArrays(t *testing.T) {
+	// Two channels of 6 bytes: status uint16, value float32
+	channels := []byte{
+		0x00, 0x01, 0x3F, 0xC0, 0x00, 0x00,
+		0x00, 0x02, 0xC0, 0x20, 0x00, 0x00,
+	}
+	channel := models.ParserField{
+		Name:     "ch",
+		DataType: DataTypeGroup,
+		Count:    2,
+		Fields: []models.ParserField{
+			{Name: "status", DataType: "uint16", Offset: 0},
+			{Name: "value", DataType: "float32", Offset: 2},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		field models.ParserField
+		data  []byte
+		want  map[string]interface{}
+		bad   []string
+	}{
+		{
+			name:  "packed array",
+			field: models.ParserField{Name: "level", DataType: "uint16", Count: 3},
+			data:  []byte{0, 1, 0, 2, 0, 3},
+			want:  map[string]interface{}{"level": []interface{}{1.0, 2.0, 3.0}},
+		},
+		{
+			name:  "strided array",
+			field: models.ParserField{Name: "level", DataType: "uint8", Offset: 1, Count: 3, Stride: 2, Scale: 0.5},
+			data:  []byte{0xFF, 2, 0xFF, 4, 0xFF, 6},
+			want:  map[string]interface{}{"level": []interface{}{1.0, 2.0, 3.0}},
+		},
+		{
+			name:  "indexed array",
+			field: models.ParserField{Name: "level", DataType: "int16", Count: 2, ArrayMode: ArrayModeIndexed},
+			data:  []byte{0xFF, 0xFF, 0x00, 0x07},
+			want:  map[string]interface{}{"level[0]": -1.0, "level[1]": 7.0},
+		},
+		{
+			name:  "bit array",
+			field: models.ParserField{Name: "alarm", DataType: "bool", Count: 4},
+			data:  []byte{0x05},
+			want:  map[string]interface{}{"alarm": []interface{}{true, false, true, false}},
+		},
+		{
+			name:  "group array",
+			field: channel,
+			data:  channels,
+			want: map[string]interface{}{"ch": []interface{}{
+				map[string]interface{}{"status": 1.0, "value": 1.5},
+				map[string]interface{}{"status": 2.0, "value": -2.5},
+			}},
+		},
+		{
+			name: "indexed group",
+			field: func() models.ParserField {
+				f := channel
+				f.ArrayMode = ArrayModeIndexed
+				return f
+			}(),
+			data: channels,
+			want: map[string]interface{}{
+				"ch[0].status": 1.0, "ch[0].value": 1.5,
+				"ch[1].status": 2.0, "ch[1].value": -2.5,
+			},
+		},
+		{
+			name: "single group",
+			field: models.ParserField{Name: "header", DataType: DataTypeGroup, Offset: 1, Fields: []models.ParserField{
+				{Name: "version", DataType: "uint8"},
+				{Name: "flags", DataType: "uint8", Offset: 1},
+			}},
+			data: []byte{0xFF, 2, 9},
+			want: map[string]interface{}{"header": map[string]interface{}{"version": 2.0, "flags": 9.0}},
+		},
+		{
+			name: "nested arrays",
+			field: models.ParserField{Name: "module", DataType: DataTypeGroup, Count: 2, Fields: []models.ParserField{
+				{Name: "id", DataType: "uint8"},
+				{Name: "inputs", DataType: "uint8", Offset: 1, Count: 2},
+			}},
+			data: []byte{1, 10, 11, 2, 20, 21},
+			want: map[string]interface{}{"module": []interface{}{
+				map[string]interface{}{"id": 1.0, "inputs": []interface{}{10.0, 11.0}},
+				map[string]interface{}{"id": 2.0, "inputs": []interface{}{20.0, 21.0}},
+			}},
+		},
+		{
+			name:  "element out of range",
+			field: models.ParserField{Name: "level", DataType: "uint16", Count: 4},
+			data:  []byte{0, 1, 0, 2, 0, 3},
+			want:  map[string]interface{}{},
+			bad:   []string{"level"},
+		},
+		{
+			name:  "count beyond the limit",
+			field: models.ParserField{Name: "level", DataType: "uint8", Count: MaxArrayCount + 1},
+			data:  []byte{0, 1, 0, 2},
+			want:  map[string]interface{}{},
+			bad:   []string{"level"},
+		},
+		{
+			name:  "strided count beyond the frame",
+			field: models.ParserField{Name: "level", DataType: "uint8", Offset: 1, Count: 4, Stride: 2},
+			data:  []byte{0xFF, 2, 0xFF, 4, 0xFF, 6},
+			want:  map[string]interface{}{},
+			bad:   []string{"level"},
+		},
+		{
+			name:  "string array without length",
+			field: models.ParserField{Name: "tag", DataType: "string", Count: 2},
+			data:  []byte("abcd"),
+			want:  map[string]interface{}{},
+			bad:   []string{"tag"},
+		},
+	}
+
+	engine := NewEngine()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &models.Parser{Fields: []models.ParserField{tt.field}}
+
+			result, err := engine.Parse(context.Background(), p, tt.data)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if got := result.DeviceData[""]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DeviceData = %v, want %v", got, tt.want)
+			}
+			checkBadFields(t, result, tt.bad)
+		})
+	}
+}
+
+func TestParseOversizedCountField(t *testing.T) {
+	// A count of 0x7FFFFFFF in a 6-byte frame must not be allocated
+	p := &models.Parser{Fields: []models.ParserField{
+		{Name: "count", DataType: "uint32", Endianness: "big"},
+		{Name: "values", DataType: "uint8", Offset: 4, CountField: "count"},
+		{Name: "group", DataType: DataTypeGroup, Offset: 4, CountField: "count", Fields: []models.ParserField{
+			{Name: "value", DataType: "uint8"},
+		}},
+	}}
+
+	result, err := NewEngine().Parse(context.Background(), p, []byte{0x7F, 0xFF, 0xFF, 0xFF, 1, 2})
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if got := result.DeviceData[""]; !reflect.DeepEqual(got, map[string]interface{}{"count": float64(0x7FFFFFFF)}) {
+		t.Errorf("DeviceData = %v, want only the count", got)
+	}
+	checkBadFields(t, result, []string{"values", "group"})
+}
+
+func TestValidateArrays(t *testing.T) {
+	valid := []models.ParserField{{Name: "level", DataType: "uint8", Count: MaxArrayCount}}
+	if err := ValidateArrays(valid); err != nil {
+		t.Errorf("ValidateArrays() error = %v", err)
+	}
+
+	invalid := [][]models.ParserField{
+		{{Name: "level", DataType: "uint8", Count: MaxArrayCount + 1}},
+		{{Name: "level", DataType: "uint8", Count: -1}},
+		{{Name: "group", DataType: DataTypeGroup, Fields: []models.ParserField{{Name: "level", DataType: "uint8", Count: 2, Stride: -1}}}},
+	}
+	for _, fields := range invalid {
+		if err := ValidateArrays(fields); err == nil {
+			t.Errorf("ValidateArrays(%+v) accepted an invalid array", fields)
+		}
+	}
+}
+
+// checkBadFields verifies that exactly the named fields of the default
+// device were reported as bad
+func checkBadFields(t *testing.T, result *ParserResult, bad []string) {
+	t.Helper()
+	quality := result.Quality[""]
+	if len(quality) != len(bad) {
+		t.Errorf("Quality = %v, want bad fields %v", quality, bad)
+	}
+	for _, name := range bad {
+		if q := quality[name]; q.Quality != models.QualityBad || q.Error == "" {
+			t.Errorf("Quality[%s] = %+v, want bad with error", name, q)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package parser
+
+import (
+	"fmt"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+// Bit orders for ParserField.BitOrder
+const (
+	BitOrderLSB = "lsb" // bit 0 is the least significant bit of the container (default)
+	BitOrderMSB = "msb" // bit 0 is the most significant bit of the container
+)
+
+// IsBitField reports whether the field selects bits rather than whole bytes.
+// A bit range covering a whole integer, or set on a non-integer type, is
+// decoded as the plain value.
+func IsBitField(field models.ParserField) bool {
+	if field.DataType == "bool" || field.DataType == "bits" {
+		return true
+	}
+	size, _ := bitContainer(field.DataType)
+	if size <= 0 || field.BitWidth == 0 {
+		return false
+	}
+	return field.BitOffset != 0 || field.BitWidth != size*8
+}
+
+// parseBitField extracts BitWidth bits at BitOffset from the container that
+// starts at Offset. Integer types use their own size as the container, read
+// with the field's byte order; "bool" and "bits" use the smallest number of
+// bytes covering the selected bits, so fields can span byte boundaries.
+// Single bits decode as booleans, signed types are sign-extended.
+func parseBitField(field models.ParserField, data []byte) (interface{}, error) {
+	layout, err := BitFieldLayoutOf(field)
+	if err != nil {
+		return nil, err
+	}
+	size, width, signed := layout.Size, layout.Width, layout.Signed
+	if field.Offset+size > len(data) {
+		return nil, fmt.Errorf("insufficient data for %d-byte bit field container", size)
+	}
+
+	ordered, err := ApplyByteOrder(field, data[field.Offset:field.Offset+size])
+	if err != nil {
+		return nil, err
+	}
+	var container uint64
+	for _, b := range ordered {
+		container = container<<8 | uint64(b)
+	}
+
+	raw := container >> layout.Shift
+	if width < 64 {
+		raw &= 1<<width - 1
+	}
+
+	if width == 1 && !signed {
+		return raw == 1, nil
+	}
+
+	if signed && width < 64 && raw&(1<<(width-1)) != 0 {
+		return applyTransform(float64(int64(raw)-int64(1)<<width), field.Scale, field.ValueOffset), nil
+	}
+	if signed {
+		return applyTransform(float64(int64(raw)), field.Scale, field.ValueOffset), nil
+	}
+	return applyTransform(float64(raw), field.Scale, field.ValueOffset), nil
+}
+
+// BitFieldLayout locates a bit field within its container
+type BitFieldLayout struct {
+	Size   int // container size in bytes
+	Shift  int // position of the field's least significant bit in the container
+	Width  int // in bits
+	Signed bool
+}
+
+// BitFieldLayoutOf resolves the container size, bit order and width of a
+// bit field, validating its bit range
+func BitFieldLayoutOf(field models.ParserField) (BitFieldLayout, error) {
+	width := field.BitWidth
+	if width == 0 {
+		width = 1
+	}
+	if width > 64 || field.BitOffset < 0 {
+		return BitFieldLayout{}, fmt.Errorf("invalid bit range %d+%d", field.BitOffset, width)
+	}
+
+	size, signed := bitContainer(field.DataType)
+	if size == 0 {
+		return BitFieldLayout{}, fmt.Errorf("data type %s does not support bit fields", field.DataType)
+	}
+	if size < 0 {
+		size = (field.BitOffset + width + 7) / 8
+	}
+
+	containerBits := size * 8
+	if field.BitOffset+width > containerBits || size > 8 {
+		return BitFieldLayout{}, fmt.Errorf("bit range %d+%d exceeds %d-bit container", field.BitOffset, width, containerBits)
+	}
+
+	layout := BitFieldLayout{Size: size, Width: width, Signed: signed}
+	switch field.BitOrder {
+	case "", BitOrderLSB:
+		layout.Shift = field.BitOffset
+	case BitOrderMSB:
+		layout.Shift = containerBits - field.BitOffset - width
+	default:
+		return BitFieldLayout{}, fmt.Errorf("unknown bit order: %s", field.BitOrder)
+	}
+	return layout, nil
+}
+
+// bitContainer returns the container size in bytes for a data type, -1 for
+// types sized by the bit range and 0 for types without bit field support.
+func bitContainer(dataType string) (size int, signed bool) {
+	switch dataType {
+	case "uint8":
+		return 1, false
+	case "int8":
+		return 1, true
+	case "uint16":
+		return 2, false
+	case "int16":
+		return 2, true
+	case "uint32":
+		return 4, false
+	case "int32":
+		return 4, true
+	case "bool", "bits":
+		return -1, false
+	default:
+		return 0, false
+	}
+}
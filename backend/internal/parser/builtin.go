@@ -7,4 +7,5 @@ const (
 	BuiltInInt16Unsigned = "int16_unsigned"
 	BuiltInInt32Signed   = "int32_signed"
 	BuiltInRawBytes      = "raw_bytes"
+	BuiltInJSON          = "json"
 )
@@ -0,0 +1,149 @@
+package parser
+
+import (
+	"fmt"
+	"hash/crc32"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/iotstudio/iotstudio/internal/protocols/modbus"
+)
+
+// Checksum algorithms for models.Checksum
+const (
+	ChecksumCRC16Modbus = "crc16_modbus"
+	ChecksumCRC16CCITT  = "crc16_ccitt"
+	ChecksumCRC32       = "crc32"
+	ChecksumLRC         = "lrc"
+	ChecksumXOR         = "xor"
+	ChecksumSum8        = "sum8"
+)
+
+// ChecksumError reports a frame whose checksum does not match its contents
+type ChecksumError struct {
+	Algorithm string
+	Expected  uint32 // checksum carried in the frame
+	Actual    uint32 // checksum calculated over the covered bytes
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch: frame has %#x, calculated %#x", e.Algorithm, e.Expected, e.Actual)
+}
+
+// ValidateChecksum verifies the frame against the checksum definition and
+// returns a *ChecksumError if it does not match.
+func ValidateChecksum(checksum *models.Checksum, data []byte) error {
+	size, calculate, err := checksumAlgorithm(checksum.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	offset := -size
+	if checksum.Offset != nil {
+		offset = *checksum.Offset
+	}
+	if offset < 0 {
+		offset += len(data)
+	}
+	if offset < 0 || offset+size > len(data) {
+		return fmt.Errorf("checksum at offset %d outside frame of %d bytes", offset, len(data))
+	}
+
+	start, end := checksum.Start, checksum.End
+	if start < 0 {
+		start += len(data)
+	}
+	// A range starting at a leading checksum covers the bytes after it
+	if offset <= start && start < offset+size {
+		start = offset + size
+	}
+	switch {
+	case end == 0 && offset < start:
+		end = len(data)
+	case end == 0:
+		end = offset
+	case end < 0:
+		end += len(data)
+	}
+	if start < 0 || start > end || end > len(data) {
+		return fmt.Errorf("checksum range %d..%d outside frame of %d bytes", checksum.Start, checksum.End, len(data))
+	}
+	if start == end {
+		return fmt.Errorf("checksum range %d..%d covers no bytes of the %d byte frame", checksum.Start, checksum.End, len(data))
+	}
+
+	// The Modbus CRC is transmitted low byte first, everything else defaults
+	// to network byte order.
+	little := checksum.Algorithm == ChecksumCRC16Modbus
+	switch checksum.Endianness {
+	case "little":
+		little = true
+	case "big":
+		little = false
+	}
+
+	var expected uint32
+	for i := 0; i < size; i++ {
+		b := data[offset+i]
+		if little {
+			expected |= uint32(b) << (8 * i)
+		} else {
+			expected = expected<<8 | uint32(b)
+		}
+	}
+
+	actual := calculate(data[start:end])
+	if actual != expected {
+		return &ChecksumError{Algorithm: checksum.Algorithm, Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+// checksumAlgorithm returns the checksum size in bytes and its function
+func checksumAlgorithm(name string) (int, func([]byte) uint32, error) {
+	switch name {
+	case ChecksumCRC16Modbus:
+		return 2, func(b []byte) uint32 { return uint32(modbus.CalculateCRC16(b)) }, nil
+	case ChecksumCRC16CCITT:
+		return 2, func(b []byte) uint32 { return uint32(crc16CCITT(b)) }, nil
+	case ChecksumCRC32:
+		return 4, crc32.ChecksumIEEE, nil
+	case ChecksumLRC:
+		return 1, func(b []byte) uint32 { return uint32(-sum8(b)) }, nil
+	case ChecksumXOR:
+		return 1, func(b []byte) uint32 {
+			var x byte
+			for _, v := range b {
+				x ^= v
+			}
+			return uint32(x)
+		}, nil
+	case ChecksumSum8:
+		return 1, func(b []byte) uint32 { return uint32(sum8(b)) }, nil
+	default:
+		return 0, nil, fmt.Errorf("unknown checksum algorithm: %s", name)
+	}
+}
+
+func sum8(b []byte) byte {
+	var sum byte
+	for _, v := range b {
+		sum += v
+	}
+	return sum
+}
+
+// crc16CCITT computes CRC-16/CCITT-FALSE (polynomial 0x1021, initial 0xFFFF)
+func crc16CCITT(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,89 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+func TestValidateChecksum(t *testing.T) {
+	request := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0A}
+	digits := []byte("123456789")
+	frame := func(parts ...[]byte) []byte {
+		var out []byte
+		for _, p := range parts {
+			out = append(out, p...)
+		}
+		return out
+	}
+	offset := func(n int) *int { return &n }
+
+	tests := []struct {
+		name     string
+		checksum models.Checksum
+		data     []byte
+		mismatch bool
+		wantErr  bool
+	}{
+		{"modbus crc", models.Checksum{Algorithm: ChecksumCRC16Modbus}, frame(request, []byte{0xC5, 0xCD}), false, false},
+		{"modbus crc corrupt", models.Checksum{Algorithm: ChecksumCRC16Modbus}, frame(request, []byte{0xCD, 0xC5}), true, false},
+		{"modbus crc big endian", models.Checksum{Algorithm: ChecksumCRC16Modbus, Endianness: "big"}, frame(request, []byte{0xCD, 0xC5}), false, false},
+		{"crc16 ccitt", models.Checksum{Algorithm: ChecksumCRC16CCITT}, frame(digits, []byte{0x29, 0xB1}), false, false},
+		{"crc32", models.Checksum{Algorithm: ChecksumCRC32}, frame(digits, []byte{0xCB, 0xF4, 0x39, 0x26}), false, false},
+		{"crc32 little endian", models.Checksum{Algorithm: ChecksumCRC32, Endianness: "little"}, frame(digits, []byte{0x26, 0x39, 0xF4, 0xCB}), false, false},
+		{"lrc", models.Checksum{Algorithm: ChecksumLRC}, frame(request, []byte{0xF2}), false, false},
+		{"xor", models.Checksum{Algorithm: ChecksumXOR}, frame(request, []byte{0x08}), false, false},
+		{"sum8", models.Checksum{Algorithm: ChecksumSum8}, frame(request, []byte{0x0E}), false, false},
+		{"sum8 corrupt", models.Checksum{Algorithm: ChecksumSum8}, frame(request, []byte{0x0F}), true, false},
+		{"covered range", models.Checksum{Algorithm: ChecksumXOR, Start: 1, End: 3}, frame([]byte{0x02, 0x10, 0x20, 0x03}, []byte{0x30}), false, false},
+		{"leading checksum", models.Checksum{Algorithm: ChecksumSum8, Offset: offset(1), Start: 2, End: -1}, []byte{0x02, 0x03, 0x01, 0x02, 0x03}, false, false},
+		{"trailer after checksum", models.Checksum{Algorithm: ChecksumSum8, Offset: offset(-2), Start: 1}, []byte{0x02, 0x05, 0x06, 0x0B, 0x03}, false, false},
+		{"checksum at byte 0", models.Checksum{Algorithm: ChecksumXOR, Offset: offset(0), Start: 1}, []byte{0x30, 0x10, 0x20}, false, false},
+		{"checksum at byte 0 corrupt", models.Checksum{Algorithm: ChecksumXOR, Offset: offset(0), Start: 1}, []byte{0x31, 0x10, 0x20}, true, false},
+		{"checksum at byte 0 default range", models.Checksum{Algorithm: ChecksumXOR, Offset: offset(0)}, []byte{0x30, 0x10, 0x20}, false, false},
+		{"checksum at byte 0 default range corrupt", models.Checksum{Algorithm: ChecksumXOR, Offset: offset(0)}, []byte{0x31, 0x10, 0x20}, true, false},
+		{"unknown algorithm", models.Checksum{Algorithm: "md5"}, request, false, true},
+		{"frame too short", models.Checksum{Algorithm: ChecksumCRC32}, []byte{0x01}, false, true},
+		{"range outside frame", models.Checksum{Algorithm: ChecksumXOR, Start: 4, End: 2}, request, false, true},
+		{"empty range", models.Checksum{Algorithm: ChecksumXOR, Start: 3, End: 3}, request, false, true},
+		{"nothing after leading checksum", models.Checksum{Algorithm: ChecksumXOR, Offset: offset(0)}, []byte{0x00}, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateChecksum(&tt.checksum, tt.data)
+
+			var checksumErr *ChecksumError
+			if got := errors.As(err, &checksumErr); got != tt.mismatch {
+				t.Fatalf("ValidateChecksum() error = %v, want mismatch %v", err, tt.mismatch)
+			}
+			if !tt.mismatch && (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateChecksum() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseRejectsCorruptFrames(t *testing.T) {
+	p := &models.Parser{
+		Checksum: &models.Checksum{Algorithm: ChecksumCRC16Modbus},
+		Fields:   []models.ParserField{{Name: "value", DataType: "uint16", Offset: 3}},
+	}
+	engine := NewEngine()
+
+	result, err := engine.Parse(context.Background(), p, []byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B})
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if got := result.DeviceData[""]["value"]; got != 42.0 {
+		t.Errorf("value = %v, want 42", got)
+	}
+
+	_, err = engine.Parse(context.Background(), p, []byte{0x01, 0x03, 0x02, 0x00, 0x2B, 0x39, 0x9B})
+	var checksumErr *ChecksumError
+	if !errors.As(err, &checksumErr) {
+		t.Fatalf("Parse() error = %v, want *ChecksumError", err)
+	}
+}
@@ -0,0 +1,127 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+// Change is a single difference between two parser definitions. Path names
+// the property, e.g. fields.temperature.scale; From is omitted for added
+// properties and To for removed ones.
+type Change struct {
+	Path string      `json:"path"`
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// DiffParsers compares two definitions of a parser. Fields are matched by
+// name, so moving a field is not a change; the ID, version and timestamps
+// are ignored.
+func DiffParsers(from, to *models.Parser) ([]Change, error) {
+	before, err := definition(from)
+	if err != nil {
+		return nil, err
+	}
+	after, err := definition(to)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []Change{}
+	diffValues("", before, after, &changes)
+	return changes, nil
+}
+
+// definition returns the parser as generic JSON values
+func definition(p *models.Parser) (map[string]interface{}, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode parser: %w", err)
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("failed to decode parser: %w", err)
+	}
+	for _, key := range []string{"id", "version", "createdAt", "updatedAt"} {
+		delete(values, key)
+	}
+	return values, nil
+}
+
+func diffValues(path string, from, to interface{}, changes *[]Change) {
+	fromMap, fromIsMap := from.(map[string]interface{})
+	toMap, toIsMap := to.(map[string]interface{})
+	if fromIsMap && toIsMap {
+		diffMaps(path, fromMap, toMap, changes)
+		return
+	}
+
+	fromList, fromIsList := from.([]interface{})
+	toList, toIsList := to.([]interface{})
+	if fromIsList && toIsList {
+		fromNamed, ok := byName(fromList)
+		toNamed, ok2 := byName(toList)
+		if ok && ok2 {
+			diffMaps(path, fromNamed, toNamed, changes)
+			return
+		}
+		for i := 0; i < max(len(fromList), len(toList)); i++ {
+			var a, b interface{}
+			if i < len(fromList) {
+				a = fromList[i]
+			}
+			if i < len(toList) {
+				b = toList[i]
+			}
+			diffValues(fmt.Sprintf("%s[%d]", path, i), a, b, changes)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(from, to) {
+		*changes = append(*changes, Change{Path: path, From: from, To: to})
+	}
+}
+
+func diffMaps(path string, from, to map[string]interface{}, changes *[]Change) {
+	keys := make([]string, 0, len(from)+len(to))
+	for key := range from {
+		keys = append(keys, key)
+	}
+	for key := range to {
+		if _, ok := from[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		child := key
+		if path != "" {
+			child = path + "." + key
+		}
+		diffValues(child, from[key], to[key], changes)
+	}
+}
+
+// byName indexes a list of objects by their name property. It fails if an
+// element has no name or names repeat, e.g. for variants.
+func byName(list []interface{}) (map[string]interface{}, bool) {
+	named := make(map[string]interface{}, len(list))
+	for _, element := range list {
+		object, ok := element.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		name, _ := object["name"].(string)
+		if _, duplicate := named[name]; name == "" || duplicate {
+			return nil, false
+		}
+		named[name] = object
+	}
+	return named, true
+}
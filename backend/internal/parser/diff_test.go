@@ -0,0 +1,57 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+func TestDiffParsers(t *testing.T) {
+	from := &models.Parser{
+		ID:      "p1",
+		Name:    "meter",
+		Version: 1,
+		Fields: []models.ParserField{
+			{Name: "voltage", DataType: "uint16", Scale: 0.1},
+			{Name: "current", DataType: "uint16", Offset: 2},
+		},
+	}
+	to := &models.Parser{
+		ID:       "p1",
+		Name:     "meter",
+		Version:  2,
+		Checksum: &models.Checksum{Algorithm: ChecksumCRC16Modbus},
+		Fields: []models.ParserField{
+			{Name: "current", DataType: "uint16", Offset: 2},
+			{Name: "voltage", DataType: "uint16", Scale: 0.01},
+			{Name: "frequency", DataType: "uint16", Offset: 4},
+		},
+	}
+
+	changes, err := DiffParsers(from, to)
+	if err != nil {
+		t.Fatalf("DiffParsers() error = %v", err)
+	}
+
+	var paths []string
+	for _, change := range changes {
+		paths = append(paths, change.Path)
+	}
+	want := []string{"checksum", "fields.frequency", "fields.voltage.scale"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("paths = %v, want %v", paths, want)
+	}
+
+	if changes[1].From != nil {
+		t.Errorf("added field From = %v, want nil", changes[1].From)
+	}
+	if changes[2].From != 0.1 || changes[2].To != 0.01 {
+		t.Errorf("scale change = %+v, want 0.1 -> 0.01", changes[2])
+	}
+
+	same, err := DiffParsers(from, from)
+	if err != nil || len(same) != 0 {
+		t.Errorf("DiffParsers(same) = %v, %v, want no changes", same, err)
+	}
+}
@@ -3,57 +3,114 @@ package parser
 import (
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"math"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/iotstudio/iotstudio/internal/models"
 )
 
 type ParserResult struct {
 	DeviceData map[string]map[string]interface{}
-	Error      error
+	// Fields that did not decode cleanly, by device ID and field name.
+	// Fields missing here are good; bad fields are missing from DeviceData.
+	Quality map[string]map[string]models.FieldQuality
+	Error   error
+}
+
+func (r *ParserResult) setQuality(deviceID, name string, quality models.FieldQuality) {
+	if r.Quality == nil {
+		r.Quality = make(map[string]map[string]models.FieldQuality)
+	}
+	if r.Quality[deviceID] == nil {
+		r.Quality[deviceID] = make(map[string]models.FieldQuality)
+	}
+	r.Quality[deviceID][name] = quality
 }
 
 type Engine struct {
 	parsers map[string]*models.Parser
+
+	mu            sync.Mutex
+	scripts       map[string]*compiledScript
+	scriptTimeout time.Duration
+	scriptMemory  uint64
+	expressions   map[string]*Expression
 }
 
 func NewEngine() *Engine {
 	return &Engine{
-		parsers: make(map[string]*models.Parser),
+		parsers:       make(map[string]*models.Parser),
+		scripts:       make(map[string]*compiledScript),
+		scriptTimeout: defaultScriptTimeout,
+		scriptMemory:  defaultScriptMemory,
+		expressions:   make(map[string]*Expression),
 	}
 }
 
 func (e *Engine) Parse(ctx context.Context, mparser *models.Parser, data []byte) (*ParserResult, error) {
-	result := &ParserResult{
-		DeviceData: make(map[string]map[string]interface{}),
+	if mparser.Checksum != nil {
+		if err := ValidateChecksum(mparser.Checksum, data); err != nil {
+			return nil, err
+		}
+	}
+
+	if mparser.Type == ParserTypeJavaScript {
+		return e.parseScript(ctx, mparser, data)
 	}
 
 	if mparser.BuiltInType != "" {
 		return e.parseBuiltIn(ctx, mparser, data)
 	}
 
-	deviceFields := make(map[string][]models.ParserField)
-	for _, field := range mparser.Fields {
-		deviceFields[field.DeviceID] = append(deviceFields[field.DeviceID], field)
+	// A field that fails to decode is reported in the result's quality
+	// rather than dropping the whole frame
+	sc := newScope(nil)
+	sc.trace = &tracer{}
+	result, err := e.parseFields(mparser.Fields, data, sc)
+	if err != nil {
+		return nil, err
 	}
+	for _, entry := range sc.trace.fields {
+		if entry.Quality == models.QualityGood {
+			continue
+		}
+		name := entry.Name
+		if name == "" {
+			name = entry.DataType
+		}
+		result.setQuality(entry.DeviceID, name, models.FieldQuality{Quality: entry.Quality, Error: entry.Error})
+	}
+	return result, nil
+}
 
-	for deviceID, fields := range deviceFields {
-		deviceData := make(map[string]interface{})
-
-		for _, field := range fields {
-			value, err := e.parseField(field, data)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse field %s for device %s: %w",
-					field.Name, deviceID, err)
-			}
+// parseFields decodes field definitions in order, so later fields can refer
+// to earlier ones, and then evaluates the expression fields. Unless the
+// scope is traced, the first failing field fails the whole frame.
+func (e *Engine) parseFields(fields []models.ParserField, data []byte, sc *scope) (*ParserResult, error) {
+	result := &ParserResult{
+		DeviceData: make(map[string]map[string]interface{}),
+	}
 
-			deviceData[field.Name] = value
+	for _, field := range fields {
+		deviceData, ok := result.DeviceData[field.DeviceID]
+		if !ok {
+			deviceData = make(map[string]interface{})
+			result.DeviceData[field.DeviceID] = deviceData
 		}
 
-		result.DeviceData[deviceID] = deviceData
+		sc.deviceID = field.DeviceID
+		if _, err := e.decodeField(field, data, deviceData, sc); err != nil {
+			return nil, fmt.Errorf("failed to parse field %s for device %s: %w",
+				field.Name, field.DeviceID, err)
+		}
+	}
+	if err := e.evaluateExpressions(sc); err != nil {
+		return nil, fmt.Errorf("failed to evaluate %w", err)
 	}
 
 	return result, nil
@@ -113,6 +170,38 @@ func (e *Engine) parseBuiltIn(ctx context.Context, mparser *models.Parser, data
 		}
 		result.DeviceData[mparser.Fields[0].DeviceID] = deviceData
 
+	case BuiltInJSON:
+		var payload map[string]interface{}
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return nil, fmt.Errorf("invalid JSON payload: %w", err)
+		}
+
+		// Without field definitions every top-level key is passed through to
+		// the device the payload was received from.
+		if len(mparser.Fields) == 0 {
+			result.DeviceData[""] = payload
+			break
+		}
+
+		for _, field := range mparser.Fields {
+			value, ok := lookupJSONPath(payload, field.Name)
+			if !ok {
+				result.setQuality(field.DeviceID, field.Name, models.FieldQuality{
+					Quality: models.QualityBad,
+					Error:   "not found in JSON payload",
+				})
+				continue
+			}
+			if number, ok := value.(float64); ok {
+				value = applyTransform(number, field.Scale, field.ValueOffset)
+			}
+
+			if result.DeviceData[field.DeviceID] == nil {
+				result.DeviceData[field.DeviceID] = make(map[string]interface{})
+			}
+			result.DeviceData[field.DeviceID][field.Name] = value
+		}
+
 	default:
 		return nil, fmt.Errorf("unknown built-in parser type: %s", mparser.BuiltInType)
 	}
@@ -125,83 +214,15 @@ func (e *Engine) parseField(field models.ParserField, data []byte) (interface{},
 		return nil, fmt.Errorf("offset %d out of bounds", field.Offset)
 	}
 
-	switch field.DataType {
-	case "uint8":
-		if field.Offset+1 > len(data) {
-			return nil, fmt.Errorf("insufficient data for uint8")
-		}
-		value := uint8(data[field.Offset])
-		return applyTransform(float64(value), field.Scale, field.ValueOffset), nil
-
-	case "int8":
-		if field.Offset+1 > len(data) {
-			return nil, fmt.Errorf("insufficient data for int8")
-		}
-		value := int8(data[field.Offset])
-		return applyTransform(float64(value), field.Scale, float64(field.Offset)), nil
-
-	case "uint16":
-		if field.Offset+2 > len(data) {
-			return nil, fmt.Errorf("insufficient data for uint16")
-		}
-		value := binary.BigEndian.Uint16(data[field.Offset : field.Offset+2])
-		if field.Endianness == "little" {
-			value = binary.LittleEndian.Uint16(data[field.Offset : field.Offset+2])
-		}
-		return applyTransform(float64(value), field.Scale, field.ValueOffset), nil
-
-	case "int16":
-		if field.Offset+2 > len(data) {
-			return nil, fmt.Errorf("insufficient data for int16")
-		}
-		value := int16(binary.BigEndian.Uint16(data[field.Offset : field.Offset+2]))
-		if field.Endianness == "little" {
-			value = int16(binary.LittleEndian.Uint16(data[field.Offset : field.Offset+2]))
-		}
-		return applyTransform(float64(value), field.Scale, float64(field.Offset)), nil
-
-	case "uint32":
-		if field.Offset+4 > len(data) {
-			return nil, fmt.Errorf("insufficient data for uint32")
-		}
-		value := binary.BigEndian.Uint32(data[field.Offset : field.Offset+4])
-		if field.Endianness == "little" {
-			value = binary.LittleEndian.Uint32(data[field.Offset : field.Offset+4])
-		}
-		return applyTransform(float64(value), field.Scale, float64(field.Offset)), nil
-
-	case "int32":
-		if field.Offset+4 > len(data) {
-			return nil, fmt.Errorf("insufficient data for int32")
-		}
-		value := int32(binary.BigEndian.Uint32(data[field.Offset : field.Offset+4]))
-		if field.Endianness == "little" {
-			value = int32(binary.LittleEndian.Uint32(data[field.Offset : field.Offset+4]))
-		}
-		return applyTransform(float64(value), field.Scale, field.ValueOffset), nil
-
-	case "float32":
-		if field.Offset+4 > len(data) {
-			return nil, fmt.Errorf("insufficient data for float32")
-		}
-		bits := binary.BigEndian.Uint32(data[field.Offset : field.Offset+4])
-		if field.Endianness == "little" {
-			bits = binary.LittleEndian.Uint32(data[field.Offset : field.Offset+4])
-		}
-		value := float32(math.Float32frombits(uint32(bits)))
-		return applyTransform(float64(value), field.Scale, float64(field.Offset)), nil
+	if IsBitField(field) {
+		return parseBitField(field, data)
+	}
 
-	case "float64":
-		if field.Offset+8 > len(data) {
-			return nil, fmt.Errorf("insufficient data for float64")
-		}
-		bits := binary.BigEndian.Uint64(data[field.Offset : field.Offset+8])
-		if field.Endianness == "little" {
-			bits = binary.LittleEndian.Uint64(data[field.Offset : field.Offset+8])
-		}
-		value := math.Float64frombits(bits)
-		return applyTransform(value, field.Scale, float64(field.Offset)), nil
+	if size := numericSize(field.DataType); size > 0 {
+		return parseNumeric(field, data, size)
+	}
 
+	switch field.DataType {
 	case "ascii_int":
 		length := 4
 		if field.ArrayLength > 0 {
@@ -214,7 +235,7 @@ func (e *Engine) parseField(field models.ParserField, data []byte) (interface{},
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse ascii_int: %w", err)
 		}
-		return applyTransform(float64(value), field.Scale, float64(field.Offset)), nil
+		return applyTransform(float64(value), field.Scale, field.ValueOffset), nil
 
 	case "ascii_decimal":
 		length := 8
@@ -234,7 +255,7 @@ func (e *Engine) parseField(field models.ParserField, data []byte) (interface{},
 		}
 		divisor := math.Pow(10, float64(len(data[field.Offset+length/2:field.Offset+length])))
 		value := float64(integral) + float64(decimal)/divisor
-		return applyTransform(value, field.Scale, float64(field.Offset)), nil
+		return applyTransform(value, field.Scale, field.ValueOffset), nil
 
 	case "string":
 		length := len(data) - field.Offset
@@ -261,3 +282,19 @@ func applyTransform(value float64, scale float64, valueOffset float64) interface
 	}
 	return value*scale + valueOffset
 }
+
+// lookupJSONPath resolves a dot-separated path such as "sensors.temperature"
+func lookupJSONPath(payload map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = payload
+	for _, key := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = object[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
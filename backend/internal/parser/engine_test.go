@@ -0,0 +1,209 @@
+package parser
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+func TestParseBitField(t *testing.T) {
+	// Status word 0xA5 0x3C: 1010 0101 0011 1100
+	status := []byte{0xA5, 0x3C}
+
+	tests := []struct {
+		name    string
+		field   models.ParserField
+		data    []byte
+		want    interface{}
+		wantErr bool
+	}{
+		{"bool lsb set", models.ParserField{DataType: "bool", BitOffset: 2}, []byte{0x04}, true, false},
+		{"bool lsb clear", models.ParserField{DataType: "bool", BitOffset: 0}, []byte{0x04}, false, false},
+		{"bool msb", models.ParserField{DataType: "bool", BitOffset: 0, BitOrder: BitOrderMSB}, []byte{0x80}, true, false},
+		{"bool in second byte", models.ParserField{DataType: "bool", BitOffset: 9}, status, false, false},
+		{"uint16 single bit", models.ParserField{DataType: "uint16", BitOffset: 15, BitWidth: 1}, status, true, false},
+		{"uint16 nibble", models.ParserField{DataType: "uint16", BitOffset: 4, BitWidth: 4}, status, 3.0, false},
+		{"uint16 across bytes", models.ParserField{DataType: "uint16", BitOffset: 6, BitWidth: 4}, status, 4.0, false},
+		{"uint16 little endian", models.ParserField{DataType: "uint16", BitOffset: 0, BitWidth: 8, Endianness: "little"}, status, 165.0, false},
+		{"uint16 msb order", models.ParserField{DataType: "uint16", BitOffset: 0, BitWidth: 3, BitOrder: BitOrderMSB}, status, 5.0, false},
+		{"int16 signed", models.ParserField{DataType: "int16", BitOffset: 12, BitWidth: 4}, status, -6.0, false},
+		{"int8 signed single bit", models.ParserField{DataType: "int8", BitOffset: 0, BitWidth: 1}, []byte{0x01}, -1.0, false},
+		{"scaled", models.ParserField{DataType: "uint8", BitOffset: 0, BitWidth: 4, Scale: 0.5, ValueOffset: 1}, []byte{0x0A}, 6.0, false},
+		{"bits spanning bytes", models.ParserField{DataType: "bits", Offset: 1, BitOffset: 4, BitWidth: 12}, []byte{0x00, 0x12, 0x34}, 0x123 * 1.0, false},
+		{"exceeds container", models.ParserField{DataType: "uint8", BitOffset: 6, BitWidth: 4}, status, nil, true},
+		{"insufficient data", models.ParserField{DataType: "uint32", BitOffset: 0, BitWidth: 4}, status, nil, true},
+		{"word-swapped container", models.ParserField{DataType: "uint32", BitOffset: 16, BitWidth: 8, ByteOrder: ByteOrderCDAB}, []byte{0x00, 0x00, 0x00, 0xAB}, 171.0, false},
+		{"whole register", models.ParserField{DataType: "uint16", BitWidth: 16}, status, 42300.0, false},
+		{"ignored on floats", models.ParserField{DataType: "float32", BitWidth: 16}, []byte{0x3F, 0x80, 0, 0}, 1.0, false},
+		{"unknown bit order", models.ParserField{DataType: "bool", BitOrder: "middle"}, status, nil, true},
+	}
+
+	engine := NewEngine()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := engine.parseField(tt.field, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseField() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseField() = %v (%T), want %v (%T)", got, got, tt.want, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNumeric(t *testing.T) {
+	tests := []struct {
+		name    string
+		field   models.ParserField
+		data    []byte
+		want    interface{}
+		wantErr bool
+	}{
+		{"uint32 ABCD", models.ParserField{DataType: "uint32", ByteOrder: ByteOrderABCD}, []byte{0x12, 0x34, 0x56, 0x78}, 305419896.0, false},
+		{"uint32 CDAB", models.ParserField{DataType: "uint32", ByteOrder: ByteOrderCDAB}, []byte{0x56, 0x78, 0x12, 0x34}, 305419896.0, false},
+		{"uint32 BADC", models.ParserField{DataType: "uint32", ByteOrder: ByteOrderBADC}, []byte{0x34, 0x12, 0x78, 0x56}, 305419896.0, false},
+		{"uint32 DCBA", models.ParserField{DataType: "uint32", ByteOrder: ByteOrderDCBA}, []byte{0x78, 0x56, 0x34, 0x12}, 305419896.0, false},
+		{"uint32 little endian", models.ParserField{DataType: "uint32", Endianness: "little"}, []byte{0x78, 0x56, 0x34, 0x12}, 305419896.0, false},
+		{"byte order overrides endianness", models.ParserField{DataType: "uint32", Endianness: "little", ByteOrder: ByteOrderABCD}, []byte{0x12, 0x34, 0x56, 0x78}, 305419896.0, false},
+		{"int32 CDAB", models.ParserField{DataType: "int32", ByteOrder: ByteOrderCDAB}, []byte{0xFF, 0xFE, 0xFF, 0xFF}, -2.0, false},
+		{"float32 ABCD", models.ParserField{DataType: "float32"}, []byte{0x3F, 0xC0, 0x00, 0x00}, 1.5, false},
+		{"float32 CDAB", models.ParserField{DataType: "float32", ByteOrder: ByteOrderCDAB}, []byte{0x00, 0x00, 0x3F, 0xC0}, 1.5, false},
+		{"float32 BADC", models.ParserField{DataType: "float32", ByteOrder: ByteOrderBADC}, []byte{0xC0, 0x3F, 0x00, 0x00}, 1.5, false},
+		{"float32 DCBA", models.ParserField{DataType: "float32", ByteOrder: ByteOrderDCBA}, []byte{0x00, 0x00, 0xC0, 0x3F}, 1.5, false},
+		{"uint16 BADC", models.ParserField{DataType: "uint16", ByteOrder: ByteOrderBADC}, []byte{0x34, 0x12}, 4660.0, false},
+		{"uint16 CDAB", models.ParserField{DataType: "uint16", ByteOrder: ByteOrderCDAB}, []byte{0x12, 0x34}, 4660.0, false},
+		{"int8 ignores byte order", models.ParserField{DataType: "int8", ByteOrder: ByteOrderCDAB}, []byte{0xFE}, -2.0, false},
+
+		{"uint64 ABCD", models.ParserField{DataType: "uint64"}, []byte{0, 0, 0x01, 0, 0, 0, 0, 0x05}, 1099511627781.0, false},
+		{"uint64 CDAB", models.ParserField{DataType: "uint64", ByteOrder: ByteOrderCDAB}, []byte{0, 0x05, 0, 0, 0x01, 0, 0, 0}, 1099511627781.0, false},
+		{"uint64 BADC", models.ParserField{DataType: "uint64", ByteOrder: ByteOrderBADC}, []byte{0, 0, 0, 0x01, 0, 0, 0x05, 0}, 1099511627781.0, false},
+		{"uint64 DCBA", models.ParserField{DataType: "uint64", ByteOrder: ByteOrderDCBA}, []byte{0x05, 0, 0, 0, 0, 0x01, 0, 0}, 1099511627781.0, false},
+		{"int64 negative", models.ParserField{DataType: "int64", ByteOrder: ByteOrderDCBA}, []byte{0x00, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, -256.0, false},
+		{"float64 CDAB", models.ParserField{DataType: "float64", ByteOrder: ByteOrderCDAB}, []byte{0, 0, 0, 0, 0, 0, 0x3F, 0xF0}, 1.0, false},
+
+		{"float16 one", models.ParserField{DataType: "float16"}, []byte{0x3C, 0x00}, 1.0, false},
+		{"float16 negative", models.ParserField{DataType: "float16"}, []byte{0xC0, 0x00}, -2.0, false},
+		{"float16 fraction", models.ParserField{DataType: "float16"}, []byte{0x35, 0x55}, 0.333251953125, false},
+		{"float16 subnormal", models.ParserField{DataType: "float16"}, []byte{0x00, 0x01}, math.Ldexp(1, -24), false},
+		{"float16 infinity", models.ParserField{DataType: "float16"}, []byte{0x7C, 0x00}, nil, true},
+		{"float16 NaN", models.ParserField{DataType: "float16"}, []byte{0x7E, 0x00}, nil, true},
+		{"float32 NaN", models.ParserField{DataType: "float32"}, []byte{0x7F, 0xC0, 0x00, 0x00}, nil, true},
+		{"float32 negative infinity", models.ParserField{DataType: "float32"}, []byte{0xFF, 0x80, 0x00, 0x00}, nil, true},
+		{"float64 infinity", models.ParserField{DataType: "float64"}, []byte{0x7F, 0xF0, 0, 0, 0, 0, 0, 0}, nil, true},
+		{"float16 little endian", models.ParserField{DataType: "float16", Endianness: "little"}, []byte{0x00, 0x3C}, 1.0, false},
+
+		{"bcd16", models.ParserField{DataType: "bcd16"}, []byte{0x12, 0x34}, 1234.0, false},
+		{"bcd32", models.ParserField{DataType: "bcd32"}, []byte{0x00, 0x12, 0x34, 0x56}, 123456.0, false},
+		{"bcd32 CDAB", models.ParserField{DataType: "bcd32", ByteOrder: ByteOrderCDAB}, []byte{0x34, 0x56, 0x00, 0x12}, 123456.0, false},
+		{"bcd32 DCBA", models.ParserField{DataType: "bcd32", ByteOrder: ByteOrderDCBA}, []byte{0x56, 0x34, 0x12, 0x00}, 123456.0, false},
+		{"bcd invalid digit", models.ParserField{DataType: "bcd16"}, []byte{0x1A, 0x00}, nil, true},
+
+		{"packed16 positive", models.ParserField{DataType: "packed16"}, []byte{0x12, 0x3C}, 123.0, false},
+		{"packed16 negative", models.ParserField{DataType: "packed16"}, []byte{0x12, 0x3D}, -123.0, false},
+		{"packed16 unsigned", models.ParserField{DataType: "packed16"}, []byte{0x12, 0x3F}, 123.0, false},
+		{"packed32 negative B", models.ParserField{DataType: "packed32"}, []byte{0x01, 0x23, 0x45, 0x6B}, -123456.0, false},
+		{"packed32 CDAB", models.ParserField{DataType: "packed32", ByteOrder: ByteOrderCDAB}, []byte{0x45, 0x6D, 0x01, 0x23}, -123456.0, false},
+		{"packed64 scaled", models.ParserField{DataType: "packed64", Scale: 0.01}, []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x12, 0x34, 0x5D}, -123.45, false},
+		{"packed invalid digit", models.ParserField{DataType: "packed16"}, []byte{0x1A, 0x3C}, nil, true},
+		{"packed invalid sign", models.ParserField{DataType: "packed16"}, []byte{0x12, 0x39}, nil, true},
+
+		{"fixed16 Q8.8", models.ParserField{DataType: "fixed16", FractionBits: 8}, []byte{0x01, 0x80}, 1.5, false},
+		{"fixed16 negative", models.ParserField{DataType: "fixed16", FractionBits: 8}, []byte{0xFF, 0x80}, -0.5, false},
+		{"ufixed16", models.ParserField{DataType: "ufixed16", FractionBits: 8}, []byte{0xFF, 0x80}, 255.5, false},
+		{"fixed32 Q16.16", models.ParserField{DataType: "fixed32", FractionBits: 16}, []byte{0x00, 0x01, 0x80, 0x00}, 1.5, false},
+		{"fixed32 CDAB", models.ParserField{DataType: "fixed32", FractionBits: 16, ByteOrder: ByteOrderCDAB}, []byte{0x80, 0x00, 0x00, 0x01}, 1.5, false},
+		{"ufixed32", models.ParserField{DataType: "ufixed32", FractionBits: 31}, []byte{0xC0, 0x00, 0x00, 0x00}, 1.5, false},
+
+		{"scale and value offset", models.ParserField{DataType: "uint8", Scale: 0.5, ValueOffset: -40}, []byte{200}, 60.0, false},
+		{"start offset is not a value offset", models.ParserField{DataType: "int16", Offset: 1}, []byte{0x00, 0x00, 0x05}, 5.0, false},
+		{"unknown byte order", models.ParserField{DataType: "uint32", ByteOrder: "ACBD"}, []byte{0, 0, 0, 0}, nil, true},
+		{"insufficient data", models.ParserField{DataType: "uint64"}, []byte{0, 0, 0, 0}, nil, true},
+	}
+
+	engine := NewEngine()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := engine.parseField(tt.field, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseField() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseField() = %v (%T), want %v (%T)", got, got, tt.want, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQuality(t *testing.T) {
+	low, high := 0.0, 100.0
+	p := &models.Parser{Fields: []models.ParserField{
+		{Name: "temperature", DataType: "int16", DeviceID: "dev-1", Scale: 0.1, Min: &low, Max: &high},
+		{Name: "pressure", DataType: "uint16", DeviceID: "dev-1", Offset: 2},
+		{Name: "flow", DataType: "float32", DeviceID: "dev-2", Offset: 4},
+		{Name: "level", DataType: "uint8", DeviceID: "dev-2", Offset: 2, Max: &high},
+	}}
+
+	// temperature is 120.0, flow runs past the end of the frame
+	result, err := NewEngine().Parse(context.Background(), p, []byte{0x04, 0xB0, 0x00, 0x05, 0x00})
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	wantData := map[string]map[string]interface{}{
+		"dev-1": {"temperature": 120.0, "pressure": 5.0},
+		"dev-2": {"level": 0.0},
+	}
+	if !reflect.DeepEqual(result.DeviceData, wantData) {
+		t.Errorf("DeviceData = %v, want %v", result.DeviceData, wantData)
+	}
+
+	wantQuality := map[string]map[string]models.FieldQuality{
+		"dev-1": {"temperature": {Quality: models.QualityOutOfRange, Error: "120 above maximum 100"}},
+		"dev-2": {"flow": {Quality: models.QualityBad, Error: "insufficient data for float32"}},
+	}
+	if !reflect.DeepEqual(result.Quality, wantQuality) {
+		t.Errorf("Quality = %v, want %v", result.Quality, wantQuality)
+	}
+}
+
+func TestParseJSONQuality(t *testing.T) {
+	p := &models.Parser{BuiltInType: BuiltInJSON, Fields: []models.ParserField{
+		{Name: "temperature"},
+		{Name: "status.alarm"},
+	}}
+
+	result, err := NewEngine().Parse(context.Background(), p, []byte(`{"temperature": 21.5}`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if got := result.DeviceData[""]["temperature"]; got != 21.5 {
+		t.Errorf("temperature = %v, want 21.5", got)
+	}
+	if q := result.Quality[""]["status.alarm"]; q.Quality != models.QualityBad {
+		t.Errorf("Quality[status.alarm] = %+v, want bad", q)
+	}
+}
+
+func TestParseNonFiniteFloatIsBad(t *testing.T) {
+	p := &models.Parser{Fields: []models.ParserField{
+		{Name: "flow", DataType: "float32"},
+		{Name: "level", DataType: "uint8", Offset: 4},
+	}}
+
+	result, err := NewEngine().Parse(context.Background(), p, []byte{0x7F, 0xC0, 0x00, 0x00, 0x07})
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if got := result.DeviceData[""]; !reflect.DeepEqual(got, map[string]interface{}{"level": 7.0}) {
+		t.Errorf("DeviceData = %v, want only level", got)
+	}
+	checkBadFields(t, result, []string{"flow"})
+	if _, err := json.Marshal(result.DeviceData); err != nil {
+		t.Errorf("json.Marshal() error = %v", err)
+	}
+}
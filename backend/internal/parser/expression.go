@@ -0,0 +1,854 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+// DataTypeExpression marks a field computed from other fields after all raw
+// fields of the frame have been decoded.
+const DataTypeExpression = "expression"
+
+// ExpressionError reports a syntax error in an expression
+type ExpressionError struct {
+	Position int    `json:"position"` // byte offset in the expression
+	Message  string `json:"message"`
+}
+
+func (e *ExpressionError) Error() string {
+	return fmt.Sprintf("expression error at %d: %s", e.Position, e.Message)
+}
+
+// Expression is a compiled expression
+type Expression struct {
+	source string
+	root   exprNode
+}
+
+// CompileExpression parses an expression. The language supports numbers,
+// 'strings', true/false, field references, the operators
+// + - * / % ^ == != < <= > >= && || ! and c ? a : b, and the functions
+// listed in exprFunctions.
+func CompileExpression(source string) (*Expression, error) {
+	p := &exprParser{lexer: exprLexer{src: source}}
+	p.next()
+	root, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %q", p.tok.text)
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+// ValidateExpressions compiles every expression field, including those
+// nested in groups and variants, and checks their lookup curves.
+func ValidateExpressions(fields []models.ParserField) error {
+	for _, field := range fields {
+		if field.DataType == DataTypeExpression {
+			if _, err := CompileExpression(field.Expression); err != nil {
+				return fmt.Errorf("field %s: %w", field.Name, err)
+			}
+			if err := validateCurve(field.Curve); err != nil {
+				return fmt.Errorf("field %s: %w", field.Name, err)
+			}
+		}
+		if err := ValidateExpressions(field.Fields); err != nil {
+			return err
+		}
+		for _, variant := range field.Variants {
+			if err := ValidateExpressions(variant.Fields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateCurve(curve [][2]float64) error {
+	if curve == nil {
+		return nil
+	}
+	if len(curve) < 2 {
+		return fmt.Errorf("curve needs at least two points")
+	}
+	for i := 1; i < len(curve); i++ {
+		if curve[i][0] <= curve[i-1][0] {
+			return fmt.Errorf("curve points must be sorted by strictly increasing x")
+		}
+	}
+	return nil
+}
+
+func (e *Engine) expression(source string) (*Expression, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if expr, ok := e.expressions[source]; ok {
+		return expr, nil
+	}
+	expr, err := CompileExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	e.expressions[source] = expr
+	return expr, nil
+}
+
+// evaluateExpressions computes the expression fields queued while decoding
+// a frame, in definition order, so expressions may use earlier ones.
+// In a dry run, failures are traced and evaluation continues.
+func (e *Engine) evaluateExpressions(sc *scope) error {
+	pending := sc.expressions
+	sc.expressions = nil
+
+	for _, p := range pending {
+		sc.deviceID = p.deviceID
+		value, err := e.evaluate(p, sc)
+		if err == nil {
+			p.out[p.field.Name] = value
+			sc.record(p.field.Name, value, p.field.Offset)
+		}
+		if sc.trace != nil {
+			sc.trace.add(sc, p.field, p.field.Offset, p.field.Offset, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("field %s: %w", p.field.Name, err)
+		}
+	}
+	return nil
+}
+
+func (e *Engine) evaluate(p pendingExpression, sc *scope) (interface{}, error) {
+	expr, err := e.expression(p.field.Expression)
+	if err != nil {
+		return nil, err
+	}
+	value, err := expr.root.eval(&exprEnv{field: p.field, values: p.out, scope: sc})
+	if err != nil {
+		return nil, err
+	}
+	if number, ok := value.(float64); ok {
+		if math.IsNaN(number) || math.IsInf(number, 0) {
+			return nil, fmt.Errorf("result is not a finite number")
+		}
+		value = applyTransform(number, p.field.Scale, p.field.ValueOffset)
+	}
+	return value, nil
+}
+
+type pendingExpression struct {
+	field    models.ParserField
+	out      map[string]interface{}
+	deviceID string
+}
+
+// exprEnv resolves field references: values of the same device (or group
+// element) first, then fields decoded in enclosing scopes.
+type exprEnv struct {
+	field  models.ParserField
+	values map[string]interface{}
+	scope  *scope
+}
+
+func (env *exprEnv) lookup(name string) (interface{}, bool) {
+	if value, ok := env.values[name]; ok {
+		return value, true
+	}
+	value, _, ok := env.scope.lookup(name)
+	return value, ok
+}
+
+// Lexer
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+type exprLexer struct {
+	src string
+	pos int
+}
+
+// operators are matched longest first
+var exprOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "+", "-", "*", "/", "%", "^", "<", ">", "!", "?", ":", "(", ")", ","}
+
+func (l *exprLexer) next() (token, error) {
+	for l.pos < len(l.src) && unicode.IsSpace(rune(l.src[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case isDigit(c) || c == '.' && l.pos+1 < len(l.src) && isDigit(l.src[l.pos+1]):
+		l.pos = scanNumber(l.src, l.pos)
+		return token{kind: tokNumber, text: l.src[start:l.pos], pos: start}, nil
+
+	case c == '\'' || c == '"':
+		end := strings.IndexByte(l.src[l.pos+1:], c)
+		if end < 0 {
+			return token{}, &ExpressionError{Position: start, Message: "unterminated string"}
+		}
+		l.pos += end + 2
+		return token{kind: tokString, text: l.src[start+1 : l.pos-1], pos: start}, nil
+
+	case c == '_' || unicode.IsLetter(rune(c)):
+		// Names may contain dots and [n] indexes to refer to group members
+		// and indexed arrays, e.g. ch[0].value
+		for l.pos < len(l.src) {
+			ch := l.src[l.pos]
+			if ch == '_' || ch == '.' || isDigit(ch) || unicode.IsLetter(rune(ch)) {
+				l.pos++
+				continue
+			}
+			if ch == '[' {
+				end := strings.IndexByte(l.src[l.pos:], ']')
+				if end < 0 {
+					return token{}, &ExpressionError{Position: l.pos, Message: "unterminated index"}
+				}
+				l.pos += end + 1
+				continue
+			}
+			break
+		}
+		return token{kind: tokIdent, text: l.src[start:l.pos], pos: start}, nil
+	}
+
+	for _, op := range exprOperators {
+		if strings.HasPrefix(l.src[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOperator, text: op, pos: start}, nil
+		}
+	}
+	return token{}, &ExpressionError{Position: start, Message: fmt.Sprintf("unexpected character %q", c)}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// scanNumber returns the end of the number starting at pos: 0x hex, or
+// decimal with an optional fraction and exponent.
+func scanNumber(src string, pos int) int {
+	if strings.HasPrefix(src[pos:], "0x") || strings.HasPrefix(src[pos:], "0X") {
+		pos += 2
+		for pos < len(src) && isHexDigit(src[pos]) {
+			pos++
+		}
+		return pos
+	}
+	for pos < len(src) && (isDigit(src[pos]) || src[pos] == '.') {
+		pos++
+	}
+	if pos < len(src) && (src[pos] == 'e' || src[pos] == 'E') {
+		pos++
+		if pos < len(src) && (src[pos] == '+' || src[pos] == '-') {
+			pos++
+		}
+		for pos < len(src) && isDigit(src[pos]) {
+			pos++
+		}
+	}
+	return pos
+}
+
+// Parser
+
+type exprParser struct {
+	lexer exprLexer
+	tok   token
+	err   error
+}
+
+func (p *exprParser) next() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lexer.next()
+	if p.err != nil {
+		p.tok = token{kind: tokEOF, pos: p.lexer.pos}
+	}
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	return &ExpressionError{Position: p.tok.pos, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *exprParser) isOperator(ops ...string) bool {
+	if p.tok.kind != tokOperator {
+		return false
+	}
+	for _, op := range ops {
+		if p.tok.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.isOperator(op) {
+		if p.tok.kind == tokEOF {
+			return p.errorf("expected %q", op)
+		}
+		return p.errorf("expected %q, got %q", op, p.tok.text)
+	}
+	p.next()
+	return nil
+}
+
+func (p *exprParser) parseTernary() (exprNode, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.isOperator("?") {
+		return cond, nil
+	}
+	p.next()
+	then, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	return &ternaryNode{cond: cond, then: then, otherwise: otherwise}, nil
+}
+
+// binaryPrecedence lists binary operators from lowest to highest precedence
+var binaryPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) parseBinary(level int) (exprNode, error) {
+	if level == len(binaryPrecedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator(binaryPrecedence[level]...) {
+		op := p.tok.text
+		p.next()
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.isOperator("-", "!") {
+		op := p.tok.text
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	return p.parsePower()
+}
+
+// parsePower handles the right-associative ^ operator, which binds tighter
+// than unary minus on its left: -2^2 is -4.
+func (p *exprParser) parsePower() (exprNode, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isOperator("^") {
+		return base, nil
+	}
+	p.next()
+	exponent, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return &binaryNode{op: "^", left: base, right: exponent}, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokNumber:
+		p.next()
+		value, err := parseNumberLiteral(tok.text)
+		if err != nil {
+			return nil, &ExpressionError{Position: tok.pos, Message: fmt.Sprintf("invalid number %q", tok.text)}
+		}
+		return &literalNode{value: value}, nil
+
+	case tokString:
+		p.next()
+		return &literalNode{value: tok.text}, nil
+
+	case tokIdent:
+		p.next()
+		switch tok.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		}
+		if !p.isOperator("(") {
+			return &fieldNode{name: tok.text}, nil
+		}
+		return p.parseCall(tok)
+
+	case tokOperator:
+		if tok.text == "(" {
+			p.next()
+			inner, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		}
+		return nil, p.errorf("unexpected %q", tok.text)
+
+	default:
+		return nil, p.errorf("unexpected end of expression")
+	}
+}
+
+func (p *exprParser) parseCall(name token) (exprNode, error) {
+	fn, ok := exprFunctions[name.text]
+	if !ok {
+		return nil, &ExpressionError{Position: name.pos, Message: fmt.Sprintf("unknown function %s", name.text)}
+	}
+	p.next() // (
+
+	var args []exprNode
+	if !p.isOperator(")") {
+		for {
+			arg, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if !p.isOperator(",") {
+				break
+			}
+			p.next()
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	if len(args) < fn.minArgs || fn.maxArgs >= 0 && len(args) > fn.maxArgs {
+		return nil, &ExpressionError{Position: name.pos, Message: fmt.Sprintf("wrong number of arguments for %s", name.text)}
+	}
+	return &callNode{name: name.text, fn: fn, args: args}, nil
+}
+
+func parseNumberLiteral(text string) (float64, error) {
+	lower := strings.ToLower(text)
+	if strings.HasPrefix(lower, "0x") {
+		value, err := strconv.ParseUint(lower[2:], 16, 64)
+		return float64(value), err
+	}
+	return strconv.ParseFloat(text, 64)
+}
+
+// Evaluation
+
+type exprNode interface {
+	eval(env *exprEnv) (interface{}, error)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(*exprEnv) (interface{}, error) {
+	return n.value, nil
+}
+
+type fieldNode struct {
+	name string
+}
+
+func (n *fieldNode) eval(env *exprEnv) (interface{}, error) {
+	value, ok := env.lookup(n.name)
+	if !ok {
+		return nil, fmt.Errorf("unknown field %s", n.name)
+	}
+	return value, nil
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n *unaryNode) eval(env *exprEnv) (interface{}, error) {
+	value, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		return !truthy(value), nil
+	}
+	number, err := toNumber(value)
+	if err != nil {
+		return nil, err
+	}
+	return -number, nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *binaryNode) eval(env *exprEnv) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// Logical operators short-circuit
+	switch n.op {
+	case "&&":
+		if !truthy(left) {
+			return false, nil
+		}
+		right, err := n.right.eval(env)
+		return truthy(right), err
+	case "||":
+		if truthy(left) {
+			return true, nil
+		}
+		right, err := n.right.eval(env)
+		return truthy(right), err
+	}
+
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equalValues(left, right), nil
+	case "!=":
+		return !equalValues(left, right), nil
+	}
+
+	// + concatenates when either side is a string
+	if n.op == "+" {
+		_, ls := left.(string)
+		_, rs := right.(string)
+		if ls || rs {
+			return formatValue(left) + formatValue(right), nil
+		}
+	}
+
+	a, err := toNumber(left)
+	if err != nil {
+		return nil, err
+	}
+	b, err := toNumber(right)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return a / b, nil
+	case "%":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Mod(a, b), nil
+	case "^":
+		return math.Pow(a, b), nil
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case ">":
+		return a > b, nil
+	case ">=":
+		return a >= b, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
+
+type ternaryNode struct {
+	cond, then, otherwise exprNode
+}
+
+func (n *ternaryNode) eval(env *exprEnv) (interface{}, error) {
+	cond, err := n.cond.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if truthy(cond) {
+		return n.then.eval(env)
+	}
+	return n.otherwise.eval(env)
+}
+
+type callNode struct {
+	name string
+	fn   exprFunction
+	args []exprNode
+}
+
+func (n *callNode) eval(env *exprEnv) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	value, err := n.fn.call(env, args)
+	if err != nil {
+		return nil, fmt.Errorf("%s(): %w", n.name, err)
+	}
+	return value, nil
+}
+
+type exprFunction struct {
+	minArgs, maxArgs int // maxArgs -1 for variadic
+	call             func(env *exprEnv, args []interface{}) (interface{}, error)
+}
+
+// exprFunctions are the functions available to expressions. lookup and
+// interpolate use the Lookup table and Curve of the field being computed.
+var exprFunctions = map[string]exprFunction{
+	"abs":   math1(math.Abs),
+	"ceil":  math1(math.Ceil),
+	"floor": math1(math.Floor),
+	"sqrt":  math1(math.Sqrt),
+	"exp":   math1(math.Exp),
+	"log":   math1(math.Log),
+	"log10": math1(math.Log10),
+	"sin":   math1(math.Sin),
+	"cos":   math1(math.Cos),
+	"tan":   math1(math.Tan),
+	"pow": {2, 2, func(_ *exprEnv, args []interface{}) (interface{}, error) {
+		numbers, err := toNumbers(args)
+		if err != nil {
+			return nil, err
+		}
+		return math.Pow(numbers[0], numbers[1]), nil
+	}},
+	"round": {1, 2, func(_ *exprEnv, args []interface{}) (interface{}, error) {
+		numbers, err := toNumbers(args)
+		if err != nil {
+			return nil, err
+		}
+		if len(numbers) == 1 {
+			return math.Round(numbers[0]), nil
+		}
+		factor := math.Pow(10, numbers[1])
+		return math.Round(numbers[0]*factor) / factor, nil
+	}},
+	"min": {1, -1, func(_ *exprEnv, args []interface{}) (interface{}, error) {
+		numbers, err := toNumbers(args)
+		if err != nil {
+			return nil, err
+		}
+		result := numbers[0]
+		for _, v := range numbers[1:] {
+			result = math.Min(result, v)
+		}
+		return result, nil
+	}},
+	"max": {1, -1, func(_ *exprEnv, args []interface{}) (interface{}, error) {
+		numbers, err := toNumbers(args)
+		if err != nil {
+			return nil, err
+		}
+		result := numbers[0]
+		for _, v := range numbers[1:] {
+			result = math.Max(result, v)
+		}
+		return result, nil
+	}},
+	"clamp": {3, 3, func(_ *exprEnv, args []interface{}) (interface{}, error) {
+		numbers, err := toNumbers(args)
+		if err != nil {
+			return nil, err
+		}
+		return math.Min(math.Max(numbers[0], numbers[1]), numbers[2]), nil
+	}},
+	"lookup": {1, 2, func(env *exprEnv, args []interface{}) (interface{}, error) {
+		if value, ok := env.field.Lookup[formatValue(args[0])]; ok {
+			return value, nil
+		}
+		if len(args) == 2 {
+			return args[1], nil
+		}
+		return nil, nil
+	}},
+	"interpolate": {1, 1, func(env *exprEnv, args []interface{}) (interface{}, error) {
+		x, err := toNumber(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return interpolate(env.field.Curve, x)
+	}},
+}
+
+func math1(fn func(float64) float64) exprFunction {
+	return exprFunction{1, 1, func(_ *exprEnv, args []interface{}) (interface{}, error) {
+		x, err := toNumber(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return fn(x), nil
+	}}
+}
+
+// interpolate evaluates the piecewise-linear curve at x, holding the end
+// values outside the defined range.
+func interpolate(curve [][2]float64, x float64) (float64, error) {
+	if err := validateCurve(curve); err != nil {
+		return 0, err
+	}
+	if curve == nil {
+		return 0, fmt.Errorf("field has no curve")
+	}
+
+	i := sort.Search(len(curve), func(i int) bool { return curve[i][0] >= x })
+	switch i {
+	case 0:
+		return curve[0][1], nil
+	case len(curve):
+		return curve[len(curve)-1][1], nil
+	}
+	lo, hi := curve[i-1], curve[i]
+	return lo[1] + (x-lo[0])*(hi[1]-lo[1])/(hi[0]-lo[0]), nil
+}
+
+func toNumber(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("%v is not a number", value)
+	}
+}
+
+func toNumbers(values []interface{}) ([]float64, error) {
+	numbers := make([]float64, len(values))
+	for i, value := range values {
+		number, err := toNumber(value)
+		if err != nil {
+			return nil, err
+		}
+		numbers[i] = number
+	}
+	return numbers, nil
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	default:
+		return value != nil
+	}
+}
+
+func equalValues(a, b interface{}) bool {
+	if x, ok := a.(float64); ok {
+		if y, err := toNumber(b); err == nil {
+			return x == y
+		}
+	}
+	if y, ok := b.(float64); ok {
+		if x, err := toNumber(a); err == nil {
+			return x == y
+		}
+	}
+	return formatValue(a) == formatValue(b)
+}
+
+// formatValue renders a value as used for lookup keys and string
+// concatenation: integral numbers without a fraction, e.g. 3 not 3.000000.
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,165 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+func TestEvaluateExpression(t *testing.T) {
+	values := map[string]interface{}{
+		"voltage":      230.0,
+		"current":      2.5,
+		"status":       1.0,
+		"running":      true,
+		"name":         "pump",
+		"ch[0].value":  1.5,
+		"ch[1].value":  2.5,
+		"header.flags": 4.0,
+	}
+
+	tests := []struct {
+		name    string
+		expr    string
+		field   models.ParserField
+		want    interface{}
+		wantErr bool
+	}{
+		{"product", "voltage * current", models.ParserField{}, 575.0, false},
+		{"precedence", "1 + 2 * 3 - 4 / 2", models.ParserField{}, 5.0, false},
+		{"parentheses", "(1 + 2) * 3", models.ParserField{}, 9.0, false},
+		{"power is right associative", "2 ^ 3 ^ 2", models.ParserField{}, 512.0, false},
+		{"unary minus binds looser than power", "-2 ^ 2", models.ParserField{}, -4.0, false},
+		{"modulo", "7 % 4", models.ParserField{}, 3.0, false},
+		{"hex and exponent literals", "0x10 + 1.5e2", models.ParserField{}, 166.0, false},
+		{"comparison", "voltage > 220 && current <= 2.5", models.ParserField{}, true, false},
+		{"negation", "!running || status != 1", models.ParserField{}, false, false},
+		{"ternary", "status == 1 ? 'on' : 'off'", models.ParserField{}, "on", false},
+		{"string concatenation", "name + '-' + status", models.ParserField{}, "pump-1", false},
+		{"indexed names", "ch[0].value + ch[1].value + header.flags", models.ParserField{}, 8.0, false},
+		{"math functions", "round(sqrt(2), 3) + abs(-1) + floor(1.7) + ceil(0.2)", models.ParserField{}, 4.414, false},
+		{"min max clamp", "min(3, 1, 2) + max(3, 1, 2) + clamp(12, 0, 10)", models.ParserField{}, 14.0, false},
+		{"lookup", "lookup(status)", models.ParserField{Lookup: map[string]interface{}{"0": "idle", "1": "running"}}, "running", false},
+		{"lookup default", "lookup(status + 5, 'unknown')", models.ParserField{Lookup: map[string]interface{}{"1": "running"}}, "unknown", false},
+		{"lookup missing", "lookup(7)", models.ParserField{Lookup: map[string]interface{}{"1": "running"}}, nil, false},
+		{"interpolate", "interpolate(current)", models.ParserField{Curve: [][2]float64{{0, 0}, {2, 100}, {4, 500}}}, 200.0, false},
+		{"interpolate clamps", "interpolate(10)", models.ParserField{Curve: [][2]float64{{0, 0}, {2, 100}}}, 100.0, false},
+		{"unknown field", "power * 2", models.ParserField{}, nil, true},
+		{"division by zero", "voltage / (status - 1)", models.ParserField{}, nil, true},
+		{"string arithmetic", "name * 2", models.ParserField{}, nil, true},
+		{"interpolate without curve", "interpolate(1)", models.ParserField{}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := CompileExpression(tt.expr)
+			if err != nil {
+				t.Fatalf("CompileExpression() error = %v", err)
+			}
+
+			got, err := expr.root.eval(&exprEnv{field: tt.field, values: values, scope: newScope(nil)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("eval() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("eval() = %v (%T), want %v (%T)", got, got, tt.want, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileExpressionErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		position int
+	}{
+		{"empty", "", 0},
+		{"dangling operator", "1 +", 3},
+		{"unbalanced parenthesis", "(1 + 2", 6},
+		{"unknown function", "1 + cosh(2)", 4},
+		{"wrong arity", "pow(2)", 0},
+		{"unterminated string", "name == 'pump", 8},
+		{"trailing token", "1 2", 2},
+		{"invalid character", "a # b", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CompileExpression(tt.expr)
+			var exprErr *ExpressionError
+			if !errors.As(err, &exprErr) {
+				t.Fatalf("CompileExpression() error = %v, want *ExpressionError", err)
+			}
+			if exprErr.Position != tt.position {
+				t.Errorf("Position = %d, want %d (%v)", exprErr.Position, tt.position, err)
+			}
+		})
+	}
+}
+
+func TestParseExpressionFields(t *testing.T) {
+	p := &models.Parser{Fields: []models.ParserField{
+		// Expressions may precede the fields they use
+		{Name: "power", DataType: DataTypeExpression, Expression: "voltage * current", Scale: 0.001},
+		{Name: "voltage", DataType: "uint16", Offset: 0, Scale: 0.1},
+		{Name: "current", DataType: "uint16", Offset: 2, Scale: 0.01},
+		{Name: "state", DataType: DataTypeExpression, Expression: "lookup(mode, 'fault')",
+			Lookup: map[string]interface{}{"0": "stopped", "1": "running"}},
+		{Name: "mode", DataType: "uint8", Offset: 4},
+		{Name: "ch", DataType: DataTypeGroup, Offset: 5, Count: 2, Fields: []models.ParserField{
+			{Name: "raw", DataType: "uint8"},
+			{Name: "level", DataType: DataTypeExpression, Expression: "interpolate(raw)", Curve: [][2]float64{{0, 0}, {100, 1000}}},
+		}},
+	}}
+
+	result, err := NewEngine().Parse(context.Background(), p, []byte{0x08, 0xFC, 0x01, 0xF4, 0x01, 50, 200})
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	got := result.DeviceData[""]
+	if power := got["power"].(float64); power < 1.149 || power > 1.151 {
+		t.Errorf("power = %v, want 1.15", power)
+	}
+	if got["state"] != "running" {
+		t.Errorf("state = %v, want running", got["state"])
+	}
+	wantChannels := []interface{}{
+		map[string]interface{}{"raw": 50.0, "level": 500.0},
+		map[string]interface{}{"raw": 200.0, "level": 1000.0},
+	}
+	if !reflect.DeepEqual(got["ch"], wantChannels) {
+		t.Errorf("ch = %v, want %v", got["ch"], wantChannels)
+	}
+}
+
+func TestValidateExpressions(t *testing.T) {
+	valid := []models.ParserField{
+		{Name: "a", DataType: "uint8"},
+		{Name: "b", DataType: DataTypeExpression, Expression: "a * 2"},
+	}
+	if err := ValidateExpressions(valid); err != nil {
+		t.Errorf("ValidateExpressions() error = %v", err)
+	}
+
+	nested := []models.ParserField{
+		{DataType: DataTypeVariant, Variants: []models.ParserVariant{{Fields: []models.ParserField{
+			{Name: "b", DataType: DataTypeExpression, Expression: "a *"},
+		}}}},
+	}
+	var exprErr *ExpressionError
+	if err := ValidateExpressions(nested); !errors.As(err, &exprErr) {
+		t.Errorf("ValidateExpressions() error = %v, want *ExpressionError", err)
+	}
+
+	unsorted := []models.ParserField{
+		{Name: "v", DataType: DataTypeExpression, Expression: "interpolate(1)", Curve: [][2]float64{{2, 0}, {1, 1}}},
+	}
+	if err := ValidateExpressions(unsorted); err == nil {
+		t.Error("ValidateExpressions() error = nil for unsorted curve")
+	}
+}
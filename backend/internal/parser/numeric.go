@@ -0,0 +1,214 @@
+package parser
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+// Byte orders for ParserField.ByteOrder, named after the position of the
+// bytes of the big-endian value ABCD on the wire. For 64-bit values the
+// pattern extends per 16-bit word, e.g. CDAB swaps the word order.
+const (
+	ByteOrderABCD = "ABCD" // big endian
+	ByteOrderCDAB = "CDAB" // big-endian words, little-endian word order
+	ByteOrderBADC = "BADC" // byte-swapped words, big-endian word order
+	ByteOrderDCBA = "DCBA" // little endian
+)
+
+// numericSize returns the encoded size in bytes of a fixed-width numeric
+// data type, or 0 for other types.
+func numericSize(dataType string) int {
+	switch dataType {
+	case "uint8", "int8":
+		return 1
+	case "uint16", "int16", "float16", "bcd16", "packed16", "fixed16", "ufixed16":
+		return 2
+	case "uint32", "int32", "float32", "bcd32", "packed32", "fixed32", "ufixed32":
+		return 4
+	case "uint64", "int64", "float64", "packed64":
+		return 8
+	default:
+		return 0
+	}
+}
+
+// ApplyByteOrder rearranges b between the field's wire order and big
+// endian. Every supported order is its own inverse, so the same call
+// decodes and encodes. ByteOrder takes precedence over Endianness.
+func ApplyByteOrder(field models.ParserField, b []byte) ([]byte, error) {
+	order := field.ByteOrder
+	if order == "" {
+		order = ByteOrderABCD
+		if field.Endianness == "little" {
+			order = ByteOrderDCBA
+		}
+	}
+
+	out := append([]byte(nil), b...)
+	if len(out) < 2 {
+		return out, nil
+	}
+
+	switch order {
+	case ByteOrderABCD:
+	case ByteOrderDCBA:
+		reverseBytes(out)
+	case ByteOrderBADC, ByteOrderCDAB:
+		if len(out)%2 != 0 {
+			return nil, fmt.Errorf("byte order %s requires whole 16-bit words, got %d bytes", order, len(out))
+		}
+		if order == ByteOrderCDAB {
+			reverseBytes(out)
+		}
+		for i := 0; i < len(out); i += 2 {
+			out[i], out[i+1] = out[i+1], out[i]
+		}
+	default:
+		return nil, fmt.Errorf("unknown byte order: %s", order)
+	}
+	return out, nil
+}
+
+func reverseBytes(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
+
+// parseNumeric decodes a fixed-width numeric field and applies its scale and
+// value offset. 64-bit integers are reported as float64 like every other
+// number, so magnitudes above 2^53 lose precision. NaN and infinite floats
+// are errors, so the field is marked bad rather than stored.
+func parseNumeric(field models.ParserField, data []byte, size int) (interface{}, error) {
+	if field.Offset+size > len(data) {
+		return nil, fmt.Errorf("insufficient data for %s", field.DataType)
+	}
+
+	b, err := ApplyByteOrder(field, data[field.Offset:field.Offset+size])
+	if err != nil {
+		return nil, err
+	}
+
+	var value float64
+	switch field.DataType {
+	case "uint8":
+		value = float64(b[0])
+	case "int8":
+		value = float64(int8(b[0]))
+	case "uint16":
+		value = float64(binary.BigEndian.Uint16(b))
+	case "int16":
+		value = float64(int16(binary.BigEndian.Uint16(b)))
+	case "uint32":
+		value = float64(binary.BigEndian.Uint32(b))
+	case "int32":
+		value = float64(int32(binary.BigEndian.Uint32(b)))
+	case "uint64":
+		value = float64(binary.BigEndian.Uint64(b))
+	case "int64":
+		value = float64(int64(binary.BigEndian.Uint64(b)))
+	case "float16":
+		value = float16ToFloat64(binary.BigEndian.Uint16(b))
+	case "float32":
+		value = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case "float64":
+		value = math.Float64frombits(binary.BigEndian.Uint64(b))
+	case "bcd16", "bcd32":
+		value, err = decodeBCD(b)
+		if err != nil {
+			return nil, err
+		}
+	case "packed16", "packed32", "packed64":
+		value, err = decodePackedDecimal(b)
+		if err != nil {
+			return nil, err
+		}
+	case "fixed16":
+		value = fixedPoint(float64(int16(binary.BigEndian.Uint16(b))), field.FractionBits)
+	case "ufixed16":
+		value = fixedPoint(float64(binary.BigEndian.Uint16(b)), field.FractionBits)
+	case "fixed32":
+		value = fixedPoint(float64(int32(binary.BigEndian.Uint32(b))), field.FractionBits)
+	case "ufixed32":
+		value = fixedPoint(float64(binary.BigEndian.Uint32(b)), field.FractionBits)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("%s is not a finite number", field.DataType)
+	}
+
+	return applyTransform(value, field.Scale, field.ValueOffset), nil
+}
+
+// float16ToFloat64 converts an IEEE 754 half-precision value
+func float16ToFloat64(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1.0
+	}
+	exponent := int(h>>10) & 0x1F
+	mantissa := float64(h & 0x3FF)
+
+	switch exponent {
+	case 0:
+		return sign * math.Ldexp(mantissa, -24)
+	case 0x1F:
+		if mantissa != 0 {
+			return math.NaN()
+		}
+		return math.Inf(int(sign))
+	default:
+		return sign * math.Ldexp(1+mantissa/1024, exponent-15)
+	}
+}
+
+// decodeBCD reads packed BCD, two decimal digits per byte, most significant
+// digit first.
+func decodeBCD(b []byte) (float64, error) {
+	var value float64
+	for _, octet := range b {
+		for _, digit := range []byte{octet >> 4, octet & 0x0F} {
+			if digit > 9 {
+				return 0, fmt.Errorf("invalid BCD digit %#x", digit)
+			}
+			value = value*10 + float64(digit)
+		}
+	}
+	return value, nil
+}
+
+// decodePackedDecimal reads signed packed decimal (COBOL COMP-3): two
+// decimal digits per byte, most significant first, with the sign in the
+// last nibble. 0xB and 0xD are negative; 0xA, 0xC, 0xE and 0xF positive.
+func decodePackedDecimal(b []byte) (float64, error) {
+	var value float64
+	for i, octet := range b {
+		digits := []byte{octet >> 4, octet & 0x0F}
+		if i == len(b)-1 {
+			digits = digits[:1]
+		}
+		for _, digit := range digits {
+			if digit > 9 {
+				return 0, fmt.Errorf("invalid packed decimal digit %#x", digit)
+			}
+			value = value*10 + float64(digit)
+		}
+	}
+
+	switch sign := b[len(b)-1] & 0x0F; sign {
+	case 0x0B, 0x0D:
+		return -value, nil
+	case 0x0A, 0x0C, 0x0E, 0x0F:
+		return value, nil
+	default:
+		return 0, fmt.Errorf("invalid packed decimal sign %#x", sign)
+	}
+}
+
+// fixedPoint interprets raw as a Q-format number with fractionBits bits
+// after the binary point.
+func fixedPoint(raw float64, fractionBits int) float64 {
+	return math.Ldexp(raw, -fractionBits)
+}
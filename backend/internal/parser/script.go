@@ -0,0 +1,266 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/metrics"
+	"time"
+
+	"github.com/dop251/goja"
+	jsparser "github.com/dop251/goja/parser"
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+// ParserTypeJavaScript selects the script parser; the script is in Parser.Script
+const ParserTypeJavaScript = "javascript"
+
+const (
+	defaultScriptTimeout = 100 * time.Millisecond
+	defaultScriptMemory  = 64 << 20
+	memoryCheckInterval  = time.Millisecond
+	maxScriptCallStack   = 256
+	scriptFilename       = "parser.js"
+)
+
+// scriptMemoryError interrupts a script that allocated more than the limit
+type scriptMemoryError struct {
+	limit uint64
+}
+
+func (e *scriptMemoryError) Error() string {
+	return fmt.Sprintf("script exceeded memory limit of %d MiB", e.limit>>20)
+}
+
+// ScriptError reports a compile or runtime error in a parser script
+type ScriptError struct {
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *ScriptError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", scriptFilename, e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", scriptFilename, e.Message)
+}
+
+type compiledScript struct {
+	source  string
+	program *goja.Program
+}
+
+// CompileScript checks a parser script for syntax errors
+func CompileScript(source string) (*goja.Program, error) {
+	ast, err := jsparser.ParseFile(nil, scriptFilename, source, 0)
+	if err != nil {
+		var list jsparser.ErrorList
+		if errors.As(err, &list) && len(list) > 0 {
+			return nil, &ScriptError{Line: list[0].Position.Line, Column: list[0].Position.Column, Message: list[0].Message}
+		}
+		return nil, &ScriptError{Message: err.Error()}
+	}
+
+	program, err := goja.CompileAST(ast, true)
+	if err != nil {
+		return nil, &ScriptError{Message: err.Error()}
+	}
+	return program, nil
+}
+
+// SetScriptTimeout limits the run time of a single script invocation
+func (e *Engine) SetScriptTimeout(timeout time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.scriptTimeout = timeout
+}
+
+// SetScriptMemoryLimit limits the bytes a single script invocation may
+// allocate
+func (e *Engine) SetScriptMemoryLimit(limit uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.scriptMemory = limit
+}
+
+func (e *Engine) program(mparser *models.Parser) (*goja.Program, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if cached, ok := e.scripts[mparser.ID]; ok && cached.source == mparser.Script {
+		return cached.program, nil
+	}
+
+	program, err := CompileScript(mparser.Script)
+	if err != nil {
+		return nil, err
+	}
+	e.scripts[mparser.ID] = &compiledScript{source: mparser.Script, program: program}
+	return program, nil
+}
+
+// parseScript runs the parser script in a fresh runtime. The script must
+// define parse(bytes, view), receiving the frame as a Uint8Array and a
+// DataView over it, and return an object mapping device IDs to field
+// objects; an object of plain values is taken as the fields of the device
+// the frame came from. The runtime has no host bindings, so scripts cannot perform I/O;
+// runs exceeding the script timeout or the context deadline are interrupted,
+// as are runs allocating more than the memory limit.
+func (e *Engine) parseScript(ctx context.Context, mparser *models.Parser, data []byte) (*ParserResult, error) {
+	program, err := e.program(mparser)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	timeout := e.scriptTimeout
+	memory := e.scriptMemory
+	e.mu.Unlock()
+
+	vm := goja.New()
+	vm.SetMaxCallStackSize(maxScriptCallStack)
+
+	// The time and memory limits both cancel ctx, so the first one reached
+	// is the cause the script is interrupted with
+	ctx, cancelCause := context.WithCancelCause(ctx)
+	defer cancelCause(nil)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		vm.Interrupt(context.Cause(ctx))
+	})
+	defer stop()
+	watchScriptMemory(ctx, cancelCause, memory)
+
+	if _, err := vm.RunProgram(program); err != nil {
+		return nil, scriptError(err, timeout)
+	}
+
+	parse, ok := goja.AssertFunction(vm.Get("parse"))
+	if !ok {
+		return nil, &ScriptError{Message: "script must define a parse(bytes, view) function"}
+	}
+
+	buffer := vm.NewArrayBuffer(append([]byte(nil), data...))
+	bytes, err := vm.New(vm.Get("Uint8Array"), vm.ToValue(buffer))
+	if err != nil {
+		return nil, scriptError(err, timeout)
+	}
+	view, err := vm.New(vm.Get("DataView"), vm.ToValue(buffer))
+	if err != nil {
+		return nil, scriptError(err, timeout)
+	}
+
+	value, err := parse(goja.Undefined(), bytes, view)
+	if err != nil {
+		return nil, scriptError(err, timeout)
+	}
+
+	exported, ok := value.Export().(map[string]interface{})
+	if !ok {
+		return nil, &ScriptError{Message: "parse() must return an object mapping device IDs to fields"}
+	}
+
+	result := &ParserResult{
+		DeviceData: make(map[string]map[string]interface{}),
+	}
+	for deviceID, fields := range exported {
+		deviceData, ok := fields.(map[string]interface{})
+		if !ok {
+			result.DeviceData = map[string]map[string]interface{}{
+				"": normalizeScriptValue(exported).(map[string]interface{}),
+			}
+			return result, nil
+		}
+		result.DeviceData[deviceID] = normalizeScriptValue(deviceData).(map[string]interface{})
+	}
+
+	return result, nil
+}
+
+// watchScriptMemory cancels the script's context once the process has
+// allocated more than limit bytes, until the context is done. goja cannot
+// account allocations per runtime, so the process total is sampled:
+// allocations by other goroutines count against the script, and a single
+// large allocation is only caught after it was made.
+func watchScriptMemory(ctx context.Context, cancel context.CancelCauseFunc, limit uint64) {
+	sample := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(sample)
+	start := sample[0].Value.Uint64()
+
+	go func() {
+		ticker := time.NewTicker(memoryCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				metrics.Read(sample)
+				if sample[0].Value.Uint64()-start > limit {
+					cancel(&scriptMemoryError{limit: limit})
+					return
+				}
+			}
+		}
+	}()
+}
+
+// normalizeScriptValue reports integral script numbers as float64, matching
+// the values produced by field definitions.
+func normalizeScriptValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case int64:
+		return float64(value)
+	case []interface{}:
+		for i := range value {
+			value[i] = normalizeScriptValue(value[i])
+		}
+		return value
+	case map[string]interface{}:
+		for k := range value {
+			value[k] = normalizeScriptValue(value[k])
+		}
+		return value
+	default:
+		return v
+	}
+}
+
+// scriptError converts a goja error into a ScriptError with the location of
+// the innermost script frame.
+func scriptError(err error, timeout time.Duration) error {
+	var interrupted *goja.InterruptedError
+	if errors.As(err, &interrupted) {
+		msg := fmt.Sprintf("script interrupted: %v", interrupted.Value())
+		var memoryErr *scriptMemoryError
+		if errors.Is(interrupted.Unwrap(), context.DeadlineExceeded) {
+			msg = fmt.Sprintf("script exceeded time limit of %s", timeout)
+		} else if errors.As(interrupted.Unwrap(), &memoryErr) {
+			msg = memoryErr.Error()
+		}
+		return &ScriptError{Message: msg}
+	}
+
+	var exception *goja.Exception
+	if errors.As(err, &exception) {
+		scriptErr := &ScriptError{Message: exception.Value().String()}
+		for _, frame := range exception.Stack() {
+			if pos := frame.Position(); pos.Filename == scriptFilename && pos.Line > 0 {
+				scriptErr.Line = pos.Line
+				scriptErr.Column = pos.Column
+				break
+			}
+		}
+		return scriptErr
+	}
+
+	var stackOverflow *goja.StackOverflowError
+	if errors.As(err, &stackOverflow) {
+		return &ScriptError{Message: "maximum call stack size exceeded"}
+	}
+
+	return &ScriptError{Message: err.Error()}
+}
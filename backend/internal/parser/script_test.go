@@ -0,0 +1,118 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+func TestParseScript(t *testing.T) {
+	engine := NewEngine()
+	p := &models.Parser{
+		ID:   "p1",
+		Type: ParserTypeJavaScript,
+		Script: `
+function parse(bytes, view) {
+  return {
+    "dev-1": { temperature: view.getInt16(0) / 10, alarm: (bytes[2] & 0x01) === 1 },
+    "dev-2": { level: view.getFloat32(3, true) }
+  };
+}`,
+	}
+
+	result, err := engine.Parse(context.Background(), p, []byte{0x00, 0xD2, 0x01, 0x00, 0x00, 0xC0, 0x3F})
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	want := map[string]map[string]interface{}{
+		"dev-1": {"temperature": 21.0, "alarm": true},
+		"dev-2": {"level": 1.5},
+	}
+	if !reflect.DeepEqual(result.DeviceData, want) {
+		t.Errorf("DeviceData = %v, want %v", result.DeviceData, want)
+	}
+}
+
+func TestParseScriptFlatFields(t *testing.T) {
+	p := &models.Parser{
+		ID:     "p1",
+		Type:   ParserTypeJavaScript,
+		Script: "function parse(bytes) { return { status: bytes[0], ok: true }; }",
+	}
+
+	result, err := NewEngine().Parse(context.Background(), p, []byte{7})
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	want := map[string]map[string]interface{}{"": {"status": 7.0, "ok": true}}
+	if !reflect.DeepEqual(result.DeviceData, want) {
+		t.Errorf("DeviceData = %v, want %v", result.DeviceData, want)
+	}
+}
+
+func TestParseScriptErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		line    int
+		message string
+	}{
+		{"syntax error", "function parse(bytes) {\n  return bytes[;\n}", 2, "Unexpected token"},
+		{"runtime error", "function parse(bytes) {\n  var x = null;\n  return x.value;\n}", 3, "TypeError"},
+		{"thrown error", "function parse(bytes) {\n  if (bytes.length < 4) throw new Error('short frame');\n}", 2, "short frame"},
+		{"no I/O bindings", "function parse(bytes) {\n  return require('fs');\n}", 2, "require is not defined"},
+		{"missing parse", "var x = 1;", 0, "must define a parse"},
+		{"not an object", "function parse(bytes) { return 42; }", 0, "must return an object"},
+		{"stack overflow", "function f() { return f(); }\nfunction parse(bytes) { return f(); }", 0, "call stack"},
+		{"time limit", "function parse(bytes) { for (;;) {} }", 0, "exceeded time limit"},
+	}
+
+	engine := NewEngine()
+	engine.SetScriptTimeout(50 * time.Millisecond)
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &models.Parser{ID: string(rune('a' + i)), Type: ParserTypeJavaScript, Script: tt.script}
+
+			_, err := engine.Parse(context.Background(), p, []byte{0x01})
+			var scriptErr *ScriptError
+			if !errors.As(err, &scriptErr) {
+				t.Fatalf("Parse() error = %v, want *ScriptError", err)
+			}
+			if scriptErr.Line != tt.line {
+				t.Errorf("Line = %d, want %d (%v)", scriptErr.Line, tt.line, err)
+			}
+			if !strings.Contains(scriptErr.Message, tt.message) {
+				t.Errorf("Message = %q, want it to contain %q", scriptErr.Message, tt.message)
+			}
+		})
+	}
+}
+
+func TestParseScriptMemoryLimit(t *testing.T) {
+	engine := NewEngine()
+	// The time limit must not be reached first
+	engine.SetScriptTimeout(10 * time.Second)
+	engine.SetScriptMemoryLimit(1 << 20)
+
+	p := &models.Parser{ID: "p1", Type: ParserTypeJavaScript, Script: `function parse(bytes) {
+  var rows = [];
+  for (;;) rows.push(new Array(256).fill(rows.length));
+}`}
+
+	_, err := engine.Parse(context.Background(), p, []byte{0x01})
+	var scriptErr *ScriptError
+	if !errors.As(err, &scriptErr) {
+		t.Fatalf("Parse() error = %v, want *ScriptError", err)
+	}
+	if want := "script exceeded memory limit of 1 MiB"; scriptErr.Message != want {
+		t.Errorf("Message = %q, want %q", scriptErr.Message, want)
+	}
+}
@@ -0,0 +1,135 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+// FieldTrace describes how a single field was decoded during a dry run
+type FieldTrace struct {
+	Name     string      `json:"name"` // full name, e.g. ch[0].value for group members
+	DeviceID string      `json:"deviceId"`
+	DataType string      `json:"dataType"`
+	Offset   int         `json:"offset"` // first byte consumed
+	Length   int         `json:"length"` // bytes consumed; 0 for computed fields
+	Value    interface{} `json:"value,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Quality  string      `json:"quality"`
+}
+
+// ChecksumResult reports the outcome of the parser's checksum validation
+type ChecksumResult struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// TestResult is the outcome of a dry run. Fields lists every field with its
+// byte range and either its value or its error.
+type TestResult struct {
+	DeviceData map[string]map[string]interface{} `json:"deviceData"`
+	Fields     []FieldTrace                      `json:"fields"`
+	Checksum   *ChecksumResult                   `json:"checksum,omitempty"`
+	Error      string                            `json:"error,omitempty"` // failure of the parser as a whole
+}
+
+type tracer struct {
+	fields []FieldTrace
+}
+
+func (t *tracer) add(sc *scope, field models.ParserField, start, end int, err error) int {
+	t.fields = append(t.fields, FieldTrace{})
+	index := len(t.fields) - 1
+	t.set(index, sc, field, start, end, err)
+	return index
+}
+
+func (t *tracer) update(index int, sc *scope, field models.ParserField, end int, err error) {
+	t.set(index, sc, field, t.fields[index].Offset, end, err)
+}
+
+func (t *tracer) set(index int, sc *scope, field models.ParserField, start, end int, err error) {
+	entry := FieldTrace{
+		Name:     sc.prefix + field.Name,
+		DeviceID: sc.deviceID,
+		DataType: field.DataType,
+		Offset:   start,
+		Length:   max(end-start, 0),
+		Quality:  models.QualityGood,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		entry.Quality = models.QualityBad
+	} else if value, ok := sc.values[scopeKey{sc.deviceID, field.Name}]; ok {
+		entry.Value = value
+		if err := checkRange(field, value); err != nil {
+			entry.Error = err.Error()
+			entry.Quality = models.QualityOutOfRange
+		}
+	}
+	t.fields[index] = entry
+}
+
+// checkRange reports numeric values outside the field's Min and Max. Such
+// values are kept, since the device did send them.
+func checkRange(field models.ParserField, value interface{}) error {
+	number, ok := value.(float64)
+	if !ok {
+		return nil
+	}
+	if field.Min != nil && number < *field.Min {
+		return fmt.Errorf("%v below minimum %v", number, *field.Min)
+	}
+	if field.Max != nil && number > *field.Max {
+		return fmt.Errorf("%v above maximum %v", number, *field.Max)
+	}
+	return nil
+}
+
+// Test decodes a sample frame like Parse, but does not stop at a checksum
+// failure. It reports the checksum outcome, every field's byte range and
+// value or error, and the data Parse would have produced.
+func (e *Engine) Test(ctx context.Context, mparser *models.Parser, data []byte) *TestResult {
+	result := &TestResult{
+		DeviceData: make(map[string]map[string]interface{}),
+		Fields:     []FieldTrace{},
+	}
+
+	if mparser.Checksum != nil {
+		result.Checksum = &ChecksumResult{Valid: true}
+		if err := ValidateChecksum(mparser.Checksum, data); err != nil {
+			result.Checksum = &ChecksumResult{Error: err.Error()}
+		}
+	}
+
+	if mparser.Type == ParserTypeJavaScript || mparser.BuiltInType != "" {
+		var (
+			parsed *ParserResult
+			err    error
+		)
+		if mparser.Type == ParserTypeJavaScript {
+			parsed, err = e.parseScript(ctx, mparser, data)
+		} else {
+			parsed, err = e.parseBuiltIn(ctx, mparser, data)
+		}
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		result.DeviceData = parsed.DeviceData
+		return result
+	}
+
+	sc := newScope(nil)
+	sc.trace = &tracer{}
+	parsed, err := e.parseFields(mparser.Fields, data, sc)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if parsed != nil {
+		result.DeviceData = parsed.DeviceData
+	}
+	result.Fields = append(result.Fields, sc.trace.fields...)
+	return result
+}
@@ -0,0 +1,77 @@
+package parser
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+func TestEngineTest(t *testing.T) {
+	p := &models.Parser{
+		Checksum: &models.Checksum{Algorithm: ChecksumSum8},
+		Fields: []models.ParserField{
+			{Name: "type", DataType: "uint8", DeviceID: "dev-1"},
+			{Name: "ch", DataType: DataTypeGroup, DeviceID: "dev-1", Offset: 1, Count: 2, Fields: []models.ParserField{
+				{Name: "value", DataType: "uint16"},
+			}},
+			{Name: "total", DataType: DataTypeExpression, DeviceID: "dev-1", Expression: "type * 2"},
+			{Name: "broken", DataType: DataTypeExpression, DeviceID: "dev-1", Expression: "missing + 1"},
+			{Name: "far", DataType: "uint32", DeviceID: "dev-2", Offset: 4},
+			{Name: "flag", DataType: "bool", DeviceID: "dev-2", Offset: 5, BitOffset: 1},
+		},
+	}
+
+	// Trailing checksum byte is wrong on purpose
+	result := NewEngine().Test(context.Background(), p, []byte{0x03, 0x00, 0x01, 0x00, 0x02, 0x02, 0xFF})
+
+	if result.Checksum == nil || result.Checksum.Valid || result.Checksum.Error == "" {
+		t.Errorf("Checksum = %+v, want invalid", result.Checksum)
+	}
+	if result.Error != "" {
+		t.Errorf("Error = %q", result.Error)
+	}
+
+	want := []FieldTrace{
+		{Name: "type", DeviceID: "dev-1", DataType: "uint8", Offset: 0, Length: 1, Value: 3.0, Quality: models.QualityGood},
+		{Name: "ch", DeviceID: "dev-1", DataType: DataTypeGroup, Offset: 1, Length: 4, Value: []interface{}{
+			map[string]interface{}{"value": 1.0},
+			map[string]interface{}{"value": 2.0},
+		}, Quality: models.QualityGood},
+		{Name: "ch[0].value", DeviceID: "dev-1", DataType: "uint16", Offset: 1, Length: 2, Value: 1.0, Quality: models.QualityGood},
+		{Name: "ch[1].value", DeviceID: "dev-1", DataType: "uint16", Offset: 3, Length: 2, Value: 2.0, Quality: models.QualityGood},
+		{Name: "far", DeviceID: "dev-2", DataType: "uint32", Offset: 4, Length: 0, Error: "insufficient data for uint32", Quality: models.QualityBad},
+		{Name: "flag", DeviceID: "dev-2", DataType: "bool", Offset: 5, Length: 1, Value: true, Quality: models.QualityGood},
+		{Name: "total", DeviceID: "dev-1", DataType: DataTypeExpression, Offset: 0, Length: 0, Value: 6.0, Quality: models.QualityGood},
+		{Name: "broken", DeviceID: "dev-1", DataType: DataTypeExpression, Offset: 0, Length: 0, Error: "unknown field missing", Quality: models.QualityBad},
+	}
+	if !reflect.DeepEqual(result.Fields, want) {
+		t.Errorf("Fields =\n%+v\nwant\n%+v", result.Fields, want)
+	}
+
+	wantData := map[string]map[string]interface{}{
+		"dev-1": {"type": 3.0, "ch": want[1].Value, "total": 6.0},
+		"dev-2": {"flag": true},
+	}
+	if !reflect.DeepEqual(result.DeviceData, wantData) {
+		t.Errorf("DeviceData = %v, want %v", result.DeviceData, wantData)
+	}
+}
+
+func TestEngineTestScript(t *testing.T) {
+	p := &models.Parser{ID: "p1", Type: ParserTypeJavaScript, Script: "function parse(bytes) { return { level: bytes[0] }; }"}
+
+	result := NewEngine().Test(context.Background(), p, []byte{7})
+	if result.Error != "" {
+		t.Fatalf("Error = %q", result.Error)
+	}
+	if got := result.DeviceData[""]["level"]; got != 7.0 {
+		t.Errorf("level = %v, want 7", got)
+	}
+
+	p = &models.Parser{ID: "p2", Type: ParserTypeJavaScript, Script: "function parse(bytes) { return bytes[; }"}
+	if result := NewEngine().Test(context.Background(), p, []byte{7}); result.Error == "" {
+		t.Error("Error is empty for a script with a syntax error")
+	}
+}
@@ -0,0 +1,171 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+// DataTypeVariant marks a field that selects one of its Variants by the
+// value of the Switch field and decodes that layout in place.
+const DataTypeVariant = "variant"
+
+// scope holds the values and end offsets of the fields decoded so far, so
+// later fields can refer to them by name. Fields only see those of their own
+// device. Groups open a nested scope per element; lookups fall back to the
+// enclosing scopes.
+type scope struct {
+	parent *scope
+	values map[scopeKey]interface{}
+	ends   map[scopeKey]int
+
+	// Expression fields waiting for the raw fields of this scope
+	expressions []pendingExpression
+
+	// Set when tracing a dry run; see Engine.Test
+	trace    *tracer
+	deviceID string // of the field being decoded
+	prefix   string
+}
+
+type scopeKey struct {
+	deviceID string
+	name     string
+}
+
+func newScope(parent *scope) *scope {
+	sc := &scope{
+		parent: parent,
+		values: make(map[scopeKey]interface{}),
+		ends:   make(map[scopeKey]int),
+	}
+	if parent != nil {
+		sc.trace = parent.trace
+		sc.deviceID = parent.deviceID
+		sc.prefix = parent.prefix
+	}
+	return sc
+}
+
+func (s *scope) record(name string, value interface{}, end int) {
+	key := scopeKey{s.deviceID, name}
+	s.values[key] = value
+	s.ends[key] = end
+}
+
+func (s *scope) lookup(name string) (interface{}, int, bool) {
+	key := scopeKey{s.deviceID, name}
+	for sc := s; sc != nil; sc = sc.parent {
+		if value, ok := sc.values[key]; ok {
+			return value, sc.ends[key], true
+		}
+	}
+	return nil, 0, false
+}
+
+// resolve applies the field's references to earlier fields: After moves the
+// offset past the referenced field, LengthField and CountField supply the
+// byte length and the element count.
+func (s *scope) resolve(field models.ParserField, data []byte) (models.ParserField, error) {
+	if field.After != "" {
+		_, end, ok := s.lookup(field.After)
+		if !ok {
+			return field, fmt.Errorf("field %s must be decoded before %s", field.After, field.Name)
+		}
+		field.Offset += end
+	}
+
+	if field.LengthField != "" {
+		length, err := s.lookupCount(field.LengthField)
+		if err != nil {
+			return field, err
+		}
+		if field.Offset+length > len(data) {
+			return field, fmt.Errorf("length %d from %s exceeds frame of %d bytes", length, field.LengthField, len(data))
+		}
+		field.ArrayLength = length
+	}
+
+	if field.CountField != "" {
+		count, err := s.lookupCount(field.CountField)
+		if err != nil {
+			return field, err
+		}
+		field.Count = count
+	}
+
+	return field, nil
+}
+
+// lookupCount returns a previously decoded field as a non-negative integer
+func (s *scope) lookupCount(name string) (int, error) {
+	value, _, ok := s.lookup(name)
+	if !ok {
+		return 0, fmt.Errorf("field %s not decoded yet", name)
+	}
+	number, ok := value.(float64)
+	if !ok || number < 0 || number > math.MaxInt32 || number != math.Trunc(number) {
+		return 0, fmt.Errorf("field %s is not a valid length: %v", name, value)
+	}
+	return int(number), nil
+}
+
+// decodeVariant decodes the layout selected by the Switch field. Member
+// offsets are relative to the variant's own offset, and members are added to
+// the enclosing field set rather than nested.
+func (e *Engine) decodeVariant(field models.ParserField, data []byte, out map[string]interface{}, sc *scope) (int, error) {
+	discriminator, _, ok := sc.lookup(field.Switch)
+	if !ok {
+		return 0, fmt.Errorf("switch field %s not decoded yet", field.Switch)
+	}
+
+	variant := matchVariant(field.Variants, discriminator)
+	if variant == nil {
+		return 0, fmt.Errorf("no variant matches %s = %v", field.Switch, discriminator)
+	}
+
+	end := field.Offset
+	for _, member := range variant.Fields {
+		if member.After == "" {
+			member.Offset += field.Offset
+		}
+		memberEnd, err := e.decodeField(member, data, out, sc)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", member.Name, err)
+		}
+		end = max(end, memberEnd)
+	}
+	return end, nil
+}
+
+// matchVariant returns the first variant matching the discriminator, or the
+// default variant. Numeric matches may be written in decimal or as 0x hex.
+func matchVariant(variants []models.ParserVariant, discriminator interface{}) *models.ParserVariant {
+	var fallback *models.ParserVariant
+	for i := range variants {
+		variant := &variants[i]
+		if variant.Match == "" {
+			if fallback == nil {
+				fallback = variant
+			}
+			continue
+		}
+
+		switch value := discriminator.(type) {
+		case float64:
+			if match, err := strconv.ParseInt(variant.Match, 0, 64); err == nil && float64(match) == value {
+				return variant
+			}
+			if match, err := strconv.ParseFloat(variant.Match, 64); err == nil && match == value {
+				return variant
+			}
+		default:
+			if fmt.Sprint(value) == variant.Match {
+				return variant
+			}
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,184 @@
+package parser
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+func TestParseVariants(t *testing.T) {
+	// Message type byte followed by a type-specific body
+	p := &models.Parser{Fields: []models.ParserField{
+		{Name: "type", DataType: "uint8"},
+		{DataType: DataTypeVariant, Switch: "type", Offset: 1, Variants: []models.ParserVariant{
+			{Match: "1", Fields: []models.ParserField{
+				{Name: "temperature", DataType: "int16", Scale: 0.5},
+			}},
+			{Match: "0x02", Fields: []models.ParserField{
+				{Name: "length", DataType: "uint8"},
+				{Name: "tag", DataType: "string", Offset: 1, LengthField: "length"},
+				{Name: "code", DataType: "uint16", After: "tag"},
+			}},
+			{Match: "3", Fields: []models.ParserField{
+				{Name: "count", DataType: "uint8"},
+				{Name: "readings", DataType: "uint16", Offset: 1, CountField: "count"},
+			}},
+			{Fields: []models.ParserField{
+				{Name: "body", DataType: "raw_bytes"},
+			}},
+		}},
+	}}
+
+	tests := []struct {
+		name string
+		data []byte
+		want map[string]interface{}
+		bad  []string
+	}{
+		{
+			name: "fixed layout",
+			data: []byte{0x01, 0x00, 0x2A},
+			want: map[string]interface{}{"type": 1.0, "temperature": 21.0},
+		},
+		{
+			name: "length prefixed string",
+			data: []byte{0x02, 0x03, 'a', 'b', 'c', 0x00, 0x07},
+			want: map[string]interface{}{"type": 2.0, "length": 3.0, "tag": "abc", "code": 7.0},
+		},
+		{
+			name: "empty string",
+			data: []byte{0x02, 0x00, 0x00, 0x07},
+			want: map[string]interface{}{"type": 2.0, "length": 0.0, "tag": "", "code": 7.0},
+		},
+		{
+			name: "counted array",
+			data: []byte{0x03, 0x02, 0x00, 0x01, 0x00, 0x02},
+			want: map[string]interface{}{"type": 3.0, "count": 2.0, "readings": []interface{}{1.0, 2.0}},
+		},
+		{
+			name: "empty counted array",
+			data: []byte{0x03, 0x00},
+			want: map[string]interface{}{"type": 3.0, "count": 0.0, "readings": []interface{}{}},
+		},
+		{
+			name: "default variant",
+			data: []byte{0x09, 0xAA},
+			want: map[string]interface{}{"type": 9.0, "body": []byte{0xAA}},
+		},
+		{
+			name: "length beyond frame",
+			data: []byte{0x02, 0x05, 'a', 'b'},
+			want: map[string]interface{}{"type": 2.0, "length": 5.0},
+			bad:  []string{"tag", "code"},
+		},
+	}
+
+	engine := NewEngine()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := engine.Parse(context.Background(), p, tt.data)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if got := result.DeviceData[""]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DeviceData = %v, want %v", got, tt.want)
+			}
+			checkBadFields(t, result, tt.bad)
+		})
+	}
+}
+
+func TestParseVariableLengthGroups(t *testing.T) {
+	p := &models.Parser{Fields: []models.ParserField{
+		{Name: "count", DataType: "uint8"},
+		{Name: "records", DataType: DataTypeGroup, Offset: 1, CountField: "count", Fields: []models.ParserField{
+			{Name: "length", DataType: "uint8"},
+			{Name: "name", DataType: "string", Offset: 1, LengthField: "length"},
+		}},
+		{Name: "checksum", DataType: "uint8", After: "records"},
+	}}
+
+	result, err := NewEngine().Parse(context.Background(), p, []byte{2, 1, 'x', 2, 'y', 'z', 0xEE})
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	want := map[string]interface{}{
+		"count": 2.0,
+		"records": []interface{}{
+			map[string]interface{}{"length": 1.0, "name": "x"},
+			map[string]interface{}{"length": 2.0, "name": "yz"},
+		},
+		"checksum": 238.0,
+	}
+	if got := result.DeviceData[""]; !reflect.DeepEqual(got, want) {
+		t.Errorf("DeviceData = %v, want %v", got, want)
+	}
+}
+
+func TestParseVariantErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []models.ParserField
+		bad    string
+	}{
+		{"no matching variant", []models.ParserField{
+			{Name: "type", DataType: "uint8"},
+			{DataType: DataTypeVariant, Switch: "type", Variants: []models.ParserVariant{{Match: "7"}}},
+		}, DataTypeVariant},
+		{"switch not decoded", []models.ParserField{
+			{DataType: DataTypeVariant, Switch: "type", Variants: []models.ParserVariant{{}}},
+		}, DataTypeVariant},
+		{"after unknown field", []models.ParserField{
+			{Name: "value", DataType: "uint8", After: "header"},
+		}, "value"},
+		{"length from string", []models.ParserField{
+			{Name: "tag", DataType: "string", ArrayLength: 1},
+			{Name: "body", DataType: "raw_bytes", LengthField: "tag"},
+		}, "body"},
+	}
+
+	engine := NewEngine()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &models.Parser{Fields: tt.fields}
+			result, err := engine.Parse(context.Background(), p, []byte{0x01, 0x02})
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			checkBadFields(t, result, []string{tt.bad})
+		})
+	}
+}
+
+func TestParseReferencesStayWithinDevice(t *testing.T) {
+	// Both devices have a count; each array and expression must use its own
+	p := &models.Parser{Fields: []models.ParserField{
+		{Name: "count", DataType: "uint8", DeviceID: "dev-1"},
+		{Name: "count", DataType: "uint8", DeviceID: "dev-2", Offset: 1},
+		{Name: "values", DataType: "uint8", DeviceID: "dev-1", Offset: 2, CountField: "count"},
+		{Name: "values", DataType: "uint8", DeviceID: "dev-2", Offset: 1, After: "count", CountField: "count"},
+		{Name: "total", DataType: DataTypeExpression, DeviceID: "dev-1", Expression: "count * 10"},
+		{Name: "total", DataType: DataTypeExpression, DeviceID: "dev-2", Expression: "count * 10"},
+		{Name: "orphan", DataType: "uint8", DeviceID: "dev-3", Offset: 2, CountField: "count"},
+	}}
+
+	result, err := NewEngine().Parse(context.Background(), p, []byte{1, 3, 7, 8, 9, 10})
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	want := map[string]map[string]interface{}{
+		"dev-1": {"count": 1.0, "values": []interface{}{7.0}, "total": 10.0},
+		"dev-2": {"count": 3.0, "values": []interface{}{8.0, 9.0, 10.0}, "total": 30.0},
+		"dev-3": {},
+	}
+	if !reflect.DeepEqual(result.DeviceData, want) {
+		t.Errorf("DeviceData = %v, want %v", result.DeviceData, want)
+	}
+	if q := result.Quality["dev-3"]["orphan"]; q.Quality != models.QualityBad {
+		t.Errorf("Quality of a count from another device = %+v, want bad", q)
+	}
+}
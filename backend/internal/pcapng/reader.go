@@ -0,0 +1,225 @@
+package pcapng
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// ErrNotPcapng is returned when a file does not start with a section header
+var ErrNotPcapng = errors.New("not a pcapng file")
+
+const (
+	blockSimplePacket uint32 = 0x00000003
+
+	optionTimestampResolution uint16 = 9 // if_tsresol
+
+	maxBlockLength = 16 << 20
+)
+
+// Packet is a packet read from a pcapng file
+type Packet struct {
+	Timestamp time.Time
+	LinkType  uint16
+	Direction Direction // 0 when the file does not record it
+	Data      []byte
+}
+
+type iface struct {
+	linkType       uint16
+	ticksPerSecond uint64
+}
+
+// Reader reads the packets of a pcapng file, section by section. Both byte
+// orders are supported.
+type Reader struct {
+	r          io.Reader
+	order      binary.ByteOrder
+	interfaces []iface
+}
+
+// NewReader reads the first section header
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: r}
+	blockType, _, err := reader.readBlock()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrNotPcapng
+		}
+		return nil, err
+	}
+	if blockType != blockSectionHeader {
+		return nil, ErrNotPcapng
+	}
+	return reader, nil
+}
+
+// Next returns the next packet, or io.EOF after the last one. Blocks other
+// than interface descriptions and packets are skipped.
+func (r *Reader) Next() (*Packet, error) {
+	for {
+		blockType, body, err := r.readBlock()
+		if err != nil {
+			return nil, err
+		}
+
+		switch blockType {
+		case blockSectionHeader:
+			r.interfaces = nil
+		case blockInterface:
+			if len(body) < 8 {
+				return nil, fmt.Errorf("interface description too short")
+			}
+			r.interfaces = append(r.interfaces, r.parseInterface(body))
+		case blockEnhancedPacket:
+			return r.parseEnhancedPacket(body)
+		case blockSimplePacket:
+			if len(r.interfaces) == 0 || len(body) < 4 {
+				return nil, fmt.Errorf("invalid simple packet block")
+			}
+			length := min(int(r.order.Uint32(body[0:4])), len(body)-4)
+			return &Packet{LinkType: r.interfaces[0].linkType, Data: body[4 : 4+length]}, nil
+		}
+	}
+}
+
+// readBlock reads one block and returns its body. The byte order is taken
+// from each section header.
+func (r *Reader) readBlock() (uint32, []byte, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r.r, header[:8]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, nil, fmt.Errorf("truncated block: %w", err)
+		}
+		return 0, nil, err
+	}
+
+	if binary.LittleEndian.Uint32(header[0:4]) == blockSectionHeader {
+		if _, err := io.ReadFull(r.r, header[8:12]); err != nil {
+			return 0, nil, fmt.Errorf("truncated section header: %w", err)
+		}
+		switch byteOrderMagic {
+		case binary.LittleEndian.Uint32(header[8:12]):
+			r.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(header[8:12]):
+			r.order = binary.BigEndian
+		default:
+			return 0, nil, ErrNotPcapng
+		}
+	} else if r.order == nil {
+		return 0, nil, ErrNotPcapng
+	}
+
+	blockType := r.order.Uint32(header[0:4])
+	length := r.order.Uint32(header[4:8])
+	if length < 12 || length%4 != 0 || length > maxBlockLength {
+		return 0, nil, fmt.Errorf("invalid block length %d", length)
+	}
+
+	rest := make([]byte, length-8)
+	read := 0
+	if blockType == blockSectionHeader {
+		read = copy(rest, header[8:12])
+	}
+	if _, err := io.ReadFull(r.r, rest[read:]); err != nil {
+		return 0, nil, fmt.Errorf("truncated block: %w", err)
+	}
+	return blockType, rest[:len(rest)-4], nil
+}
+
+func (r *Reader) parseInterface(body []byte) iface {
+	result := iface{linkType: r.order.Uint16(body[0:2]), ticksPerSecond: 1_000_000}
+	if value := r.options(body[8:])[optionTimestampResolution]; len(value) >= 1 {
+		// The high bit selects a negative power of two instead of ten
+		base := uint64(10)
+		if value[0]&0x80 != 0 {
+			base = 2
+		}
+		result.ticksPerSecond = 1
+		for i := 0; i < int(value[0]&0x7F) && result.ticksPerSecond <= math.MaxUint64/base; i++ {
+			result.ticksPerSecond *= base
+		}
+	}
+	return result
+}
+
+func (r *Reader) parseEnhancedPacket(body []byte) (*Packet, error) {
+	if len(body) < 20 {
+		return nil, fmt.Errorf("enhanced packet block too short")
+	}
+
+	index := int(r.order.Uint32(body[0:4]))
+	if index >= len(r.interfaces) {
+		return nil, fmt.Errorf("packet for unknown interface %d", index)
+	}
+	iface := r.interfaces[index]
+
+	ticks := uint64(r.order.Uint32(body[4:8]))<<32 | uint64(r.order.Uint32(body[8:12]))
+	captured := int(r.order.Uint32(body[12:16]))
+	padded := (captured + 3) &^ 3
+	if 20+padded > len(body) {
+		return nil, fmt.Errorf("packet data exceeds block")
+	}
+
+	packet := &Packet{
+		Timestamp: time.Unix(int64(ticks/iface.ticksPerSecond), int64(float64(ticks%iface.ticksPerSecond)/float64(iface.ticksPerSecond)*1e9)),
+		LinkType:  iface.linkType,
+		Data:      body[20 : 20+captured],
+	}
+	for code, value := range r.options(body[20+padded:]) {
+		if code == optionFlags && len(value) >= 4 {
+			packet.Direction = Direction(r.order.Uint32(value) & 0x3)
+		}
+	}
+	return packet, nil
+}
+
+// options returns the options of a block by code
+func (r *Reader) options(data []byte) map[uint16][]byte {
+	options := make(map[uint16][]byte)
+	for len(data) >= 4 {
+		code := r.order.Uint16(data[0:2])
+		length := int(r.order.Uint16(data[2:4]))
+		if code == optionEnd || 4+length > len(data) {
+			break
+		}
+		options[code] = data[4 : 4+length]
+		data = data[4+(length+3)&^3:]
+	}
+	return options
+}
+
+// TCPPayload returns the TCP payload of an IPv4 or IPv6 packet, as found in
+// LinkTypeRaw captures, and whether the packet is TCP at all
+func TCPPayload(packet []byte) ([]byte, bool) {
+	var segment []byte
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		headerLength := int(packet[0]&0x0F) * 4
+		totalLength := int(binary.BigEndian.Uint16(packet[2:4]))
+		if packet[9] != 6 || headerLength < 20 || totalLength < headerLength || totalLength > len(packet) {
+			return nil, false
+		}
+		segment = packet[headerLength:totalLength]
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		payloadLength := int(binary.BigEndian.Uint16(packet[4:6]))
+		if packet[6] != 6 || 40+payloadLength > len(packet) {
+			return nil, false
+		}
+		segment = packet[40 : 40+payloadLength]
+	default:
+		return nil, false
+	}
+
+	if len(segment) < 20 {
+		return nil, false
+	}
+	dataOffset := int(segment[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(segment) {
+		return nil, false
+	}
+	return segment[dataOffset:], true
+}
@@ -0,0 +1,69 @@
+package pcapng
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestReaderRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, LinkTypeRaw)
+	if err != nil {
+		t.Fatalf("NewWriter() error = %v", err)
+	}
+
+	stream := &TCPStream{
+		Client: netip.MustParseAddrPort("192.0.2.1:49152"),
+		Server: netip.MustParseAddrPort("192.0.2.2:502"),
+	}
+	start := time.UnixMilli(1704067200000)
+	payloads := []struct {
+		direction Direction
+		data      []byte
+	}{
+		{Outbound, []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x06, 0x01, 0x03, 0x00, 0x00, 0x00, 0x01}},
+		{Inbound, []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x05, 0x01, 0x03, 0x02, 0x00, 0x2A}},
+	}
+	for i, p := range payloads {
+		packet := stream.Packets(p.direction == Outbound, p.data)[0]
+		if err := w.WritePacket(start.Add(time.Duration(i)*250*time.Millisecond), p.direction, packet); err != nil {
+			t.Fatalf("WritePacket() error = %v", err)
+		}
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	for i, p := range payloads {
+		packet, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		if packet.LinkType != LinkTypeRaw || packet.Direction != p.direction {
+			t.Errorf("packet %d: link type %d, direction %d", i, packet.LinkType, packet.Direction)
+		}
+		if want := start.Add(time.Duration(i) * 250 * time.Millisecond); !packet.Timestamp.Equal(want) {
+			t.Errorf("packet %d: timestamp %v, want %v", i, packet.Timestamp, want)
+		}
+		payload, ok := TCPPayload(packet.Data)
+		if !ok || !bytes.Equal(payload, p.data) {
+			t.Errorf("packet %d: payload % x, want % x", i, payload, p.data)
+		}
+	}
+	if _, err := r.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("Next() after last packet error = %v, want EOF", err)
+	}
+}
+
+func TestReaderNotPcapng(t *testing.T) {
+	for _, data := range []string{"", `[{"id":1}]`} {
+		if _, err := NewReader(bytes.NewReader([]byte(data))); !errors.Is(err, ErrNotPcapng) {
+			t.Errorf("NewReader(%q) error = %v, want ErrNotPcapng", data, err)
+		}
+	}
+}
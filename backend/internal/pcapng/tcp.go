@@ -0,0 +1,96 @@
+package pcapng
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// maxSegment is the largest payload that fits a single IPv4 packet
+const maxSegment = 65535 - 40
+
+// TCPStream wraps payloads in IPv4 and TCP headers of a single connection,
+// so that analysers dissect them like traffic captured on the network, e.g.
+// as Modbus/TCP when the server port is 502. Sequence numbers follow the
+// bytes sent in each direction.
+type TCPStream struct {
+	Client netip.AddrPort
+	Server netip.AddrPort
+
+	clientSeq uint32
+	serverSeq uint32
+}
+
+// Packets returns the IPv4 packets carrying a payload sent by the client or
+// by the server. Payloads too large for one packet are split.
+func (s *TCPStream) Packets(fromClient bool, payload []byte) [][]byte {
+	var packets [][]byte
+	for {
+		n := min(len(payload), maxSegment)
+		packets = append(packets, s.packet(fromClient, payload[:n]))
+		payload = payload[n:]
+		if len(payload) == 0 {
+			return packets
+		}
+	}
+}
+
+func (s *TCPStream) packet(fromClient bool, payload []byte) []byte {
+	src, dst := s.Client, s.Server
+	seq, ack := &s.clientSeq, s.serverSeq
+	if !fromClient {
+		src, dst = s.Server, s.Client
+		seq, ack = &s.serverSeq, s.clientSeq
+	}
+
+	packet := make([]byte, 40+len(payload))
+
+	ip := packet[:20]
+	ip[0] = 0x45 // version 4, 20 byte header
+	binary.BigEndian.PutUint16(ip[2:4], uint16(len(packet)))
+	binary.BigEndian.PutUint16(ip[6:8], 0x4000) // don't fragment
+	ip[8] = 64                                  // TTL
+	ip[9] = 6                                   // TCP
+	srcAddr, dstAddr := src.Addr().As4(), dst.Addr().As4()
+	copy(ip[12:16], srcAddr[:])
+	copy(ip[16:20], dstAddr[:])
+	binary.BigEndian.PutUint16(ip[10:12], checksum(0, ip))
+
+	tcp := packet[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:4], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:8], *seq)
+	binary.BigEndian.PutUint32(tcp[8:12], ack)
+	tcp[12] = 5 << 4 // 20 byte header
+	tcp[13] = 0x18   // PSH, ACK
+	binary.BigEndian.PutUint16(tcp[14:16], 0xFFFF)
+	copy(tcp[20:], payload)
+
+	pseudo := make([]byte, 12)
+	copy(pseudo[0:4], srcAddr[:])
+	copy(pseudo[4:8], dstAddr[:])
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:18], checksum(sum(0, pseudo), tcp))
+
+	*seq += uint32(len(payload))
+	return packet
+}
+
+// checksum is the Internet checksum of data, continuing a partial sum
+func checksum(partial uint32, data []byte) uint16 {
+	total := sum(partial, data)
+	for total > 0xFFFF {
+		total = total>>16 + total&0xFFFF
+	}
+	return ^uint16(total)
+}
+
+func sum(partial uint32, data []byte) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		partial += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		partial += uint32(data[len(data)-1]) << 8
+	}
+	return partial
+}
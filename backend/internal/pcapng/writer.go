@@ -0,0 +1,98 @@
+// Package pcapng writes captured frames in the pcapng format read by
+// Wireshark and tcpdump.
+package pcapng
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Link types of the single interface in a file
+const (
+	LinkTypeRaw   uint16 = 101 // IPv4 or IPv6 packets without a link-layer header
+	LinkTypeUser0 uint16 = 147 // user defined, used for serial frames such as Modbus RTU
+)
+
+// Direction of a packet relative to the capturing host
+type Direction uint32
+
+const (
+	Inbound  Direction = 1
+	Outbound Direction = 2
+)
+
+const (
+	blockSectionHeader  uint32 = 0x0A0D0D0A
+	blockInterface      uint32 = 0x00000001
+	blockEnhancedPacket uint32 = 0x00000006
+
+	byteOrderMagic uint32 = 0x1A2B3C4D
+
+	optionEnd   uint16 = 0
+	optionFlags uint16 = 2 // epb_flags; bits 0-1 hold the direction
+)
+
+// Writer writes a pcapng section with one interface
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter writes the section header and the interface description for the
+// link type. Timestamps are stored in microseconds.
+func NewWriter(w io.Writer, linkType uint16) (*Writer, error) {
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:4], byteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:6], 1) // major version
+	binary.LittleEndian.PutUint16(shb[6:8], 0) // minor version
+	binary.LittleEndian.PutUint64(shb[8:16], ^uint64(0))
+	if err := writeBlock(w, blockSectionHeader, shb); err != nil {
+		return nil, fmt.Errorf("failed to write section header: %w", err)
+	}
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:2], linkType)
+	binary.LittleEndian.PutUint32(idb[4:8], 0) // no snap length limit
+	if err := writeBlock(w, blockInterface, idb); err != nil {
+		return nil, fmt.Errorf("failed to write interface description: %w", err)
+	}
+
+	return &Writer{w: w}, nil
+}
+
+// WritePacket writes one packet as an enhanced packet block
+func (w *Writer) WritePacket(timestamp time.Time, direction Direction, data []byte) error {
+	micros := uint64(timestamp.UnixMicro())
+	padded := (len(data) + 3) &^ 3
+
+	body := make([]byte, 20+padded+12)
+	binary.LittleEndian.PutUint32(body[0:4], 0) // interface ID
+	binary.LittleEndian.PutUint32(body[4:8], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(micros))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(len(data)))
+	copy(body[20:], data)
+
+	options := body[20+padded:]
+	binary.LittleEndian.PutUint16(options[0:2], optionFlags)
+	binary.LittleEndian.PutUint16(options[2:4], 4)
+	binary.LittleEndian.PutUint32(options[4:8], uint32(direction))
+	binary.LittleEndian.PutUint16(options[8:10], optionEnd)
+
+	return writeBlock(w.w, blockEnhancedPacket, body)
+}
+
+// writeBlock frames a block body, which must be padded to 32 bits, with its
+// type and leading and trailing total length
+func writeBlock(w io.Writer, blockType uint32, body []byte) error {
+	block := make([]byte, 12+len(body))
+	length := uint32(len(block))
+	binary.LittleEndian.PutUint32(block[0:4], blockType)
+	binary.LittleEndian.PutUint32(block[4:8], length)
+	copy(block[8:], body)
+	binary.LittleEndian.PutUint32(block[len(block)-4:], length)
+
+	_, err := w.Write(block)
+	return err
+}
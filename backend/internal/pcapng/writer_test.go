@@ -0,0 +1,102 @@
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, LinkTypeUser0)
+	if err != nil {
+		t.Fatalf("NewWriter() error = %v", err)
+	}
+
+	timestamp := time.UnixMilli(1704067200123)
+	frame := []byte{0x01, 0x03, 0x02, 0x00, 0xD2}
+	if err := w.WritePacket(timestamp, Outbound, frame); err != nil {
+		t.Fatalf("WritePacket() error = %v", err)
+	}
+
+	// Walk the blocks, checking that both length fields agree
+	data := buf.Bytes()
+	var blocks [][]byte
+	for len(data) > 0 {
+		length := binary.LittleEndian.Uint32(data[4:8])
+		if int(length) > len(data) || length%4 != 0 {
+			t.Fatalf("invalid block length %d", length)
+		}
+		if trailer := binary.LittleEndian.Uint32(data[length-4 : length]); trailer != length {
+			t.Fatalf("trailing length %d, want %d", trailer, length)
+		}
+		blocks = append(blocks, data[:length])
+		data = data[length:]
+	}
+
+	if len(blocks) != 3 {
+		t.Fatalf("got %d blocks, want 3", len(blocks))
+	}
+	if magic := binary.LittleEndian.Uint32(blocks[0][8:12]); magic != byteOrderMagic {
+		t.Errorf("byte order magic = %#x", magic)
+	}
+	if linkType := binary.LittleEndian.Uint16(blocks[1][8:10]); linkType != LinkTypeUser0 {
+		t.Errorf("link type = %d, want %d", linkType, LinkTypeUser0)
+	}
+
+	epb := blocks[2]
+	if blockType := binary.LittleEndian.Uint32(epb[0:4]); blockType != blockEnhancedPacket {
+		t.Fatalf("block type = %#x, want enhanced packet", blockType)
+	}
+	micros := uint64(binary.LittleEndian.Uint32(epb[12:16]))<<32 | uint64(binary.LittleEndian.Uint32(epb[16:20]))
+	if micros != uint64(timestamp.UnixMicro()) {
+		t.Errorf("timestamp = %d, want %d", micros, timestamp.UnixMicro())
+	}
+	if captured := binary.LittleEndian.Uint32(epb[20:24]); captured != uint32(len(frame)) {
+		t.Errorf("captured length = %d", captured)
+	}
+	if !bytes.Equal(epb[28:28+len(frame)], frame) {
+		t.Errorf("packet data = % x", epb[28:28+len(frame)])
+	}
+	options := epb[36:]
+	if code, flags := binary.LittleEndian.Uint16(options[0:2]), binary.LittleEndian.Uint32(options[4:8]); code != optionFlags || flags != uint32(Outbound) {
+		t.Errorf("option %d = %d, want flags %d", code, flags, Outbound)
+	}
+}
+
+func TestTCPStream(t *testing.T) {
+	stream := &TCPStream{
+		Client: netip.MustParseAddrPort("192.0.2.1:49152"),
+		Server: netip.MustParseAddrPort("192.0.2.2:502"),
+	}
+
+	request := stream.Packets(true, []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x06, 0x01, 0x03, 0x00, 0x00, 0x00, 0x01})
+	response := stream.Packets(false, []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x05, 0x01, 0x03, 0x02, 0x00, 0x2A})
+	next := stream.Packets(true, []byte{0x00})
+
+	if len(request) != 1 || len(response) != 1 || len(next) != 1 {
+		t.Fatalf("got %d, %d and %d packets, want one each", len(request), len(response), len(next))
+	}
+
+	for _, packet := range [][]byte{request[0], response[0], next[0]} {
+		if got := checksum(0, packet[:20]); got != 0 {
+			t.Errorf("IPv4 header checksum does not verify: %#04x", got)
+		}
+		pseudo := append(append([]byte{}, packet[12:20]...), 0, 6, 0, byte(len(packet)-20))
+		if got := checksum(sum(0, pseudo), packet[20:]); got != 0 {
+			t.Errorf("TCP checksum does not verify: %#04x", got)
+		}
+	}
+
+	if port := binary.BigEndian.Uint16(response[0][20:22]); port != 502 {
+		t.Errorf("response source port = %d, want 502", port)
+	}
+	if seq := binary.BigEndian.Uint32(next[0][24:28]); seq != 12 {
+		t.Errorf("client sequence = %d, want 12", seq)
+	}
+	if ack := binary.BigEndian.Uint32(next[0][28:32]); ack != 11 {
+		t.Errorf("client acknowledgement = %d, want 11", ack)
+	}
+}
@@ -0,0 +1,361 @@
+package modbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	protocol "github.com/iotstudio/iotstudio/internal/protocols"
+	"github.com/iotstudio/iotstudio/pkg/api"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultGatewayQueueSize = 32
+	defaultGatewayTimeout   = 5 * time.Second
+)
+
+// Transactor forwards raw request PDUs; implemented by ModbusTCPHandler and ModbusRTUHandler
+type Transactor interface {
+	Transact(ctx context.Context, unitID uint8, pdu []byte) ([]byte, error)
+}
+
+// GatewayRoute sends requests for a unit ID to the handler of a connection
+type GatewayRoute struct {
+	UnitID       uint8
+	ConnectionID string
+	TargetUnitID uint8 // unit addressed upstream, 0 keeps UnitID
+}
+
+type GatewayConfig struct {
+	Addr      string
+	Routes    []GatewayRoute
+	Handlers  func(connID string) (protocol.ProtocolHandler, error)
+	QueueSize int           // pending requests per upstream connection
+	Timeout   time.Duration // per request, including time spent queued
+}
+
+// Gateway accepts Modbus TCP (MBAP) requests and forwards them to the RTU or
+// TCP handler routed for their unit ID. Each upstream connection has its own
+// queue served by a single worker, so a serial bus only ever carries one
+// transaction at a time.
+type Gateway struct {
+	config   GatewayConfig
+	routes   map[uint8]GatewayRoute
+	listener net.Listener
+	done     chan struct{}
+	stop     sync.Once
+
+	mu      sync.Mutex
+	buses   map[string]*gatewayBus
+	clients map[net.Conn]struct{}
+	metrics api.GatewayMetrics
+}
+
+type gatewayBus struct {
+	queue        chan *gatewayRequest
+	requests     int64
+	errors       int64
+	totalLatency time.Duration
+}
+
+type gatewayRequest struct {
+	ctx      context.Context
+	route    GatewayRoute
+	pdu      []byte
+	response chan []byte
+}
+
+func NewGateway(config GatewayConfig) *Gateway {
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultGatewayQueueSize
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultGatewayTimeout
+	}
+
+	routes := make(map[uint8]GatewayRoute, len(config.Routes))
+	for _, route := range config.Routes {
+		if route.TargetUnitID == 0 {
+			route.TargetUnitID = route.UnitID
+		}
+		routes[route.UnitID] = route
+	}
+
+	return &Gateway{
+		config:  config,
+		routes:  routes,
+		done:    make(chan struct{}),
+		buses:   make(map[string]*gatewayBus),
+		clients: make(map[net.Conn]struct{}),
+	}
+}
+
+func (g *Gateway) Listen() error {
+	listener, err := net.Listen("tcp", g.config.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", g.config.Addr, err)
+	}
+
+	g.mu.Lock()
+	g.listener = listener
+	g.mu.Unlock()
+
+	log.Info().Str("addr", listener.Addr().String()).Int("routes", len(g.routes)).Msg("Modbus gateway listening")
+	return nil
+}
+
+func (g *Gateway) Addr() net.Addr {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.listener == nil {
+		return nil
+	}
+	return g.listener.Addr()
+}
+
+// Serve accepts Modbus TCP clients until the context is cancelled
+func (g *Gateway) Serve(ctx context.Context) error {
+	g.mu.Lock()
+	listener := g.listener
+	g.mu.Unlock()
+
+	if listener == nil {
+		return errors.New("modbus gateway is not listening")
+	}
+
+	go func() {
+		<-ctx.Done()
+		g.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("accept failed: %w", err)
+		}
+
+		g.mu.Lock()
+		g.clients[conn] = struct{}{}
+		g.metrics.ActiveClients++
+		g.mu.Unlock()
+
+		go g.serveClient(ctx, conn)
+	}
+}
+
+func (g *Gateway) Close() error {
+	g.stop.Do(func() { close(g.done) })
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var err error
+	if g.listener != nil {
+		err = g.listener.Close()
+	}
+	for conn := range g.clients {
+		conn.Close()
+	}
+	return err
+}
+
+func (g *Gateway) GetMetrics() api.GatewayMetrics {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	metrics := g.metrics
+	metrics.Buses = make(map[string]api.GatewayBusMetrics, len(g.buses))
+	for id, bus := range g.buses {
+		m := api.GatewayBusMetrics{
+			QueueDepth: len(bus.queue),
+			Requests:   bus.requests,
+			ErrorCount: bus.errors,
+		}
+		if bus.requests > 0 {
+			m.AverageLatency = float64(bus.totalLatency.Microseconds()) / float64(bus.requests) / 1000
+		}
+		metrics.Buses[id] = m
+	}
+	return metrics
+}
+
+func (g *Gateway) serveClient(ctx context.Context, conn net.Conn) {
+	defer func() {
+		conn.Close()
+		g.mu.Lock()
+		delete(g.clients, conn)
+		g.metrics.ActiveClients--
+		g.mu.Unlock()
+	}()
+
+	header := make([]byte, 7)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+
+		mbap, _ := ParseMBAPHeader(header)
+		if mbap.ProtocolID != 0 || mbap.Length < 2 || mbap.Length > maxPDULength+1 {
+			log.Warn().Str("client", conn.RemoteAddr().String()).Msg("Invalid MBAP header, closing gateway client")
+			return
+		}
+
+		pdu := make([]byte, mbap.Length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+
+		response := g.forward(ctx, mbap.UnitID, pdu)
+		if len(response) == 0 {
+			// Broadcasts get no response
+			continue
+		}
+
+		frame := BuildMBAPFrame(NewMBAPHeader(mbap.TransactionID, mbap.UnitID, uint16(len(response))), response)
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+// forward queues the request on the bus routed for the unit ID and waits
+// for its response, answering with a gateway exception on failure. The
+// response to a broadcast is empty.
+func (g *Gateway) forward(ctx context.Context, unitID uint8, pdu []byte) []byte {
+	g.mu.Lock()
+	g.metrics.Requests++
+	g.mu.Unlock()
+
+	route, ok := g.routes[unitID]
+	if !ok {
+		return g.exception(pdu[0], ExceptionGatewayPathUnavailable)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, g.config.Timeout)
+	defer cancel()
+
+	req := &gatewayRequest{ctx: ctx, route: route, pdu: pdu, response: make(chan []byte, 1)}
+
+	select {
+	case g.bus(route.ConnectionID).queue <- req:
+	default:
+		g.mu.Lock()
+		g.metrics.Rejected++
+		g.mu.Unlock()
+		return g.exception(pdu[0], ExceptionServerDeviceBusy)
+	}
+
+	select {
+	case response := <-req.response:
+		if response == nil {
+			return g.exception(pdu[0], ExceptionGatewayTargetFailed)
+		}
+		g.mu.Lock()
+		g.metrics.Responses++
+		g.mu.Unlock()
+		return response
+	case <-ctx.Done():
+		g.mu.Lock()
+		g.metrics.Timeouts++
+		g.mu.Unlock()
+		return g.exception(pdu[0], ExceptionGatewayTargetFailed)
+	}
+}
+
+func (g *Gateway) exception(funcCode uint8, code uint8) []byte {
+	g.mu.Lock()
+	g.metrics.Exceptions++
+	g.mu.Unlock()
+	return []byte{funcCode | 0x80, code}
+}
+
+// bus returns the queue of an upstream connection, starting its worker on
+// first use
+func (g *Gateway) bus(connID string) *gatewayBus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	bus, ok := g.buses[connID]
+	if !ok {
+		bus = &gatewayBus{queue: make(chan *gatewayRequest, g.config.QueueSize)}
+		g.buses[connID] = bus
+		go g.runBus(connID, bus)
+	}
+	return bus
+}
+
+func (g *Gateway) runBus(connID string, bus *gatewayBus) {
+	for {
+		var req *gatewayRequest
+		select {
+		case req = <-bus.queue:
+		case <-g.done:
+			return
+		}
+
+		if req.ctx.Err() != nil {
+			// The client already received a timeout exception
+			continue
+		}
+
+		start := time.Now()
+		response, err := g.transact(req)
+		latency := time.Since(start)
+
+		g.mu.Lock()
+		bus.requests++
+		bus.totalLatency += latency
+		if err != nil {
+			bus.errors++
+		}
+		g.mu.Unlock()
+
+		if err != nil {
+			log.Warn().Err(err).
+				Str("connection", connID).
+				Uint8("unit_id", req.route.TargetUnitID).
+				Msg("Gateway request failed")
+			response = nil
+		}
+		req.response <- response
+	}
+}
+
+func (g *Gateway) transact(req *gatewayRequest) ([]byte, error) {
+	if g.config.Handlers == nil {
+		return nil, ErrNotConnected
+	}
+
+	handler, err := g.config.Handlers(req.route.ConnectionID)
+	if err != nil {
+		return nil, err
+	}
+	if handler == nil || !handler.IsConnected() {
+		return nil, ErrNotConnected
+	}
+
+	upstream, ok := handler.(Transactor)
+	if !ok {
+		return nil, fmt.Errorf("connection %s is not a Modbus connection", req.route.ConnectionID)
+	}
+
+	response, err := upstream.Transact(req.ctx, req.route.TargetUnitID, req.pdu)
+	if err != nil {
+		return nil, err
+	}
+	if response == nil && req.route.TargetUnitID == broadcastUnitID {
+		return []byte{}, nil
+	}
+	if len(response) == 0 || response[0]&0x7F != req.pdu[0] {
+		return nil, fmt.Errorf("%w: function code mismatch", ErrInvalidResponse)
+	}
+	return response, nil
+}
@@ -0,0 +1,272 @@
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	protocol "github.com/iotstudio/iotstudio/internal/protocols"
+	"github.com/iotstudio/iotstudio/pkg/api"
+	"github.com/rs/zerolog"
+)
+
+// startSlave runs a Modbus TCP slave that answers every request with two
+// holding registers and reports the unit ID it was addressed with.
+func startSlave(t *testing.T) (string, <-chan uint8) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	units := make(chan uint8, 16)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		header := make([]byte, 7)
+		for {
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			mbap, _ := ParseMBAPHeader(header)
+			pdu := make([]byte, mbap.Length-1)
+			if _, err := io.ReadFull(conn, pdu); err != nil {
+				return
+			}
+			units <- mbap.UnitID
+
+			response := []byte{pdu[0], 4, 0x00, 0x01, 0x00, 0x02}
+			conn.Write(BuildMBAPFrame(NewMBAPHeader(mbap.TransactionID, mbap.UnitID, uint16(len(response))), response))
+		}
+	}()
+
+	return listener.Addr().String(), units
+}
+
+func TestGateway(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := NewModbusLogger(zerolog.Nop())
+
+	rtu := NewModbusRTUHandler(ModbusRTUConfig{UseMock: true, Timeout: time.Second, Logger: logger})
+	if err := rtu.Connect(ctx, api.ConnectionConfig{}); err != nil {
+		t.Fatalf("RTU Connect() error = %v", err)
+	}
+
+	slaveAddr, units := startSlave(t)
+	host, port, _ := net.SplitHostPort(slaveAddr)
+	portNum, _ := strconv.Atoi(port)
+	tcp := NewModbusTCPHandler(ModbusTCPConfig{Host: host, Port: portNum, Timeout: time.Second, Logger: logger})
+	if err := tcp.Connect(ctx, api.ConnectionConfig{}); err != nil {
+		t.Fatalf("TCP Connect() error = %v", err)
+	}
+	defer tcp.Disconnect()
+
+	handlers := map[string]protocol.ProtocolHandler{"bus1": rtu, "plc": tcp}
+	gw := NewGateway(GatewayConfig{
+		Addr: "127.0.0.1:0",
+		Routes: []GatewayRoute{
+			{UnitID: 1, ConnectionID: "bus1"},
+			{UnitID: 2, ConnectionID: "plc", TargetUnitID: 9},
+		},
+		Handlers: func(connID string) (protocol.ProtocolHandler, error) {
+			return handlers[connID], nil
+		},
+	})
+	if err := gw.Listen(); err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	go gw.Serve(ctx)
+
+	conn, err := net.Dial("tcp", gw.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	readHolding := []byte{0x03, 0x00, 0x10, 0x00, 0x02}
+
+	tests := []struct {
+		name   string
+		txID   uint16
+		unitID uint8
+		pdu    []byte
+		want   []byte
+	}{
+		{"RTU slave", 0x1234, 1, readHolding, []byte{0x03, 4, 0, 0, 0, 0}},
+		{"TCP upstream", 0x1235, 2, readHolding, []byte{0x03, 4, 0, 1, 0, 2}},
+		{"RTU exception", 0x1236, 1, []byte{0x2B, 0x0E, 0x01, 0x00}, []byte{0xAB, ExceptionIllegalFunction}},
+		{"no route", 0x1237, 7, readHolding, []byte{0x83, ExceptionGatewayPathUnavailable}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := BuildMBAPFrame(NewMBAPHeader(tt.txID, tt.unitID, uint16(len(tt.pdu))), tt.pdu)
+			if _, err := conn.Write(request); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+
+			header := make([]byte, 7)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				t.Fatalf("read header: %v", err)
+			}
+			mbap, _ := ParseMBAPHeader(header)
+			if mbap.TransactionID != tt.txID || mbap.UnitID != tt.unitID {
+				t.Errorf("MBAP = %+v, want transaction %#04x unit %d", mbap, tt.txID, tt.unitID)
+			}
+
+			pdu := make([]byte, mbap.Length-1)
+			if _, err := io.ReadFull(conn, pdu); err != nil {
+				t.Fatalf("read PDU: %v", err)
+			}
+			if !bytes.Equal(pdu, tt.want) {
+				t.Errorf("PDU = % x, want % x", pdu, tt.want)
+			}
+		})
+	}
+
+	if unit := <-units; unit != 9 {
+		t.Errorf("upstream unit ID = %d, want 9", unit)
+	}
+
+	metrics := gw.GetMetrics()
+	if metrics.Requests != 4 || metrics.Responses != 3 || metrics.Exceptions != 1 {
+		t.Errorf("metrics = %+v", metrics)
+	}
+	if metrics.Buses["bus1"].Requests != 2 || metrics.Buses["plc"].Requests != 1 {
+		t.Errorf("bus metrics = %+v", metrics.Buses)
+	}
+}
+
+func TestTCPHandlerSerializesRequests(t *testing.T) {
+	ctx := context.Background()
+
+	slaveAddr, units := startSlave(t)
+	go func() {
+		for range units {
+		}
+	}()
+	host, port, _ := net.SplitHostPort(slaveAddr)
+	portNum, _ := strconv.Atoi(port)
+	tcp := NewModbusTCPHandler(ModbusTCPConfig{Host: host, Port: portNum, Timeout: time.Second, Logger: NewModbusLogger(zerolog.Nop())})
+	if err := tcp.Connect(ctx, api.ConnectionConfig{}); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer tcp.Disconnect()
+
+	// Typed requests and gateway transactions share the connection, so
+	// each must read its own response
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			for j := 0; j < 20; j++ {
+				var err error
+				if i%2 == 0 {
+					_, err = tcp.ReadHoldingRegisters(ctx, 1, 0, 2)
+				} else {
+					_, err = tcp.Transact(ctx, 1, []byte{0x03, 0x00, 0x00, 0x00, 0x02})
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("request error = %v", err)
+		}
+	}
+}
+
+func TestRTUFrameLength(t *testing.T) {
+	readHolding := buildRTUFrame(1, []byte{0x03, 0x00, 0x10, 0x00, 0x02})
+	echo := buildRTUFrame(1, []byte{0x08, 0x00, 0x00, 0x12, 0x34, 0x56})
+	deviceID := []byte{0x01, 0x2B, 0x0E, 0x01, 0x01, 0x00, 0x00, 0x02, 0x00, 0x03, 'A', 'B', 'C', 0x01, 0x01}
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  int
+	}{
+		{"incomplete", []byte{0x01}, 0},
+		{"read registers", []byte{0x01, 0x03, 0x04}, 9},
+		{"read without byte count", []byte{0x01, 0x03}, 0},
+		{"write single register", []byte{0x01, 0x06}, 8},
+		{"exception", []byte{0x01, 0x83}, 5},
+		{"read exception status", []byte{0x01, 0x07}, 5},
+		{"get comm event counter", []byte{0x01, 0x0B}, 8},
+		{"get comm event log", []byte{0x01, 0x0C, 0x08}, 13},
+		{"read FIFO queue", []byte{0x01, 0x18, 0x00, 0x06}, 12},
+		{"read FIFO queue without byte count", []byte{0x01, 0x18, 0x00}, 0},
+		{"device identification", deviceID, 18},
+		{"device identification without objects", deviceID[:11], 0},
+		{"device identification header", deviceID[:7], 0},
+		{"other MEI type", []byte{0x01, 0x2B, 0x0D}, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rtuFrameLength(readHolding, tt.frame); got != tt.want {
+				t.Errorf("rtuFrameLength() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// Diagnostics responses echo the request, whatever its length
+	if got := rtuFrameLength(echo, []byte{0x01, 0x08}); got != len(echo) {
+		t.Errorf("rtuFrameLength() of a diagnostics echo = %d, want %d", got, len(echo))
+	}
+}
+
+func TestRTUBroadcast(t *testing.T) {
+	ctx := context.Background()
+
+	rtu := NewModbusRTUHandler(ModbusRTUConfig{UseMock: true, Timeout: time.Second, Logger: NewModbusLogger(zerolog.Nop())})
+	if err := rtu.Connect(ctx, api.ConnectionConfig{}); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer rtu.Disconnect()
+
+	// Writes return after the turnaround delay instead of the timeout
+	start := time.Now()
+	if err := rtu.WriteSingleRegister(ctx, 0, 0x10, 42); err != nil {
+		t.Fatalf("WriteSingleRegister() to unit 0 error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("WriteSingleRegister() to unit 0 took %v, want no wait for a reply", elapsed)
+	}
+	if _, err := rtu.ReadHoldingRegisters(ctx, 0, 0x10, 1); !errors.Is(err, ErrBroadcastRead) {
+		t.Errorf("ReadHoldingRegisters() from unit 0 error = %v, want ErrBroadcastRead", err)
+	}
+
+	// Forwarded broadcasts get no response, and the bus is free afterwards
+	gw := NewGateway(GatewayConfig{
+		Routes: []GatewayRoute{{UnitID: 0, ConnectionID: "bus1"}, {UnitID: 1, ConnectionID: "bus1"}},
+		Handlers: func(connID string) (protocol.ProtocolHandler, error) {
+			return rtu, nil
+		},
+	})
+	defer gw.Close()
+	if response := gw.forward(ctx, 0, []byte{0x06, 0x00, 0x10, 0x00, 0x2A}); len(response) != 0 {
+		t.Errorf("forward() of a broadcast = % x, want no response", response)
+	}
+	if response := gw.forward(ctx, 1, []byte{0x03, 0x00, 0x10, 0x00, 0x01}); !bytes.Equal(response, []byte{0x03, 2, 0, 0}) {
+		t.Errorf("forward() after a broadcast = % x, want 03 02 00 00", response)
+	}
+}
@@ -3,27 +3,54 @@ package modbus
 import (
 	"errors"
 
+	"github.com/iotstudio/iotstudio/pkg/api"
 	"github.com/rs/zerolog"
 )
 
 const (
-	ExceptionIllegalFunction     = 0x01
-	ExceptionIllegalDataAddress  = 0x02
-	ExceptionIllegalDataValue    = 0x03
-	ExceptionServerDeviceFailure = 0x04
-	ExceptionAcknowledge         = 0x05
-	ExceptionServerDeviceBusy    = 0x06
-	ExceptionMemoryParityError   = 0x08
+	ExceptionIllegalFunction        = 0x01
+	ExceptionIllegalDataAddress     = 0x02
+	ExceptionIllegalDataValue       = 0x03
+	ExceptionServerDeviceFailure    = 0x04
+	ExceptionAcknowledge            = 0x05
+	ExceptionServerDeviceBusy       = 0x06
+	ExceptionMemoryParityError      = 0x08
+	ExceptionGatewayPathUnavailable = 0x0A
+	ExceptionGatewayTargetFailed    = 0x0B
 )
 
+// maxPDULength is the largest PDU allowed by the Modbus application protocol
+const maxPDULength = 253
+
 type ModbusLogger struct {
-	logger zerolog.Logger
+	logger  zerolog.Logger
+	monitor *TrafficMonitor
 }
 
 func NewModbusLogger(logger zerolog.Logger) *ModbusLogger {
 	return &ModbusLogger{logger: logger}
 }
 
+// SetMonitor records every transaction logged from now on in the monitor
+func (l *ModbusLogger) SetMonitor(monitor *TrafficMonitor) {
+	l.monitor = monitor
+}
+
+// LogTraffic records a request/response exchange as seen on the wire
+func (l *ModbusLogger) LogTraffic(tx api.ModbusTransaction) {
+	l.logger.Trace().
+		Uint16("tx_id", tx.TxID).
+		Uint8("unit_id", tx.UnitID).
+		Str("request", tx.Request).
+		Str("response", tx.Response).
+		Float64("latency_ms", tx.Latency).
+		Msg("Modbus traffic")
+
+	if l.monitor != nil {
+		l.monitor.Record(tx)
+	}
+}
+
 func (l *ModbusLogger) LogTransaction(txID uint16, unitID uint8, funcCode uint8, request []byte, response []byte) {
 	l.logger.Debug().
 		Uint16("tx_id", txID).
@@ -87,6 +114,7 @@ var (
 	ErrTimeout         = errors.New("operation timed out")
 	ErrInvalidResponse = errors.New("invalid Modbus response")
 	ErrException       = errors.New("Modbus exception")
+	ErrBroadcastRead   = errors.New("broadcast requests are not answered")
 )
 
 type modbusError struct {
@@ -0,0 +1,158 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/iotstudio/iotstudio/pkg/api"
+)
+
+// DefaultTrafficBufferSize is the number of transactions a traffic monitor
+// keeps for retrieval
+const DefaultTrafficBufferSize = 1000
+
+var functionNames = map[uint8]string{
+	0x01: "Read Coils",
+	0x02: "Read Discrete Inputs",
+	0x03: "Read Holding Registers",
+	0x04: "Read Input Registers",
+	0x05: "Write Single Coil",
+	0x06: "Write Single Register",
+	0x0F: "Write Multiple Coils",
+	0x10: "Write Multiple Registers",
+	0x16: "Mask Write Register",
+	0x17: "Read/Write Multiple Registers",
+}
+
+// FunctionName returns the name of a Modbus function code
+func FunctionName(funcCode uint8) string {
+	if name, ok := functionNames[funcCode&0x7F]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// TrafficMonitor keeps the most recent transactions of a connection in a
+// ring buffer and passes every new one to its subscribers.
+type TrafficMonitor struct {
+	mu          sync.Mutex
+	buffer      []api.ModbusTransaction
+	next        int
+	full        bool
+	subscribers map[int]func(api.ModbusTransaction)
+	lastID      int
+}
+
+func NewTrafficMonitor(size int) *TrafficMonitor {
+	if size <= 0 {
+		size = DefaultTrafficBufferSize
+	}
+	return &TrafficMonitor{
+		buffer:      make([]api.ModbusTransaction, size),
+		subscribers: make(map[int]func(api.ModbusTransaction)),
+	}
+}
+
+// Record adds a transaction. Subscribers are called synchronously and must
+// not block.
+func (m *TrafficMonitor) Record(tx api.ModbusTransaction) {
+	m.mu.Lock()
+	m.buffer[m.next] = tx
+	m.next = (m.next + 1) % len(m.buffer)
+	if m.next == 0 {
+		m.full = true
+	}
+	subscribers := make([]func(api.ModbusTransaction), 0, len(m.subscribers))
+	for _, fn := range m.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	m.mu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(tx)
+	}
+}
+
+// Recent returns up to limit of the latest transactions matching the
+// filter, oldest first. A limit of 0 returns all buffered transactions.
+func (m *TrafficMonitor) Recent(limit int, filter api.TrafficFilter) []api.ModbusTransaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := m.next
+	if m.full {
+		count = len(m.buffer)
+	}
+
+	var matched []api.ModbusTransaction
+	for i := 1; i <= count; i++ {
+		tx := m.buffer[(m.next-i+len(m.buffer))%len(m.buffer)]
+		if !filter.Matches(tx) {
+			continue
+		}
+		matched = append(matched, tx)
+		if limit > 0 && len(matched) == limit {
+			break
+		}
+	}
+
+	result := make([]api.ModbusTransaction, len(matched))
+	for i, tx := range matched {
+		result[len(matched)-1-i] = tx
+	}
+	return result
+}
+
+// Subscribe calls fn for every transaction recorded until the returned
+// function is called
+func (m *TrafficMonitor) Subscribe(fn func(api.ModbusTransaction)) func() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastID++
+	id := m.lastID
+	m.subscribers[id] = fn
+
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.subscribers, id)
+	}
+}
+
+// newTransaction describes an exchange from its request and response PDUs
+// and the complete frames on the wire. The response is nil if none arrived.
+func newTransaction(txID uint16, unitID uint8, requestPDU, responsePDU, request, response []byte, start time.Time, err error) api.ModbusTransaction {
+	tx := api.ModbusTransaction{
+		Timestamp: start.UnixMilli(),
+		TxID:      txID,
+		UnitID:    unitID,
+		Request:   hex.EncodeToString(request),
+		Response:  hex.EncodeToString(response),
+		Latency:   float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		tx.Error = err.Error()
+	}
+
+	if len(requestPDU) > 0 {
+		tx.FunctionCode = requestPDU[0]
+		tx.Function = FunctionName(tx.FunctionCode)
+	}
+	switch {
+	case len(requestPDU) >= 5 && (tx.FunctionCode <= 0x04 || tx.FunctionCode == 0x0F || tx.FunctionCode == 0x10 || tx.FunctionCode == 0x17):
+		// Read/Write Multiple Registers reports its read range
+		tx.Address = binary.BigEndian.Uint16(requestPDU[1:3])
+		tx.Quantity = binary.BigEndian.Uint16(requestPDU[3:5])
+	case len(requestPDU) >= 3 && (tx.FunctionCode == 0x05 || tx.FunctionCode == 0x06 || tx.FunctionCode == 0x16):
+		tx.Address = binary.BigEndian.Uint16(requestPDU[1:3])
+		tx.Quantity = 1
+	}
+
+	if len(responsePDU) >= 2 && responsePDU[0]&0x80 != 0 {
+		tx.Exception = responsePDU[1]
+	}
+	return tx
+}
@@ -0,0 +1,127 @@
+package modbus
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/iotstudio/iotstudio/pkg/api"
+	"github.com/rs/zerolog"
+)
+
+func TestTrafficMonitor(t *testing.T) {
+	monitor := NewTrafficMonitor(3)
+
+	var received []uint16
+	unsubscribe := monitor.Subscribe(func(tx api.ModbusTransaction) {
+		received = append(received, tx.TxID)
+	})
+
+	for i := uint16(1); i <= 5; i++ {
+		monitor.Record(api.ModbusTransaction{TxID: i, UnitID: uint8(i % 2), FunctionCode: 0x03})
+		if i == 4 {
+			unsubscribe()
+		}
+	}
+
+	txIDs := func(txs []api.ModbusTransaction) []uint16 {
+		ids := []uint16{}
+		for _, tx := range txs {
+			ids = append(ids, tx.TxID)
+		}
+		return ids
+	}
+
+	unit := uint8(1)
+	write := uint8(0x06)
+	tests := []struct {
+		name   string
+		limit  int
+		filter api.TrafficFilter
+		want   []uint16
+	}{
+		{"all", 0, api.TrafficFilter{}, []uint16{3, 4, 5}},
+		{"limit", 2, api.TrafficFilter{}, []uint16{4, 5}},
+		{"unit", 0, api.TrafficFilter{UnitID: &unit}, []uint16{3, 5}},
+		{"function code", 0, api.TrafficFilter{FunctionCode: &write}, []uint16{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := txIDs(monitor.Recent(tt.limit, tt.filter))
+			if len(got) != len(tt.want) {
+				t.Fatalf("Recent() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("Recent() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	if len(received) != 4 {
+		t.Errorf("subscriber received %v, want transactions 1 to 4", received)
+	}
+}
+
+func TestTCPTraffic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	monitor := NewTrafficMonitor(DefaultTrafficBufferSize)
+	logger := NewModbusLogger(zerolog.Nop())
+	logger.SetMonitor(monitor)
+
+	slaveAddr, _ := startSlave(t)
+	host, port, _ := net.SplitHostPort(slaveAddr)
+	portNum, _ := strconv.Atoi(port)
+	handler := NewModbusTCPHandler(ModbusTCPConfig{Host: host, Port: portNum, Timeout: time.Second, Logger: logger})
+	if err := handler.Connect(ctx, api.ConnectionConfig{}); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer handler.Disconnect()
+
+	var frames []string
+	handler.SetFrameObserver(func(ctx context.Context, direction string, data []byte) {
+		frames = append(frames, direction+" "+hex.EncodeToString(data))
+	})
+
+	if _, err := handler.ReadHoldingRegisters(ctx, 5, 0x10, 2); err != nil {
+		t.Fatalf("ReadHoldingRegisters() error = %v", err)
+	}
+
+	txs := monitor.Recent(0, api.TrafficFilter{})
+	if len(txs) != 1 {
+		t.Fatalf("Recent() returned %d transactions, want 1", len(txs))
+	}
+
+	tx := txs[0]
+	if tx.UnitID != 5 || tx.FunctionCode != 0x03 || tx.Function != "Read Holding Registers" ||
+		tx.Address != 0x10 || tx.Quantity != 2 || tx.Exception != 0 || tx.Error != "" {
+		t.Errorf("transaction = %+v", tx)
+	}
+	if want := "000100000006050300100002"; tx.Request != want {
+		t.Errorf("Request = %s, want %s", tx.Request, want)
+	}
+	if want := "00010000000705030400010002"; tx.Response != want {
+		t.Errorf("Response = %s, want %s", tx.Response, want)
+	}
+
+	wantFrames := []string{"tx " + tx.Request, "rx " + tx.Response}
+	if len(frames) != 2 || frames[0] != wantFrames[0] || frames[1] != wantFrames[1] {
+		t.Errorf("observed frames %v, want %v", frames, wantFrames)
+	}
+}
+
+func TestNewTransactionException(t *testing.T) {
+	request := []byte{0x10, 0x00, 0x20, 0x00, 0x01, 0x02, 0x00, 0x07}
+	tx := newTransaction(7, 1, request, []byte{0x90, ExceptionIllegalDataAddress}, nil, nil, time.Now(), nil)
+
+	if tx.FunctionCode != 0x10 || tx.Address != 0x20 || tx.Quantity != 1 || tx.Exception != ExceptionIllegalDataAddress {
+		t.Errorf("transaction = %+v", tx)
+	}
+}
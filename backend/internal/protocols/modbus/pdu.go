@@ -16,7 +16,7 @@ func NewMBAPHeader(transactionID uint16, unitID uint8, pduLength uint16) MBAPHea
 	return MBAPHeader{
 		TransactionID: transactionID,
 		ProtocolID:    0,
-		Length:        uint16(unitID) + pduLength,
+		Length:        1 + pduLength,
 		UnitID:        unitID,
 	}
 }
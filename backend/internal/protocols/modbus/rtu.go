@@ -6,8 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/iotstudio/iotstudio/internal/models"
+	protocol "github.com/iotstudio/iotstudio/internal/protocols"
 	"github.com/iotstudio/iotstudio/pkg/api"
 	"github.com/rs/zerolog/log"
 	"go.bug.st/serial"
@@ -16,6 +19,12 @@ import (
 const (
 	t1_5 = time.Microsecond * 1750
 	t3_5 = time.Microsecond * 1750 * 3
+
+	// broadcastUnitID addresses every slave on the bus, none of which answers
+	broadcastUnitID = 0
+	// broadcastTurnaround gives the slaves time to process a broadcast
+	// before the next request
+	broadcastTurnaround = 100 * time.Millisecond
 )
 
 type ModbusRTUConfig struct {
@@ -37,13 +46,13 @@ type ModbusRTUHandler struct {
 	mu        sync.RWMutex
 	config    ModbusRTUConfig
 	metrics   api.ConnectionMetrics
-	txCounter uint16
+	txCounter atomic.Uint32                          // transaction IDs use the low 16 bits
+	observer  atomic.Pointer[protocol.FrameObserver] // read without mu, which requests may hold
 }
 
 func NewModbusRTUHandler(config ModbusRTUConfig) *ModbusRTUHandler {
 	return &ModbusRTUHandler{
-		config:    config,
-		txCounter: 0,
+		config: config,
 	}
 }
 
@@ -135,13 +144,16 @@ func (h *ModbusRTUHandler) Disconnect() error {
 }
 
 func (h *ModbusRTUHandler) ReadCoils(ctx context.Context, unitID uint8, address, quantity uint16) ([]bool, error) {
-	h.txCounter++
+	if unitID == broadcastUnitID {
+		return nil, ErrBroadcastRead
+	}
+	tx := h.nextTransaction()
 	req := ReadCoilsRequest{
 		FunctionCode:    0x01,
 		StartingAddress: address,
 		Quantity:        quantity,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, quantity)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, quantity)
 
 	pdu := make([]byte, 5)
 	pdu[0] = req.FunctionCode
@@ -149,7 +161,7 @@ func (h *ModbusRTUHandler) ReadCoils(ctx context.Context, unitID uint8, address,
 	binary.BigEndian.PutUint16(pdu[3:5], req.Quantity)
 
 	frame := buildRTUFrame(unitID, pdu)
-	response, err := h.sendRequest(ctx, frame)
+	response, err := h.sendRequest(ctx, tx, frame)
 	if err != nil {
 		return nil, err
 	}
@@ -166,18 +178,21 @@ func (h *ModbusRTUHandler) ReadCoils(ctx context.Context, unitID uint8, address,
 		coilStatus[i] = (response[2+byteIdx] & (1 << bitIdx)) != 0
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], byteCount, response[2:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], byteCount, response[2:])
 	return coilStatus, nil
 }
 
 func (h *ModbusRTUHandler) ReadDiscreteInputs(ctx context.Context, unitID uint8, address, quantity uint16) ([]bool, error) {
-	h.txCounter++
+	if unitID == broadcastUnitID {
+		return nil, ErrBroadcastRead
+	}
+	tx := h.nextTransaction()
 	req := ReadDiscreteInputsRequest{
 		FunctionCode:    0x02,
 		StartingAddress: address,
 		Quantity:        quantity,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, quantity)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, quantity)
 
 	pdu := make([]byte, 5)
 	pdu[0] = req.FunctionCode
@@ -185,7 +200,7 @@ func (h *ModbusRTUHandler) ReadDiscreteInputs(ctx context.Context, unitID uint8,
 	binary.BigEndian.PutUint16(pdu[3:5], req.Quantity)
 
 	frame := buildRTUFrame(unitID, pdu)
-	response, err := h.sendRequest(ctx, frame)
+	response, err := h.sendRequest(ctx, tx, frame)
 	if err != nil {
 		return nil, err
 	}
@@ -202,18 +217,21 @@ func (h *ModbusRTUHandler) ReadDiscreteInputs(ctx context.Context, unitID uint8,
 		inputStatus[i] = (response[2+byteIdx] & (1 << bitIdx)) != 0
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], byteCount, response[2:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], byteCount, response[2:])
 	return inputStatus, nil
 }
 
 func (h *ModbusRTUHandler) ReadHoldingRegisters(ctx context.Context, unitID uint8, address, quantity uint16) ([]uint16, error) {
-	h.txCounter++
+	if unitID == broadcastUnitID {
+		return nil, ErrBroadcastRead
+	}
+	tx := h.nextTransaction()
 	req := ReadHoldingRegistersRequest{
 		FunctionCode:    0x03,
 		StartingAddress: address,
 		Quantity:        quantity,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, quantity)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, quantity)
 
 	pdu := make([]byte, 5)
 	pdu[0] = req.FunctionCode
@@ -221,7 +239,7 @@ func (h *ModbusRTUHandler) ReadHoldingRegisters(ctx context.Context, unitID uint
 	binary.BigEndian.PutUint16(pdu[3:5], req.Quantity)
 
 	frame := buildRTUFrame(unitID, pdu)
-	response, err := h.sendRequest(ctx, frame)
+	response, err := h.sendRequest(ctx, tx, frame)
 	if err != nil {
 		return nil, err
 	}
@@ -236,18 +254,21 @@ func (h *ModbusRTUHandler) ReadHoldingRegisters(ctx context.Context, unitID uint
 		registerValues[i] = binary.BigEndian.Uint16(response[2+i*2 : 4+i*2])
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], byteCount, response[2:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], byteCount, response[2:])
 	return registerValues, nil
 }
 
 func (h *ModbusRTUHandler) ReadInputRegisters(ctx context.Context, unitID uint8, address, quantity uint16) ([]uint16, error) {
-	h.txCounter++
+	if unitID == broadcastUnitID {
+		return nil, ErrBroadcastRead
+	}
+	tx := h.nextTransaction()
 	req := ReadInputRegistersRequest{
 		FunctionCode:    0x04,
 		StartingAddress: address,
 		Quantity:        quantity,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, quantity)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, quantity)
 
 	pdu := make([]byte, 5)
 	pdu[0] = req.FunctionCode
@@ -255,7 +276,7 @@ func (h *ModbusRTUHandler) ReadInputRegisters(ctx context.Context, unitID uint8,
 	binary.BigEndian.PutUint16(pdu[3:5], req.Quantity)
 
 	frame := buildRTUFrame(unitID, pdu)
-	response, err := h.sendRequest(ctx, frame)
+	response, err := h.sendRequest(ctx, tx, frame)
 	if err != nil {
 		return nil, err
 	}
@@ -270,12 +291,12 @@ func (h *ModbusRTUHandler) ReadInputRegisters(ctx context.Context, unitID uint8,
 		registerValues[i] = binary.BigEndian.Uint16(response[2+i*2 : 4+i*2])
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], byteCount, response[2:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], byteCount, response[2:])
 	return registerValues, nil
 }
 
 func (h *ModbusRTUHandler) WriteSingleCoil(ctx context.Context, unitID uint8, address uint16, outputValue bool) error {
-	h.txCounter++
+	tx := h.nextTransaction()
 	value := uint16(0)
 	if outputValue {
 		value = 0xFF00
@@ -286,7 +307,7 @@ func (h *ModbusRTUHandler) WriteSingleCoil(ctx context.Context, unitID uint8, ad
 		OutputAddress: address,
 		OutputValue:   value,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, 1)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, 1)
 
 	pdu := make([]byte, 5)
 	pdu[0] = req.FunctionCode
@@ -294,10 +315,13 @@ func (h *ModbusRTUHandler) WriteSingleCoil(ctx context.Context, unitID uint8, ad
 	binary.BigEndian.PutUint16(pdu[3:5], req.OutputValue)
 
 	frame := buildRTUFrame(unitID, pdu)
-	response, err := h.sendRequest(ctx, frame)
+	response, err := h.sendRequest(ctx, tx, frame)
 	if err != nil {
 		return err
 	}
+	if unitID == broadcastUnitID {
+		return nil
+	}
 
 	if response[0] != 0x05 {
 		return fmt.Errorf("unexpected function code: 0x%02x", response[0])
@@ -307,23 +331,23 @@ func (h *ModbusRTUHandler) WriteSingleCoil(ctx context.Context, unitID uint8, ad
 		return fmt.Errorf("invalid response length: %d", len(response))
 	}
 
-	respValue := binary.BigEndian.Uint16(response[1:5])
+	respValue := binary.BigEndian.Uint16(response[3:5])
 	if respValue != value {
 		return fmt.Errorf("coil value mismatch: expected %04x, got %04x", value, respValue)
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], uint8(len(response)), response[1:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], uint8(len(response)), response[1:])
 	return nil
 }
 
 func (h *ModbusRTUHandler) WriteSingleRegister(ctx context.Context, unitID uint8, address, value uint16) error {
-	h.txCounter++
+	tx := h.nextTransaction()
 	req := WriteSingleRegisterRequest{
 		FunctionCode:    0x06,
 		RegisterAddress: address,
 		RegisterValue:   value,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, 1)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, 1)
 
 	pdu := make([]byte, 5)
 	pdu[0] = req.FunctionCode
@@ -331,10 +355,13 @@ func (h *ModbusRTUHandler) WriteSingleRegister(ctx context.Context, unitID uint8
 	binary.BigEndian.PutUint16(pdu[3:5], req.RegisterValue)
 
 	frame := buildRTUFrame(unitID, pdu)
-	response, err := h.sendRequest(ctx, frame)
+	response, err := h.sendRequest(ctx, tx, frame)
 	if err != nil {
 		return err
 	}
+	if unitID == broadcastUnitID {
+		return nil
+	}
 
 	if response[0] != 0x06 {
 		return fmt.Errorf("unexpected function code: 0x%02x", response[0])
@@ -344,17 +371,17 @@ func (h *ModbusRTUHandler) WriteSingleRegister(ctx context.Context, unitID uint8
 		return fmt.Errorf("invalid response length: %d", len(response))
 	}
 
-	respValue := binary.BigEndian.Uint16(response[1:5])
+	respValue := binary.BigEndian.Uint16(response[3:5])
 	if respValue != value {
 		return fmt.Errorf("register value mismatch: expected %04x, got %04x", value, respValue)
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], uint8(len(response)), response[1:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], uint8(len(response)), response[1:])
 	return nil
 }
 
 func (h *ModbusRTUHandler) WriteMultipleCoils(ctx context.Context, unitID uint8, address uint16, values []bool) error {
-	h.txCounter++
+	tx := h.nextTransaction()
 	quantity := uint16(len(values))
 
 	outputBytes := make([]byte, (quantity+7)/8)
@@ -370,7 +397,7 @@ func (h *ModbusRTUHandler) WriteMultipleCoils(ctx context.Context, unitID uint8,
 		Quantity:        quantity,
 		OutputValues:    outputBytes[:(quantity+7)/8],
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, quantity)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, quantity)
 
 	pdu := make([]byte, 6+len(req.OutputValues))
 	pdu[0] = req.FunctionCode
@@ -380,21 +407,24 @@ func (h *ModbusRTUHandler) WriteMultipleCoils(ctx context.Context, unitID uint8,
 	copy(pdu[6:], req.OutputValues)
 
 	frame := buildRTUFrame(unitID, pdu)
-	response, err := h.sendRequest(ctx, frame)
+	response, err := h.sendRequest(ctx, tx, frame)
 	if err != nil {
 		return err
 	}
+	if unitID == broadcastUnitID {
+		return nil
+	}
 
 	if response[0] != 0x0F {
 		return fmt.Errorf("unexpected function code: 0x%02x", response[0])
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], uint8(len(response)), response[1:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], uint8(len(response)), response[1:])
 	return nil
 }
 
 func (h *ModbusRTUHandler) WriteMultipleRegisters(ctx context.Context, unitID uint8, address uint16, values []uint16) error {
-	h.txCounter++
+	tx := h.nextTransaction()
 	quantity := uint16(len(values))
 
 	req := WriteMultipleRegistersRequest{
@@ -402,7 +432,7 @@ func (h *ModbusRTUHandler) WriteMultipleRegisters(ctx context.Context, unitID ui
 		StartingAddress: address,
 		RegisterValues:  values,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, quantity)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, quantity)
 
 	pdu := make([]byte, 5+len(values)*2)
 	pdu[0] = req.FunctionCode
@@ -415,21 +445,27 @@ func (h *ModbusRTUHandler) WriteMultipleRegisters(ctx context.Context, unitID ui
 	}
 
 	frame := buildRTUFrame(unitID, pdu)
-	response, err := h.sendRequest(ctx, frame)
+	response, err := h.sendRequest(ctx, tx, frame)
 	if err != nil {
 		return err
 	}
+	if unitID == broadcastUnitID {
+		return nil
+	}
 
 	if response[0] != 0x10 {
 		return fmt.Errorf("unexpected function code: 0x%02x", response[0])
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], uint8(len(response)), response[1:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], uint8(len(response)), response[1:])
 	return nil
 }
 
 func (h *ModbusRTUHandler) ReadWriteMultipleRegisters(ctx context.Context, unitID uint8, readStartAddr, writeStartAddr uint16, writeValues []uint16) ([]uint16, error) {
-	h.txCounter++
+	if unitID == broadcastUnitID {
+		return nil, ErrBroadcastRead
+	}
+	tx := h.nextTransaction()
 
 	req := ReadWriteMultipleRegistersRequest{
 		FunctionCode:      0x17,
@@ -438,7 +474,7 @@ func (h *ModbusRTUHandler) ReadWriteMultipleRegisters(ctx context.Context, unitI
 		WriteStartAddress: writeStartAddr,
 		RegisterValues:    writeValues,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, readStartAddr, req.ReadWriteCount)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, readStartAddr, req.ReadWriteCount)
 
 	pdu := make([]byte, 10+len(writeValues)*2)
 	pdu[0] = req.FunctionCode
@@ -453,7 +489,7 @@ func (h *ModbusRTUHandler) ReadWriteMultipleRegisters(ctx context.Context, unitI
 	}
 
 	frame := buildRTUFrame(unitID, pdu)
-	response, err := h.sendRequest(ctx, frame)
+	response, err := h.sendRequest(ctx, tx, frame)
 	if err != nil {
 		return nil, err
 	}
@@ -468,12 +504,12 @@ func (h *ModbusRTUHandler) ReadWriteMultipleRegisters(ctx context.Context, unitI
 		registerValues[i] = binary.BigEndian.Uint16(response[2+i*2 : 4+i*2])
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], byteCount, response[2:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], byteCount, response[2:])
 	return registerValues, nil
 }
 
 func (h *ModbusRTUHandler) MaskWriteRegister(ctx context.Context, unitID uint8, address, andMask, orMask uint16) error {
-	h.txCounter++
+	tx := h.nextTransaction()
 
 	req := MaskWriteRegisterRequest{
 		FunctionCode:    0x16,
@@ -481,7 +517,7 @@ func (h *ModbusRTUHandler) MaskWriteRegister(ctx context.Context, unitID uint8,
 		AndMask:         andMask,
 		OrMask:          orMask,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, 1)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, 1)
 
 	pdu := make([]byte, 7)
 	pdu[0] = req.FunctionCode
@@ -490,10 +526,13 @@ func (h *ModbusRTUHandler) MaskWriteRegister(ctx context.Context, unitID uint8,
 	binary.BigEndian.PutUint16(pdu[5:7], req.OrMask)
 
 	frame := buildRTUFrame(unitID, pdu)
-	response, err := h.sendRequest(ctx, frame)
+	response, err := h.sendRequest(ctx, tx, frame)
 	if err != nil {
 		return err
 	}
+	if unitID == broadcastUnitID {
+		return nil
+	}
 
 	if response[0] != 0x16 {
 		return fmt.Errorf("unexpected function code: 0x%02x", response[0])
@@ -511,55 +550,128 @@ func (h *ModbusRTUHandler) MaskWriteRegister(ctx context.Context, unitID uint8,
 		return fmt.Errorf("register mask mismatch")
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], uint8(len(response)), response[1:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], uint8(len(response)), response[1:])
 	return nil
 }
 
-func (h *ModbusRTUHandler) sendRequest(ctx context.Context, frame []byte) ([]byte, error) {
+// Transact sends a raw request PDU and returns the response PDU unmodified,
+// including exception responses, or no PDU for a broadcast. Used by the
+// gateway to forward requests.
+func (h *ModbusRTUHandler) Transact(ctx context.Context, unitID uint8, pdu []byte) ([]byte, error) {
+	if len(pdu) == 0 || len(pdu) > maxPDULength {
+		return nil, fmt.Errorf("invalid PDU length: %d", len(pdu))
+	}
+
+	tx := h.nextTransaction()
+	response, err := h.sendRequest(ctx, tx, buildRTUFrame(unitID, pdu))
+	if err != nil {
+		return nil, err
+	}
+
+	h.config.Logger.LogTransaction(tx, unitID, pdu[0], pdu, response)
+	return response, nil
+}
+
+// nextTransaction numbers a request for the logs
+func (h *ModbusRTUHandler) nextTransaction() uint16 {
+	return uint16(h.txCounter.Add(1))
+}
+
+// sendRequest writes an RTU frame and returns the response PDU, without the
+// slave address and CRC. Broadcasts return no PDU. Requests hold mu until
+// they are answered, so only one is on the bus at a time.
+func (h *ModbusRTUHandler) sendRequest(ctx context.Context, tx uint16, frame []byte) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
 	if h.port == nil {
 		return nil, ErrNotConnected
 	}
 
+	start := time.Now()
+	response, pdu, err := h.exchange(ctx, tx, frame)
+	h.config.Logger.LogTraffic(newTransaction(tx, frame[0], frame[1:len(frame)-2], pdu, frame, response, start, err))
+	if err != nil {
+		return nil, err
+	}
+
+	return pdu, nil
+}
+
+// exchange writes an RTU frame and returns the response frame together with
+// its validated PDU
+func (h *ModbusRTUHandler) exchange(ctx context.Context, tx uint16, frame []byte) ([]byte, []byte, error) {
 	_, err := h.port.Write(frame)
 	if err != nil {
 		h.metrics.ErrorCount++
-		return nil, fmt.Errorf("failed to write request: %w", err)
+		return nil, nil, fmt.Errorf("failed to write request: %w", err)
 	}
 
 	h.metrics.BytesWritten += int64(len(frame))
 	h.metrics.WriteCount++
 	h.metrics.LastWrite = time.Now()
+	h.observe(ctx, models.FrameSent, frame)
 
-	response, err := h.readResponse(ctx)
+	if frame[0] == broadcastUnitID {
+		return nil, nil, h.turnaround(ctx)
+	}
+
+	response, err := h.readResponse(ctx, frame)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	h.observe(ctx, models.FrameReceived, response)
 
-	if len(response) < 3 {
-		return nil, fmt.Errorf("invalid response length: %d", len(response))
+	if len(response) < 4 {
+		return response, nil, fmt.Errorf("invalid response length: %d", len(response))
 	}
 
 	crc := binary.LittleEndian.Uint16(response[len(response)-2:])
 	dataWithoutCRC := response[:len(response)-2]
 
 	if !ValidateCRC(dataWithoutCRC, crc) {
-		h.config.Logger.LogException(h.txCounter, ExceptionIllegalDataValue, "CRC validation failed")
-		return nil, fmt.Errorf("%w: CRC mismatch", ErrException)
+		h.config.Logger.LogException(tx, ExceptionIllegalDataValue, "CRC validation failed")
+		return response, nil, fmt.Errorf("%w: CRC mismatch", ErrException)
+	}
+
+	if dataWithoutCRC[0] != frame[0] {
+		return response, nil, fmt.Errorf("%w: response from unit %d, expected %d", ErrInvalidResponse, dataWithoutCRC[0], frame[0])
 	}
 
-	return dataWithoutCRC, nil
+	return response, dataWithoutCRC[1:], nil
 }
 
-func (h *ModbusRTUHandler) readResponse(ctx context.Context) ([]byte, error) {
+// turnaround waits for the slaves to process a broadcast
+func (h *ModbusRTUHandler) turnaround(ctx context.Context) error {
+	timer := time.NewTimer(broadcastTurnaround)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *ModbusRTUHandler) readResponse(ctx context.Context, request []byte) ([]byte, error) {
 	response := make([]byte, 256)
 
+	timeout := time.Second
+	if h.config.Timeout > 0 {
+		timeout = h.config.Timeout
+	}
+
 	totalRead := 0
-	deadline := time.Now().Add(h.config.Timeout)
+	deadline := time.Now().Add(timeout)
 
 	for {
 		if time.Now().After(deadline) {
 			return nil, ErrTimeout
 		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
 		n, err := h.port.Read(response[totalRead:])
 		if err != nil {
@@ -572,15 +684,82 @@ func (h *ModbusRTUHandler) readResponse(ctx context.Context) ([]byte, error) {
 
 		totalRead += n
 
-		if totalRead >= 3 {
-			expectedLength := int(response[1]) + 3
-			if totalRead >= expectedLength {
-				break
-			}
+		expected := rtuFrameLength(request, response[:totalRead])
+		if expected < 0 {
+			return nil, fmt.Errorf("%w: cannot frame function 0x%02x", ErrInvalidResponse, response[1])
+		}
+		if expected > 0 && totalRead >= expected {
+			return response[:expected], nil
+		}
+		if totalRead == len(response) {
+			return nil, fmt.Errorf("%w: frame too long", ErrInvalidResponse)
+		}
+	}
+}
+
+// rtuFrameLength returns the length of the response frame (address, PDU and
+// CRC) to request from its first bytes, 0 when not enough has been received
+// yet, or -1 when its content does not tell.
+func rtuFrameLength(request, frame []byte) int {
+	if len(frame) < 2 {
+		return 0
+	}
+
+	funcCode := frame[1]
+	switch {
+	case funcCode&0x80 != 0:
+		return 5
+	case funcCode == 0x07:
+		// Read Exception Status: one status byte
+		return 5
+	case funcCode == 0x05 || funcCode == 0x06 || funcCode == 0x0B || funcCode == 0x0F || funcCode == 0x10:
+		// Echoes, and Get Comm Event Counter's status and count
+		return 8
+	case funcCode == 0x08:
+		// Diagnostics echoes the sub-function and the data of the request
+		return len(request)
+	case funcCode == 0x16:
+		return 10
+	case funcCode == 0x18:
+		// Read FIFO Queue has a 16-bit byte count
+		if len(frame) < 4 {
+			return 0
+		}
+		return 4 + int(binary.BigEndian.Uint16(frame[2:4])) + 2
+	case funcCode == 0x2B:
+		return deviceIdentificationLength(frame)
+	default:
+		// Read functions and Get Comm Event Log carry a byte count after
+		// the function code
+		if len(frame) < 3 {
+			return 0
 		}
+		return 3 + int(frame[2]) + 2
 	}
+}
 
-	return response[:totalRead], nil
+// deviceIdentificationLength frames a Read Device Identification response
+// (function 0x2B, MEI type 0x0E) by walking its objects, each an ID, a
+// length and the value. Other MEI types cannot be framed.
+func deviceIdentificationLength(frame []byte) int {
+	if len(frame) < 3 {
+		return 0
+	}
+	if frame[2] != 0x0E {
+		return -1
+	}
+	if len(frame) < 8 {
+		return 0
+	}
+
+	n := 8
+	for i := 0; i < int(frame[7]); i++ {
+		if len(frame) < n+2 {
+			return 0
+		}
+		n += 2 + int(frame[n+1])
+	}
+	return n + 2
 }
 
 func (h *ModbusRTUHandler) Read(ctx context.Context) ([]byte, error) {
@@ -597,6 +776,7 @@ func (h *ModbusRTUHandler) Read(ctx context.Context) ([]byte, error) {
 	h.metrics.BytesRead += int64(n)
 	h.metrics.ReadCount++
 	h.metrics.LastRead = time.Now()
+	h.observe(ctx, models.FrameReceived, data[:n])
 
 	return data[:n], nil
 }
@@ -618,10 +798,22 @@ func (h *ModbusRTUHandler) Write(ctx context.Context, data []byte) error {
 	h.metrics.BytesWritten += int64(n)
 	h.metrics.WriteCount++
 	h.metrics.LastWrite = time.Now()
+	h.observe(ctx, models.FrameSent, data[:n])
 
 	return nil
 }
 
+func (h *ModbusRTUHandler) SetFrameObserver(observer protocol.FrameObserver) {
+	h.observer.Store(&observer)
+}
+
+// observe passes a frame to the observer, if any
+func (h *ModbusRTUHandler) observe(ctx context.Context, direction string, data []byte) {
+	if observer := h.observer.Load(); observer != nil && *observer != nil && len(data) > 0 {
+		(*observer)(ctx, direction, data)
+	}
+}
+
 func (h *ModbusRTUHandler) IsConnected() bool {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
@@ -677,25 +869,23 @@ func (m *mockSerialPort) Write(p []byte) (int, error) {
 
 	m.data = append(m.data, p...)
 
-	if len(p) > 6 && p[0] != 0x15 && p[0] != 0x16 && p[0] != 0x17 {
+	// Broadcasts are not answered
+	if len(p) > 6 && p[0] != broadcastUnitID {
 		funcCode := p[1]
 		response := []byte{p[0], funcCode}
 
 		if funcCode == 0x01 || funcCode == 0x02 {
 			response = append(response, 1, 0xFF)
 		} else if funcCode == 0x03 || funcCode == 0x04 {
-			quantity := binary.BigEndian.Uint16(p[3:5])
-			byteCount := quantity * 2
-			response = append(response, uint8(byteCount))
-			for i := 0; i < int(byteCount); i++ {
+			quantity := binary.BigEndian.Uint16(p[4:6])
+			response = append(response, uint8(quantity*2))
+			for i := 0; i < int(quantity); i++ {
 				response = append(response, 0x00, 0x00)
 			}
-		} else if funcCode == 0x05 || funcCode == 0x06 {
-			response = append(response, p[1], p[2], p[3], p[4])
-		} else if funcCode == 0x0F {
-			response = append(response, p[1], p[2], p[3])
-		} else if funcCode == 0x10 {
-			response = append(response, p[1], p[2], p[3])
+		} else if funcCode == 0x05 || funcCode == 0x06 || funcCode == 0x0F || funcCode == 0x10 {
+			response = append(response, p[2], p[3], p[4], p[5])
+		} else {
+			response = []byte{p[0], funcCode | 0x80, ExceptionIllegalFunction}
 		}
 
 		crc := CalculateCRC16(response)
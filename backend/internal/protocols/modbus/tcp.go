@@ -5,10 +5,15 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/iotstudio/iotstudio/internal/models"
+	protocol "github.com/iotstudio/iotstudio/internal/protocols"
 	"github.com/iotstudio/iotstudio/pkg/api"
 	"github.com/rs/zerolog/log"
 )
@@ -29,13 +34,13 @@ type ModbusTCPHandler struct {
 	mu        sync.RWMutex
 	config    ModbusTCPConfig
 	metrics   api.ConnectionMetrics
-	txCounter uint16
+	txCounter atomic.Uint32                          // transaction IDs use the low 16 bits
+	observer  atomic.Pointer[protocol.FrameObserver] // read without mu, which requests may hold
 }
 
 func NewModbusTCPHandler(config ModbusTCPConfig) *ModbusTCPHandler {
 	return &ModbusTCPHandler{
-		config:    config,
-		txCounter: 0,
+		config: config,
 	}
 }
 
@@ -52,7 +57,7 @@ func (h *ModbusTCPHandler) Connect(ctx context.Context, config api.ConnectionCon
 		return nil
 	}
 
-	address := fmt.Sprintf("%s:%d", h.config.Host, h.config.Port)
+	address := net.JoinHostPort(h.config.Host, strconv.Itoa(h.config.Port))
 	timeout := 30 * time.Second
 	if h.config.Timeout > 0 {
 		timeout = h.config.Timeout
@@ -89,20 +94,20 @@ func (h *ModbusTCPHandler) Disconnect() error {
 }
 
 func (h *ModbusTCPHandler) ReadCoils(ctx context.Context, unitID uint8, address, quantity uint16) ([]bool, error) {
-	h.txCounter++
+	tx := h.nextTransaction()
 	req := ReadCoilsRequest{
 		FunctionCode:    0x01,
 		StartingAddress: address,
 		Quantity:        quantity,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, quantity)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, quantity)
 
 	pdu := make([]byte, 5)
 	pdu[0] = req.FunctionCode
 	binary.BigEndian.PutUint16(pdu[1:3], req.StartingAddress)
 	binary.BigEndian.PutUint16(pdu[3:5], req.Quantity)
 
-	response, err := h.sendRequest(ctx, unitID, pdu)
+	response, err := h.sendRequest(ctx, tx, unitID, pdu)
 	if err != nil {
 		return nil, err
 	}
@@ -119,25 +124,25 @@ func (h *ModbusTCPHandler) ReadCoils(ctx context.Context, unitID uint8, address,
 		coilStatus[i] = (response[2+byteIdx] & (1 << bitIdx)) != 0
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], byteCount, response[2:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], byteCount, response[2:])
 	return coilStatus, nil
 }
 
 func (h *ModbusTCPHandler) ReadDiscreteInputs(ctx context.Context, unitID uint8, address, quantity uint16) ([]bool, error) {
-	h.txCounter++
+	tx := h.nextTransaction()
 	req := ReadDiscreteInputsRequest{
 		FunctionCode:    0x02,
 		StartingAddress: address,
 		Quantity:        quantity,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, quantity)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, quantity)
 
 	pdu := make([]byte, 5)
 	pdu[0] = req.FunctionCode
 	binary.BigEndian.PutUint16(pdu[1:3], req.StartingAddress)
 	binary.BigEndian.PutUint16(pdu[3:5], req.Quantity)
 
-	response, err := h.sendRequest(ctx, unitID, pdu)
+	response, err := h.sendRequest(ctx, tx, unitID, pdu)
 	if err != nil {
 		return nil, err
 	}
@@ -154,25 +159,25 @@ func (h *ModbusTCPHandler) ReadDiscreteInputs(ctx context.Context, unitID uint8,
 		inputStatus[i] = (response[2+byteIdx] & (1 << bitIdx)) != 0
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], byteCount, response[2:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], byteCount, response[2:])
 	return inputStatus, nil
 }
 
 func (h *ModbusTCPHandler) ReadHoldingRegisters(ctx context.Context, unitID uint8, address, quantity uint16) ([]uint16, error) {
-	h.txCounter++
+	tx := h.nextTransaction()
 	req := ReadHoldingRegistersRequest{
 		FunctionCode:    0x03,
 		StartingAddress: address,
 		Quantity:        quantity,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, quantity)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, quantity)
 
 	pdu := make([]byte, 5)
 	pdu[0] = req.FunctionCode
 	binary.BigEndian.PutUint16(pdu[1:3], req.StartingAddress)
 	binary.BigEndian.PutUint16(pdu[3:5], req.Quantity)
 
-	response, err := h.sendRequest(ctx, unitID, pdu)
+	response, err := h.sendRequest(ctx, tx, unitID, pdu)
 	if err != nil {
 		return nil, err
 	}
@@ -187,25 +192,25 @@ func (h *ModbusTCPHandler) ReadHoldingRegisters(ctx context.Context, unitID uint
 		registerValues[i] = binary.BigEndian.Uint16(response[2+i*2 : 4+i*2])
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], byteCount, response[2:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], byteCount, response[2:])
 	return registerValues, nil
 }
 
 func (h *ModbusTCPHandler) ReadInputRegisters(ctx context.Context, unitID uint8, address, quantity uint16) ([]uint16, error) {
-	h.txCounter++
+	tx := h.nextTransaction()
 	req := ReadInputRegistersRequest{
 		FunctionCode:    0x04,
 		StartingAddress: address,
 		Quantity:        quantity,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, quantity)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, quantity)
 
 	pdu := make([]byte, 5)
 	pdu[0] = req.FunctionCode
 	binary.BigEndian.PutUint16(pdu[1:3], req.StartingAddress)
 	binary.BigEndian.PutUint16(pdu[3:5], req.Quantity)
 
-	response, err := h.sendRequest(ctx, unitID, pdu)
+	response, err := h.sendRequest(ctx, tx, unitID, pdu)
 	if err != nil {
 		return nil, err
 	}
@@ -220,12 +225,12 @@ func (h *ModbusTCPHandler) ReadInputRegisters(ctx context.Context, unitID uint8,
 		registerValues[i] = binary.BigEndian.Uint16(response[2+i*2 : 4+i*2])
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], byteCount, response[2:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], byteCount, response[2:])
 	return registerValues, nil
 }
 
 func (h *ModbusTCPHandler) WriteSingleCoil(ctx context.Context, unitID uint8, address uint16, outputValue bool) error {
-	h.txCounter++
+	tx := h.nextTransaction()
 	value := uint16(0)
 	if outputValue {
 		value = 0xFF00
@@ -236,14 +241,14 @@ func (h *ModbusTCPHandler) WriteSingleCoil(ctx context.Context, unitID uint8, ad
 		OutputAddress: address,
 		OutputValue:   value,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, 1)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, 1)
 
 	pdu := make([]byte, 5)
 	pdu[0] = req.FunctionCode
 	binary.BigEndian.PutUint16(pdu[1:3], req.OutputAddress)
 	binary.BigEndian.PutUint16(pdu[3:5], req.OutputValue)
 
-	response, err := h.sendRequest(ctx, unitID, pdu)
+	response, err := h.sendRequest(ctx, tx, unitID, pdu)
 	if err != nil {
 		return err
 	}
@@ -256,30 +261,30 @@ func (h *ModbusTCPHandler) WriteSingleCoil(ctx context.Context, unitID uint8, ad
 		return fmt.Errorf("invalid response length: %d", len(response))
 	}
 
-	respValue := binary.BigEndian.Uint16(response[1:5])
+	respValue := binary.BigEndian.Uint16(response[3:5])
 	if respValue != value {
 		return fmt.Errorf("coil value mismatch: expected %04x, got %04x", value, respValue)
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], uint8(len(response)), response[1:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], uint8(len(response)), response[1:])
 	return nil
 }
 
 func (h *ModbusTCPHandler) WriteSingleRegister(ctx context.Context, unitID uint8, address, value uint16) error {
-	h.txCounter++
+	tx := h.nextTransaction()
 	req := WriteSingleRegisterRequest{
 		FunctionCode:    0x06,
 		RegisterAddress: address,
 		RegisterValue:   value,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, 1)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, 1)
 
 	pdu := make([]byte, 5)
 	pdu[0] = req.FunctionCode
 	binary.BigEndian.PutUint16(pdu[1:3], req.RegisterAddress)
 	binary.BigEndian.PutUint16(pdu[3:5], req.RegisterValue)
 
-	response, err := h.sendRequest(ctx, unitID, pdu)
+	response, err := h.sendRequest(ctx, tx, unitID, pdu)
 	if err != nil {
 		return err
 	}
@@ -292,17 +297,17 @@ func (h *ModbusTCPHandler) WriteSingleRegister(ctx context.Context, unitID uint8
 		return fmt.Errorf("invalid response length: %d", len(response))
 	}
 
-	respValue := binary.BigEndian.Uint16(response[1:5])
+	respValue := binary.BigEndian.Uint16(response[3:5])
 	if respValue != value {
 		return fmt.Errorf("register value mismatch: expected %04x, got %04x", value, respValue)
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], uint8(len(response)), response[1:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], uint8(len(response)), response[1:])
 	return nil
 }
 
 func (h *ModbusTCPHandler) WriteMultipleCoils(ctx context.Context, unitID uint8, address uint16, values []bool) error {
-	h.txCounter++
+	tx := h.nextTransaction()
 	quantity := uint16(len(values))
 
 	outputBytes := make([]byte, (quantity+7)/8)
@@ -318,7 +323,7 @@ func (h *ModbusTCPHandler) WriteMultipleCoils(ctx context.Context, unitID uint8,
 		Quantity:        quantity,
 		OutputValues:    outputBytes[:(quantity+7)/8],
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, quantity)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, quantity)
 
 	pdu := make([]byte, 6+len(req.OutputValues))
 	pdu[0] = req.FunctionCode
@@ -327,7 +332,7 @@ func (h *ModbusTCPHandler) WriteMultipleCoils(ctx context.Context, unitID uint8,
 	pdu[5] = uint8(len(req.OutputValues))
 	copy(pdu[6:], req.OutputValues)
 
-	response, err := h.sendRequest(ctx, unitID, pdu)
+	response, err := h.sendRequest(ctx, tx, unitID, pdu)
 	if err != nil {
 		return err
 	}
@@ -336,12 +341,12 @@ func (h *ModbusTCPHandler) WriteMultipleCoils(ctx context.Context, unitID uint8,
 		return fmt.Errorf("unexpected function code: 0x%02x", response[0])
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], uint8(len(response)), response[1:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], uint8(len(response)), response[1:])
 	return nil
 }
 
 func (h *ModbusTCPHandler) WriteMultipleRegisters(ctx context.Context, unitID uint8, address uint16, values []uint16) error {
-	h.txCounter++
+	tx := h.nextTransaction()
 	quantity := uint16(len(values))
 
 	req := WriteMultipleRegistersRequest{
@@ -349,7 +354,7 @@ func (h *ModbusTCPHandler) WriteMultipleRegisters(ctx context.Context, unitID ui
 		StartingAddress: address,
 		RegisterValues:  values,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, quantity)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, quantity)
 
 	pdu := make([]byte, 5+len(values)*2)
 	pdu[0] = req.FunctionCode
@@ -361,7 +366,7 @@ func (h *ModbusTCPHandler) WriteMultipleRegisters(ctx context.Context, unitID ui
 		binary.BigEndian.PutUint16(pdu[6+i*2:8+i*2], val)
 	}
 
-	response, err := h.sendRequest(ctx, unitID, pdu)
+	response, err := h.sendRequest(ctx, tx, unitID, pdu)
 	if err != nil {
 		return err
 	}
@@ -370,12 +375,12 @@ func (h *ModbusTCPHandler) WriteMultipleRegisters(ctx context.Context, unitID ui
 		return fmt.Errorf("unexpected function code: 0x%02x", response[0])
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], uint8(len(response)), response[1:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], uint8(len(response)), response[1:])
 	return nil
 }
 
 func (h *ModbusTCPHandler) ReadWriteMultipleRegisters(ctx context.Context, unitID uint8, readStartAddr, writeStartAddr uint16, writeValues []uint16) ([]uint16, error) {
-	h.txCounter++
+	tx := h.nextTransaction()
 
 	req := ReadWriteMultipleRegistersRequest{
 		FunctionCode:      0x17,
@@ -384,7 +389,7 @@ func (h *ModbusTCPHandler) ReadWriteMultipleRegisters(ctx context.Context, unitI
 		WriteStartAddress: writeStartAddr,
 		RegisterValues:    writeValues,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, readStartAddr, req.ReadWriteCount)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, readStartAddr, req.ReadWriteCount)
 
 	pdu := make([]byte, 10+len(writeValues)*2)
 	pdu[0] = req.FunctionCode
@@ -398,7 +403,7 @@ func (h *ModbusTCPHandler) ReadWriteMultipleRegisters(ctx context.Context, unitI
 		binary.BigEndian.PutUint16(pdu[10+i*2:12+i*2], val)
 	}
 
-	response, err := h.sendRequest(ctx, unitID, pdu)
+	response, err := h.sendRequest(ctx, tx, unitID, pdu)
 	if err != nil {
 		return nil, err
 	}
@@ -413,12 +418,12 @@ func (h *ModbusTCPHandler) ReadWriteMultipleRegisters(ctx context.Context, unitI
 		registerValues[i] = binary.BigEndian.Uint16(response[2+i*2 : 4+i*2])
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], byteCount, response[2:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], byteCount, response[2:])
 	return registerValues, nil
 }
 
 func (h *ModbusTCPHandler) MaskWriteRegister(ctx context.Context, unitID uint8, address, andMask, orMask uint16) error {
-	h.txCounter++
+	tx := h.nextTransaction()
 
 	req := MaskWriteRegisterRequest{
 		FunctionCode:    0x16,
@@ -426,7 +431,7 @@ func (h *ModbusTCPHandler) MaskWriteRegister(ctx context.Context, unitID uint8,
 		AndMask:         andMask,
 		OrMask:          orMask,
 	}
-	h.config.Logger.LogRequest(h.txCounter, unitID, req.FunctionCode, address, 1)
+	h.config.Logger.LogRequest(tx, unitID, req.FunctionCode, address, 1)
 
 	pdu := make([]byte, 7)
 	pdu[0] = req.FunctionCode
@@ -434,7 +439,7 @@ func (h *ModbusTCPHandler) MaskWriteRegister(ctx context.Context, unitID uint8,
 	binary.BigEndian.PutUint16(pdu[3:5], req.AndMask)
 	binary.BigEndian.PutUint16(pdu[5:7], req.OrMask)
 
-	response, err := h.sendRequest(ctx, unitID, pdu)
+	response, err := h.sendRequest(ctx, tx, unitID, pdu)
 	if err != nil {
 		return err
 	}
@@ -455,11 +460,39 @@ func (h *ModbusTCPHandler) MaskWriteRegister(ctx context.Context, unitID uint8,
 		return fmt.Errorf("register mask mismatch")
 	}
 
-	h.config.Logger.LogResponse(h.txCounter, unitID, response[0], uint8(len(response)), response[1:])
+	h.config.Logger.LogResponse(tx, unitID, response[0], uint8(len(response)), response[1:])
 	return nil
 }
 
-func (h *ModbusTCPHandler) sendRequest(ctx context.Context, unitID uint8, pdu []byte) ([]byte, error) {
+// Transact sends a raw request PDU and returns the response PDU unmodified,
+// including exception responses. Used by the gateway to forward requests.
+func (h *ModbusTCPHandler) Transact(ctx context.Context, unitID uint8, pdu []byte) ([]byte, error) {
+	if len(pdu) == 0 || len(pdu) > maxPDULength {
+		return nil, fmt.Errorf("invalid PDU length: %d", len(pdu))
+	}
+
+	tx := h.nextTransaction()
+	response, err := h.sendRequest(ctx, tx, unitID, pdu)
+	if err != nil {
+		return nil, err
+	}
+
+	h.config.Logger.LogTransaction(tx, unitID, pdu[0], pdu, response)
+	return response, nil
+}
+
+// nextTransaction returns the transaction ID of a new request
+func (h *ModbusTCPHandler) nextTransaction() uint16 {
+	return uint16(h.txCounter.Add(1))
+}
+
+// sendRequest sends a request PDU and returns the response PDU. Requests
+// hold mu until they are answered, so responses cannot be read by another
+// request.
+func (h *ModbusTCPHandler) sendRequest(ctx context.Context, tx uint16, unitID uint8, pdu []byte) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
 	if h.config.UseMock {
 		return h.mockSendRequest(pdu)
 	}
@@ -468,7 +501,25 @@ func (h *ModbusTCPHandler) sendRequest(ctx context.Context, unitID uint8, pdu []
 		return nil, ErrNotConnected
 	}
 
-	mbap := buildMBAP(h.txCounter, uint8(len(pdu)), unitID)
+	start := time.Now()
+	request, response, err := h.exchange(ctx, tx, unitID, pdu)
+	var responsePDU []byte
+	if len(response) > 7 {
+		responsePDU = response[7:]
+	}
+	h.config.Logger.LogTraffic(newTransaction(tx, unitID, pdu, responsePDU, request, response, start, err))
+	if err != nil {
+		return nil, err
+	}
+
+	return responsePDU, nil
+}
+
+// exchange writes a request ADU and reads the response ADU, both including
+// the MBAP header
+func (h *ModbusTCPHandler) exchange(ctx context.Context, tx uint16, unitID uint8, pdu []byte) ([]byte, []byte, error) {
+
+	mbap := buildMBAP(tx, uint8(len(pdu)), unitID)
 	frame := append(mbap, pdu...)
 
 	timeout := 30 * time.Second
@@ -480,55 +531,55 @@ func (h *ModbusTCPHandler) sendRequest(ctx context.Context, unitID uint8, pdu []
 	_, err := h.conn.Write(frame)
 	if err != nil {
 		h.metrics.ErrorCount++
-		return nil, fmt.Errorf("failed to write request: %w", err)
+		return frame, nil, fmt.Errorf("failed to write request: %w", err)
 	}
 
 	h.metrics.BytesWritten += int64(len(frame))
 	h.metrics.WriteCount++
 	h.metrics.LastWrite = time.Now()
+	h.observe(ctx, models.FrameSent, frame)
 
-	response, err := h.readResponse(ctx)
+	response, err := h.readResponse(ctx, tx)
+	h.observe(ctx, models.FrameReceived, response)
 	if err != nil {
-		return nil, err
+		return frame, response, err
 	}
 
-	return response, nil
+	return frame, response, nil
 }
 
-func (h *ModbusTCPHandler) readResponse(ctx context.Context) ([]byte, error) {
-	response := make([]byte, 256)
+// readResponse reads a response ADU. On errors it returns what was read so
+// far, for the traffic monitor.
+func (h *ModbusTCPHandler) readResponse(ctx context.Context, tx uint16) ([]byte, error) {
+	response := make([]byte, 7+256)
 
-	mbap := make([]byte, 7)
-	_, err := h.conn.Read(mbap)
+	mbap := response[:7]
+	n, err := io.ReadFull(h.conn, mbap)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read MBAP header: %w", err)
+		return response[:n], fmt.Errorf("failed to read MBAP header: %w", err)
 	}
 
-	if mbap[0] != byte(h.txCounter>>8) || mbap[1] != byte(h.txCounter&0xFF) {
-		return nil, fmt.Errorf("transaction ID mismatch")
+	if binary.BigEndian.Uint16(mbap[0:2]) != tx {
+		return mbap, fmt.Errorf("transaction ID mismatch")
 	}
 
 	length := binary.BigEndian.Uint16(mbap[4:6])
 	pduLength := int(length - 1)
 
-	if pduLength > 256 {
-		return nil, fmt.Errorf("PDU length too large: %d", pduLength)
+	if pduLength < 1 || pduLength > 256 {
+		return mbap, fmt.Errorf("invalid PDU length: %d", pduLength)
 	}
 
-	totalRead := 0
-	for totalRead < pduLength {
-		n, err := h.conn.Read(response[totalRead:pduLength])
-		if err != nil {
-			return nil, fmt.Errorf("failed to read PDU: %w", err)
-		}
-		totalRead += n
+	totalRead, err := io.ReadFull(h.conn, response[7:7+pduLength])
+	if err != nil {
+		return response[:7+totalRead], fmt.Errorf("failed to read PDU: %w", err)
 	}
 
 	h.metrics.BytesRead += int64(7 + totalRead)
 	h.metrics.ReadCount++
 	h.metrics.LastRead = time.Now()
 
-	return response[:totalRead], nil
+	return response[:7+totalRead], nil
 }
 
 func (h *ModbusTCPHandler) mockSendRequest(pdu []byte) ([]byte, error) {
@@ -580,6 +631,7 @@ func (h *ModbusTCPHandler) Read(ctx context.Context) ([]byte, error) {
 	h.metrics.BytesRead += int64(n)
 	h.metrics.ReadCount++
 	h.metrics.LastRead = time.Now()
+	h.observe(ctx, models.FrameReceived, data[:n])
 
 	return data[:n], nil
 }
@@ -601,10 +653,22 @@ func (h *ModbusTCPHandler) Write(ctx context.Context, data []byte) error {
 	h.metrics.BytesWritten += int64(n)
 	h.metrics.WriteCount++
 	h.metrics.LastWrite = time.Now()
+	h.observe(ctx, models.FrameSent, data[:n])
 
 	return nil
 }
 
+func (h *ModbusTCPHandler) SetFrameObserver(observer protocol.FrameObserver) {
+	h.observer.Store(&observer)
+}
+
+// observe passes a frame to the observer, if any
+func (h *ModbusTCPHandler) observe(ctx context.Context, direction string, data []byte) {
+	if observer := h.observer.Load(); observer != nil && *observer != nil && len(data) > 0 {
+		(*observer)(ctx, direction, data)
+	}
+}
+
 func (h *ModbusTCPHandler) IsConnected() bool {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
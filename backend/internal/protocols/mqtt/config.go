@@ -0,0 +1,43 @@
+package mqtt
+
+import (
+	"strings"
+	"time"
+)
+
+const defaultQueueSize = 1024
+
+type MQTTConfig struct {
+	Broker        string         `json:"broker"`
+	ClientID      string         `json:"clientId"`
+	Username      string         `json:"username"`
+	Password      string         `json:"password"`
+	CleanSession  bool           `json:"cleanSession"`
+	KeepAlive     time.Duration  `json:"keepAlive"`
+	Timeout       time.Duration  `json:"timeout"`
+	Subscriptions []Subscription `json:"subscriptions"`
+	PublishTopic  string         `json:"publishTopic"`
+	QueueSize     int            `json:"queueSize"`
+}
+
+type Subscription struct {
+	Topic         string `json:"topic"`
+	QoS           byte   `json:"qos"`
+	DeviceSegment *int   `json:"deviceSegment"` // nil selects the first wildcard level
+}
+
+// deviceSegment returns the topic level holding the device key: the
+// configured one, or else the level of the first wildcard in the filter,
+// or the last level of a filter without wildcards
+func (s Subscription) deviceSegment() int {
+	if s.DeviceSegment != nil {
+		return *s.DeviceSegment
+	}
+	levels := strings.Split(s.Topic, "/")
+	for i, level := range levels {
+		if level == "+" || level == "#" {
+			return i
+		}
+	}
+	return len(levels) - 1
+}
@@ -0,0 +1,295 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	protocol "github.com/iotstudio/iotstudio/internal/protocols"
+	"github.com/iotstudio/iotstudio/pkg/api"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrNotConnected = errors.New("not connected")
+
+type MQTTHandler struct {
+	config     MQTTConfig
+	client     paho.Client
+	messages   chan *protocol.Message
+	done       chan struct{}
+	mu         sync.RWMutex
+	metrics    api.ConnectionMetrics
+	connected  bool // between Connect and Disconnect
+	online     bool // the client holds a session with the broker
+	subscribed bool
+}
+
+func NewMQTTHandler(config MQTTConfig) *MQTTHandler {
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultQueueSize
+	}
+
+	return &MQTTHandler{
+		config:  config,
+		metrics: api.ConnectionMetrics{},
+	}
+}
+
+func (h *MQTTHandler) Connect(ctx context.Context, cfg api.ConnectionConfig) error {
+	h.mu.Lock()
+	if h.connected {
+		h.mu.Unlock()
+		return fmt.Errorf("already connected to %s", h.config.Broker)
+	}
+	h.messages = make(chan *protocol.Message, h.config.QueueSize)
+	h.done = make(chan struct{})
+	h.mu.Unlock()
+
+	timeout := 30 * time.Second
+	if h.config.Timeout > 0 {
+		timeout = h.config.Timeout
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(h.config.Broker).
+		SetClientID(h.config.ClientID).
+		SetUsername(h.config.Username).
+		SetPassword(h.config.Password).
+		SetCleanSession(h.config.CleanSession).
+		SetConnectTimeout(timeout).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(h.onConnect).
+		SetConnectionLostHandler(h.onConnectionLost)
+
+	if h.config.KeepAlive > 0 {
+		opts.SetKeepAlive(h.config.KeepAlive)
+	}
+
+	// The lock is not held while talking to the broker: retained messages may
+	// be delivered before the last SUBACK and the message handler needs it.
+	client := paho.NewClient(opts)
+	err := waitToken(ctx, client.Connect(), timeout)
+	if err != nil {
+		err = fmt.Errorf("failed to connect to %s: %w", h.config.Broker, err)
+	} else if err = h.subscribe(ctx, client, timeout); err != nil {
+		client.Disconnect(250)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err != nil {
+		h.metrics.ErrorCount++
+		return err
+	}
+
+	h.client = client
+	h.connected = true
+	h.online = client.IsConnectionOpen()
+	h.subscribed = true
+
+	log.Info().
+		Str("broker", h.config.Broker).
+		Int("subscriptions", len(h.config.Subscriptions)).
+		Msg("MQTT connection established")
+
+	return nil
+}
+
+func (h *MQTTHandler) Disconnect() error {
+	h.mu.Lock()
+	if !h.connected {
+		h.mu.Unlock()
+		return nil
+	}
+	client := h.client
+	h.client = nil
+	h.connected = false
+	h.online = false
+	h.subscribed = false
+	close(h.done)
+	h.mu.Unlock()
+
+	// Without the lock: the client waits for the message handlers to return,
+	// and they take it to find the queue
+	client.Disconnect(250)
+
+	log.Info().
+		Str("broker", h.config.Broker).
+		Msg("MQTT connection closed")
+
+	return nil
+}
+
+// ReadMessage returns the next message received on any subscription
+func (h *MQTTHandler) ReadMessage(ctx context.Context) (*protocol.Message, error) {
+	h.mu.RLock()
+	if !h.connected {
+		h.mu.RUnlock()
+		return nil, ErrNotConnected
+	}
+	messages, done := h.messages, h.done
+	h.mu.RUnlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-done:
+		return nil, ErrNotConnected
+	case msg := <-messages:
+		h.mu.Lock()
+		h.metrics.BytesRead += int64(len(msg.Payload))
+		h.metrics.ReadCount++
+		h.metrics.LastRead = time.Now()
+		h.mu.Unlock()
+		return msg, nil
+	}
+}
+
+func (h *MQTTHandler) Read(ctx context.Context) ([]byte, error) {
+	msg, err := h.ReadMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Payload, nil
+}
+
+// Write publishes data to the configured publish topic
+func (h *MQTTHandler) Write(ctx context.Context, data []byte) error {
+	h.mu.RLock()
+	client, connected := h.client, h.connected && h.online
+	h.mu.RUnlock()
+
+	if !connected {
+		return ErrNotConnected
+	}
+	if h.config.PublishTopic == "" {
+		return fmt.Errorf("no publish topic configured")
+	}
+
+	timeout := 30 * time.Second
+	if h.config.Timeout > 0 {
+		timeout = h.config.Timeout
+	}
+
+	if err := waitToken(ctx, client.Publish(h.config.PublishTopic, 0, false, data), timeout); err != nil {
+		h.mu.Lock()
+		h.metrics.ErrorCount++
+		h.mu.Unlock()
+		return fmt.Errorf("publish error: %w", err)
+	}
+
+	h.mu.Lock()
+	h.metrics.BytesWritten += int64(len(data))
+	h.metrics.WriteCount++
+	h.metrics.LastWrite = time.Now()
+	h.mu.Unlock()
+
+	return nil
+}
+
+// IsConnected reports whether the client is connected to the broker. It is
+// false while the client reconnects after losing the connection.
+func (h *MQTTHandler) IsConnected() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.connected && h.online
+}
+
+func (h *MQTTHandler) GetMetrics() api.ConnectionMetrics {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.metrics
+}
+
+func (h *MQTTHandler) subscribe(ctx context.Context, client paho.Client, timeout time.Duration) error {
+	for _, sub := range h.config.Subscriptions {
+		token := client.Subscribe(sub.Topic, sub.QoS, h.messageHandler(sub))
+		if err := waitToken(ctx, token, timeout); err != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", sub.Topic, err)
+		}
+	}
+	return nil
+}
+
+func (h *MQTTHandler) messageHandler(sub Subscription) paho.MessageHandler {
+	return func(_ paho.Client, m paho.Message) {
+		msg := &protocol.Message{
+			Source:    m.Topic(),
+			DeviceKey: topicSegment(m.Topic(), sub.deviceSegment()),
+			Payload:   m.Payload(),
+			Timestamp: time.Now(),
+		}
+
+		h.mu.RLock()
+		messages, done := h.messages, h.done
+		h.mu.RUnlock()
+
+		select {
+		case <-done:
+		case messages <- msg:
+		default:
+			h.mu.Lock()
+			h.metrics.ErrorCount++
+			h.mu.Unlock()
+			log.Warn().Str("topic", m.Topic()).Msg("MQTT message queue full, dropping message")
+		}
+	}
+}
+
+// onConnect marks the connection online and restores subscriptions after an
+// automatic reconnect
+func (h *MQTTHandler) onConnect(client paho.Client) {
+	h.mu.Lock()
+	h.online = true
+	resubscribe := h.subscribed
+	h.mu.Unlock()
+
+	if !resubscribe {
+		return
+	}
+
+	for _, sub := range h.config.Subscriptions {
+		token := client.Subscribe(sub.Topic, sub.QoS, h.messageHandler(sub))
+		if token.Wait() && token.Error() != nil {
+			log.Error().Err(token.Error()).Str("topic", sub.Topic).Msg("Failed to resubscribe")
+		}
+	}
+
+	log.Info().Str("broker", h.config.Broker).Msg("MQTT connection re-established")
+}
+
+func (h *MQTTHandler) onConnectionLost(_ paho.Client, err error) {
+	h.mu.Lock()
+	h.online = false
+	h.metrics.ErrorCount++
+	h.mu.Unlock()
+
+	log.Warn().Err(err).Str("broker", h.config.Broker).Msg("MQTT connection lost")
+}
+
+func topicSegment(topic string, index int) string {
+	segments := strings.Split(topic, "/")
+	if index < 0 || index >= len(segments) {
+		return ""
+	}
+	return segments[index]
+}
+
+func waitToken(ctx context.Context, token paho.Token, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return fmt.Errorf("timed out after %s", timeout)
+	case <-token.Done():
+		return token.Error()
+	}
+}
@@ -0,0 +1,254 @@
+package mqtt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/iotstudio/iotstudio/internal/parser"
+	"github.com/iotstudio/iotstudio/pkg/api"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+func startBroker(t *testing.T) (*mochi.Server, string) {
+	t.Helper()
+
+	addr := freeAddress(t)
+	broker := startBrokerAt(t, addr)
+	t.Cleanup(func() { broker.Close() })
+
+	return broker, "tcp://" + addr
+}
+
+// freeAddress returns a local address nothing is listening on
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve port: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func startBrokerAt(t *testing.T, addr string) *mochi.Server {
+	t.Helper()
+
+	broker := mochi.New(&mochi.Options{InlineClient: true})
+	if err := broker.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatalf("Failed to add auth hook: %v", err)
+	}
+	if err := broker.AddListener(listeners.NewTCP(listeners.Config{ID: "test", Address: addr})); err != nil {
+		t.Fatalf("Failed to add listener: %v", err)
+	}
+	if err := broker.Serve(); err != nil {
+		t.Fatalf("Failed to start broker: %v", err)
+	}
+
+	return broker
+}
+
+func TestMQTTHandlerReadMessage(t *testing.T) {
+	broker, url := startBroker(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	handler := NewMQTTHandler(MQTTConfig{
+		Broker:   url,
+		ClientID: "iotstudio-test",
+		Timeout:  5 * time.Second,
+		Subscriptions: []Subscription{
+			{Topic: "plant/+/telemetry", QoS: 1},
+		},
+	})
+
+	if err := handler.Connect(ctx, api.ConnectionConfig{}); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer handler.Disconnect()
+
+	if !handler.IsConnected() {
+		t.Fatal("IsConnected() = false after Connect")
+	}
+
+	payload := []byte(`{"temperature": 21.5, "status": {"alarm": true}}`)
+	if err := broker.Publish("plant/boiler-1/telemetry", payload, false, 1); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	msg, err := handler.ReadMessage(ctx)
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+
+	if msg.Source != "plant/boiler-1/telemetry" {
+		t.Errorf("Source = %q, want %q", msg.Source, "plant/boiler-1/telemetry")
+	}
+	if msg.DeviceKey != "boiler-1" {
+		t.Errorf("DeviceKey = %q, want %q", msg.DeviceKey, "boiler-1")
+	}
+
+	result, err := parser.NewEngine().Parse(ctx, &models.Parser{
+		BuiltInType: parser.BuiltInJSON,
+		Fields: []models.ParserField{
+			{Name: "temperature", Scale: 2},
+			{Name: "status.alarm"},
+		},
+	}, msg.Payload)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	if got := result.DeviceData[""]["temperature"]; got != 43.0 {
+		t.Errorf("temperature = %v, want 43", got)
+	}
+	if got := result.DeviceData[""]["status.alarm"]; got != true {
+		t.Errorf("status.alarm = %v, want true", got)
+	}
+
+	metrics := handler.GetMetrics()
+	if metrics.ReadCount != 1 || metrics.BytesRead != int64(len(payload)) {
+		t.Errorf("metrics = %+v, want 1 read of %d bytes", metrics, len(payload))
+	}
+}
+
+func TestMQTTHandlerWrite(t *testing.T) {
+	broker, url := startBroker(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	received := make(chan []byte, 1)
+	err := broker.Subscribe("devices/out", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		received <- pk.Payload
+	})
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	handler := NewMQTTHandler(MQTTConfig{
+		Broker:       url,
+		ClientID:     "iotstudio-writer",
+		Timeout:      5 * time.Second,
+		PublishTopic: "devices/out",
+	})
+
+	if err := handler.Write(ctx, []byte("x")); err != ErrNotConnected {
+		t.Errorf("Write() before Connect error = %v, want %v", err, ErrNotConnected)
+	}
+
+	if err := handler.Connect(ctx, api.ConnectionConfig{}); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer handler.Disconnect()
+
+	if err := handler.Write(ctx, []byte{0x01, 0x02}); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	select {
+	case payload := <-received:
+		if string(payload) != "\x01\x02" {
+			t.Errorf("payload = %x, want 0102", payload)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for published message")
+	}
+}
+
+func TestTopicSegment(t *testing.T) {
+	tests := []struct {
+		topic string
+		index int
+		want  string
+	}{
+		{"plant/boiler-1/telemetry", 1, "boiler-1"},
+		{"plant/boiler-1/telemetry", 0, "plant"},
+		{"plant/boiler-1/telemetry", 3, ""},
+		{"plant/boiler-1/telemetry", -1, ""},
+	}
+
+	for _, tt := range tests {
+		if got := topicSegment(tt.topic, tt.index); got != tt.want {
+			t.Errorf("topicSegment(%q, %d) = %q, want %q", tt.topic, tt.index, got, tt.want)
+		}
+	}
+}
+
+func TestSubscriptionDeviceSegment(t *testing.T) {
+	two := 2
+	tests := []struct {
+		sub  Subscription
+		want int
+	}{
+		{Subscription{Topic: "plant/+/telemetry"}, 1},
+		{Subscription{Topic: "plant/line-1/#"}, 2},
+		{Subscription{Topic: "plant/+/+/data"}, 1},
+		{Subscription{Topic: "plant/boiler-1"}, 1},
+		{Subscription{Topic: "plant/+/telemetry/+", DeviceSegment: &two}, 2},
+	}
+
+	for _, tt := range tests {
+		if got := tt.sub.deviceSegment(); got != tt.want {
+			t.Errorf("deviceSegment(%q) = %d, want %d", tt.sub.Topic, got, tt.want)
+		}
+	}
+}
+
+func TestMQTTHandlerReconnect(t *testing.T) {
+	addr := freeAddress(t)
+	broker := startBrokerAt(t, addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	handler := NewMQTTHandler(MQTTConfig{
+		Broker:        "tcp://" + addr,
+		ClientID:      "iotstudio-reconnect",
+		Timeout:       5 * time.Second,
+		Subscriptions: []Subscription{{Topic: "plant/+/telemetry", QoS: 1}},
+	})
+	if err := handler.Connect(ctx, api.ConnectionConfig{}); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer handler.Disconnect()
+
+	broker.Close()
+	waitFor(t, ctx, "IsConnected() = false after the broker stopped", func() bool {
+		return !handler.IsConnected()
+	})
+	if err := handler.Write(ctx, []byte("x")); err != ErrNotConnected {
+		t.Errorf("Write() while offline error = %v, want %v", err, ErrNotConnected)
+	}
+
+	broker = startBrokerAt(t, addr)
+	defer broker.Close()
+	waitFor(t, ctx, "IsConnected() = true after reconnecting", handler.IsConnected)
+
+	// Subscriptions are restored, so messages flow again
+	waitFor(t, ctx, "message after reconnecting", func() bool {
+		if err := broker.Publish("plant/boiler-1/telemetry", []byte("{}"), false, 1); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+		readCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancel()
+		msg, err := handler.ReadMessage(readCtx)
+		return err == nil && msg.DeviceKey == "boiler-1"
+	})
+}
+
+func waitFor(t *testing.T, ctx context.Context, what string, cond func() bool) {
+	t.Helper()
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %s", what)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
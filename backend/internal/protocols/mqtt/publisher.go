@@ -0,0 +1,257 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	FormatJSON      = "json"
+	FormatSparkplug = "sparkplug"
+
+	DefaultTopicTemplate = "iotstudio/{session}/{device}/{field}"
+)
+
+// topicEscaper percent-encodes the characters that would split a topic
+// level or are not allowed in topic names, so session and device IDs and
+// field names each fill exactly one level
+var topicEscaper = strings.NewReplacer(
+	"%", "%25",
+	"/", "%2F",
+	"+", "%2B",
+	"#", "%23",
+	"\x00", "%00",
+)
+
+type PublisherConfig struct {
+	Broker        string        `json:"broker"`
+	ClientID      string        `json:"clientId"`
+	Username      string        `json:"username"`
+	Password      string        `json:"password"`
+	TopicTemplate string        `json:"topicTemplate"`
+	QoS           byte          `json:"qos"`
+	Retain        bool          `json:"retain"`
+	Format        string        `json:"format"`
+	Timeout       time.Duration `json:"timeout"`
+}
+
+// Publisher forwards parsed data points to an MQTT broker (northbound bridge).
+//
+// When the topic template contains {field} every field is published on its
+// own topic, otherwise one message per data point carries all fields. The
+// sparkplug format always publishes one message per data point with a
+// Sparkplug-style metrics array.
+//
+// WriteDataPoints waits for the broker. It is meant to be called from the
+// connection manager's sink queue, which is the only buffer in front of the
+// broker and counts what it drops.
+type Publisher struct {
+	config PublisherConfig
+	client paho.Client
+	mu     sync.Mutex
+	seq    uint64
+}
+
+type fieldPayload struct {
+	Timestamp int64       `json:"timestamp"`
+	Value     interface{} `json:"value"`
+}
+
+type pointPayload struct {
+	Timestamp int64                  `json:"timestamp"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+type sparkplugMetric struct {
+	Name      string      `json:"name"`
+	Timestamp int64       `json:"timestamp"`
+	Value     interface{} `json:"value"`
+}
+
+type sparkplugPayload struct {
+	Timestamp int64             `json:"timestamp"`
+	Seq       uint64            `json:"seq"`
+	Metrics   []sparkplugMetric `json:"metrics"`
+}
+
+type publication struct {
+	topic   string
+	payload []byte
+}
+
+func NewPublisher(config PublisherConfig) *Publisher {
+	if config.TopicTemplate == "" {
+		config.TopicTemplate = DefaultTopicTemplate
+	}
+	if config.Format == "" {
+		config.Format = FormatJSON
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 30 * time.Second
+	}
+	return &Publisher{config: config}
+}
+
+func (p *Publisher) Connect(ctx context.Context) error {
+	if p.config.Format != FormatJSON && p.config.Format != FormatSparkplug {
+		return fmt.Errorf("unknown payload format: %s", p.config.Format)
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(p.config.Broker).
+		SetClientID(p.config.ClientID).
+		SetUsername(p.config.Username).
+		SetPassword(p.config.Password).
+		SetConnectTimeout(p.config.Timeout).
+		SetAutoReconnect(true)
+
+	client := paho.NewClient(opts)
+	if err := waitToken(ctx, client.Connect(), p.config.Timeout); err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", p.config.Broker, err)
+	}
+
+	p.mu.Lock()
+	p.client = client
+	p.mu.Unlock()
+
+	log.Info().
+		Str("broker", p.config.Broker).
+		Str("topicTemplate", p.config.TopicTemplate).
+		Str("format", p.config.Format).
+		Msg("MQTT bridge connected")
+
+	return nil
+}
+
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	client := p.client
+	p.client = nil
+	p.mu.Unlock()
+
+	if client != nil {
+		client.Disconnect(250)
+	}
+	return nil
+}
+
+// WriteDataPoints publishes the messages for the points, so the publisher
+// can be used as a data sink next to storage. The messages are handed to
+// the client in order and then awaited together, for at most the timeout.
+func (p *Publisher) WriteDataPoints(ctx context.Context, points []models.DataPoint) error {
+	var publications []publication
+	for _, point := range points {
+		encoded, err := p.encode(point)
+		if err != nil {
+			return err
+		}
+		publications = append(publications, encoded...)
+	}
+
+	p.mu.Lock()
+	client := p.client
+	p.mu.Unlock()
+
+	if client == nil {
+		return ErrNotConnected
+	}
+
+	tokens := make([]paho.Token, len(publications))
+	for i, pub := range publications {
+		tokens[i] = client.Publish(pub.topic, p.config.QoS, p.config.Retain, pub.payload)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	defer cancel()
+
+	var failed int
+	var firstErr error
+	for i, token := range tokens {
+		if err := waitToken(ctx, token, p.config.Timeout); err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = fmt.Errorf("topic %s: %w", publications[i].topic, err)
+			}
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("failed to publish %d of %d messages: %w", failed, len(tokens), firstErr)
+	}
+	return nil
+}
+
+func (p *Publisher) encode(point models.DataPoint) ([]publication, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(point.Data), &values); err != nil {
+		return nil, fmt.Errorf("invalid data for device %s: %w", point.DeviceID, err)
+	}
+
+	if p.config.Format == FormatSparkplug {
+		p.mu.Lock()
+		seq := p.seq % 256
+		p.seq++
+		p.mu.Unlock()
+
+		payload := sparkplugPayload{Timestamp: point.Timestamp, Seq: seq}
+		for _, name := range sortedKeys(values) {
+			payload.Metrics = append(payload.Metrics, sparkplugMetric{
+				Name:      name,
+				Timestamp: point.Timestamp,
+				Value:     values[name],
+			})
+		}
+
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		return []publication{{topic: p.topic(point, ""), payload: data}}, nil
+	}
+
+	if !strings.Contains(p.config.TopicTemplate, "{field}") {
+		data, err := json.Marshal(pointPayload{Timestamp: point.Timestamp, Data: values})
+		if err != nil {
+			return nil, err
+		}
+		return []publication{{topic: p.topic(point, ""), payload: data}}, nil
+	}
+
+	publications := make([]publication, 0, len(values))
+	for _, name := range sortedKeys(values) {
+		data, err := json.Marshal(fieldPayload{Timestamp: point.Timestamp, Value: values[name]})
+		if err != nil {
+			return nil, err
+		}
+		publications = append(publications, publication{topic: p.topic(point, name), payload: data})
+	}
+	return publications, nil
+}
+
+// topic fills in the template. The values are escaped, so a device ID or
+// field name containing "/", "+" or "#" cannot add a level or a wildcard.
+func (p *Publisher) topic(point models.DataPoint, field string) string {
+	topic := strings.NewReplacer(
+		"{session}", topicEscaper.Replace(point.SessionID),
+		"{device}", topicEscaper.Replace(point.DeviceID),
+		"{field}", topicEscaper.Replace(field),
+	).Replace(p.config.TopicTemplate)
+	return strings.TrimSuffix(topic, "/")
+}
+
+func sortedKeys(values map[string]interface{}) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,215 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/iotstudio/iotstudio/internal/models"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+type received struct {
+	topic   string
+	payload []byte
+}
+
+func collect(t *testing.T, broker *mochi.Server, filter string) <-chan received {
+	t.Helper()
+
+	ch := make(chan received, 16)
+	err := broker.Subscribe(filter, 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		ch <- received{topic: pk.TopicName, payload: pk.Payload}
+	})
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	return ch
+}
+
+func next(t *testing.T, ch <-chan received) received {
+	t.Helper()
+
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for published message")
+		return received{}
+	}
+}
+
+func TestPublisherPerField(t *testing.T) {
+	broker, url := startBroker(t)
+	messages := collect(t, broker, "iotstudio/#")
+	ctx := context.Background()
+
+	pub := NewPublisher(PublisherConfig{Broker: url, ClientID: "bridge", QoS: 1, Retain: true})
+	if err := pub.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer pub.Close()
+
+	err := pub.WriteDataPoints(ctx, []models.DataPoint{{
+		SessionID: "s1",
+		DeviceID:  "d1",
+		Timestamp: 1700000000000,
+		Data:      `{"pressure": 1.5, "temperature": 21}`,
+	}})
+	if err != nil {
+		t.Fatalf("WriteDataPoints() error = %v", err)
+	}
+
+	want := []struct {
+		topic string
+		value float64
+	}{
+		{"iotstudio/s1/d1/pressure", 1.5},
+		{"iotstudio/s1/d1/temperature", 21},
+	}
+
+	for _, w := range want {
+		msg := next(t, messages)
+		if msg.topic != w.topic {
+			t.Errorf("topic = %q, want %q", msg.topic, w.topic)
+		}
+
+		var payload fieldPayload
+		if err := json.Unmarshal(msg.payload, &payload); err != nil {
+			t.Fatalf("invalid payload %s: %v", msg.payload, err)
+		}
+		if payload.Value != w.value || payload.Timestamp != 1700000000000 {
+			t.Errorf("payload = %+v, want value %v", payload, w.value)
+		}
+	}
+}
+
+func TestPublisherSparkplug(t *testing.T) {
+	broker, url := startBroker(t)
+	messages := collect(t, broker, "plant/#")
+	ctx := context.Background()
+
+	pub := NewPublisher(PublisherConfig{
+		Broker:        url,
+		ClientID:      "bridge",
+		TopicTemplate: "plant/{session}/{device}",
+		Format:        FormatSparkplug,
+	})
+	if err := pub.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer pub.Close()
+
+	points := []models.DataPoint{
+		{SessionID: "s1", DeviceID: "d1", Timestamp: 1000, Data: `{"b": true, "a": 2}`},
+		{SessionID: "s1", DeviceID: "d2", Timestamp: 2000, Data: `{"c": "on"}`},
+	}
+	if err := pub.WriteDataPoints(ctx, points); err != nil {
+		t.Fatalf("WriteDataPoints() error = %v", err)
+	}
+
+	for i, point := range points {
+		msg := next(t, messages)
+		if want := "plant/s1/" + point.DeviceID; msg.topic != want {
+			t.Errorf("topic = %q, want %q", msg.topic, want)
+		}
+
+		var payload sparkplugPayload
+		if err := json.Unmarshal(msg.payload, &payload); err != nil {
+			t.Fatalf("invalid payload %s: %v", msg.payload, err)
+		}
+		if payload.Seq != uint64(i) || payload.Timestamp != point.Timestamp {
+			t.Errorf("payload seq/timestamp = %d/%d, want %d/%d", payload.Seq, payload.Timestamp, i, point.Timestamp)
+		}
+		if i == 0 && (len(payload.Metrics) != 2 || payload.Metrics[0].Name != "a" || payload.Metrics[1].Value != true) {
+			t.Errorf("metrics = %+v", payload.Metrics)
+		}
+	}
+}
+
+func TestPublisherKeepsOrder(t *testing.T) {
+	broker, url := startBroker(t)
+	ch := make(chan received, 100)
+	if err := broker.Subscribe("iotstudio/#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		ch <- received{topic: pk.TopicName, payload: pk.Payload}
+	}); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	pub := NewPublisher(PublisherConfig{Broker: url, ClientID: "bridge", QoS: 1, TopicTemplate: "iotstudio/{device}"})
+	if err := pub.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer pub.Close()
+
+	points := make([]models.DataPoint, 50)
+	for i := range points {
+		points[i] = models.DataPoint{DeviceID: "d1", Timestamp: int64(i), Data: `{"v": 1}`}
+	}
+	if err := pub.WriteDataPoints(context.Background(), points); err != nil {
+		t.Fatalf("WriteDataPoints() error = %v", err)
+	}
+
+	for i := range points {
+		var payload pointPayload
+		if err := json.Unmarshal(next(t, ch).payload, &payload); err != nil {
+			t.Fatalf("invalid payload: %v", err)
+		}
+		if payload.Timestamp != int64(i) {
+			t.Fatalf("message %d has timestamp %d, want them in order", i, payload.Timestamp)
+		}
+	}
+}
+
+func TestPublisherEscapesTopicLevels(t *testing.T) {
+	broker, url := startBroker(t)
+	messages := collect(t, broker, "iotstudio/#")
+	ctx := context.Background()
+
+	pub := NewPublisher(PublisherConfig{Broker: url, ClientID: "bridge", QoS: 1})
+	if err := pub.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer pub.Close()
+
+	err := pub.WriteDataPoints(ctx, []models.DataPoint{{
+		SessionID: "s/1",
+		DeviceID:  "d+1",
+		Data:      `{"flow#2": 1, "100%": 2}`,
+	}})
+	if err != nil {
+		t.Fatalf("WriteDataPoints() error = %v", err)
+	}
+
+	for _, want := range []string{"iotstudio/s%2F1/d%2B1/100%25", "iotstudio/s%2F1/d%2B1/flow%232"} {
+		if msg := next(t, messages); msg.topic != want {
+			t.Errorf("topic = %q, want %q", msg.topic, want)
+		}
+	}
+}
+
+func TestPublisherTimeout(t *testing.T) {
+	// The client never connects, so the message is never acknowledged
+	pub := NewPublisher(PublisherConfig{QoS: 1, Timeout: 100 * time.Millisecond})
+	pub.client = paho.NewClient(paho.NewClientOptions())
+
+	start := time.Now()
+	err := pub.WriteDataPoints(context.Background(), []models.DataPoint{{DeviceID: "d1", Data: `{"a": 1}`}})
+	if err == nil {
+		t.Error("WriteDataPoints() error = nil for an unacknowledged message")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("WriteDataPoints() blocked for %v", elapsed)
+	}
+}
+
+func TestPublisherNotConnected(t *testing.T) {
+	pub := NewPublisher(PublisherConfig{})
+	err := pub.WriteDataPoints(context.Background(), []models.DataPoint{{Data: "{}"}})
+	if err != ErrNotConnected {
+		t.Errorf("WriteDataPoints() error = %v, want %v", err, ErrNotConnected)
+	}
+}
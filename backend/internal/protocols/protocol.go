@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"context"
+	"time"
 
 	"github.com/iotstudio/iotstudio/pkg/api"
 )
@@ -27,5 +28,36 @@ type ProtocolHandler interface {
 	GetMetrics() api.ConnectionMetrics
 }
 
+// Message is a payload received from a message-oriented protocol together with its origin
+type Message struct {
+	// Source identifies where the payload came from, e.g. the MQTT topic
+	Source string
+
+	// DeviceKey is matched against Device.Address or Device.ID to attribute the payload
+	DeviceKey string
+
+	Payload   []byte
+	Timestamp time.Time
+}
+
+// MessageReader is implemented by handlers that can attribute each payload to a device
+type MessageReader interface {
+	// ReadMessage blocks until the next message is available
+	ReadMessage(ctx context.Context) (*Message, error)
+}
+
+// FrameObserver is called with every frame a handler sends or receives on
+// the wire, with the context of the call that moved it, so the caller can
+// tell which frames belong to its own request. Direction is models.FrameSent
+// or models.FrameReceived; data must not be retained after the call returns.
+type FrameObserver func(ctx context.Context, direction string, data []byte)
+
+// FrameCapturer is implemented by handlers that can report the raw frames
+// they exchange, including those behind higher-level calls
+type FrameCapturer interface {
+	// SetFrameObserver registers the observer; nil disables it
+	SetFrameObserver(observer FrameObserver)
+}
+
 // ProtocolFactory is a function that creates a new protocol handler
 type ProtocolFactory func(ctx context.Context, config api.ConnectionConfig) (ProtocolHandler, error)
@@ -0,0 +1,9 @@
+package replay
+
+type ReplayConfig struct {
+	Path    string  `json:"path"`  // raw frame export (JSON) or pcapng file, relative to Dir
+	Speed   float64 `json:"speed"` // 2 plays twice as fast as recorded; 0 means 1
+	Loop    bool    `json:"loop"`
+	Dir     string  `json:"-"` // the only directory recordings are read from
+	MaxSize int64   `json:"-"` // in bytes; 0 means defaultMaxSize
+}
@@ -0,0 +1,303 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/iotstudio/iotstudio/internal/pcapng"
+	"github.com/iotstudio/iotstudio/pkg/api"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrNotConnected = errors.New("not connected")
+
+// ErrOutsideDir is returned for recordings outside the recordings directory
+var ErrOutsideDir = errors.New("recording is outside the recordings directory")
+
+const (
+	defaultMaxSize = 64 << 20
+	// idlePeriod separates the passes over a recording of a single instant
+	idlePeriod = time.Second
+)
+
+// frame is a received frame and its time after the first one
+type frame struct {
+	offset time.Duration
+	data   []byte
+}
+
+// ReplayHandler plays back the frames received in a recording through Read,
+// at the recorded pace or scaled. Frames sent in the recording are skipped
+// and writes are discarded.
+type ReplayHandler struct {
+	config    ReplayConfig
+	frames    []frame
+	period    time.Duration // from one pass to the next, as recorded
+	next      int
+	start     time.Time // when the current pass began
+	done      chan struct{}
+	mu        sync.Mutex
+	metrics   api.ConnectionMetrics
+	connected bool
+}
+
+func NewReplayHandler(config ReplayConfig) *ReplayHandler {
+	if config.Speed <= 0 {
+		config.Speed = 1
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = defaultMaxSize
+	}
+
+	return &ReplayHandler{
+		config:  config,
+		metrics: api.ConnectionMetrics{},
+	}
+}
+
+// Connect loads the recording and starts playback
+func (h *ReplayHandler) Connect(ctx context.Context, cfg api.ConnectionConfig) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.connected {
+		return fmt.Errorf("already replaying %s", h.config.Path)
+	}
+
+	frames, err := loadFrames(h.config.Dir, h.config.Path, h.config.MaxSize)
+	if err != nil {
+		h.metrics.ErrorCount++
+		return err
+	}
+	if len(frames) == 0 {
+		return fmt.Errorf("no received frames in %s", h.config.Path)
+	}
+
+	h.frames = frames
+	h.period = loopPeriod(frames)
+	h.next = 0
+	h.start = time.Now()
+	h.done = make(chan struct{})
+	h.connected = true
+
+	log.Info().
+		Str("path", h.config.Path).
+		Int("frames", len(frames)).
+		Float64("speed", h.config.Speed).
+		Msg("Replay started")
+
+	return nil
+}
+
+func (h *ReplayHandler) Disconnect() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.connected {
+		return nil
+	}
+
+	close(h.done)
+	h.connected = false
+
+	log.Info().Str("path", h.config.Path).Msg("Replay stopped")
+
+	return nil
+}
+
+// Read waits until the next frame is due and returns it. At the end of the
+// recording it starts over one period after the last pass began when
+// looping, and returns io.EOF otherwise.
+func (h *ReplayHandler) Read(ctx context.Context) ([]byte, error) {
+	h.mu.Lock()
+	if !h.connected {
+		h.mu.Unlock()
+		return nil, ErrNotConnected
+	}
+	if h.next == len(h.frames) {
+		if !h.config.Loop {
+			h.mu.Unlock()
+			return nil, io.EOF
+		}
+		h.next = 0
+		h.start = h.start.Add(time.Duration(float64(h.period) / h.config.Speed))
+	}
+	next := h.frames[h.next]
+	h.next++
+	due := h.start.Add(time.Duration(float64(next.offset) / h.config.Speed))
+	done := h.done
+	h.mu.Unlock()
+
+	if wait := time.Until(due); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-done:
+			return nil, ErrNotConnected
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	h.mu.Lock()
+	h.metrics.BytesRead += int64(len(next.data))
+	h.metrics.ReadCount++
+	h.metrics.LastRead = time.Now()
+	h.mu.Unlock()
+
+	return next.data, nil
+}
+
+// Write discards the data, as there is no device to answer it
+func (h *ReplayHandler) Write(ctx context.Context, data []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.connected {
+		return ErrNotConnected
+	}
+
+	h.metrics.BytesWritten += int64(len(data))
+	h.metrics.WriteCount++
+	h.metrics.LastWrite = time.Now()
+
+	return nil
+}
+
+func (h *ReplayHandler) IsConnected() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.connected
+}
+
+func (h *ReplayHandler) GetMetrics() api.ConnectionMetrics {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.metrics
+}
+
+// loopPeriod is the time a pass over frames takes: the recorded span and,
+// between the last frame and the first of the next pass, the mean spacing
+func loopPeriod(frames []frame) time.Duration {
+	span := frames[len(frames)-1].offset
+	if span <= 0 {
+		return idlePeriod
+	}
+	return span + span/time.Duration(len(frames)-1)
+}
+
+// loadFrames reads the received frames of a raw frame export or pcapng file
+// at path within dir, refusing files larger than maxSize bytes
+func loadFrames(dir, path string, maxSize int64) ([]frame, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no recordings directory configured")
+	}
+	name := path
+	if filepath.IsAbs(path) {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve recordings directory: %w", err)
+		}
+		if name, err = filepath.Rel(absDir, path); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrOutsideDir, path)
+		}
+	}
+	if !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("%w: %s", ErrOutsideDir, path)
+	}
+
+	// Symbolic links cannot lead out of dir either
+	file, err := os.OpenInRoot(dir, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recording: %w", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("recording %s is larger than %d bytes", path, maxSize)
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		return loadExport(trimmed)
+	}
+	return loadPcapng(data)
+}
+
+func loadExport(data []byte) ([]frame, error) {
+	var raw []models.RawFrame
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid frame export: %w", err)
+	}
+
+	var frames []frame
+	var first int64
+	for _, rf := range raw {
+		if rf.Direction == models.FrameSent {
+			continue
+		}
+		if frames == nil {
+			first = rf.Timestamp
+		}
+		frames = append(frames, frame{
+			offset: time.Duration(rf.Timestamp-first) * time.Millisecond,
+			data:   rf.Data,
+		})
+	}
+	return frames, nil
+}
+
+// loadPcapng reads the inbound packets of a pcapng file. Packets without a
+// recorded direction count as received. IP packets contribute their TCP
+// payload; others, e.g. serial frames, are used as they are.
+func loadPcapng(data []byte) ([]frame, error) {
+	reader, err := pcapng.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported recording: %w", err)
+	}
+
+	var frames []frame
+	var first time.Time
+	for {
+		packet, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid pcapng recording: %w", err)
+		}
+		if packet.Direction == pcapng.Outbound {
+			continue
+		}
+
+		payload := packet.Data
+		if packet.LinkType == pcapng.LinkTypeRaw {
+			var ok bool
+			if payload, ok = pcapng.TCPPayload(packet.Data); !ok {
+				continue
+			}
+		}
+		if len(payload) == 0 {
+			continue
+		}
+
+		if frames == nil {
+			first = packet.Timestamp
+		}
+		frames = append(frames, frame{offset: packet.Timestamp.Sub(first), data: payload})
+	}
+}
@@ -0,0 +1,223 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/iotstudio/iotstudio/internal/pcapng"
+	"github.com/iotstudio/iotstudio/pkg/api"
+)
+
+func writeExport(t *testing.T, frames []models.RawFrame) string {
+	t.Helper()
+
+	data, err := json.Marshal(frames)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "capture.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	return path
+}
+
+func readAll(t *testing.T, handler *ReplayHandler, count int) [][]byte {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var frames [][]byte
+	for i := 0; i < count; i++ {
+		data, err := handler.Read(ctx)
+		if err != nil {
+			t.Fatalf("Read() %d error = %v", i, err)
+		}
+		frames = append(frames, data)
+	}
+	return frames
+}
+
+func TestReplayExport(t *testing.T) {
+	path := writeExport(t, []models.RawFrame{
+		{Timestamp: 1000, Direction: models.FrameReceived, Data: []byte{0x01}},
+		{Timestamp: 1010, Direction: models.FrameSent, Data: []byte{0xFF}},
+		{Timestamp: 1100, Direction: models.FrameReceived, Data: []byte{0x02}},
+	})
+
+	handler := NewReplayHandler(ReplayConfig{Path: path, Speed: 2, Dir: filepath.Dir(path)})
+	if err := handler.Connect(context.Background(), api.ConnectionConfig{}); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer handler.Disconnect()
+
+	start := time.Now()
+	frames := readAll(t, handler, 2)
+	elapsed := time.Since(start)
+
+	if !bytes.Equal(frames[0], []byte{0x01}) || !bytes.Equal(frames[1], []byte{0x02}) {
+		t.Errorf("frames = % x, want 01 and 02", frames)
+	}
+	// 100ms apart in the recording, played at twice the speed
+	if elapsed < 45*time.Millisecond || elapsed > time.Second {
+		t.Errorf("replay took %v, want about 50ms", elapsed)
+	}
+
+	if _, err := handler.Read(context.Background()); !errors.Is(err, io.EOF) {
+		t.Errorf("Read() after the last frame error = %v, want EOF", err)
+	}
+	if metrics := handler.GetMetrics(); metrics.ReadCount != 2 || metrics.BytesRead != 2 {
+		t.Errorf("metrics = %+v", metrics)
+	}
+}
+
+func TestReplayLoop(t *testing.T) {
+	path := writeExport(t, []models.RawFrame{
+		{Timestamp: 1000, Direction: models.FrameReceived, Data: []byte{0x01}},
+		{Timestamp: 1001, Direction: models.FrameReceived, Data: []byte{0x02}},
+	})
+
+	handler := NewReplayHandler(ReplayConfig{Path: path, Loop: true, Dir: filepath.Dir(path)})
+	if err := handler.Connect(context.Background(), api.ConnectionConfig{}); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer handler.Disconnect()
+
+	frames := readAll(t, handler, 5)
+	for i, want := range []byte{0x01, 0x02, 0x01, 0x02, 0x01} {
+		if !bytes.Equal(frames[i], []byte{want}) {
+			t.Errorf("frame %d = % x, want %02x", i, frames[i], want)
+		}
+	}
+}
+
+func TestReplayLoopKeepsPeriod(t *testing.T) {
+	path := writeExport(t, []models.RawFrame{
+		{Timestamp: 0, Direction: models.FrameReceived, Data: []byte{0x01}},
+		{Timestamp: 50, Direction: models.FrameReceived, Data: []byte{0x02}},
+	})
+
+	handler := NewReplayHandler(ReplayConfig{Path: path, Loop: true, Dir: filepath.Dir(path)})
+	if err := handler.Connect(context.Background(), api.ConnectionConfig{}); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer handler.Disconnect()
+
+	// The first frame comes round again 50ms after the last, as often as
+	// the recording has frames
+	start := time.Now()
+	readAll(t, handler, 3)
+	if elapsed := time.Since(start); elapsed < 95*time.Millisecond || elapsed > time.Second {
+		t.Errorf("two passes took %v, want about 100ms", elapsed)
+	}
+}
+
+func TestReplayRecordingLimits(t *testing.T) {
+	dir := t.TempDir()
+	path := writeExport(t, []models.RawFrame{{Timestamp: 0, Direction: models.FrameReceived, Data: []byte{0x01}}})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "capture.json"), data, 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := os.Symlink(path, filepath.Join(dir, "link.json")); err != nil {
+		t.Fatalf("Symlink() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		maxSize int64
+		wantErr bool
+	}{
+		{"relative", "capture.json", 0, false},
+		{"absolute inside", filepath.Join(dir, "capture.json"), 0, false},
+		{"parent", "../capture.json", 0, true},
+		{"absolute outside", path, 0, true},
+		{"symbolic link out", "link.json", 0, true},
+		{"too large", "capture.json", int64(len(data)) - 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewReplayHandler(ReplayConfig{Path: tt.path, Dir: dir, MaxSize: tt.maxSize})
+			err := handler.Connect(context.Background(), api.ConnectionConfig{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Connect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			handler.Disconnect()
+		})
+	}
+
+	if err := NewReplayHandler(ReplayConfig{Path: "capture.json"}).Connect(context.Background(), api.ConnectionConfig{}); err == nil {
+		t.Error("Connect() without a recordings directory succeeded")
+	}
+}
+
+func TestReplayPcapng(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := pcapng.NewWriter(&buf, pcapng.LinkTypeRaw)
+	if err != nil {
+		t.Fatalf("NewWriter() error = %v", err)
+	}
+	stream := &pcapng.TCPStream{
+		Client: netip.MustParseAddrPort("192.0.2.1:49152"),
+		Server: netip.MustParseAddrPort("192.0.2.2:502"),
+	}
+
+	request := []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x06, 0x01, 0x03, 0x00, 0x00, 0x00, 0x01}
+	response := []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x05, 0x01, 0x03, 0x02, 0x00, 0x2A}
+	now := time.Now()
+	w.WritePacket(now, pcapng.Outbound, stream.Packets(true, request)[0])
+	w.WritePacket(now.Add(time.Millisecond), pcapng.Inbound, stream.Packets(false, response)[0])
+
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	handler := NewReplayHandler(ReplayConfig{Path: path, Dir: filepath.Dir(path)})
+	if err := handler.Connect(context.Background(), api.ConnectionConfig{}); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer handler.Disconnect()
+
+	if frames := readAll(t, handler, 1); !bytes.Equal(frames[0], response) {
+		t.Errorf("frame = % x, want % x", frames[0], response)
+	}
+	if _, err := handler.Read(context.Background()); !errors.Is(err, io.EOF) {
+		t.Errorf("Read() after the last frame error = %v, want EOF", err)
+	}
+}
+
+func TestReplayDisconnectWhileWaiting(t *testing.T) {
+	path := writeExport(t, []models.RawFrame{
+		{Timestamp: 0, Data: []byte{0x01}},
+		{Timestamp: 60000, Data: []byte{0x02}},
+	})
+
+	handler := NewReplayHandler(ReplayConfig{Path: path, Dir: filepath.Dir(path)})
+	if err := handler.Connect(context.Background(), api.ConnectionConfig{}); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	readAll(t, handler, 1)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		handler.Disconnect()
+	}()
+	if _, err := handler.Read(context.Background()); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Read() error = %v, want ErrNotConnected", err)
+	}
+}
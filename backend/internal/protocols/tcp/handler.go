@@ -7,6 +7,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/iotstudio/iotstudio/internal/models"
+	protocol "github.com/iotstudio/iotstudio/internal/protocols"
 	"github.com/iotstudio/iotstudio/pkg/api"
 	"github.com/rs/zerolog/log"
 )
@@ -17,6 +19,7 @@ type TCPHandler struct {
 	mu        sync.RWMutex
 	metrics   api.ConnectionMetrics
 	connected bool
+	observer  protocol.FrameObserver
 }
 
 func NewTCPHandler(config TCPConfig) *TCPHandler {
@@ -90,25 +93,45 @@ func (h *TCPHandler) Disconnect() error {
 	return nil
 }
 
+// Read blocks until data arrives, ctx ends or the connection is closed. The
+// lock is not held while waiting, so Disconnect can unblock it.
 func (h *TCPHandler) Read(ctx context.Context) ([]byte, error) {
 	h.mu.RLock()
-	defer h.mu.RUnlock()
+	conn := h.conn
+	connected := h.connected
+	h.mu.RUnlock()
 
-	if !h.connected || h.conn == nil {
+	if !connected || conn == nil {
 		return nil, fmt.Errorf("not connected")
 	}
 
+	conn.SetReadDeadline(time.Time{}) // clear one left by an earlier cancelled read
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
 	buffer := make([]byte, h.config.ReadBufferSize)
-	n, err := h.conn.Read(buffer)
+	n, err := conn.Read(buffer)
 	if err != nil {
+		h.mu.Lock()
 		h.metrics.ErrorCount++
+		h.mu.Unlock()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, fmt.Errorf("read error: %w", err)
 	}
 
 	data := buffer[:n]
+	h.mu.Lock()
 	h.metrics.BytesRead += int64(n)
 	h.metrics.ReadCount++
 	h.metrics.LastRead = time.Now()
+	observer := h.observer
+	h.mu.Unlock()
+
+	if observer != nil {
+		observer(ctx, models.FrameReceived, data)
+	}
 
 	return data, nil
 }
@@ -131,9 +154,19 @@ func (h *TCPHandler) Write(ctx context.Context, data []byte) error {
 	h.metrics.WriteCount++
 	h.metrics.LastWrite = time.Now()
 
+	if h.observer != nil {
+		h.observer(ctx, models.FrameSent, data[:n])
+	}
+
 	return nil
 }
 
+func (h *TCPHandler) SetFrameObserver(observer protocol.FrameObserver) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.observer = observer
+}
+
 func (h *TCPHandler) IsConnected() bool {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
@@ -1,17 +1,27 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/iotstudio/iotstudio/internal/connections"
+	"github.com/iotstudio/iotstudio/internal/ingest"
 	"github.com/iotstudio/iotstudio/internal/models"
+	engine "github.com/iotstudio/iotstudio/internal/parser"
+	"github.com/iotstudio/iotstudio/internal/protocols/modbus"
 	"github.com/iotstudio/iotstudio/internal/storage"
+	"github.com/iotstudio/iotstudio/pkg/api"
 
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
@@ -19,15 +29,20 @@ import (
 
 type Server struct {
 	httpServer *http.Server
+	gateway    *modbus.Gateway
 	upgrader   websocket.Upgrader
 	storage    storage.Storage
 	connMgr    *connections.ConnectionManager
+	parsers    *engine.Engine
+	hub        *hub
 	logger     zerolog.Logger
 }
 
 type ServerConfig struct {
-	Addr    string
-	Storage storage.Storage
+	Addr       string
+	Storage    storage.Storage
+	Ingest     ingest.Config
+	Recordings connections.RecordingsConfig
 }
 
 func NewServer(config ServerConfig) *Server {
@@ -41,14 +56,21 @@ func NewServer(config ServerConfig) *Server {
 
 	logger := zerolog.New(zerolog.ConsoleWriter{Out: log.Writer()}).With().Timestamp().Logger()
 
-	return &Server{
+	s := &Server{
 		upgrader: upgrader,
 		storage:  config.Storage,
 		connMgr: connections.NewConnectionManager(connections.Config{
-			Storage: config.Storage,
+			Storage:    config.Storage,
+			Ingest:     config.Ingest,
+			Recordings: config.Recordings,
 		}),
-		logger: logger,
+		parsers: engine.NewEngine(),
+		hub:     newHub(logger),
+		logger:  logger,
 	}
+	s.connMgr.AddSink(s.hub)
+
+	return s
 }
 
 func (s *Server) Start(ctx context.Context, addr string) error {
@@ -64,6 +86,10 @@ func (s *Server) Start(ctx context.Context, addr string) error {
 	mux.HandleFunc("/api/devices/", s.handleDevices)
 	mux.HandleFunc("/api/parsers", s.handleParsers)
 	mux.HandleFunc("/api/parsers/", s.handleParsers)
+	mux.HandleFunc("/api/parsers/test", s.handleParserTest)
+	mux.HandleFunc("/api/data", s.handleData)
+	mux.HandleFunc("/api/gateway/metrics", s.handleGatewayMetrics)
+	mux.HandleFunc("/api/ingest/metrics", s.handleIngestMetrics)
 
 	s.httpServer = &http.Server{
 		Addr:         addr,
@@ -106,6 +132,12 @@ func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/sessions"), "/")
+	if id, ok := strings.CutSuffix(path, "/connections"); ok {
+		s.handleSessionConnections(w, r, id)
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		sessions, err := s.storage.ListSessions(r.Context())
@@ -139,10 +171,328 @@ func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/connections"), "/")
+	if id, ok := strings.CutSuffix(path, "/frames"); ok && r.Method == "GET" {
+		s.handleConnectionFrames(w, r, id)
+		return
+	}
+	if id, ok := strings.CutSuffix(path, "/capture.pcapng"); ok && r.Method == "GET" {
+		s.handleConnectionPcapng(w, r, id)
+		return
+	}
+	if id, ok := strings.CutSuffix(path, "/traffic"); ok && r.Method == "GET" {
+		s.handleConnectionTraffic(w, r, id)
+		return
+	}
+	if path != "" && !strings.Contains(path, "/") && r.Method == "DELETE" {
+		if err := s.connMgr.RemoveConnection(r.Context(), path); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"connections": []}`))
 }
 
+// handleSessionConnections lists the connections of a session, or creates
+// one and starts it in the background. Started raw TCP, MQTT and replay
+// connections are read continuously and their data stored.
+func (s *Server) handleSessionConnections(w http.ResponseWriter, r *http.Request, sessionID string) {
+	switch r.Method {
+	case "GET":
+		conns, err := s.storage.ListConnectionsBySession(r.Context(), sessionID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		if conns == nil {
+			conns = []*models.Connection{}
+		}
+		json.NewEncoder(w).Encode(conns)
+
+	case "POST":
+		// The protocol config may be sent as an object or as a JSON string
+		var body struct {
+			models.Connection
+			Config json.RawMessage `json:"config"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "Invalid request body"}`))
+			return
+		}
+		conn := body.Connection
+		if err := json.Unmarshal(body.Config, &conn.Config); err != nil {
+			conn.Config = string(body.Config)
+		}
+		conn.SessionID = sessionID
+		conn.CreatedAt = time.Now()
+		conn.UpdatedAt = conn.CreatedAt
+
+		if err := s.connMgr.CreateConnection(r.Context(), &conn); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		// Connecting retries with backoff, longer than a request should take
+		go func(connID string) {
+			if err := s.connMgr.StartConnection(context.Background(), connID); err != nil {
+				s.logger.Warn().Err(err).Str("connID", connID).Msg("Failed to start connection")
+			}
+		}(conn.ID)
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(conn)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleConnectionFrames downloads the raw frames captured for a connection
+// between the start and end query parameters (unix milliseconds).
+func (s *Server) handleConnectionFrames(w http.ResponseWriter, r *http.Request, connID string) {
+	start, end, err := timeRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	frames, err := s.storage.QueryRawFrames(r.Context(), connID, start, end)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if frames == nil {
+		frames = []models.RawFrame{}
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="capture-%s.json"`, connID))
+	json.NewEncoder(w).Encode(frames)
+}
+
+// handleConnectionPcapng downloads the raw frames captured for a connection
+// as a pcapng file, for Wireshark or vendor support
+func (s *Server) handleConnectionPcapng(w http.ResponseWriter, r *http.Request, connID string) {
+	start, end, err := timeRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	conn, err := s.storage.GetConnection(r.Context(), connID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	frames, err := s.storage.QueryRawFrames(r.Context(), connID, start, end)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := writePcapng(&buf, conn, frames); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pcapng")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="capture-%s.pcapng"`, connID))
+	w.Write(buf.Bytes())
+}
+
+// handleConnectionTraffic returns the latest Modbus transactions of a
+// connection, optionally filtered by the unitId and functionCode query
+// parameters and capped by limit.
+func (s *Server) handleConnectionTraffic(w http.ResponseWriter, r *http.Request, connID string) {
+	monitor, err := s.connMgr.TrafficMonitor(connID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	query := r.URL.Query()
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid limit: " + value})
+			return
+		}
+	}
+
+	var filter api.TrafficFilter
+	for name, target := range map[string]**uint8{"unitId": &filter.UnitID, "functionCode": &filter.FunctionCode} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseUint(value, 0, 8)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("invalid %s: %s", name, value)})
+			return
+		}
+		b := uint8(parsed)
+		*target = &b
+	}
+
+	json.NewEncoder(w).Encode(monitor.Recent(limit, filter))
+}
+
+// maxBuckets limits the number of buckets a single data query may span
+const maxBuckets = 10000
+
+// handleData returns a device's data between start and end, aggregated per
+// bucket (milliseconds or a duration such as 5m) with the comma-separated
+// agg and fields parameters. Without a bucket the raw points are returned.
+func (s *Server) handleData(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	sessionID, deviceID := query.Get("session"), query.Get("device")
+	if sessionID == "" || deviceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "session and device are required"})
+		return
+	}
+
+	start, end, err := timeRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	if query.Get("bucket") == "" {
+		points, err := s.storage.QueryData(r.Context(), sessionID, deviceID, start, end)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		if points == nil {
+			points = []models.DataPoint{}
+		}
+		json.NewEncoder(w).Encode(points)
+		return
+	}
+
+	bucket, err := parseBucket(query.Get("bucket"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if (end-start)/bucket >= maxBuckets {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("bucket too small: more than %d buckets", maxBuckets)})
+		return
+	}
+
+	aggregations := []string{models.AggregateAvg}
+	if value := query.Get("agg"); value != "" {
+		aggregations = strings.Split(value, ",")
+	}
+	for _, aggregation := range aggregations {
+		if !models.IsAggregation(aggregation) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "unknown aggregation: " + aggregation})
+			return
+		}
+	}
+
+	var fields []string
+	if value := query.Get("fields"); value != "" {
+		fields = strings.Split(value, ",")
+	}
+
+	buckets, err := s.storage.AggregateData(r.Context(), models.AggregateQuery{
+		SessionID:    sessionID,
+		DeviceID:     deviceID,
+		Start:        start,
+		End:          end,
+		Bucket:       bucket,
+		Aggregations: aggregations,
+		Fields:       fields,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if buckets == nil {
+		buckets = []models.AggregateBucket{}
+	}
+
+	json.NewEncoder(w).Encode(buckets)
+}
+
+// parseBucket reads a bucket size in milliseconds, given as a number or a
+// duration such as 30s or 1h
+func parseBucket(value string) (int64, error) {
+	bucket, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		duration, durationErr := time.ParseDuration(value)
+		if durationErr != nil {
+			return 0, fmt.Errorf("invalid bucket: %s", value)
+		}
+		bucket = duration.Milliseconds()
+	}
+	if bucket <= 0 {
+		return 0, fmt.Errorf("invalid bucket: %s", value)
+	}
+	return bucket, nil
+}
+
+// timeRange reads the optional start and end query parameters in unix
+// milliseconds; they default to the beginning of time and now.
+func timeRange(r *http.Request) (int64, int64, error) {
+	query := r.URL.Query()
+	start, end := int64(0), time.Now().UnixMilli()
+	if value := query.Get("start"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid start: %s", value)
+		}
+		start = parsed
+	}
+	if value := query.Get("end"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid end: %s", value)
+		}
+		end = parsed
+	}
+	return start, end, nil
+}
+
 func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -177,6 +527,7 @@ func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(fmt.Sprintf(`{"error": "%s"}`, err.Error())))
 			return
 		}
+		s.connMgr.InvalidateDevices(device.ConnectionID)
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(device)
 	}
@@ -185,6 +536,11 @@ func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleParsers(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/parsers"), "/"); id != "" {
+		s.handleParser(w, r, id)
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		parsers, err := s.storage.ListParsers(r.Context())
@@ -202,8 +558,14 @@ func (s *Server) handleParsers(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(`{"error": "Invalid request body"}`))
 			return
 		}
+		if body := validateParser(&parser); body != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(body)
+			return
+		}
 		parser.ID = uuid.New().String()
 		parser.CreatedAt = time.Now()
+		parser.UpdatedAt = parser.CreatedAt
 
 		if err := s.storage.CreateParser(r.Context(), &parser); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -215,6 +577,166 @@ func (s *Server) handleParsers(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// validateParser checks scripts and expressions before a parser is saved
+// and returns the error body to send, or nil if the parser is valid
+func validateParser(parser *models.Parser) map[string]interface{} {
+	if parser.Type == engine.ParserTypeJavaScript {
+		if _, err := engine.CompileScript(parser.Script); err != nil {
+			return map[string]interface{}{"error": err.Error(), "script": err}
+		}
+	}
+	if err := engine.ValidateArrays(parser.Fields); err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	if err := engine.ValidateExpressions(parser.Fields); err != nil {
+		body := map[string]interface{}{"error": err.Error()}
+		var exprErr *engine.ExpressionError
+		if errors.As(err, &exprErr) {
+			body["expression"] = exprErr
+		}
+		return body
+	}
+	return nil
+}
+
+// handleParser serves /api/parsers/{id} and the version history below
+// /api/parsers/{id}/versions. Every update stores a new version; rolling
+// back saves an old definition as the newest version.
+func (s *Server) handleParser(w http.ResponseWriter, r *http.Request, path string) {
+	id, rest, _ := strings.Cut(path, "/")
+
+	current, err := s.storage.GetParser(r.Context(), id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	switch {
+	case rest == "" && r.Method == "GET":
+		json.NewEncoder(w).Encode(current)
+
+	case rest == "" && r.Method == "PUT":
+		var parser models.Parser
+		if err := json.NewDecoder(r.Body).Decode(&parser); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "Invalid request body"}`))
+			return
+		}
+		if body := validateParser(&parser); body != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(body)
+			return
+		}
+		parser.ID = current.ID
+		parser.CreatedAt = current.CreatedAt
+		s.saveParser(w, r, &parser)
+
+	case rest == "" && r.Method == "DELETE":
+		if err := s.storage.DeleteParser(r.Context(), id); err != nil {
+			if errors.Is(err, storage.ErrInUse) {
+				w.WriteHeader(http.StatusConflict)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case rest == "versions" && r.Method == "GET":
+		versions, err := s.storage.ListParserVersions(r.Context(), id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(versions)
+
+	case rest == "versions/diff" && r.Method == "GET":
+		s.handleParserDiff(w, r, current)
+
+	case strings.HasPrefix(rest, "versions/"):
+		number, action, _ := strings.Cut(strings.TrimPrefix(rest, "versions/"), "/")
+		version, err := strconv.Atoi(number)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": "Invalid parser version"}`))
+			return
+		}
+		stored, err := s.storage.GetParserVersion(r.Context(), id, version)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+
+		switch {
+		case action == "" && r.Method == "GET":
+			json.NewEncoder(w).Encode(stored)
+		case action == "rollback" && r.Method == "POST":
+			parser := stored.Parser
+			parser.CreatedAt = current.CreatedAt
+			s.saveParser(w, r, &parser)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": "Not found"}`))
+		}
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "Not found"}`))
+	}
+}
+
+func (s *Server) saveParser(w http.ResponseWriter, r *http.Request, parser *models.Parser) {
+	if err := s.storage.UpdateParser(r.Context(), parser); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(parser)
+}
+
+// handleParserDiff compares the versions given by the from and to query
+// parameters; to defaults to the current version.
+func (s *Server) handleParserDiff(w http.ResponseWriter, r *http.Request, current *models.Parser) {
+	query := r.URL.Query()
+	from, err := strconv.Atoi(query.Get("from"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "from parameter is required"}`))
+		return
+	}
+	to := current.Version
+	if query.Get("to") != "" {
+		if to, err = strconv.Atoi(query.Get("to")); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "Invalid to parameter"}`))
+			return
+		}
+	}
+
+	versions := make([]*models.Parser, 0, 2)
+	for _, number := range []int{from, to} {
+		version, err := s.storage.GetParserVersion(r.Context(), current.ID, number)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		versions = append(versions, &version.Parser)
+	}
+
+	changes, err := engine.DiffParsers(versions[0], versions[1])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"from": from, "to": to, "changes": changes})
+}
+
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -225,20 +747,163 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	s.logger.Info().Msg("WebSocket client connected")
 
+	client := s.hub.register(conn)
+	defer s.hub.unregister(client)
+
 	for {
-		messageType, p, err := conn.ReadMessage()
+		_, p, err := conn.ReadMessage()
 		if err != nil {
-			s.logger.Error().Err(err).Msg("Failed to read message")
+			if _, ok := err.(*websocket.CloseError); !ok {
+				s.logger.Error().Err(err).Msg("Failed to read message")
+			}
 			break
 		}
 
-		s.logger.Info().Int("type", messageType).Bytes("message", p).Msg("Received message")
+		var msg api.Message
+		if err := json.Unmarshal(p, &msg); err != nil {
+			client.trySend(api.Message{Type: "error", Timestamp: time.Now().UnixMilli(), Error: "invalid message: " + err.Error()})
+			continue
+		}
 
-		if err := conn.WriteMessage(messageType, p); err != nil {
-			s.logger.Error().Err(err).Msg("Failed to write message")
-			break
+		switch msg.Type {
+		case "subscribe":
+			client.subscribe(msg.SessionID)
+		case "unsubscribe":
+			client.unsubscribe(msg.SessionID)
+		case "subscribe_traffic":
+			monitor, err := s.connMgr.TrafficMonitor(msg.ConnectionID)
+			if err != nil {
+				client.trySend(api.Message{Type: "error", ConnectionID: msg.ConnectionID, Timestamp: time.Now().UnixMilli(), Error: err.Error()})
+				continue
+			}
+			var filter api.TrafficFilter
+			if msg.Filter != nil {
+				filter = *msg.Filter
+			}
+			s.hub.subscribeTraffic(client, msg.ConnectionID, monitor, filter)
+		case "unsubscribe_traffic":
+			s.hub.unsubscribeTraffic(client, msg.ConnectionID)
+		default:
+			client.trySend(api.Message{Type: "error", Timestamp: time.Now().UnixMilli(), Error: "unknown message type: " + msg.Type})
+		}
+	}
+}
+
+// parserTestRequest is the body of POST /api/parsers/test. The parser is
+// either a stored one (ParserID, optionally at an earlier or later Version)
+// or given inline; the frame is a captured one (FrameID), hex or base64.
+type parserTestRequest struct {
+	ParserID string         `json:"parserId"`
+	Version  int            `json:"version"`
+	Parser   *models.Parser `json:"parser"`
+	FrameID  int64          `json:"frameId"`
+	Hex      string         `json:"hex"`
+	Base64   string         `json:"base64"`
+}
+
+func (s *Server) handleParserTest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"error": "Method not allowed"}`))
+		return
+	}
+
+	var req parserTestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Invalid request body"}`))
+		return
+	}
+
+	parser := req.Parser
+	if req.ParserID != "" && req.Version > 0 {
+		stored, err := s.storage.GetParserVersion(r.Context(), req.ParserID, req.Version)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
 		}
+		parser = &stored.Parser
+	} else if req.ParserID != "" {
+		stored, err := s.storage.GetParser(r.Context(), req.ParserID)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		parser = stored
 	}
+	if parser == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Either parserId or parser is required"}`))
+		return
+	}
+
+	var data []byte
+	if req.FrameID != 0 {
+		frame, err := s.storage.GetRawFrame(r.Context(), req.FrameID)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		data = frame.Data
+	} else {
+		var err error
+		if data, err = decodeSample(req.Hex, req.Base64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(s.parsers.Test(r.Context(), parser, data))
+}
+
+// decodeSample decodes a sample frame given as hex, which may be separated
+// by spaces, colons or dashes and carry a 0x prefix, or as base64.
+func decodeSample(hexData, base64Data string) ([]byte, error) {
+	switch {
+	case hexData != "":
+		cleaned := strings.NewReplacer(" ", "", ":", "", "-", "", "\n", "", "\t", "").Replace(hexData)
+		cleaned = strings.TrimPrefix(strings.TrimPrefix(cleaned, "0x"), "0X")
+		data, err := hex.DecodeString(cleaned)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex sample: %w", err)
+		}
+		return data, nil
+	case base64Data != "":
+		data, err := base64.StdEncoding.DecodeString(base64Data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 sample: %w", err)
+		}
+		return data, nil
+	default:
+		return nil, errors.New("either hex or base64 sample data is required")
+	}
+}
+
+func (s *Server) handleGatewayMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if s.gateway == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "Modbus gateway is not enabled"}`))
+		return
+	}
+	json.NewEncoder(w).Encode(s.gateway.GetMetrics())
+}
+
+func (s *Server) handleIngestMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.connMgr.IngestMetrics())
+}
+
+// SetGateway exposes the metrics of a running Modbus gateway
+func (s *Server) SetGateway(gateway *modbus.Gateway) {
+	s.gateway = gateway
 }
 
 func (s *Server) GetConnectionManager() *connections.ConnectionManager {
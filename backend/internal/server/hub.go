@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/iotstudio/iotstudio/internal/protocols/modbus"
+	"github.com/iotstudio/iotstudio/pkg/api"
+	"github.com/rs/zerolog"
+)
+
+// clientQueueSize is the number of messages buffered per WebSocket client
+// before further messages to it are dropped
+const clientQueueSize = 256
+
+// hub forwards stored data points to the WebSocket clients subscribed to
+// their session. It is registered as a sink with the connection manager.
+// Clients can also follow the Modbus traffic of a connection.
+type hub struct {
+	mu      sync.RWMutex
+	clients map[*wsClient]struct{}
+	logger  zerolog.Logger
+}
+
+type wsClient struct {
+	conn *websocket.Conn
+	send chan api.Message
+
+	mu       sync.RWMutex
+	sessions map[string]bool
+	traffic  map[string]func() // connection ID to unsubscribe function
+}
+
+func newHub(logger zerolog.Logger) *hub {
+	return &hub{
+		clients: make(map[*wsClient]struct{}),
+		logger:  logger,
+	}
+}
+
+func (h *hub) register(conn *websocket.Conn) *wsClient {
+	client := &wsClient{
+		conn:     conn,
+		send:     make(chan api.Message, clientQueueSize),
+		sessions: make(map[string]bool),
+		traffic:  make(map[string]func()),
+	}
+
+	h.mu.Lock()
+	h.clients[client] = struct{}{}
+	h.mu.Unlock()
+
+	go client.writeLoop()
+	return client
+}
+
+func (h *hub) unregister(client *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.clients[client]; ok {
+		client.mu.Lock()
+		for connID, cancel := range client.traffic {
+			cancel()
+			delete(client.traffic, connID)
+		}
+		client.mu.Unlock()
+
+		delete(h.clients, client)
+		close(client.send)
+	}
+}
+
+// subscribeTraffic sends the client a traffic message for every transaction
+// on the connection that passes the filter. A new subscription to the same
+// connection replaces the previous one.
+func (h *hub) subscribeTraffic(client *wsClient, connID string, monitor *modbus.TrafficMonitor, filter api.TrafficFilter) {
+	cancel := monitor.Subscribe(func(tx api.ModbusTransaction) {
+		if !filter.Matches(tx) {
+			return
+		}
+		msg := api.Message{
+			Type:         "traffic",
+			ConnectionID: connID,
+			Timestamp:    tx.Timestamp,
+			Transaction:  &tx,
+		}
+		if !h.sendTo(client, msg) {
+			h.logger.Warn().Str("connectionId", connID).Msg("WebSocket client too slow, dropping traffic")
+		}
+	})
+
+	client.mu.Lock()
+	previous := client.traffic[connID]
+	client.traffic[connID] = cancel
+	client.mu.Unlock()
+
+	if previous != nil {
+		previous()
+	}
+}
+
+func (h *hub) unsubscribeTraffic(client *wsClient, connID string) {
+	client.mu.Lock()
+	cancel := client.traffic[connID]
+	delete(client.traffic, connID)
+	client.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// sendTo queues a message for a client unless it has been unregistered in
+// the meantime
+func (h *hub) sendTo(client *wsClient, msg api.Message) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if _, ok := h.clients[client]; !ok {
+		return true
+	}
+	return client.trySend(msg)
+}
+
+// WriteDataPoints sends each point as a data message to the clients
+// subscribed to its session
+func (h *hub) WriteDataPoints(ctx context.Context, points []models.DataPoint) error {
+	for _, point := range points {
+		msg := api.Message{
+			Type:      "data",
+			SessionID: point.SessionID,
+			DeviceID:  point.DeviceID,
+			Timestamp: point.Timestamp,
+		}
+		if err := json.Unmarshal([]byte(point.Data), &msg.Data); err != nil {
+			return fmt.Errorf("invalid data for device %s: %w", point.DeviceID, err)
+		}
+		if point.Quality != "" {
+			if err := json.Unmarshal([]byte(point.Quality), &msg.Quality); err != nil {
+				return fmt.Errorf("invalid quality for device %s: %w", point.DeviceID, err)
+			}
+		}
+		h.broadcast(msg)
+	}
+	return nil
+}
+
+func (h *hub) broadcast(msg api.Message) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for client := range h.clients {
+		if !client.subscribed(msg.SessionID) {
+			continue
+		}
+		if !client.trySend(msg) {
+			h.logger.Warn().Str("sessionId", msg.SessionID).Msg("WebSocket client too slow, dropping message")
+		}
+	}
+}
+
+// trySend queues a message without blocking and reports whether there was
+// room for it
+func (c *wsClient) trySend(msg api.Message) bool {
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *wsClient) subscribe(sessionID string) {
+	c.mu.Lock()
+	c.sessions[sessionID] = true
+	c.mu.Unlock()
+}
+
+func (c *wsClient) unsubscribe(sessionID string) {
+	c.mu.Lock()
+	delete(c.sessions, sessionID)
+	c.mu.Unlock()
+}
+
+func (c *wsClient) subscribed(sessionID string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sessions[sessionID]
+}
+
+// writeLoop is the only writer to the connection; it ends when the client
+// is unregistered
+func (c *wsClient) writeLoop() {
+	for msg := range c.send {
+		if err := c.conn.WriteJSON(msg); err != nil {
+			return
+		}
+	}
+}
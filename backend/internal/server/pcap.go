@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/netip"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/iotstudio/iotstudio/internal/pcapng"
+	"github.com/iotstudio/iotstudio/pkg/api"
+)
+
+// Addresses of the synthetic TCP connection in exported captures. The device
+// address is replaced by the configured host when that is an IPv4 address.
+var (
+	captureLocalAddr  = netip.MustParseAddrPort("192.0.2.1:49152")
+	captureDeviceAddr = netip.MustParseAddr("192.0.2.2")
+)
+
+// writePcapng writes captured frames as pcapng. Frames of TCP connections
+// are wrapped in IPv4/TCP headers between this host and the device, so that
+// Wireshark dissects e.g. Modbus/TCP on port 502; other frames, such as
+// Modbus RTU, are written as they are with a user link type.
+func writePcapng(w io.Writer, conn *models.Connection, frames []models.RawFrame) error {
+	var stream *pcapng.TCPStream
+	linkType := pcapng.LinkTypeUser0
+	if conn.Type == string(api.ModbusTCP) || conn.Type == string(api.TCP) {
+		stream = &pcapng.TCPStream{Client: captureLocalAddr, Server: deviceAddr(conn)}
+		linkType = pcapng.LinkTypeRaw
+	}
+
+	writer, err := pcapng.NewWriter(w, linkType)
+	if err != nil {
+		return err
+	}
+
+	for _, frame := range frames {
+		direction := pcapng.Inbound
+		if frame.Direction == models.FrameSent {
+			direction = pcapng.Outbound
+		}
+		timestamp := time.UnixMilli(frame.Timestamp)
+
+		packets := [][]byte{frame.Data}
+		if stream != nil {
+			packets = stream.Packets(direction == pcapng.Outbound, frame.Data)
+		}
+		for _, packet := range packets {
+			if err := writer.WritePacket(timestamp, direction, packet); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deviceAddr returns the address of a TCP connection's device from its
+// config, falling back to a documentation address and port 502
+func deviceAddr(conn *models.Connection) netip.AddrPort {
+	var config struct {
+		Host string `json:"host"`
+		Port int    `json:"port"`
+	}
+	json.Unmarshal([]byte(conn.Config), &config)
+
+	addr := captureDeviceAddr
+	if parsed, err := netip.ParseAddr(config.Host); err == nil && parsed.Is4() {
+		addr = parsed
+	}
+	port := uint16(502)
+	if config.Port > 0 && config.Port <= 0xFFFF {
+		port = uint16(config.Port)
+	}
+	return netip.AddrPortFrom(addr, port)
+}
@@ -0,0 +1,298 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrSchemaTooNew is returned when a database was migrated by a newer build
+var ErrSchemaTooNew = errors.New("database schema is newer than this build")
+
+// migrationLock is the advisory lock key held while migrating, so servers
+// starting together apply each migration once
+const migrationLock = 0x10757D10
+
+// migration moves the schema from version-1 to version and back. Each runs
+// in a transaction together with the update of schema_version.
+type migration struct {
+	version     int
+	description string
+	up          func(ctx context.Context, tx *sql.Tx) error
+	down        func(ctx context.Context, tx *sql.Tx) error // nil if irreversible
+}
+
+var migrations = []migration{
+	{
+		version:     1,
+		description: "initial schema",
+		// Data points, samples and rollups have no foreign keys: points may
+		// name devices that are not configured, and checks would slow down
+		// ingest
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			return execAll(ctx, tx,
+				`CREATE TABLE sessions (
+					id TEXT PRIMARY KEY,
+					name TEXT NOT NULL,
+					status TEXT NOT NULL,
+					retention TEXT,
+					created_at BIGINT NOT NULL,
+					updated_at BIGINT NOT NULL
+				)`,
+				`CREATE TABLE parsers (
+					id TEXT PRIMARY KEY,
+					name TEXT NOT NULL,
+					type TEXT NOT NULL,
+					fields TEXT NOT NULL,
+					built_in_type TEXT,
+					script TEXT,
+					checksum TEXT,
+					version INTEGER NOT NULL DEFAULT 1,
+					created_at BIGINT NOT NULL,
+					updated_at BIGINT NOT NULL
+				)`,
+				`CREATE TABLE parser_versions (
+					parser_id TEXT NOT NULL REFERENCES parsers(id) ON DELETE CASCADE,
+					version INTEGER NOT NULL,
+					name TEXT NOT NULL,
+					type TEXT NOT NULL,
+					fields TEXT NOT NULL,
+					built_in_type TEXT,
+					script TEXT,
+					checksum TEXT,
+					created_at BIGINT NOT NULL,
+					PRIMARY KEY (parser_id, version)
+				)`,
+				`CREATE TABLE connections (
+					id TEXT PRIMARY KEY,
+					session_id TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+					parser_id TEXT REFERENCES parsers(id) ON DELETE SET NULL,
+					type TEXT NOT NULL,
+					name TEXT NOT NULL,
+					config TEXT NOT NULL,
+					framing TEXT NOT NULL,
+					delimiter TEXT,
+					fixed_size INTEGER,
+					status TEXT NOT NULL,
+					capture TEXT,
+					created_at BIGINT NOT NULL,
+					updated_at BIGINT NOT NULL
+				)`,
+				`CREATE TABLE devices (
+					id TEXT PRIMARY KEY,
+					session_id TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+					connection_id TEXT NOT NULL REFERENCES connections(id) ON DELETE CASCADE,
+					address TEXT,
+					name TEXT NOT NULL,
+					description TEXT,
+					parser_id TEXT,
+					created_at BIGINT NOT NULL,
+					updated_at BIGINT NOT NULL
+				)`,
+				// The timestamp is part of the keys so the tables can become
+				// TimescaleDB hypertables
+				`CREATE TABLE data_points (
+					id BIGSERIAL,
+					session_id TEXT NOT NULL,
+					device_id TEXT NOT NULL,
+					timestamp BIGINT NOT NULL,
+					quality TEXT,
+					parser_id TEXT,
+					parser_version INTEGER,
+					frame_id BIGINT,
+					PRIMARY KEY (id, timestamp)
+				)`,
+				`CREATE TABLE samples (
+					point_id BIGINT NOT NULL,
+					field TEXT NOT NULL,
+					session_id TEXT NOT NULL,
+					device_id TEXT NOT NULL,
+					timestamp BIGINT NOT NULL,
+					value DOUBLE PRECISION,
+					json TEXT,
+					quality TEXT,
+					PRIMARY KEY (point_id, field, timestamp)
+				)`,
+				`CREATE TABLE rollups (
+					id BIGSERIAL PRIMARY KEY,
+					session_id TEXT NOT NULL,
+					device_id TEXT NOT NULL,
+					bucket_size BIGINT NOT NULL,
+					field TEXT NOT NULL,
+					timestamp BIGINT NOT NULL,
+					min_value DOUBLE PRECISION,
+					max_value DOUBLE PRECISION,
+					sum_value DOUBLE PRECISION,
+					sample_count BIGINT NOT NULL,
+					first_value DOUBLE PRECISION,
+					last_value DOUBLE PRECISION,
+					first_timestamp BIGINT,
+					last_timestamp BIGINT,
+					UNIQUE (session_id, device_id, bucket_size, field, timestamp)
+				)`,
+				`CREATE TABLE rollup_progress (
+					session_id TEXT NOT NULL,
+					bucket_size BIGINT NOT NULL,
+					rolled_until BIGINT NOT NULL,
+					PRIMARY KEY (session_id, bucket_size)
+				)`,
+				`CREATE TABLE raw_frames (
+					id BIGSERIAL PRIMARY KEY,
+					connection_id TEXT NOT NULL REFERENCES connections(id) ON DELETE CASCADE,
+					timestamp BIGINT NOT NULL,
+					direction TEXT NOT NULL,
+					data BYTEA NOT NULL
+				)`,
+				`CREATE INDEX idx_sessions_status ON sessions(status)`,
+				`CREATE INDEX idx_connections_session ON connections(session_id)`,
+				`CREATE INDEX idx_devices_session ON devices(session_id)`,
+				`CREATE INDEX idx_devices_connection ON devices(connection_id)`,
+				`CREATE INDEX idx_data_points_session_device_timestamp ON data_points(session_id, device_id, timestamp)`,
+				`CREATE INDEX idx_data_points_session_timestamp ON data_points(session_id, timestamp)`,
+				`CREATE INDEX idx_data_points_parser ON data_points(parser_id)`,
+				`CREATE INDEX idx_samples_session_device_field_timestamp ON samples(session_id, device_id, field, timestamp)`,
+				`CREATE INDEX idx_rollups_session_bucket_timestamp ON rollups(session_id, bucket_size, timestamp)`,
+				`CREATE INDEX idx_raw_frames_connection_timestamp ON raw_frames(connection_id, timestamp)`,
+			)
+		},
+		down: func(ctx context.Context, tx *sql.Tx) error {
+			return execAll(ctx, tx,
+				`DROP TABLE raw_frames`,
+				`DROP TABLE rollup_progress`,
+				`DROP TABLE rollups`,
+				`DROP TABLE samples`,
+				`DROP TABLE data_points`,
+				`DROP TABLE devices`,
+				`DROP TABLE connections`,
+				`DROP TABLE parser_versions`,
+				`DROP TABLE parsers`,
+				`DROP TABLE sessions`,
+			)
+		},
+	},
+}
+
+// LatestSchemaVersion returns the schema version this build migrates to
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Migrate moves the schema of the database at dataSource up or down to
+// version, e.g. before running an older build against it
+func Migrate(dataSource string, version int) error {
+	db, err := openDB(dataSource)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return migrate(context.Background(), db, version)
+}
+
+func migrate(ctx context.Context, db *sql.DB, target int) error {
+	// Hold the lock for the whole run on one connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLock); err != nil {
+		return fmt.Errorf("failed to lock schema: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLock)
+
+	if _, err := conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at BIGINT NOT NULL
+		)
+	`); err != nil {
+		return fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+
+	var current int
+	if err := conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	latest := LatestSchemaVersion()
+	if current > latest {
+		return fmt.Errorf("%w: database is at version %d, this build supports up to %d", ErrSchemaTooNew, current, latest)
+	}
+	if target < 0 || target > latest {
+		return fmt.Errorf("unknown schema version: %d", target)
+	}
+
+	for _, m := range migrations {
+		if m.version > target && m.version <= current && m.down == nil {
+			return fmt.Errorf("migration %d (%s) cannot be undone", m.version, m.description)
+		}
+	}
+
+	for _, m := range migrations {
+		if m.version > current && m.version <= target {
+			if err := applyMigration(ctx, conn, m, true); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if m := migrations[i]; m.version > target && m.version <= current {
+			if err := applyMigration(ctx, conn, m, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	direction := "up"
+	if up {
+		err = m.up(ctx, tx)
+		if err == nil {
+			_, err = tx.ExecContext(ctx,
+				`INSERT INTO schema_version (version, description, applied_at) VALUES ($1, $2, $3)`,
+				m.version, m.description, time.Now().Unix())
+		}
+	} else {
+		direction = "down"
+		err = m.down(ctx, tx)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, `DELETE FROM schema_version WHERE version = $1`, m.version)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("migration %d (%s) %s failed: %w", m.version, m.description, direction, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %d: %w", m.version, err)
+	}
+
+	log.Info().
+		Int("version", m.version).
+		Str("description", m.description).
+		Str("direction", direction).
+		Msg("Applied schema migration")
+	return nil
+}
+
+func execAll(ctx context.Context, tx *sql.Tx, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("%s: %w", statement, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,1629 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/iotstudio/iotstudio/internal/storage"
+	"github.com/iotstudio/iotstudio/internal/storage/timeseries"
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+const (
+	maxOpenConnections    = 25
+	maxIdleConnections    = 10
+	connectionMaxLifetime = 5 * time.Minute
+	connectionMaxIdleTime = 1 * time.Minute
+	hypertableChunk       = 24 * 60 * 60 * 1000 // a day of millisecond timestamps
+)
+
+// Options configures a PostgresStorage
+type Options struct {
+	// TimescaleDB turns data_points and samples into hypertables chunked by
+	// day. The server must have the timescaledb extension installed.
+	TimescaleDB bool
+}
+
+// PostgresStorage stores everything in a PostgreSQL database, for central
+// servers shared by several clients. The schema mirrors the SQLite one.
+type PostgresStorage struct {
+	db     *sql.DB
+	series *timeseries.Queries
+	mu     sync.RWMutex
+	ready  bool
+
+	stop          chan struct{}
+	retentionDone chan struct{}
+	closeOnce     sync.Once
+}
+
+// NewPostgresStorage connects to the database at dataSource, a postgres://
+// URL or key=value connection string, and migrates its schema
+func NewPostgresStorage(dataSource string, options Options) (*PostgresStorage, error) {
+	db, err := openDB(dataSource)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if err := migrate(ctx, db, LatestSchemaVersion()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migration failed: %w", err)
+	}
+	if options.TimescaleDB {
+		if err := createHypertables(ctx, db); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	storage := &PostgresStorage{
+		db:            db,
+		series:        timeseries.New(db, timeseries.Numbered),
+		stop:          make(chan struct{}),
+		retentionDone: make(chan struct{}),
+		ready:         true,
+	}
+	go storage.retentionRoutine()
+	return storage, nil
+}
+
+func openDB(dataSource string) (*sql.DB, error) {
+	db, err := sql.Open("pgx", dataSource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	db.SetMaxOpenConns(maxOpenConnections)
+	db.SetMaxIdleConns(maxIdleConnections)
+	db.SetConnMaxLifetime(connectionMaxLifetime)
+	db.SetConnMaxIdleTime(connectionMaxIdleTime)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	return db, nil
+}
+
+// createHypertables partitions the time-series tables by timestamp. Existing
+// rows are moved into chunks the first time.
+func createHypertables(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `CREATE EXTENSION IF NOT EXISTS timescaledb`); err != nil {
+		return fmt.Errorf("failed to enable TimescaleDB: %w", err)
+	}
+	for _, table := range []string{"data_points", "samples"} {
+		if _, err := db.ExecContext(ctx, `
+			SELECT create_hypertable($1::regclass, 'timestamp',
+				chunk_time_interval => $2::bigint, if_not_exists => TRUE, migrate_data => TRUE)
+		`, table, hypertableChunk); err != nil {
+			return fmt.Errorf("failed to create hypertable %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func (s *PostgresStorage) CreateSession(ctx context.Context, session *models.Session) error {
+	if err := session.Validate(); err != nil {
+		return err
+	}
+	retentionJSON, err := marshalRetention(session.Retention)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO sessions (id, name, status, retention, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+
+	result, err := s.db.ExecContext(ctx, query,
+		session.ID,
+		session.Name,
+		session.Status,
+		retentionJSON,
+		session.CreatedAt.Unix(),
+		session.UpdatedAt.Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("no rows inserted")
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) GetSession(ctx context.Context, id string) (*models.Session, error) {
+	query := `
+		SELECT id, name, status, retention, created_at, updated_at
+		FROM sessions
+		WHERE id = $1
+	`
+
+	var session models.Session
+	var retentionJSON sql.NullString
+	var createdAt, updatedAt int64
+
+	err := s.db.QueryRowContext(ctx, query, id).Scan(
+		&session.ID,
+		&session.Name,
+		&session.Status,
+		&retentionJSON,
+		&createdAt,
+		&updatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("session %w: %s", storage.ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+
+	if session.Retention, err = unmarshalRetention(retentionJSON); err != nil {
+		return nil, err
+	}
+	session.CreatedAt = time.Unix(createdAt, 0)
+	session.UpdatedAt = time.Unix(updatedAt, 0)
+
+	return &session, nil
+}
+
+func (s *PostgresStorage) ListSessions(ctx context.Context) ([]*models.Session, error) {
+	query := `
+		SELECT id, name, status, retention, created_at, updated_at
+		FROM sessions
+		ORDER BY created_at DESC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []*models.Session
+
+	for rows.Next() {
+		var session models.Session
+		var retentionJSON sql.NullString
+		var createdAt, updatedAt int64
+
+		if err := rows.Scan(
+			&session.ID,
+			&session.Name,
+			&session.Status,
+			&retentionJSON,
+			&createdAt,
+			&updatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+
+		var err error
+		if session.Retention, err = unmarshalRetention(retentionJSON); err != nil {
+			return nil, err
+		}
+
+		session.CreatedAt = time.Unix(createdAt, 0)
+		session.UpdatedAt = time.Unix(updatedAt, 0)
+		sessions = append(sessions, &session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating sessions: %w", err)
+	}
+
+	return sessions, nil
+}
+
+func (s *PostgresStorage) UpdateSession(ctx context.Context, session *models.Session) error {
+	if err := session.Validate(); err != nil {
+		return err
+	}
+	retentionJSON, err := marshalRetention(session.Retention)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE sessions
+		SET name = $1, status = $2, retention = $3, updated_at = $4
+		WHERE id = $5
+	`
+
+	session.UpdatedAt = time.Now()
+	result, err := s.db.ExecContext(ctx, query,
+		session.Name,
+		session.Status,
+		retentionJSON,
+		session.UpdatedAt.Unix(),
+		session.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update session: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("session %w: %s", storage.ErrNotFound, session.ID)
+	}
+
+	return nil
+}
+
+// DeleteSession deletes a session with everything recorded for it. Its
+// connections, their devices and raw frames go through foreign keys.
+func (s *PostgresStorage) DeleteSession(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("session %w: %s", storage.ErrNotFound, id)
+	}
+
+	for _, table := range []string{"samples", "data_points", "rollups", "rollup_progress"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE session_id = $1`, id); err != nil {
+			return fmt.Errorf("failed to delete session %s: %w", table, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) CreateConnection(ctx context.Context, conn *models.Connection) error {
+	captureJSON, err := marshalCapture(conn.Capture)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO connections (id, session_id, parser_id, type, name, config, framing, delimiter, fixed_size, status, capture, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+	`
+
+	result, err := s.db.ExecContext(ctx, query,
+		conn.ID,
+		conn.SessionID,
+		nullString(conn.ParserID),
+		conn.Type,
+		conn.Name,
+		conn.Config,
+		conn.Framing,
+		nullString(conn.Delimiter),
+		nullInt(conn.FixedSize),
+		conn.Status,
+		captureJSON,
+		conn.CreatedAt.Unix(),
+		conn.UpdatedAt.Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create connection: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("no rows inserted")
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) GetConnection(ctx context.Context, id string) (*models.Connection, error) {
+	query := `
+		SELECT id, session_id, parser_id, type, name, config, framing, delimiter, fixed_size, status, capture, created_at, updated_at
+		FROM connections
+		WHERE id = $1
+	`
+
+	var conn models.Connection
+	var createdAt, updatedAt int64
+	var parserID, delimiter, captureJSON sql.NullString
+	var fixedSize sql.NullInt64
+
+	err := s.db.QueryRowContext(ctx, query, id).Scan(
+		&conn.ID,
+		&conn.SessionID,
+		&parserID,
+		&conn.Type,
+		&conn.Name,
+		&conn.Config,
+		&conn.Framing,
+		&delimiter,
+		&fixedSize,
+		&conn.Status,
+		&captureJSON,
+		&createdAt,
+		&updatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("connection %w: %s", storage.ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection: %w", err)
+	}
+
+	if parserID.Valid {
+		conn.ParserID = parserID.String
+	}
+	if delimiter.Valid {
+		conn.Delimiter = delimiter.String
+	}
+	if fixedSize.Valid {
+		conn.FixedSize = int(fixedSize.Int64)
+	}
+	if conn.Capture, err = unmarshalCapture(captureJSON); err != nil {
+		return nil, err
+	}
+
+	conn.CreatedAt = time.Unix(createdAt, 0)
+	conn.UpdatedAt = time.Unix(updatedAt, 0)
+
+	return &conn, nil
+}
+
+func (s *PostgresStorage) ListConnectionsBySession(ctx context.Context, sessionID string) ([]*models.Connection, error) {
+	query := `
+		SELECT id, session_id, parser_id, type, name, config, framing, delimiter, fixed_size, status, capture, created_at, updated_at
+		FROM connections
+		WHERE session_id = $1
+		ORDER BY created_at DESC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list connections: %w", err)
+	}
+	defer rows.Close()
+
+	var connections []*models.Connection
+
+	for rows.Next() {
+		var conn models.Connection
+		var createdAt, updatedAt int64
+		var parserID, delimiter, captureJSON sql.NullString
+		var fixedSize sql.NullInt64
+
+		if err := rows.Scan(
+			&conn.ID,
+			&conn.SessionID,
+			&parserID,
+			&conn.Type,
+			&conn.Name,
+			&conn.Config,
+			&conn.Framing,
+			&delimiter,
+			&fixedSize,
+			&conn.Status,
+			&captureJSON,
+			&createdAt,
+			&updatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan connection: %w", err)
+		}
+
+		if parserID.Valid {
+			conn.ParserID = parserID.String
+		}
+		if delimiter.Valid {
+			conn.Delimiter = delimiter.String
+		}
+		if fixedSize.Valid {
+			conn.FixedSize = int(fixedSize.Int64)
+		}
+		capture, err := unmarshalCapture(captureJSON)
+		if err != nil {
+			return nil, err
+		}
+		conn.Capture = capture
+
+		conn.CreatedAt = time.Unix(createdAt, 0)
+		conn.UpdatedAt = time.Unix(updatedAt, 0)
+		connections = append(connections, &conn)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating connections: %w", err)
+	}
+
+	return connections, nil
+}
+
+func (s *PostgresStorage) UpdateConnection(ctx context.Context, conn *models.Connection) error {
+	captureJSON, err := marshalCapture(conn.Capture)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE connections
+		SET name = $1, config = $2, framing = $3, delimiter = $4, fixed_size = $5, status = $6, capture = $7, updated_at = $8
+		WHERE id = $9
+	`
+
+	conn.UpdatedAt = time.Now()
+	result, err := s.db.ExecContext(ctx, query,
+		conn.Name,
+		conn.Config,
+		conn.Framing,
+		nullString(conn.Delimiter),
+		nullInt(conn.FixedSize),
+		conn.Status,
+		captureJSON,
+		conn.UpdatedAt.Unix(),
+		conn.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update connection: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("connection %w: %s", storage.ErrNotFound, conn.ID)
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) DeleteConnection(ctx context.Context, id string) error {
+	query := `DELETE FROM connections WHERE id = $1`
+
+	result, err := s.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete connection: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("connection %w: %s", storage.ErrNotFound, id)
+	}
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM raw_frames WHERE connection_id = $1`, id); err != nil {
+		return fmt.Errorf("failed to delete raw frames: %w", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) CreateDevice(ctx context.Context, device *models.Device) error {
+	if err := device.Validate(); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO devices (id, session_id, connection_id, address, name, description, parser_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+
+	result, err := s.db.ExecContext(ctx, query,
+		device.ID,
+		device.SessionID,
+		device.ConnectionID,
+		nullString(device.Address),
+		device.Name,
+		nullString(device.Description),
+		nullString(device.ParserID),
+		device.CreatedAt.Unix(),
+		device.UpdatedAt.Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create device: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("no rows inserted")
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) GetDevice(ctx context.Context, id string) (*models.Device, error) {
+	query := `
+		SELECT id, session_id, connection_id, address, name, description, parser_id, created_at, updated_at
+		FROM devices
+		WHERE id = $1
+	`
+
+	var device models.Device
+	var createdAt, updatedAt int64
+	var address, description, parserID sql.NullString
+
+	err := s.db.QueryRowContext(ctx, query, id).Scan(
+		&device.ID,
+		&device.SessionID,
+		&device.ConnectionID,
+		&address,
+		&device.Name,
+		&description,
+		&parserID,
+		&createdAt,
+		&updatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("device %w: %s", storage.ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device: %w", err)
+	}
+
+	if address.Valid {
+		device.Address = address.String
+	}
+	if description.Valid {
+		device.Description = description.String
+	}
+	if parserID.Valid {
+		device.ParserID = parserID.String
+	}
+
+	device.CreatedAt = time.Unix(createdAt, 0)
+	device.UpdatedAt = time.Unix(updatedAt, 0)
+
+	return &device, nil
+}
+
+func (s *PostgresStorage) ListDevicesBySession(ctx context.Context, sessionID string) ([]*models.Device, error) {
+	query := `
+		SELECT id, session_id, connection_id, address, name, description, parser_id, created_at, updated_at
+		FROM devices
+		WHERE session_id = $1
+		ORDER BY name ASC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+	defer rows.Close()
+
+	var devices []*models.Device
+
+	for rows.Next() {
+		var device models.Device
+		var createdAt, updatedAt int64
+		var address, description, parserID sql.NullString
+
+		if err := rows.Scan(
+			&device.ID,
+			&device.SessionID,
+			&device.ConnectionID,
+			&address,
+			&device.Name,
+			&description,
+			&parserID,
+			&createdAt,
+			&updatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan device: %w", err)
+		}
+
+		if address.Valid {
+			device.Address = address.String
+		}
+		if description.Valid {
+			device.Description = description.String
+		}
+		if parserID.Valid {
+			device.ParserID = parserID.String
+		}
+
+		device.CreatedAt = time.Unix(createdAt, 0)
+		device.UpdatedAt = time.Unix(updatedAt, 0)
+		devices = append(devices, &device)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating devices: %w", err)
+	}
+
+	return devices, nil
+}
+
+func (s *PostgresStorage) ListDevicesByConnection(ctx context.Context, connectionID string) ([]*models.Device, error) {
+	query := `
+		SELECT id, session_id, connection_id, address, name, description, parser_id, created_at, updated_at
+		FROM devices
+		WHERE connection_id = $1
+		ORDER BY name ASC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, connectionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+	defer rows.Close()
+
+	var devices []*models.Device
+
+	for rows.Next() {
+		var device models.Device
+		var createdAt, updatedAt int64
+		var address, description, parserID sql.NullString
+
+		if err := rows.Scan(
+			&device.ID,
+			&device.SessionID,
+			&device.ConnectionID,
+			&address,
+			&device.Name,
+			&description,
+			&parserID,
+			&createdAt,
+			&updatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan device: %w", err)
+		}
+
+		if address.Valid {
+			device.Address = address.String
+		}
+		if description.Valid {
+			device.Description = description.String
+		}
+		if parserID.Valid {
+			device.ParserID = parserID.String
+		}
+
+		device.CreatedAt = time.Unix(createdAt, 0)
+		device.UpdatedAt = time.Unix(updatedAt, 0)
+		devices = append(devices, &device)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating devices: %w", err)
+	}
+
+	return devices, nil
+}
+
+func (s *PostgresStorage) UpdateDevice(ctx context.Context, device *models.Device) error {
+	if err := device.Validate(); err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE devices
+		SET name = $1, description = $2, parser_id = $3, updated_at = $4
+		WHERE id = $5
+	`
+
+	device.UpdatedAt = time.Now()
+	result, err := s.db.ExecContext(ctx, query,
+		device.Name,
+		nullString(device.Description),
+		nullString(device.ParserID),
+		device.UpdatedAt.Unix(),
+		device.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update device: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("device %w: %s", storage.ErrNotFound, device.ID)
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) DeleteDevice(ctx context.Context, id string) error {
+	query := `DELETE FROM devices WHERE id = $1`
+
+	result, err := s.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete device: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("device %w: %s", storage.ErrNotFound, id)
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) CreateParser(ctx context.Context, parser *models.Parser) error {
+	fieldsJSON, err := json.Marshal(parser.Fields)
+	if err != nil {
+		return fmt.Errorf("failed to marshal parser fields: %w", err)
+	}
+
+	checksumJSON, err := marshalChecksum(parser.Checksum)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO parsers (id, name, type, fields, built_in_type, script, checksum, version, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+
+	parser.Version = 1
+	result, err := tx.ExecContext(ctx, query,
+		parser.ID,
+		parser.Name,
+		parser.Type,
+		string(fieldsJSON),
+		nullString(parser.BuiltInType),
+		nullString(parser.Script),
+		checksumJSON,
+		parser.Version,
+		parser.CreatedAt.Unix(),
+		parser.UpdatedAt.Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create parser: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("no rows inserted")
+	}
+
+	if err := insertParserVersion(ctx, tx, parser, fieldsJSON, checksumJSON, parser.CreatedAt); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) GetParser(ctx context.Context, id string) (*models.Parser, error) {
+	query := `
+		SELECT id, name, type, fields, built_in_type, script, checksum, version, created_at, updated_at
+		FROM parsers
+		WHERE id = $1
+	`
+
+	var parser models.Parser
+	var createdAt, updatedAt int64
+	var builtInType, script, checksumJSON sql.NullString
+	var fieldsJSON string
+
+	err := s.db.QueryRowContext(ctx, query, id).Scan(
+		&parser.ID,
+		&parser.Name,
+		&parser.Type,
+		&fieldsJSON,
+		&builtInType,
+		&script,
+		&checksumJSON,
+		&parser.Version,
+		&createdAt,
+		&updatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("parser %w: %s", storage.ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get parser: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(fieldsJSON), &parser.Fields); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal parser fields: %w", err)
+	}
+
+	if builtInType.Valid {
+		parser.BuiltInType = builtInType.String
+	}
+	parser.Script = script.String
+	if parser.Checksum, err = unmarshalChecksum(checksumJSON); err != nil {
+		return nil, err
+	}
+
+	parser.CreatedAt = time.Unix(createdAt, 0)
+	parser.UpdatedAt = time.Unix(updatedAt, 0)
+
+	return &parser, nil
+}
+
+func (s *PostgresStorage) ListParsers(ctx context.Context) ([]*models.Parser, error) {
+	query := `
+		SELECT id, name, type, fields, built_in_type, script, checksum, version, created_at, updated_at
+		FROM parsers
+		ORDER BY created_at DESC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list parsers: %w", err)
+	}
+	defer rows.Close()
+
+	var parsers []*models.Parser
+
+	for rows.Next() {
+		var parser models.Parser
+		var createdAt, updatedAt int64
+		var builtInType, script, checksumJSON sql.NullString
+		var fieldsJSON string
+
+		if err := rows.Scan(
+			&parser.ID,
+			&parser.Name,
+			&parser.Type,
+			&fieldsJSON,
+			&builtInType,
+			&script,
+			&checksumJSON,
+			&parser.Version,
+			&createdAt,
+			&updatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan parser: %w", err)
+		}
+
+		if err := json.Unmarshal([]byte(fieldsJSON), &parser.Fields); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal parser fields: %w", err)
+		}
+
+		if builtInType.Valid {
+			parser.BuiltInType = builtInType.String
+		}
+		parser.Script = script.String
+		if parser.Checksum, err = unmarshalChecksum(checksumJSON); err != nil {
+			return nil, err
+		}
+
+		parser.CreatedAt = time.Unix(createdAt, 0)
+		parser.UpdatedAt = time.Unix(updatedAt, 0)
+		parsers = append(parsers, &parser)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating parsers: %w", err)
+	}
+
+	return parsers, nil
+}
+
+func (s *PostgresStorage) UpdateParser(ctx context.Context, parser *models.Parser) error {
+	fieldsJSON, err := json.Marshal(parser.Fields)
+	if err != nil {
+		return fmt.Errorf("failed to marshal parser fields: %w", err)
+	}
+
+	checksumJSON, err := marshalChecksum(parser.Checksum)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the row so concurrent updates get consecutive versions
+	var version int
+	err = tx.QueryRowContext(ctx, `SELECT version FROM parsers WHERE id = $1 FOR UPDATE`, parser.ID).Scan(&version)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("parser %w: %s", storage.ErrNotFound, parser.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update parser: %w", err)
+	}
+
+	query := `
+		UPDATE parsers
+		SET name = $1, type = $2, fields = $3, built_in_type = $4, script = $5, checksum = $6, version = $7, updated_at = $8
+		WHERE id = $9
+	`
+
+	parser.Version = version + 1
+	parser.UpdatedAt = time.Now()
+	if _, err := tx.ExecContext(ctx, query,
+		parser.Name,
+		parser.Type,
+		string(fieldsJSON),
+		nullString(parser.BuiltInType),
+		nullString(parser.Script),
+		checksumJSON,
+		parser.Version,
+		parser.UpdatedAt.Unix(),
+		parser.ID,
+	); err != nil {
+		return fmt.Errorf("failed to update parser: %w", err)
+	}
+
+	if err := insertParserVersion(ctx, tx, parser, fieldsJSON, checksumJSON, parser.UpdatedAt); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteParser deletes a parser with its versions. It is refused while data
+// points record which version decoded them.
+func (s *PostgresStorage) DeleteParser(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var used bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM data_points WHERE parser_id = $1)`, id).Scan(&used); err != nil {
+		return fmt.Errorf("failed to delete parser: %w", err)
+	}
+	if used {
+		return fmt.Errorf("parser %w: %s decoded stored data points", storage.ErrInUse, id)
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM parsers WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete parser: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("parser %w: %s", storage.ErrNotFound, id)
+	}
+
+	// parser_versions rows go with it through their foreign key
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func insertParserVersion(ctx context.Context, tx *sql.Tx, parser *models.Parser, fieldsJSON []byte, checksumJSON sql.NullString, createdAt time.Time) error {
+	query := `
+		INSERT INTO parser_versions (parser_id, version, name, type, fields, built_in_type, script, checksum, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+
+	if _, err := tx.ExecContext(ctx, query,
+		parser.ID,
+		parser.Version,
+		parser.Name,
+		parser.Type,
+		string(fieldsJSON),
+		nullString(parser.BuiltInType),
+		nullString(parser.Script),
+		checksumJSON,
+		createdAt.Unix(),
+	); err != nil {
+		return fmt.Errorf("failed to record parser version: %w", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) ListParserVersions(ctx context.Context, parserID string) ([]*models.ParserVersion, error) {
+	query := `
+		SELECT version, name, type, fields, built_in_type, script, checksum, created_at
+		FROM parser_versions
+		WHERE parser_id = $1
+		ORDER BY version DESC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, parserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list parser versions: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []*models.ParserVersion
+
+	for rows.Next() {
+		version, err := scanParserVersion(rows, parserID)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating parser versions: %w", err)
+	}
+
+	return versions, nil
+}
+
+func (s *PostgresStorage) GetParserVersion(ctx context.Context, parserID string, version int) (*models.ParserVersion, error) {
+	query := `
+		SELECT version, name, type, fields, built_in_type, script, checksum, created_at
+		FROM parser_versions
+		WHERE parser_id = $1 AND version = $2
+	`
+
+	result, err := scanParserVersion(s.db.QueryRowContext(ctx, query, parserID, version), parserID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("parser version %w: %s v%d", storage.ErrNotFound, parserID, version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// scanParserVersion reads a parser_versions row selected as version, name,
+// type, fields, built_in_type, script, checksum, created_at. sql.ErrNoRows
+// is returned unwrapped.
+func scanParserVersion(row interface{ Scan(...interface{}) error }, parserID string) (*models.ParserVersion, error) {
+	var version models.ParserVersion
+	var createdAt int64
+	var builtInType, script, checksumJSON sql.NullString
+	var fieldsJSON string
+
+	err := row.Scan(
+		&version.Version,
+		&version.Parser.Name,
+		&version.Parser.Type,
+		&fieldsJSON,
+		&builtInType,
+		&script,
+		&checksumJSON,
+		&createdAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan parser version: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(fieldsJSON), &version.Parser.Fields); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal parser fields: %w", err)
+	}
+	version.Parser.BuiltInType = builtInType.String
+	version.Parser.Script = script.String
+	if version.Parser.Checksum, err = unmarshalChecksum(checksumJSON); err != nil {
+		return nil, err
+	}
+
+	version.ParserID = parserID
+	version.CreatedAt = time.Unix(createdAt, 0)
+	version.Parser.ID = parserID
+	version.Parser.Version = version.Version
+	version.Parser.UpdatedAt = version.CreatedAt
+
+	return &version, nil
+}
+
+// WriteDataPoints stores each point's header in data_points and its fields
+// as samples, one row per field
+func (s *PostgresStorage) WriteDataPoints(ctx context.Context, points []models.DataPoint) error {
+	if len(points) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	pointStmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO data_points (session_id, device_id, timestamp, quality, parser_id, parser_version, frame_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer pointStmt.Close()
+
+	sampleStmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO samples (point_id, field, session_id, device_id, timestamp, value, json, quality)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer sampleStmt.Close()
+
+	var numeric []timeseries.Sample
+	for _, point := range points {
+		samples, err := splitSamples(point)
+		if err != nil {
+			return err
+		}
+
+		var pointID int64
+		if err := pointStmt.QueryRowContext(ctx,
+			point.SessionID,
+			point.DeviceID,
+			point.Timestamp,
+			nullString(point.Quality),
+			nullString(point.ParserID),
+			nullInt(point.ParserVersion),
+			sql.NullInt64{Int64: point.FrameID, Valid: point.FrameID != 0},
+		).Scan(&pointID); err != nil {
+			return fmt.Errorf("failed to insert data point: %w", err)
+		}
+
+		for _, sample := range samples {
+			if _, err := sampleStmt.ExecContext(ctx,
+				pointID,
+				sample.field,
+				point.SessionID,
+				point.DeviceID,
+				point.Timestamp,
+				sample.value,
+				sample.json,
+				sample.quality,
+			); err != nil {
+				return fmt.Errorf("failed to insert sample: %w", err)
+			}
+			if sample.value.Valid {
+				numeric = append(numeric, timeseries.Sample{
+					SessionID: point.SessionID,
+					DeviceID:  point.DeviceID,
+					Field:     sample.field,
+					Timestamp: point.Timestamp,
+					Value:     sample.value.Float64,
+				})
+			}
+		}
+	}
+
+	// Points behind the rollups go into them now
+	if err := s.series.RollUpLate(ctx, tx, numeric); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// sample is one field of a data point. Numbers are kept in value so they can
+// be aggregated; other values are kept as JSON.
+type sample struct {
+	field   string
+	value   sql.NullFloat64
+	json    sql.NullString
+	quality sql.NullString // NULL when good
+}
+
+// splitSamples turns a point's JSON data into samples carrying the quality
+// of their field
+func splitSamples(point models.DataPoint) ([]sample, error) {
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(point.Data), &data); err != nil {
+		return nil, fmt.Errorf("invalid data for device %s: %w", point.DeviceID, err)
+	}
+	var quality map[string]models.FieldQuality
+	if point.Quality != "" {
+		if err := json.Unmarshal([]byte(point.Quality), &quality); err != nil {
+			return nil, fmt.Errorf("invalid quality for device %s: %w", point.DeviceID, err)
+		}
+	}
+
+	samples := make([]sample, 0, len(data))
+	for field, raw := range data {
+		sample := sample{field: field}
+		var number float64
+		if err := json.Unmarshal(raw, &number); err == nil {
+			sample.value = sql.NullFloat64{Float64: number, Valid: true}
+		} else {
+			sample.json = sql.NullString{String: string(raw), Valid: true}
+		}
+		if q, ok := quality[field]; ok && q.Quality != models.QualityGood {
+			sample.quality = sql.NullString{String: q.Quality, Valid: true}
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// QueryData returns a device's points with their data reassembled from the
+// samples
+func (s *PostgresStorage) QueryData(ctx context.Context, sessionID string, deviceID string, start, end int64) ([]models.DataPoint, error) {
+	query := `
+		SELECT dp.id, dp.session_id, dp.device_id, dp.timestamp, dp.quality, dp.parser_id, dp.parser_version, dp.frame_id,
+			s.field, s.value, s.json
+		FROM data_points dp
+		LEFT JOIN samples s ON s.point_id = dp.id
+		WHERE dp.session_id = $1 AND dp.device_id = $2 AND dp.timestamp BETWEEN $3 AND $4
+		ORDER BY dp.timestamp ASC, dp.id ASC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, sessionID, deviceID, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query data: %w", err)
+	}
+	defer rows.Close()
+
+	var points []models.DataPoint
+	var data map[string]json.RawMessage
+	lastID := int64(-1)
+
+	// flush encodes the data of the point collected so far
+	flush := func() error {
+		if len(points) == 0 {
+			return nil
+		}
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return fmt.Errorf("failed to encode data point: %w", err)
+		}
+		points[len(points)-1].Data = string(encoded)
+		return nil
+	}
+
+	for rows.Next() {
+		var id int64
+		var point models.DataPoint
+		var quality, parserID, field, rawJSON sql.NullString
+		var parserVersion, frameID sql.NullInt64
+		var value sql.NullFloat64
+
+		if err := rows.Scan(
+			&id,
+			&point.SessionID,
+			&point.DeviceID,
+			&point.Timestamp,
+			&quality,
+			&parserID,
+			&parserVersion,
+			&frameID,
+			&field,
+			&value,
+			&rawJSON,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan data point: %w", err)
+		}
+
+		if id != lastID {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			point.Quality = quality.String
+			point.ParserID = parserID.String
+			point.ParserVersion = int(parserVersion.Int64)
+			point.FrameID = frameID.Int64
+			points = append(points, point)
+			data = make(map[string]json.RawMessage)
+			lastID = id
+		}
+
+		if !field.Valid {
+			continue
+		}
+		if value.Valid {
+			encoded, err := json.Marshal(value.Float64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode field %s: %w", field.String, err)
+			}
+			data[field.String] = encoded
+		} else {
+			data[field.String] = json.RawMessage(rawJSON.String)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating data points: %w", err)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	return points, nil
+}
+
+// AggregateData reads from the largest rollup whose bucket divides the
+// requested one, up to where it reaches, and from the raw samples after
+// that. Ranges served by a rollup are widened to its buckets.
+func (s *PostgresStorage) AggregateData(ctx context.Context, query models.AggregateQuery) ([]models.AggregateBucket, error) {
+	return s.series.Aggregate(ctx, query)
+}
+
+func (s *PostgresStorage) WriteRawFrame(ctx context.Context, frame *models.RawFrame) error {
+	query := `
+		INSERT INTO raw_frames (connection_id, timestamp, direction, data)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`
+
+	if err := s.db.QueryRowContext(ctx, query,
+		frame.ConnectionID,
+		frame.Timestamp,
+		frame.Direction,
+		frame.Data,
+	).Scan(&frame.ID); err != nil {
+		return fmt.Errorf("failed to insert raw frame: %w", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) WriteRawFrames(ctx context.Context, frames []*models.RawFrame) error {
+	if len(frames) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO raw_frames (connection_id, timestamp, direction, data)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	ids := make([]int64, len(frames))
+	for i, frame := range frames {
+		if err := stmt.QueryRowContext(ctx, frame.ConnectionID, frame.Timestamp, frame.Direction, frame.Data).Scan(&ids[i]); err != nil {
+			return fmt.Errorf("failed to insert raw frame: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit raw frames: %w", err)
+	}
+	for i, frame := range frames {
+		frame.ID = ids[i]
+	}
+
+	return nil
+}
+
+// IsTransient reports whether the write failed on a conflict with another
+// transaction, a full or restarting server, or a connection lost before the
+// statement was sent
+func (s *PostgresStorage) IsTransient(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "40001", // serialization_failure
+			"40P01", // deadlock_detected
+			"55P03", // lock_not_available
+			"53300", // too_many_connections
+			"57P03": // cannot_connect_now
+			return true
+		}
+		return false
+	}
+	return pgconn.SafeToRetry(err) || errors.Is(err, driver.ErrBadConn)
+}
+
+func (s *PostgresStorage) GetRawFrame(ctx context.Context, id int64) (*models.RawFrame, error) {
+	query := `
+		SELECT id, connection_id, timestamp, direction, data
+		FROM raw_frames
+		WHERE id = $1
+	`
+
+	var frame models.RawFrame
+	err := s.db.QueryRowContext(ctx, query, id).Scan(
+		&frame.ID,
+		&frame.ConnectionID,
+		&frame.Timestamp,
+		&frame.Direction,
+		&frame.Data,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("raw frame %w: %d", storage.ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get raw frame: %w", err)
+	}
+
+	return &frame, nil
+}
+
+func (s *PostgresStorage) QueryRawFrames(ctx context.Context, connectionID string, start, end int64) ([]models.RawFrame, error) {
+	query := `
+		SELECT id, connection_id, timestamp, direction, data
+		FROM raw_frames
+		WHERE connection_id = $1 AND timestamp BETWEEN $2 AND $3
+		ORDER BY id ASC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, connectionID, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query raw frames: %w", err)
+	}
+	defer rows.Close()
+
+	var frames []models.RawFrame
+
+	for rows.Next() {
+		var frame models.RawFrame
+
+		if err := rows.Scan(
+			&frame.ID,
+			&frame.ConnectionID,
+			&frame.Timestamp,
+			&frame.Direction,
+			&frame.Data,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan raw frame: %w", err)
+		}
+
+		frames = append(frames, frame)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating raw frames: %w", err)
+	}
+
+	return frames, nil
+}
+
+func (s *PostgresStorage) PruneRawFrames(ctx context.Context, connectionID string, before int64, maxBytes int64) (int64, error) {
+	var deleted int64
+
+	if before > 0 {
+		result, err := s.db.ExecContext(ctx,
+			`DELETE FROM raw_frames WHERE connection_id = $1 AND timestamp < $2`,
+			connectionID, before)
+		if err != nil {
+			return 0, fmt.Errorf("failed to prune raw frames: %w", err)
+		}
+		rows, _ := result.RowsAffected()
+		deleted += rows
+	}
+
+	if maxBytes > 0 {
+		// Keep the newest frames whose total size fits
+		result, err := s.db.ExecContext(ctx, `
+			DELETE FROM raw_frames WHERE id IN (
+				SELECT id FROM (
+					SELECT id, SUM(length(data)) OVER (ORDER BY id DESC) AS total
+					FROM raw_frames
+					WHERE connection_id = $1
+				) AS totals
+				WHERE total > $2
+			)
+		`, connectionID, maxBytes)
+		if err != nil {
+			return 0, fmt.Errorf("failed to prune raw frames: %w", err)
+		}
+		rows, _ := result.RowsAffected()
+		deleted += rows
+	}
+
+	return deleted, nil
+}
+
+func (s *PostgresStorage) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.retentionDone
+		if s.db != nil {
+			err = s.db.Close()
+		}
+	})
+	return err
+}
+
+func marshalChecksum(checksum *models.Checksum) (sql.NullString, error) {
+	if checksum == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(checksum)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to marshal parser checksum: %w", err)
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func unmarshalChecksum(data sql.NullString) (*models.Checksum, error) {
+	if !data.Valid {
+		return nil, nil
+	}
+	var checksum models.Checksum
+	if err := json.Unmarshal([]byte(data.String), &checksum); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal parser checksum: %w", err)
+	}
+	return &checksum, nil
+}
+
+func marshalCapture(capture *models.Capture) (sql.NullString, error) {
+	if capture == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(capture)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to marshal connection capture: %w", err)
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func unmarshalCapture(data sql.NullString) (*models.Capture, error) {
+	if !data.Valid {
+		return nil, nil
+	}
+	var capture models.Capture
+	if err := json.Unmarshal([]byte(data.String), &capture); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal connection capture: %w", err)
+	}
+	return &capture, nil
+}
+
+func marshalRetention(retention *models.Retention) (sql.NullString, error) {
+	if retention == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(retention)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to marshal session retention: %w", err)
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func unmarshalRetention(data sql.NullString) (*models.Retention, error) {
+	if !data.Valid {
+		return nil, nil
+	}
+	var retention models.Retention
+	if err := json.Unmarshal([]byte(data.String), &retention); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal session retention: %w", err)
+	}
+	return &retention, nil
+}
+
+func nullString(s string) sql.NullString {
+	if s == "" {
+		return sql.NullString{Valid: false}
+	}
+	return sql.NullString{String: s, Valid: true}
+}
+
+func nullInt(i int) sql.NullInt64 {
+	if i == 0 {
+		return sql.NullInt64{Valid: false}
+	}
+	return sql.NullInt64{Int64: int64(i), Valid: true}
+}
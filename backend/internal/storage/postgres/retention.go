@@ -0,0 +1,187 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	retentionInterval = 10 * time.Minute
+	// Buckets are rolled up this long after they end. Points arriving
+	// later are added to their rollups one at a time as they are written.
+	rollupDelay = time.Minute
+	// Rows rolled up or deleted per transaction, so writers are never
+	// blocked for long
+	retentionBatchSize = 5000
+)
+
+// retentionRoutine applies the retention policies until the storage is closed
+func (s *PostgresStorage) retentionRoutine() {
+	defer close(s.retentionDone)
+
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.stop
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := s.ApplyRetention(ctx, time.Now().UnixMilli())
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to apply retention policies")
+				continue
+			}
+			if report.Rollups > 0 || report.DeletedPoints > 0 || report.DeletedRollups > 0 {
+				log.Info().
+					Int("sessions", report.Sessions).
+					Int64("rollups", report.Rollups).
+					Int64("deletedPoints", report.DeletedPoints).
+					Int64("deletedRollups", report.DeletedRollups).
+					Int64("reclaimedBytes", report.ReclaimedBytes).
+					Msg("Applied retention policies")
+			}
+		}
+	}
+}
+
+// ApplyRetention rolls up and purges the data of every session with a
+// retention policy, as of now (unix milliseconds). Raw points are only
+// deleted once every rollup of their session has summarised them.
+//
+// ReclaimedBytes is the size of the deleted rows. PostgreSQL reuses their
+// space once autovacuum has processed the tables.
+func (s *PostgresStorage) ApplyRetention(ctx context.Context, now int64) (*models.RetentionReport, error) {
+	sessions, err := s.ListSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &models.RetentionReport{}
+	for _, session := range sessions {
+		if session.Retention == nil {
+			continue
+		}
+		if err := s.applySessionRetention(ctx, session.ID, session.Retention, now, report); err != nil {
+			return nil, fmt.Errorf("session %s: %w", session.ID, err)
+		}
+		report.Sessions++
+	}
+	return report, nil
+}
+
+func (s *PostgresStorage) applySessionRetention(ctx context.Context, sessionID string, retention *models.Retention, now int64, report *models.RetentionReport) error {
+	// Raw points may go once they are old enough and rolled up everywhere
+	rawBefore := int64(0)
+	if retention.RawMaxAge > 0 {
+		rawBefore = now - int64(retention.RawMaxAge)*1000
+	}
+
+	for _, rollup := range retention.Rollups {
+		bucket := int64(rollup.Bucket) * 1000
+		rolledUntil, written, err := s.series.RollUp(ctx, sessionID, bucket, (now-rollupDelay.Milliseconds())/bucket*bucket, retentionBatchSize)
+		if err != nil {
+			return err
+		}
+		report.Rollups += written
+		rawBefore = min(rawBefore, rolledUntil)
+
+		if rollup.MaxAge > 0 {
+			deleted, size, err := s.deleteRollups(ctx, sessionID, bucket, now-int64(rollup.MaxAge)*1000)
+			if err != nil {
+				return err
+			}
+			report.DeletedRollups += deleted
+			report.ReclaimedBytes += size
+		}
+	}
+
+	if rawBefore > 0 {
+		deleted, size, err := s.deleteDataPoints(ctx, sessionID, rawBefore)
+		if err != nil {
+			return err
+		}
+		report.DeletedPoints += deleted
+		report.ReclaimedBytes += size
+	}
+	return nil
+}
+
+// deleteDataPoints deletes a session's points older than before, with their
+// samples, a batch per statement. It returns the number of points and the
+// size of the deleted rows.
+func (s *PostgresStorage) deleteDataPoints(ctx context.Context, sessionID string, before int64) (int64, int64, error) {
+	var deleted, size int64
+	for {
+		var n, batchSize int64
+		err := s.db.QueryRowContext(ctx, `
+			WITH expired AS (
+				SELECT id, timestamp FROM data_points
+				WHERE session_id = $1 AND timestamp < $2
+				LIMIT $3
+			),
+			deleted_samples AS (
+				DELETE FROM samples s USING expired e
+				WHERE s.point_id = e.id AND s.timestamp = e.timestamp
+				RETURNING pg_column_size(s.*) AS size
+			),
+			deleted_points AS (
+				DELETE FROM data_points dp USING expired e
+				WHERE dp.id = e.id AND dp.timestamp = e.timestamp
+				RETURNING pg_column_size(dp.*) AS size
+			)
+			SELECT
+				(SELECT COUNT(*) FROM deleted_points),
+				(SELECT COALESCE(SUM(size), 0) FROM deleted_points) +
+				(SELECT COALESCE(SUM(size), 0) FROM deleted_samples)
+		`, sessionID, before, retentionBatchSize).Scan(&n, &batchSize)
+		if err != nil {
+			return deleted, size, fmt.Errorf("failed to delete data points: %w", err)
+		}
+		deleted += n
+		size += batchSize
+		if n < retentionBatchSize {
+			return deleted, size, nil
+		}
+	}
+}
+
+// deleteRollups deletes a session's buckets of one size older than before, a
+// batch per statement. It returns the number of buckets and the size of the
+// deleted rows.
+func (s *PostgresStorage) deleteRollups(ctx context.Context, sessionID string, bucket, before int64) (int64, int64, error) {
+	var deleted, size int64
+	for {
+		var n, batchSize int64
+		err := s.db.QueryRowContext(ctx, `
+			WITH deleted AS (
+				DELETE FROM rollups r WHERE id IN (
+					SELECT id FROM rollups
+					WHERE session_id = $1 AND bucket_size = $2 AND timestamp < $3
+					LIMIT $4
+				)
+				RETURNING pg_column_size(r.*) AS size
+			)
+			SELECT COUNT(*), COALESCE(SUM(size), 0) FROM deleted
+		`, sessionID, bucket, before, retentionBatchSize).Scan(&n, &batchSize)
+		if err != nil {
+			return deleted, size, fmt.Errorf("failed to delete rollups: %w", err)
+		}
+		deleted += n
+		size += batchSize
+		if n < retentionBatchSize {
+			return deleted, size, nil
+		}
+	}
+}
@@ -0,0 +1,516 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrSchemaTooNew is returned when a database was migrated by a newer build
+var ErrSchemaTooNew = errors.New("database schema is newer than this build")
+
+// migration moves the schema from version-1 to version and back. Each runs
+// in a transaction together with the update of schema_version.
+//
+// Migrations 1 to 3 also run against databases created before schema
+// versions were recorded, so they skip tables, indexes and columns that
+// already exist. Later migrations can change the schema directly.
+type migration struct {
+	version     int
+	description string
+	up          func(ctx context.Context, tx *sql.Tx) error
+	down        func(ctx context.Context, tx *sql.Tx) error // nil if irreversible
+}
+
+var migrations = []migration{
+	{
+		version:     1,
+		description: "initial schema",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			if err := execAll(ctx, tx,
+				`CREATE TABLE IF NOT EXISTS sessions (
+					id TEXT PRIMARY KEY,
+					name TEXT NOT NULL,
+					status TEXT NOT NULL,
+					created_at INTEGER NOT NULL,
+					updated_at INTEGER NOT NULL
+				)`,
+				`CREATE TABLE IF NOT EXISTS connections (
+					id TEXT PRIMARY KEY,
+					session_id TEXT NOT NULL,
+					parser_id TEXT,
+					type TEXT NOT NULL,
+					name TEXT NOT NULL,
+					config TEXT NOT NULL,
+					framing TEXT NOT NULL,
+					delimiter TEXT,
+					fixed_size INTEGER,
+					status TEXT NOT NULL,
+					created_at INTEGER NOT NULL,
+					updated_at INTEGER NOT NULL,
+					FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE,
+					FOREIGN KEY (parser_id) REFERENCES parsers(id) ON DELETE SET NULL
+				)`,
+				`CREATE TABLE IF NOT EXISTS devices (
+					id TEXT PRIMARY KEY,
+					session_id TEXT NOT NULL,
+					connection_id TEXT NOT NULL,
+					address TEXT,
+					name TEXT NOT NULL,
+					description TEXT,
+					parser_id TEXT,
+					created_at INTEGER NOT NULL,
+					updated_at INTEGER NOT NULL,
+					FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE,
+					FOREIGN KEY (connection_id) REFERENCES connections(id) ON DELETE CASCADE
+				)`,
+				`CREATE TABLE IF NOT EXISTS parsers (
+					id TEXT PRIMARY KEY,
+					name TEXT NOT NULL,
+					type TEXT NOT NULL,
+					fields TEXT NOT NULL,
+					built_in_type TEXT,
+					script TEXT,
+					created_at INTEGER NOT NULL,
+					updated_at INTEGER NOT NULL
+				)`,
+				`CREATE TABLE IF NOT EXISTS parser_versions (
+					parser_id TEXT NOT NULL,
+					version INTEGER NOT NULL,
+					name TEXT NOT NULL,
+					type TEXT NOT NULL,
+					fields TEXT NOT NULL,
+					built_in_type TEXT,
+					script TEXT,
+					checksum TEXT,
+					created_at INTEGER NOT NULL,
+					PRIMARY KEY (parser_id, version),
+					FOREIGN KEY (parser_id) REFERENCES parsers(id) ON DELETE CASCADE
+				)`,
+				`CREATE TABLE IF NOT EXISTS data_points (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					session_id TEXT NOT NULL,
+					device_id TEXT NOT NULL,
+					timestamp INTEGER NOT NULL,
+					data TEXT NOT NULL,
+					FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE,
+					FOREIGN KEY (device_id) REFERENCES devices(id) ON DELETE CASCADE
+				)`,
+				`CREATE TABLE IF NOT EXISTS raw_frames (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					connection_id TEXT NOT NULL,
+					timestamp INTEGER NOT NULL,
+					direction TEXT NOT NULL,
+					data BLOB NOT NULL,
+					FOREIGN KEY (connection_id) REFERENCES connections(id) ON DELETE CASCADE
+				)`,
+				`CREATE INDEX IF NOT EXISTS idx_sessions_status ON sessions(status)`,
+				`CREATE INDEX IF NOT EXISTS idx_connections_session ON connections(session_id)`,
+				`CREATE INDEX IF NOT EXISTS idx_devices_session ON devices(session_id)`,
+				`CREATE INDEX IF NOT EXISTS idx_devices_connection ON devices(connection_id)`,
+				`CREATE INDEX IF NOT EXISTS idx_data_points_session_device ON data_points(session_id, device_id)`,
+				`CREATE INDEX IF NOT EXISTS idx_data_points_timestamp ON data_points(timestamp)`,
+				`CREATE INDEX IF NOT EXISTS idx_data_points_session_device_timestamp ON data_points(session_id, device_id, timestamp)`,
+				`CREATE INDEX IF NOT EXISTS idx_raw_frames_connection_timestamp ON raw_frames(connection_id, timestamp)`,
+			); err != nil {
+				return err
+			}
+
+			// Columns added to the tables above over time
+			for _, column := range []struct{ table, name, definition string }{
+				{"parsers", "script", "TEXT"},
+				{"parsers", "checksum", "TEXT"},
+				{"data_points", "quality", "TEXT"},
+				{"parsers", "version", "INTEGER NOT NULL DEFAULT 1"},
+				{"data_points", "parser_id", "TEXT"},
+				{"data_points", "parser_version", "INTEGER"},
+				{"data_points", "frame_id", "INTEGER"},
+				{"connections", "capture", "TEXT"},
+			} {
+				if err := ensureColumn(ctx, tx, column.table, column.name, column.definition); err != nil {
+					return err
+				}
+			}
+			if err := execAll(ctx, tx,
+				`CREATE INDEX IF NOT EXISTS idx_data_points_parser ON data_points(parser_id)`,
+			); err != nil {
+				return err
+			}
+
+			// Parsers saved before versioning start their history at their
+			// current definition
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO parser_versions (parser_id, version, name, type, fields, built_in_type, script, checksum, created_at)
+				SELECT id, version, name, type, fields, built_in_type, script, checksum, max(created_at, updated_at)
+				FROM parsers
+				WHERE id NOT IN (SELECT parser_id FROM parser_versions)
+			`); err != nil {
+				return fmt.Errorf("failed to record initial parser versions: %w", err)
+			}
+			return nil
+		},
+		down: func(ctx context.Context, tx *sql.Tx) error {
+			return execAll(ctx, tx,
+				`DROP TABLE raw_frames`,
+				`DROP TABLE data_points`,
+				`DROP TABLE parser_versions`,
+				`DROP TABLE parsers`,
+				`DROP TABLE devices`,
+				`DROP TABLE connections`,
+				`DROP TABLE sessions`,
+			)
+		},
+	},
+	{
+		version:     2,
+		description: "data point fields as samples",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			if err := execAll(ctx, tx,
+				`CREATE TABLE IF NOT EXISTS samples (
+					point_id INTEGER NOT NULL,
+					field TEXT NOT NULL,
+					session_id TEXT NOT NULL,
+					device_id TEXT NOT NULL,
+					timestamp INTEGER NOT NULL,
+					value REAL,
+					json TEXT,
+					quality TEXT,
+					PRIMARY KEY (point_id, field)
+				) WITHOUT ROWID`,
+				`CREATE INDEX IF NOT EXISTS idx_samples_session_device_field_timestamp ON samples(session_id, device_id, field, timestamp)`,
+			); err != nil {
+				return err
+			}
+			return normalizeDataPoints(ctx, tx)
+		},
+		down: func(ctx context.Context, tx *sql.Tx) error {
+			// Numbers come back as reals, e.g. 23 as 23.0
+			if _, err := tx.ExecContext(ctx, `
+				UPDATE data_points SET data = (
+					SELECT json_group_object(field, json(COALESCE(json, value)))
+					FROM samples
+					WHERE point_id = data_points.id
+				)
+				WHERE data = ''
+			`); err != nil {
+				return fmt.Errorf("failed to restore data point JSON: %w", err)
+			}
+			return execAll(ctx, tx, `DROP TABLE samples`)
+		},
+	},
+	{
+		version:     3,
+		description: "retention and rollups",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			if err := ensureColumn(ctx, tx, "sessions", "retention", "TEXT"); err != nil {
+				return err
+			}
+			return execAll(ctx, tx,
+				`CREATE TABLE IF NOT EXISTS rollups (
+					session_id TEXT NOT NULL,
+					device_id TEXT NOT NULL,
+					bucket_size INTEGER NOT NULL,
+					field TEXT NOT NULL,
+					timestamp INTEGER NOT NULL,
+					min_value REAL,
+					max_value REAL,
+					sum_value REAL,
+					sample_count INTEGER NOT NULL,
+					first_value REAL,
+					last_value REAL,
+					first_timestamp INTEGER,
+					last_timestamp INTEGER,
+					UNIQUE (session_id, device_id, bucket_size, field, timestamp)
+				)`,
+				`CREATE TABLE IF NOT EXISTS rollup_progress (
+					session_id TEXT NOT NULL,
+					bucket_size INTEGER NOT NULL,
+					rolled_until INTEGER NOT NULL,
+					PRIMARY KEY (session_id, bucket_size)
+				) WITHOUT ROWID`,
+				`CREATE INDEX IF NOT EXISTS idx_data_points_session_timestamp ON data_points(session_id, timestamp)`,
+				`CREATE INDEX IF NOT EXISTS idx_rollups_session_bucket_timestamp ON rollups(session_id, bucket_size, timestamp)`,
+			)
+		},
+		down: func(ctx context.Context, tx *sql.Tx) error {
+			return execAll(ctx, tx,
+				`DROP TABLE rollup_progress`,
+				`DROP TABLE rollups`,
+				`DROP INDEX idx_data_points_session_timestamp`,
+				`ALTER TABLE sessions DROP COLUMN retention`,
+			)
+		},
+	},
+	{
+		version:     4,
+		description: "enforce foreign keys",
+		// Foreign keys were declared but not enforced until now. Records
+		// left behind by deletes go, each kind logged with its count, and
+		// data points lose their device key: their device IDs are parser
+		// device keys, not necessarily devices.
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			if err := deleteOrphans(ctx, tx, []orphans{
+				{"connections", `DELETE FROM connections WHERE session_id NOT IN (SELECT id FROM sessions)`},
+				{"connection parsers", `UPDATE connections SET parser_id = NULL WHERE parser_id NOT IN (SELECT id FROM parsers)`},
+				{"devices", `DELETE FROM devices WHERE session_id NOT IN (SELECT id FROM sessions)
+					OR connection_id NOT IN (SELECT id FROM connections)`},
+				{"parser versions", `DELETE FROM parser_versions WHERE parser_id NOT IN (SELECT id FROM parsers)`},
+				{"raw frames", `DELETE FROM raw_frames WHERE connection_id NOT IN (SELECT id FROM connections)`},
+				{"data points", `DELETE FROM data_points WHERE session_id NOT IN (SELECT id FROM sessions)`},
+				{"samples", `DELETE FROM samples WHERE session_id NOT IN (SELECT id FROM sessions)`},
+			}); err != nil {
+				return err
+			}
+			return rebuildDataPoints(ctx, tx, `,
+				FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE`)
+		},
+		down: func(ctx context.Context, tx *sql.Tx) error {
+			return rebuildDataPoints(ctx, tx, `,
+				FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE,
+				FOREIGN KEY (device_id) REFERENCES devices(id) ON DELETE CASCADE`)
+		},
+	},
+}
+
+// LatestSchemaVersion returns the schema version this build migrates to
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Migrate moves the schema of the database at dataSource up or down to
+// version, e.g. before running an older build against it
+func Migrate(dataSource string, version int) error {
+	db, err := openDB(dataSource)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return migrate(context.Background(), db, version)
+}
+
+func migrate(ctx context.Context, db *sql.DB, target int) error {
+	if _, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at INTEGER NOT NULL
+		)
+	`); err != nil {
+		return fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+
+	var current int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	latest := LatestSchemaVersion()
+	if current > latest {
+		return fmt.Errorf("%w: database is at version %d, this build supports up to %d", ErrSchemaTooNew, current, latest)
+	}
+	if target < 0 || target > latest {
+		return fmt.Errorf("unknown schema version: %d", target)
+	}
+
+	for _, m := range migrations {
+		if m.version > target && m.version <= current && m.down == nil {
+			return fmt.Errorf("migration %d (%s) cannot be undone", m.version, m.description)
+		}
+	}
+
+	// Rebuilding tables needs foreign keys off, which only takes effect
+	// outside transactions, so migrations run on a connection of their own
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		return fmt.Errorf("failed to disable foreign keys: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `PRAGMA foreign_keys = ON`)
+
+	for _, m := range migrations {
+		if m.version > current && m.version <= target {
+			if err := applyMigration(ctx, conn, m, true); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if m := migrations[i]; m.version > target && m.version <= current {
+			if err := applyMigration(ctx, conn, m, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	direction := "up"
+	if up {
+		err = m.up(ctx, tx)
+		if err == nil {
+			_, err = tx.ExecContext(ctx,
+				`INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)`,
+				m.version, m.description, time.Now().Unix())
+		}
+	} else {
+		direction = "down"
+		err = m.down(ctx, tx)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, `DELETE FROM schema_version WHERE version = ?`, m.version)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("migration %d (%s) %s failed: %w", m.version, m.description, direction, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %d: %w", m.version, err)
+	}
+
+	log.Info().
+		Int("version", m.version).
+		Str("description", m.description).
+		Str("direction", direction).
+		Msg("Applied schema migration")
+	return nil
+}
+
+func execAll(ctx context.Context, tx *sql.Tx, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("%s: %w", statement, err)
+		}
+	}
+	return nil
+}
+
+// orphans are records a statement deletes, or unlinks, because what they
+// refer to is gone
+type orphans struct {
+	records   string
+	statement string
+}
+
+// deleteOrphans runs each statement and logs how many records it removed
+func deleteOrphans(ctx context.Context, tx *sql.Tx, all []orphans) error {
+	for _, o := range all {
+		result, err := tx.ExecContext(ctx, o.statement)
+		if err != nil {
+			return fmt.Errorf("failed to remove orphaned %s: %w", o.records, err)
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			log.Warn().Int64("rows", n).Str("records", o.records).Msg("Removed records left behind by deletes")
+		}
+	}
+	return nil
+}
+
+// normalizeDataPoints moves the JSON data of points written before samples
+// existed into the samples table
+func normalizeDataPoints(ctx context.Context, tx *sql.Tx) error {
+	result, err := tx.ExecContext(ctx, `
+		INSERT OR IGNORE INTO samples (point_id, field, session_id, device_id, timestamp, value, json, quality)
+		SELECT dp.id, j.key, dp.session_id, dp.device_id, dp.timestamp,
+			CASE WHEN j.type IN ('integer', 'real') THEN j.value END,
+			CASE j.type
+				WHEN 'integer' THEN NULL
+				WHEN 'real' THEN NULL
+				WHEN 'text' THEN json_quote(j.value)
+				WHEN 'true' THEN 'true'
+				WHEN 'false' THEN 'false'
+				WHEN 'null' THEN 'null'
+				ELSE j.value
+			END,
+			NULLIF(json_extract(dp.quality, '$.' || json_quote(j.key) || '.quality'), 'good')
+		FROM data_points dp, json_each(dp.data) j
+		WHERE dp.data != ''
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to normalize data points: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE data_points SET data = '' WHERE data != ''`); err != nil {
+		return fmt.Errorf("failed to normalize data points: %w", err)
+	}
+
+	if moved, _ := result.RowsAffected(); moved > 0 {
+		log.Info().Int64("samples", moved).Msg("Normalized stored data points into samples")
+	}
+	return nil
+}
+
+// rebuildDataPoints recreates data_points with constraints appended to its
+// columns, keeping the rows and indexes
+func rebuildDataPoints(ctx context.Context, tx *sql.Tx, constraints string) error {
+	const columns = `id, session_id, device_id, timestamp, data, quality, parser_id, parser_version, frame_id`
+	return execAll(ctx, tx,
+		`CREATE TABLE data_points_rebuilt (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			session_id TEXT NOT NULL,
+			device_id TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			data TEXT NOT NULL,
+			quality TEXT,
+			parser_id TEXT,
+			parser_version INTEGER,
+			frame_id INTEGER`+constraints+`
+		)`,
+		`INSERT INTO data_points_rebuilt (`+columns+`) SELECT `+columns+` FROM data_points`,
+		`DROP TABLE data_points`,
+		`ALTER TABLE data_points_rebuilt RENAME TO data_points`,
+		`CREATE INDEX idx_data_points_session_device ON data_points(session_id, device_id)`,
+		`CREATE INDEX idx_data_points_timestamp ON data_points(timestamp)`,
+		`CREATE INDEX idx_data_points_session_device_timestamp ON data_points(session_id, device_id, timestamp)`,
+		`CREATE INDEX idx_data_points_session_timestamp ON data_points(session_id, timestamp)`,
+		`CREATE INDEX idx_data_points_parser ON data_points(parser_id)`,
+	)
+}
+
+// ensureColumn adds a column unless a database created before schema
+// versions were recorded already has it
+func ensureColumn(ctx context.Context, tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return fmt.Errorf("failed to inspect table %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	rows.Close()
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
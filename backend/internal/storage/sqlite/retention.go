@@ -0,0 +1,222 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	retentionInterval = 10 * time.Minute
+	// Buckets are rolled up this long after they end. Points arriving
+	// later are added to their rollups one at a time as they are written.
+	rollupDelay = time.Minute
+	// Rows rolled up or deleted per transaction, so writers are never
+	// blocked for long
+	retentionBatchSize = 5000
+)
+
+// retentionRoutine applies the retention policies until the storage is closed
+func (s *SQLiteStorage) retentionRoutine() {
+	defer close(s.retentionDone)
+
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.stop
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := s.ApplyRetention(ctx, time.Now().UnixMilli())
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to apply retention policies")
+				continue
+			}
+			if report.Rollups > 0 || report.DeletedPoints > 0 || report.DeletedRollups > 0 {
+				log.Info().
+					Int("sessions", report.Sessions).
+					Int64("rollups", report.Rollups).
+					Int64("deletedPoints", report.DeletedPoints).
+					Int64("deletedRollups", report.DeletedRollups).
+					Int64("reclaimedBytes", report.ReclaimedBytes).
+					Msg("Applied retention policies")
+			}
+		}
+	}
+}
+
+// ApplyRetention rolls up and purges the data of every session with a
+// retention policy, as of now (unix milliseconds). Raw points are only
+// deleted once every rollup of their session has summarised them.
+func (s *SQLiteStorage) ApplyRetention(ctx context.Context, now int64) (*models.RetentionReport, error) {
+	sessions, err := s.ListSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	freeBefore, err := s.freeBytes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &models.RetentionReport{}
+	for _, session := range sessions {
+		if session.Retention == nil {
+			continue
+		}
+		if err := s.applySessionRetention(ctx, session.ID, session.Retention, now, report); err != nil {
+			return nil, fmt.Errorf("session %s: %w", session.ID, err)
+		}
+		report.Sessions++
+	}
+
+	freeAfter, err := s.freeBytes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.ReclaimedBytes = max(freeAfter-freeBefore, 0)
+
+	return report, nil
+}
+
+func (s *SQLiteStorage) applySessionRetention(ctx context.Context, sessionID string, retention *models.Retention, now int64, report *models.RetentionReport) error {
+	// Raw points may go once they are old enough and rolled up everywhere
+	rawBefore := int64(0)
+	if retention.RawMaxAge > 0 {
+		rawBefore = now - int64(retention.RawMaxAge)*1000
+	}
+
+	for _, rollup := range retention.Rollups {
+		bucket := int64(rollup.Bucket) * 1000
+		rolledUntil, written, err := s.series.RollUp(ctx, sessionID, bucket, (now-rollupDelay.Milliseconds())/bucket*bucket, retentionBatchSize)
+		if err != nil {
+			return err
+		}
+		report.Rollups += written
+		rawBefore = min(rawBefore, rolledUntil)
+
+		if rollup.MaxAge > 0 {
+			deleted, err := s.deleteRollups(ctx, sessionID, bucket, now-int64(rollup.MaxAge)*1000)
+			if err != nil {
+				return err
+			}
+			report.DeletedRollups += deleted
+		}
+	}
+
+	if rawBefore > 0 {
+		deleted, err := s.deleteDataPoints(ctx, sessionID, rawBefore)
+		if err != nil {
+			return err
+		}
+		report.DeletedPoints += deleted
+	}
+	return nil
+}
+
+// deleteDataPoints deletes a session's points older than before, with their
+// samples, a batch per transaction
+func (s *SQLiteStorage) deleteDataPoints(ctx context.Context, sessionID string, before int64) (int64, error) {
+	var deleted int64
+	for {
+		n, err := s.deleteDataPointBatch(ctx, sessionID, before)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+		if n < retentionBatchSize {
+			return deleted, nil
+		}
+	}
+}
+
+func (s *SQLiteStorage) deleteDataPointBatch(ctx context.Context, sessionID string, before int64) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id FROM data_points WHERE session_id = ? AND timestamp < ? LIMIT ?`,
+		sessionID, before, retentionBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find expired data points: %w", err)
+	}
+	var ids []interface{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan data point: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating data points: %w", err)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	placeholders := "?" + strings.Repeat(", ?", len(ids)-1)
+	if _, err := tx.ExecContext(ctx, `DELETE FROM samples WHERE point_id IN (`+placeholders+`)`, ids...); err != nil {
+		return 0, fmt.Errorf("failed to delete samples: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM data_points WHERE id IN (`+placeholders+`)`, ids...); err != nil {
+		return 0, fmt.Errorf("failed to delete data points: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return int64(len(ids)), nil
+}
+
+// deleteRollups deletes a session's buckets of one size older than before, a
+// batch per statement
+func (s *SQLiteStorage) deleteRollups(ctx context.Context, sessionID string, bucket, before int64) (int64, error) {
+	var deleted int64
+	for {
+		result, err := s.db.ExecContext(ctx, `
+			DELETE FROM rollups WHERE rowid IN (
+				SELECT rowid FROM rollups
+				WHERE session_id = ? AND bucket_size = ? AND timestamp < ?
+				LIMIT ?
+			)
+		`, sessionID, bucket, before, retentionBatchSize)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete rollups: %w", err)
+		}
+		n, _ := result.RowsAffected()
+		deleted += n
+		if n < retentionBatchSize {
+			return deleted, nil
+		}
+	}
+}
+
+// freeBytes returns the size of the pages in the database's free list. SQLite
+// reuses them for new data instead of growing the file.
+func (s *SQLiteStorage) freeBytes(ctx context.Context) (int64, error) {
+	var pages, pageSize int64
+	if err := s.db.QueryRowContext(ctx, `PRAGMA freelist_count`).Scan(&pages); err != nil {
+		return 0, fmt.Errorf("failed to read free list: %w", err)
+	}
+	if err := s.db.QueryRowContext(ctx, `PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return 0, fmt.Errorf("failed to read page size: %w", err)
+	}
+	return pages * pageSize, nil
+}
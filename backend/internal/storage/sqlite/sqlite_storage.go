@@ -4,13 +4,18 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/iotstudio/iotstudio/internal/storage"
+	"github.com/iotstudio/iotstudio/internal/storage/timeseries"
 	"github.com/rs/zerolog/log"
-	_ "modernc.org/sqlite"
+	sqlitedriver "modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 const (
@@ -23,13 +28,48 @@ const (
 )
 
 type SQLiteStorage struct {
-	db    *sql.DB
-	mu    sync.RWMutex
-	ready bool
+	db     *sql.DB
+	series *timeseries.Queries
+	mu     sync.RWMutex
+	ready  bool
+
+	stop          chan struct{}
+	retentionDone chan struct{}
+	closeOnce     sync.Once
 }
 
 func NewSQLiteStorage(dataSource string) (*SQLiteStorage, error) {
-	db, err := sql.Open("sqlite", dataSource)
+	db, err := openDB(dataSource)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrate(context.Background(), db, LatestSchemaVersion()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migration failed: %w", err)
+	}
+
+	storage := &SQLiteStorage{
+		db:            db,
+		series:        timeseries.New(db, timeseries.QuestionMarks),
+		stop:          make(chan struct{}),
+		retentionDone: make(chan struct{}),
+		ready:         true,
+	}
+	go storage.retentionRoutine()
+	return storage, nil
+}
+
+func openDB(dataSource string) (*sql.DB, error) {
+	// Pragmas in the data source apply to every pooled connection.
+	// Transactions take the write lock when they begin: one that read first
+	// could not upgrade once another had written, and would fail with
+	// SQLITE_BUSY instead of waiting out the busy timeout.
+	separator := "?"
+	if strings.Contains(dataSource, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("sqlite", dataSource+separator+"_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_txlock=immediate")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -43,107 +83,28 @@ func NewSQLiteStorage(dataSource string) (*SQLiteStorage, error) {
 		log.Warn().Err(err).Msg("Failed to enable WAL mode")
 	}
 
-	if _, err := db.Exec("PRAGMA busy_timeout=5000"); err != nil {
-		log.Warn().Err(err).Msg("Failed to set busy timeout")
-	}
-
-	storage := &SQLiteStorage{db: db}
-
-	if err := storage.migrate(); err != nil {
-		return nil, fmt.Errorf("migration failed: %w", err)
-	}
-
-	storage.ready = true
-	return storage, nil
-}
-
-func (s *SQLiteStorage) migrate() error {
-	migrations := []string{
-		`CREATE TABLE IF NOT EXISTS sessions (
-			id TEXT PRIMARY KEY,
-			name TEXT NOT NULL,
-			status TEXT NOT NULL,
-			created_at INTEGER NOT NULL,
-			updated_at INTEGER NOT NULL
-		)`,
-		`CREATE TABLE IF NOT EXISTS connections (
-			id TEXT PRIMARY KEY,
-			session_id TEXT NOT NULL,
-			parser_id TEXT,
-			type TEXT NOT NULL,
-			name TEXT NOT NULL,
-			config TEXT NOT NULL,
-			framing TEXT NOT NULL,
-			delimiter TEXT,
-			fixed_size INTEGER,
-			status TEXT NOT NULL,
-			created_at INTEGER NOT NULL,
-			updated_at INTEGER NOT NULL,
-			FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE,
-			FOREIGN KEY (parser_id) REFERENCES parsers(id) ON DELETE SET NULL
-		)`,
-		`CREATE TABLE IF NOT EXISTS devices (
-			id TEXT PRIMARY KEY,
-			session_id TEXT NOT NULL,
-			connection_id TEXT NOT NULL,
-			address TEXT,
-			name TEXT NOT NULL,
-			description TEXT,
-			parser_id TEXT,
-			created_at INTEGER NOT NULL,
-			updated_at INTEGER NOT NULL,
-			FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE,
-			FOREIGN KEY (connection_id) REFERENCES connections(id) ON DELETE CASCADE
-		)`,
-		`CREATE TABLE IF NOT EXISTS parsers (
-			id TEXT PRIMARY KEY,
-			name TEXT NOT NULL,
-			type TEXT NOT NULL,
-			fields TEXT NOT NULL,
-			built_in_type TEXT,
-			created_at INTEGER NOT NULL,
-			updated_at INTEGER NOT NULL
-		)`,
-		`CREATE TABLE IF NOT EXISTS data_points (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			session_id TEXT NOT NULL,
-			device_id TEXT NOT NULL,
-			timestamp INTEGER NOT NULL,
-			data TEXT NOT NULL,
-			FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE,
-			FOREIGN KEY (device_id) REFERENCES devices(id) ON DELETE CASCADE
-		)`,
-		`CREATE INDEX IF NOT EXISTS idx_sessions_status ON sessions(status)`,
-		`CREATE INDEX IF NOT EXISTS idx_connections_session ON connections(session_id)`,
-		`CREATE INDEX IF NOT EXISTS idx_devices_session ON devices(session_id)`,
-		`CREATE INDEX IF NOT EXISTS idx_devices_connection ON devices(connection_id)`,
-		`CREATE INDEX IF NOT EXISTS idx_data_points_session_device ON data_points(session_id, device_id)`,
-		`CREATE INDEX IF NOT EXISTS idx_data_points_timestamp ON data_points(timestamp)`,
-	}
-
-	for _, migration := range migrations {
-		if _, err := s.db.Exec(migration); err != nil {
-			return fmt.Errorf("migration failed: %s: %w", migration, err)
-		}
-	}
-
-	return nil
+	return db, nil
 }
 
 func (s *SQLiteStorage) CreateSession(ctx context.Context, session *models.Session) error {
 	if err := session.Validate(); err != nil {
 		return err
 	}
+	retentionJSON, err := marshalRetention(session.Retention)
+	if err != nil {
+		return err
+	}
 
 	query := `
-		INSERT INTO sessions (id, name, status, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?)
+		INSERT INTO sessions (id, name, status, retention, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
 	`
 
 	result, err := s.db.ExecContext(ctx, query,
 		session.ID,
 		session.Name,
 		session.Status,
+		retentionJSON,
 		session.CreatedAt.Unix(),
 		session.UpdatedAt.Unix(),
 	)
@@ -161,29 +122,34 @@ func (s *SQLiteStorage) CreateSession(ctx context.Context, session *models.Sessi
 
 func (s *SQLiteStorage) GetSession(ctx context.Context, id string) (*models.Session, error) {
 	query := `
-		SELECT id, name, status, created_at, updated_at
+		SELECT id, name, status, retention, created_at, updated_at
 		FROM sessions
 		WHERE id = ?
 	`
 
 	var session models.Session
+	var retentionJSON sql.NullString
 	var createdAt, updatedAt int64
 
 	err := s.db.QueryRowContext(ctx, query, id).Scan(
 		&session.ID,
 		&session.Name,
 		&session.Status,
+		&retentionJSON,
 		&createdAt,
 		&updatedAt,
 	)
 
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("session not found: %s", id)
+		return nil, fmt.Errorf("session %w: %s", storage.ErrNotFound, id)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get session: %w", err)
 	}
 
+	if session.Retention, err = unmarshalRetention(retentionJSON); err != nil {
+		return nil, err
+	}
 	session.CreatedAt = time.Unix(createdAt, 0)
 	session.UpdatedAt = time.Unix(updatedAt, 0)
 
@@ -192,7 +158,7 @@ func (s *SQLiteStorage) GetSession(ctx context.Context, id string) (*models.Sess
 
 func (s *SQLiteStorage) ListSessions(ctx context.Context) ([]*models.Session, error) {
 	query := `
-		SELECT id, name, status, created_at, updated_at
+		SELECT id, name, status, retention, created_at, updated_at
 		FROM sessions
 		ORDER BY created_at DESC
 	`
@@ -207,18 +173,25 @@ func (s *SQLiteStorage) ListSessions(ctx context.Context) ([]*models.Session, er
 
 	for rows.Next() {
 		var session models.Session
+		var retentionJSON sql.NullString
 		var createdAt, updatedAt int64
 
 		if err := rows.Scan(
 			&session.ID,
 			&session.Name,
 			&session.Status,
+			&retentionJSON,
 			&createdAt,
 			&updatedAt,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan session: %w", err)
 		}
 
+		var err error
+		if session.Retention, err = unmarshalRetention(retentionJSON); err != nil {
+			return nil, err
+		}
+
 		session.CreatedAt = time.Unix(createdAt, 0)
 		session.UpdatedAt = time.Unix(updatedAt, 0)
 		sessions = append(sessions, &session)
@@ -235,10 +208,14 @@ func (s *SQLiteStorage) UpdateSession(ctx context.Context, session *models.Sessi
 	if err := session.Validate(); err != nil {
 		return err
 	}
+	retentionJSON, err := marshalRetention(session.Retention)
+	if err != nil {
+		return err
+	}
 
 	query := `
 		UPDATE sessions
-		SET name = ?, status = ?, updated_at = ?
+		SET name = ?, status = ?, retention = ?, updated_at = ?
 		WHERE id = ?
 	`
 
@@ -246,6 +223,7 @@ func (s *SQLiteStorage) UpdateSession(ctx context.Context, session *models.Sessi
 	result, err := s.db.ExecContext(ctx, query,
 		session.Name,
 		session.Status,
+		retentionJSON,
 		session.UpdatedAt.Unix(),
 		session.ID,
 	)
@@ -255,32 +233,53 @@ func (s *SQLiteStorage) UpdateSession(ctx context.Context, session *models.Sessi
 
 	rows, _ := result.RowsAffected()
 	if rows == 0 {
-		return fmt.Errorf("session not found: %s", session.ID)
+		return fmt.Errorf("session %w: %s", storage.ErrNotFound, session.ID)
 	}
 
 	return nil
 }
 
+// DeleteSession deletes a session with everything recorded for it. Its
+// connections, their devices and raw frames go through foreign keys.
 func (s *SQLiteStorage) DeleteSession(ctx context.Context, id string) error {
-	query := `DELETE FROM sessions WHERE id = ?`
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
 
-	result, err := s.db.ExecContext(ctx, query, id)
+	result, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE id = ?`, id)
 	if err != nil {
 		return fmt.Errorf("failed to delete session: %w", err)
 	}
 
 	rows, _ := result.RowsAffected()
 	if rows == 0 {
-		return fmt.Errorf("session not found: %s", id)
+		return fmt.Errorf("session %w: %s", storage.ErrNotFound, id)
+	}
+
+	for _, table := range []string{"samples", "data_points", "rollups", "rollup_progress"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE session_id = ?`, id); err != nil {
+			return fmt.Errorf("failed to delete session %s: %w", table, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	return nil
 }
 
 func (s *SQLiteStorage) CreateConnection(ctx context.Context, conn *models.Connection) error {
+	captureJSON, err := marshalCapture(conn.Capture)
+	if err != nil {
+		return err
+	}
+
 	query := `
-		INSERT INTO connections (id, session_id, parser_id, type, name, config, framing, delimiter, fixed_size, status, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO connections (id, session_id, parser_id, type, name, config, framing, delimiter, fixed_size, status, capture, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	result, err := s.db.ExecContext(ctx, query,
@@ -294,6 +293,7 @@ func (s *SQLiteStorage) CreateConnection(ctx context.Context, conn *models.Conne
 		nullString(conn.Delimiter),
 		nullInt(conn.FixedSize),
 		conn.Status,
+		captureJSON,
 		conn.CreatedAt.Unix(),
 		conn.UpdatedAt.Unix(),
 	)
@@ -311,14 +311,14 @@ func (s *SQLiteStorage) CreateConnection(ctx context.Context, conn *models.Conne
 
 func (s *SQLiteStorage) GetConnection(ctx context.Context, id string) (*models.Connection, error) {
 	query := `
-		SELECT id, session_id, parser_id, type, name, config, framing, delimiter, fixed_size, status, created_at, updated_at
+		SELECT id, session_id, parser_id, type, name, config, framing, delimiter, fixed_size, status, capture, created_at, updated_at
 		FROM connections
 		WHERE id = ?
 	`
 
 	var conn models.Connection
 	var createdAt, updatedAt int64
-	var parserID, delimiter sql.NullString
+	var parserID, delimiter, captureJSON sql.NullString
 	var fixedSize sql.NullInt64
 
 	err := s.db.QueryRowContext(ctx, query, id).Scan(
@@ -332,12 +332,13 @@ func (s *SQLiteStorage) GetConnection(ctx context.Context, id string) (*models.C
 		&delimiter,
 		&fixedSize,
 		&conn.Status,
+		&captureJSON,
 		&createdAt,
 		&updatedAt,
 	)
 
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("connection not found: %s", id)
+		return nil, fmt.Errorf("connection %w: %s", storage.ErrNotFound, id)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get connection: %w", err)
@@ -352,6 +353,9 @@ func (s *SQLiteStorage) GetConnection(ctx context.Context, id string) (*models.C
 	if fixedSize.Valid {
 		conn.FixedSize = int(fixedSize.Int64)
 	}
+	if conn.Capture, err = unmarshalCapture(captureJSON); err != nil {
+		return nil, err
+	}
 
 	conn.CreatedAt = time.Unix(createdAt, 0)
 	conn.UpdatedAt = time.Unix(updatedAt, 0)
@@ -361,7 +365,7 @@ func (s *SQLiteStorage) GetConnection(ctx context.Context, id string) (*models.C
 
 func (s *SQLiteStorage) ListConnectionsBySession(ctx context.Context, sessionID string) ([]*models.Connection, error) {
 	query := `
-		SELECT id, session_id, parser_id, type, name, config, framing, delimiter, fixed_size, status, created_at, updated_at
+		SELECT id, session_id, parser_id, type, name, config, framing, delimiter, fixed_size, status, capture, created_at, updated_at
 		FROM connections
 		WHERE session_id = ?
 		ORDER BY created_at DESC
@@ -378,7 +382,7 @@ func (s *SQLiteStorage) ListConnectionsBySession(ctx context.Context, sessionID
 	for rows.Next() {
 		var conn models.Connection
 		var createdAt, updatedAt int64
-		var parserID, delimiter sql.NullString
+		var parserID, delimiter, captureJSON sql.NullString
 		var fixedSize sql.NullInt64
 
 		if err := rows.Scan(
@@ -392,6 +396,7 @@ func (s *SQLiteStorage) ListConnectionsBySession(ctx context.Context, sessionID
 			&delimiter,
 			&fixedSize,
 			&conn.Status,
+			&captureJSON,
 			&createdAt,
 			&updatedAt,
 		); err != nil {
@@ -407,6 +412,11 @@ func (s *SQLiteStorage) ListConnectionsBySession(ctx context.Context, sessionID
 		if fixedSize.Valid {
 			conn.FixedSize = int(fixedSize.Int64)
 		}
+		capture, err := unmarshalCapture(captureJSON)
+		if err != nil {
+			return nil, err
+		}
+		conn.Capture = capture
 
 		conn.CreatedAt = time.Unix(createdAt, 0)
 		conn.UpdatedAt = time.Unix(updatedAt, 0)
@@ -421,9 +431,14 @@ func (s *SQLiteStorage) ListConnectionsBySession(ctx context.Context, sessionID
 }
 
 func (s *SQLiteStorage) UpdateConnection(ctx context.Context, conn *models.Connection) error {
+	captureJSON, err := marshalCapture(conn.Capture)
+	if err != nil {
+		return err
+	}
+
 	query := `
 		UPDATE connections
-		SET name = ?, config = ?, framing = ?, delimiter = ?, fixed_size = ?, status = ?, updated_at = ?
+		SET name = ?, config = ?, framing = ?, delimiter = ?, fixed_size = ?, status = ?, capture = ?, updated_at = ?
 		WHERE id = ?
 	`
 
@@ -435,6 +450,7 @@ func (s *SQLiteStorage) UpdateConnection(ctx context.Context, conn *models.Conne
 		nullString(conn.Delimiter),
 		nullInt(conn.FixedSize),
 		conn.Status,
+		captureJSON,
 		conn.UpdatedAt.Unix(),
 		conn.ID,
 	)
@@ -444,7 +460,7 @@ func (s *SQLiteStorage) UpdateConnection(ctx context.Context, conn *models.Conne
 
 	rows, _ := result.RowsAffected()
 	if rows == 0 {
-		return fmt.Errorf("connection not found: %s", conn.ID)
+		return fmt.Errorf("connection %w: %s", storage.ErrNotFound, conn.ID)
 	}
 
 	return nil
@@ -460,7 +476,11 @@ func (s *SQLiteStorage) DeleteConnection(ctx context.Context, id string) error {
 
 	rows, _ := result.RowsAffected()
 	if rows == 0 {
-		return fmt.Errorf("connection not found: %s", id)
+		return fmt.Errorf("connection %w: %s", storage.ErrNotFound, id)
+	}
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM raw_frames WHERE connection_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete raw frames: %w", err)
 	}
 
 	return nil
@@ -523,7 +543,7 @@ func (s *SQLiteStorage) GetDevice(ctx context.Context, id string) (*models.Devic
 	)
 
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("device not found: %s", id)
+		return nil, fmt.Errorf("device %w: %s", storage.ErrNotFound, id)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get device: %w", err)
@@ -684,7 +704,7 @@ func (s *SQLiteStorage) UpdateDevice(ctx context.Context, device *models.Device)
 
 	rows, _ := result.RowsAffected()
 	if rows == 0 {
-		return fmt.Errorf("device not found: %s", device.ID)
+		return fmt.Errorf("device %w: %s", storage.ErrNotFound, device.ID)
 	}
 
 	return nil
@@ -700,7 +720,7 @@ func (s *SQLiteStorage) DeleteDevice(ctx context.Context, id string) error {
 
 	rows, _ := result.RowsAffected()
 	if rows == 0 {
-		return fmt.Errorf("device not found: %s", id)
+		return fmt.Errorf("device %w: %s", storage.ErrNotFound, id)
 	}
 
 	return nil
@@ -712,17 +732,32 @@ func (s *SQLiteStorage) CreateParser(ctx context.Context, parser *models.Parser)
 		return fmt.Errorf("failed to marshal parser fields: %w", err)
 	}
 
+	checksumJSON, err := marshalChecksum(parser.Checksum)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
 	query := `
-		INSERT INTO parsers (id, name, type, fields, built_in_type, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?)
+		INSERT INTO parsers (id, name, type, fields, built_in_type, script, checksum, version, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := s.db.ExecContext(ctx, query,
+	parser.Version = 1
+	result, err := tx.ExecContext(ctx, query,
 		parser.ID,
 		parser.Name,
 		parser.Type,
 		string(fieldsJSON),
 		nullString(parser.BuiltInType),
+		nullString(parser.Script),
+		checksumJSON,
+		parser.Version,
 		parser.CreatedAt.Unix(),
 		parser.UpdatedAt.Unix(),
 	)
@@ -735,19 +770,27 @@ func (s *SQLiteStorage) CreateParser(ctx context.Context, parser *models.Parser)
 		return fmt.Errorf("no rows inserted")
 	}
 
+	if err := insertParserVersion(ctx, tx, parser, fieldsJSON, checksumJSON, parser.CreatedAt); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
 	return nil
 }
 
 func (s *SQLiteStorage) GetParser(ctx context.Context, id string) (*models.Parser, error) {
 	query := `
-		SELECT id, name, type, fields, built_in_type, created_at, updated_at
+		SELECT id, name, type, fields, built_in_type, script, checksum, version, created_at, updated_at
 		FROM parsers
 		WHERE id = ?
 	`
 
 	var parser models.Parser
 	var createdAt, updatedAt int64
-	var builtInType sql.NullString
+	var builtInType, script, checksumJSON sql.NullString
 	var fieldsJSON string
 
 	err := s.db.QueryRowContext(ctx, query, id).Scan(
@@ -756,12 +799,15 @@ func (s *SQLiteStorage) GetParser(ctx context.Context, id string) (*models.Parse
 		&parser.Type,
 		&fieldsJSON,
 		&builtInType,
+		&script,
+		&checksumJSON,
+		&parser.Version,
 		&createdAt,
 		&updatedAt,
 	)
 
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("parser not found: %s", id)
+		return nil, fmt.Errorf("parser %w: %s", storage.ErrNotFound, id)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get parser: %w", err)
@@ -774,6 +820,10 @@ func (s *SQLiteStorage) GetParser(ctx context.Context, id string) (*models.Parse
 	if builtInType.Valid {
 		parser.BuiltInType = builtInType.String
 	}
+	parser.Script = script.String
+	if parser.Checksum, err = unmarshalChecksum(checksumJSON); err != nil {
+		return nil, err
+	}
 
 	parser.CreatedAt = time.Unix(createdAt, 0)
 	parser.UpdatedAt = time.Unix(updatedAt, 0)
@@ -783,7 +833,7 @@ func (s *SQLiteStorage) GetParser(ctx context.Context, id string) (*models.Parse
 
 func (s *SQLiteStorage) ListParsers(ctx context.Context) ([]*models.Parser, error) {
 	query := `
-		SELECT id, name, type, fields, built_in_type, created_at, updated_at
+		SELECT id, name, type, fields, built_in_type, script, checksum, version, created_at, updated_at
 		FROM parsers
 		ORDER BY created_at DESC
 	`
@@ -799,7 +849,7 @@ func (s *SQLiteStorage) ListParsers(ctx context.Context) ([]*models.Parser, erro
 	for rows.Next() {
 		var parser models.Parser
 		var createdAt, updatedAt int64
-		var builtInType sql.NullString
+		var builtInType, script, checksumJSON sql.NullString
 		var fieldsJSON string
 
 		if err := rows.Scan(
@@ -808,6 +858,9 @@ func (s *SQLiteStorage) ListParsers(ctx context.Context) ([]*models.Parser, erro
 			&parser.Type,
 			&fieldsJSON,
 			&builtInType,
+			&script,
+			&checksumJSON,
+			&parser.Version,
 			&createdAt,
 			&updatedAt,
 		); err != nil {
@@ -821,6 +874,10 @@ func (s *SQLiteStorage) ListParsers(ctx context.Context) ([]*models.Parser, erro
 		if builtInType.Valid {
 			parser.BuiltInType = builtInType.String
 		}
+		parser.Script = script.String
+		if parser.Checksum, err = unmarshalChecksum(checksumJSON); err != nil {
+			return nil, err
+		}
 
 		parser.CreatedAt = time.Unix(createdAt, 0)
 		parser.UpdatedAt = time.Unix(updatedAt, 0)
@@ -840,49 +897,215 @@ func (s *SQLiteStorage) UpdateParser(ctx context.Context, parser *models.Parser)
 		return fmt.Errorf("failed to marshal parser fields: %w", err)
 	}
 
+	checksumJSON, err := marshalChecksum(parser.Checksum)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var version int
+	err = tx.QueryRowContext(ctx, `SELECT version FROM parsers WHERE id = ?`, parser.ID).Scan(&version)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("parser %w: %s", storage.ErrNotFound, parser.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update parser: %w", err)
+	}
+
 	query := `
 		UPDATE parsers
-		SET name = ?, type = ?, fields = ?, built_in_type = ?, updated_at = ?
+		SET name = ?, type = ?, fields = ?, built_in_type = ?, script = ?, checksum = ?, version = ?, updated_at = ?
 		WHERE id = ?
 	`
 
+	parser.Version = version + 1
 	parser.UpdatedAt = time.Now()
-	result, err := s.db.ExecContext(ctx, query,
+	if _, err := tx.ExecContext(ctx, query,
 		parser.Name,
 		parser.Type,
 		string(fieldsJSON),
 		nullString(parser.BuiltInType),
+		nullString(parser.Script),
+		checksumJSON,
+		parser.Version,
 		parser.UpdatedAt.Unix(),
 		parser.ID,
-	)
-	if err != nil {
+	); err != nil {
 		return fmt.Errorf("failed to update parser: %w", err)
 	}
 
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		return fmt.Errorf("parser not found: %s", parser.ID)
+	if err := insertParserVersion(ctx, tx, parser, fieldsJSON, checksumJSON, parser.UpdatedAt); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	return nil
 }
 
+// DeleteParser deletes a parser with its versions. It is refused while data
+// points record which version decoded them.
 func (s *SQLiteStorage) DeleteParser(ctx context.Context, id string) error {
-	query := `DELETE FROM parsers WHERE id = ?`
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
 
-	result, err := s.db.ExecContext(ctx, query, id)
+	var used bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM data_points WHERE parser_id = ?)`, id).Scan(&used); err != nil {
+		return fmt.Errorf("failed to delete parser: %w", err)
+	}
+	if used {
+		return fmt.Errorf("parser %w: %s decoded stored data points", storage.ErrInUse, id)
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM parsers WHERE id = ?`, id)
 	if err != nil {
 		return fmt.Errorf("failed to delete parser: %w", err)
 	}
 
 	rows, _ := result.RowsAffected()
 	if rows == 0 {
-		return fmt.Errorf("parser not found: %s", id)
+		return fmt.Errorf("parser %w: %s", storage.ErrNotFound, id)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM parser_versions WHERE parser_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete parser versions: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func insertParserVersion(ctx context.Context, tx *sql.Tx, parser *models.Parser, fieldsJSON []byte, checksumJSON sql.NullString, createdAt time.Time) error {
+	query := `
+		INSERT INTO parser_versions (parser_id, version, name, type, fields, built_in_type, script, checksum, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	if _, err := tx.ExecContext(ctx, query,
+		parser.ID,
+		parser.Version,
+		parser.Name,
+		parser.Type,
+		string(fieldsJSON),
+		nullString(parser.BuiltInType),
+		nullString(parser.Script),
+		checksumJSON,
+		createdAt.Unix(),
+	); err != nil {
+		return fmt.Errorf("failed to record parser version: %w", err)
 	}
 
 	return nil
 }
 
+func (s *SQLiteStorage) ListParserVersions(ctx context.Context, parserID string) ([]*models.ParserVersion, error) {
+	query := `
+		SELECT version, name, type, fields, built_in_type, script, checksum, created_at
+		FROM parser_versions
+		WHERE parser_id = ?
+		ORDER BY version DESC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, parserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list parser versions: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []*models.ParserVersion
+
+	for rows.Next() {
+		version, err := scanParserVersion(rows, parserID)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating parser versions: %w", err)
+	}
+
+	return versions, nil
+}
+
+func (s *SQLiteStorage) GetParserVersion(ctx context.Context, parserID string, version int) (*models.ParserVersion, error) {
+	query := `
+		SELECT version, name, type, fields, built_in_type, script, checksum, created_at
+		FROM parser_versions
+		WHERE parser_id = ? AND version = ?
+	`
+
+	result, err := scanParserVersion(s.db.QueryRowContext(ctx, query, parserID, version), parserID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("parser version %w: %s v%d", storage.ErrNotFound, parserID, version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// scanParserVersion reads a parser_versions row selected as version, name,
+// type, fields, built_in_type, script, checksum, created_at. sql.ErrNoRows
+// is returned unwrapped.
+func scanParserVersion(row interface{ Scan(...interface{}) error }, parserID string) (*models.ParserVersion, error) {
+	var version models.ParserVersion
+	var createdAt int64
+	var builtInType, script, checksumJSON sql.NullString
+	var fieldsJSON string
+
+	err := row.Scan(
+		&version.Version,
+		&version.Parser.Name,
+		&version.Parser.Type,
+		&fieldsJSON,
+		&builtInType,
+		&script,
+		&checksumJSON,
+		&createdAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan parser version: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(fieldsJSON), &version.Parser.Fields); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal parser fields: %w", err)
+	}
+	version.Parser.BuiltInType = builtInType.String
+	version.Parser.Script = script.String
+	if version.Parser.Checksum, err = unmarshalChecksum(checksumJSON); err != nil {
+		return nil, err
+	}
+
+	version.ParserID = parserID
+	version.CreatedAt = time.Unix(createdAt, 0)
+	version.Parser.ID = parserID
+	version.Parser.Version = version.Version
+	version.Parser.UpdatedAt = version.CreatedAt
+
+	return &version, nil
+}
+
+// WriteDataPoints stores each point's header in data_points and its fields
+// as samples, one row per field
 func (s *SQLiteStorage) WriteDataPoints(ctx context.Context, points []models.DataPoint) error {
 	if len(points) == 0 {
 		return nil
@@ -894,24 +1117,76 @@ func (s *SQLiteStorage) WriteDataPoints(ctx context.Context, points []models.Dat
 	}
 	defer tx.Rollback()
 
-	stmt, err := tx.PrepareContext(ctx, `
-		INSERT INTO data_points (session_id, device_id, timestamp, data)
-		VALUES (?, ?, ?, ?)
+	pointStmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO data_points (session_id, device_id, timestamp, data, quality, parser_id, parser_version, frame_id)
+		VALUES (?, ?, ?, '', ?, ?, ?, ?)
 	`)
 	if err != nil {
 		return fmt.Errorf("failed to prepare statement: %w", err)
 	}
-	defer stmt.Close()
+	defer pointStmt.Close()
+
+	sampleStmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO samples (point_id, field, session_id, device_id, timestamp, value, json, quality)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer sampleStmt.Close()
 
+	var numeric []timeseries.Sample
 	for _, point := range points {
-		if _, err := stmt.ExecContext(ctx,
+		samples, err := splitSamples(point)
+		if err != nil {
+			return err
+		}
+
+		result, err := pointStmt.ExecContext(ctx,
 			point.SessionID,
 			point.DeviceID,
 			point.Timestamp,
-			point.Data,
-		); err != nil {
+			nullString(point.Quality),
+			nullString(point.ParserID),
+			nullInt(point.ParserVersion),
+			sql.NullInt64{Int64: point.FrameID, Valid: point.FrameID != 0},
+		)
+		if err != nil {
 			return fmt.Errorf("failed to insert data point: %w", err)
 		}
+		pointID, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to get data point ID: %w", err)
+		}
+
+		for _, sample := range samples {
+			if _, err := sampleStmt.ExecContext(ctx,
+				pointID,
+				sample.field,
+				point.SessionID,
+				point.DeviceID,
+				point.Timestamp,
+				sample.value,
+				sample.json,
+				sample.quality,
+			); err != nil {
+				return fmt.Errorf("failed to insert sample: %w", err)
+			}
+			if sample.value.Valid {
+				numeric = append(numeric, timeseries.Sample{
+					SessionID: point.SessionID,
+					DeviceID:  point.DeviceID,
+					Field:     sample.field,
+					Timestamp: point.Timestamp,
+					Value:     sample.value.Float64,
+				})
+			}
+		}
+	}
+
+	// Points behind the rollups go into them now
+	if err := s.series.RollUpLate(ctx, tx, numeric); err != nil {
+		return err
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -921,12 +1196,56 @@ func (s *SQLiteStorage) WriteDataPoints(ctx context.Context, points []models.Dat
 	return nil
 }
 
+// sample is one field of a data point. Numbers are kept in value so they can
+// be aggregated; other values are kept as JSON.
+type sample struct {
+	field   string
+	value   sql.NullFloat64
+	json    sql.NullString
+	quality sql.NullString // NULL when good
+}
+
+// splitSamples turns a point's JSON data into samples carrying the quality
+// of their field
+func splitSamples(point models.DataPoint) ([]sample, error) {
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(point.Data), &data); err != nil {
+		return nil, fmt.Errorf("invalid data for device %s: %w", point.DeviceID, err)
+	}
+	var quality map[string]models.FieldQuality
+	if point.Quality != "" {
+		if err := json.Unmarshal([]byte(point.Quality), &quality); err != nil {
+			return nil, fmt.Errorf("invalid quality for device %s: %w", point.DeviceID, err)
+		}
+	}
+
+	samples := make([]sample, 0, len(data))
+	for field, raw := range data {
+		sample := sample{field: field}
+		var number float64
+		if err := json.Unmarshal(raw, &number); err == nil {
+			sample.value = sql.NullFloat64{Float64: number, Valid: true}
+		} else {
+			sample.json = sql.NullString{String: string(raw), Valid: true}
+		}
+		if q, ok := quality[field]; ok && q.Quality != models.QualityGood {
+			sample.quality = sql.NullString{String: q.Quality, Valid: true}
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// QueryData returns a device's points with their data reassembled from the
+// samples
 func (s *SQLiteStorage) QueryData(ctx context.Context, sessionID string, deviceID string, start, end int64) ([]models.DataPoint, error) {
 	query := `
-		SELECT session_id, device_id, timestamp, data
-		FROM data_points
-		WHERE session_id = ? AND device_id = ? AND timestamp BETWEEN ? AND ?
-		ORDER BY timestamp ASC
+		SELECT dp.id, dp.session_id, dp.device_id, dp.timestamp, dp.quality, dp.parser_id, dp.parser_version, dp.frame_id,
+			s.field, s.value, s.json
+		FROM data_points dp
+		LEFT JOIN samples s ON s.point_id = dp.id
+		WHERE dp.session_id = ? AND dp.device_id = ? AND dp.timestamp BETWEEN ? AND ?
+		ORDER BY dp.timestamp ASC, dp.id ASC
 	`
 
 	rows, err := s.db.QueryContext(ctx, query, sessionID, deviceID, start, end)
@@ -936,36 +1255,346 @@ func (s *SQLiteStorage) QueryData(ctx context.Context, sessionID string, deviceI
 	defer rows.Close()
 
 	var points []models.DataPoint
+	var data map[string]json.RawMessage
+	lastID := int64(-1)
+
+	// flush encodes the data of the point collected so far
+	flush := func() error {
+		if len(points) == 0 {
+			return nil
+		}
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return fmt.Errorf("failed to encode data point: %w", err)
+		}
+		points[len(points)-1].Data = string(encoded)
+		return nil
+	}
 
 	for rows.Next() {
+		var id int64
 		var point models.DataPoint
+		var quality, parserID, field, rawJSON sql.NullString
+		var parserVersion, frameID sql.NullInt64
+		var value sql.NullFloat64
 
 		if err := rows.Scan(
+			&id,
 			&point.SessionID,
 			&point.DeviceID,
 			&point.Timestamp,
-			&point.Data,
+			&quality,
+			&parserID,
+			&parserVersion,
+			&frameID,
+			&field,
+			&value,
+			&rawJSON,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan data point: %w", err)
 		}
 
-		points = append(points, point)
+		if id != lastID {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			point.Quality = quality.String
+			point.ParserID = parserID.String
+			point.ParserVersion = int(parserVersion.Int64)
+			point.FrameID = frameID.Int64
+			points = append(points, point)
+			data = make(map[string]json.RawMessage)
+			lastID = id
+		}
+
+		if !field.Valid {
+			continue
+		}
+		if value.Valid {
+			encoded, err := json.Marshal(value.Float64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode field %s: %w", field.String, err)
+			}
+			data[field.String] = encoded
+		} else {
+			data[field.String] = json.RawMessage(rawJSON.String)
+		}
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating data points: %w", err)
 	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
 
 	return points, nil
 }
 
-func (s *SQLiteStorage) Close() error {
-	if s.db != nil {
-		return s.db.Close()
+// AggregateData reads from the largest rollup whose bucket divides the
+// requested one, up to where it reaches, and from the raw samples after
+// that. Ranges served by a rollup are widened to its buckets.
+func (s *SQLiteStorage) AggregateData(ctx context.Context, query models.AggregateQuery) ([]models.AggregateBucket, error) {
+	return s.series.Aggregate(ctx, query)
+}
+
+func (s *SQLiteStorage) WriteRawFrame(ctx context.Context, frame *models.RawFrame) error {
+	query := `
+		INSERT INTO raw_frames (connection_id, timestamp, direction, data)
+		VALUES (?, ?, ?, ?)
+	`
+
+	result, err := s.db.ExecContext(ctx, query,
+		frame.ConnectionID,
+		frame.Timestamp,
+		frame.Direction,
+		frame.Data,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert raw frame: %w", err)
+	}
+
+	if frame.ID, err = result.LastInsertId(); err != nil {
+		return fmt.Errorf("failed to get raw frame id: %w", err)
+	}
+
+	return nil
+}
+
+func (s *SQLiteStorage) WriteRawFrames(ctx context.Context, frames []*models.RawFrame) error {
+	if len(frames) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO raw_frames (connection_id, timestamp, direction, data)
+		VALUES (?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	ids := make([]int64, len(frames))
+	for i, frame := range frames {
+		result, err := stmt.ExecContext(ctx, frame.ConnectionID, frame.Timestamp, frame.Direction, frame.Data)
+		if err != nil {
+			return fmt.Errorf("failed to insert raw frame: %w", err)
+		}
+		if ids[i], err = result.LastInsertId(); err != nil {
+			return fmt.Errorf("failed to get raw frame id: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit raw frames: %w", err)
+	}
+	for i, frame := range frames {
+		frame.ID = ids[i]
 	}
+
 	return nil
 }
 
+// IsTransient reports whether the write failed because another writer held
+// the database for longer than the busy timeout
+func (s *SQLiteStorage) IsTransient(err error) bool {
+	var sqliteErr *sqlitedriver.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	switch sqliteErr.Code() & 0xff { // extended codes keep the primary in the low byte
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return true
+	}
+	return false
+}
+
+func (s *SQLiteStorage) GetRawFrame(ctx context.Context, id int64) (*models.RawFrame, error) {
+	query := `
+		SELECT id, connection_id, timestamp, direction, data
+		FROM raw_frames
+		WHERE id = ?
+	`
+
+	var frame models.RawFrame
+	err := s.db.QueryRowContext(ctx, query, id).Scan(
+		&frame.ID,
+		&frame.ConnectionID,
+		&frame.Timestamp,
+		&frame.Direction,
+		&frame.Data,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("raw frame %w: %d", storage.ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get raw frame: %w", err)
+	}
+
+	return &frame, nil
+}
+
+func (s *SQLiteStorage) QueryRawFrames(ctx context.Context, connectionID string, start, end int64) ([]models.RawFrame, error) {
+	query := `
+		SELECT id, connection_id, timestamp, direction, data
+		FROM raw_frames
+		WHERE connection_id = ? AND timestamp BETWEEN ? AND ?
+		ORDER BY id ASC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, connectionID, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query raw frames: %w", err)
+	}
+	defer rows.Close()
+
+	var frames []models.RawFrame
+
+	for rows.Next() {
+		var frame models.RawFrame
+
+		if err := rows.Scan(
+			&frame.ID,
+			&frame.ConnectionID,
+			&frame.Timestamp,
+			&frame.Direction,
+			&frame.Data,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan raw frame: %w", err)
+		}
+
+		frames = append(frames, frame)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating raw frames: %w", err)
+	}
+
+	return frames, nil
+}
+
+func (s *SQLiteStorage) PruneRawFrames(ctx context.Context, connectionID string, before int64, maxBytes int64) (int64, error) {
+	var deleted int64
+
+	if before > 0 {
+		result, err := s.db.ExecContext(ctx,
+			`DELETE FROM raw_frames WHERE connection_id = ? AND timestamp < ?`,
+			connectionID, before)
+		if err != nil {
+			return 0, fmt.Errorf("failed to prune raw frames: %w", err)
+		}
+		rows, _ := result.RowsAffected()
+		deleted += rows
+	}
+
+	if maxBytes > 0 {
+		// Keep the newest frames whose total size fits
+		result, err := s.db.ExecContext(ctx, `
+			DELETE FROM raw_frames WHERE id IN (
+				SELECT id FROM (
+					SELECT id, SUM(length(data)) OVER (ORDER BY id DESC) AS total
+					FROM raw_frames
+					WHERE connection_id = ?
+				)
+				WHERE total > ?
+			)
+		`, connectionID, maxBytes)
+		if err != nil {
+			return 0, fmt.Errorf("failed to prune raw frames: %w", err)
+		}
+		rows, _ := result.RowsAffected()
+		deleted += rows
+	}
+
+	return deleted, nil
+}
+
+func (s *SQLiteStorage) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.retentionDone
+		if s.db != nil {
+			err = s.db.Close()
+		}
+	})
+	return err
+}
+
+func marshalChecksum(checksum *models.Checksum) (sql.NullString, error) {
+	if checksum == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(checksum)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to marshal parser checksum: %w", err)
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func unmarshalChecksum(data sql.NullString) (*models.Checksum, error) {
+	if !data.Valid {
+		return nil, nil
+	}
+	var checksum models.Checksum
+	if err := json.Unmarshal([]byte(data.String), &checksum); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal parser checksum: %w", err)
+	}
+	return &checksum, nil
+}
+
+func marshalCapture(capture *models.Capture) (sql.NullString, error) {
+	if capture == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(capture)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to marshal connection capture: %w", err)
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func unmarshalCapture(data sql.NullString) (*models.Capture, error) {
+	if !data.Valid {
+		return nil, nil
+	}
+	var capture models.Capture
+	if err := json.Unmarshal([]byte(data.String), &capture); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal connection capture: %w", err)
+	}
+	return &capture, nil
+}
+
+func marshalRetention(retention *models.Retention) (sql.NullString, error) {
+	if retention == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(retention)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to marshal session retention: %w", err)
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func unmarshalRetention(data sql.NullString) (*models.Retention, error) {
+	if !data.Valid {
+		return nil, nil
+	}
+	var retention models.Retention
+	if err := json.Unmarshal([]byte(data.String), &retention); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal session retention: %w", err)
+	}
+	return &retention, nil
+}
+
 func nullString(s string) sql.NullString {
 	if s == "" {
 		return sql.NullString{Valid: false}
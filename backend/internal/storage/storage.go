@@ -2,10 +2,19 @@ package storage
 
 import (
 	"context"
+	"errors"
 
 	"github.com/iotstudio/iotstudio/internal/models"
 )
 
+// ErrNotFound is wrapped by the errors of lookups, updates and deletes of
+// records that do not exist
+var ErrNotFound = errors.New("not found")
+
+// ErrInUse is wrapped by the errors of deletes refused because other records
+// still refer to the record
+var ErrInUse = errors.New("in use")
+
 // Storage defines the interface for all storage operations
 type Storage interface {
 	// Sessions
@@ -34,12 +43,39 @@ type Storage interface {
 	CreateParser(ctx context.Context, parser *models.Parser) error
 	GetParser(ctx context.Context, id string) (*models.Parser, error)
 	ListParsers(ctx context.Context) ([]*models.Parser, error)
+	// UpdateParser saves the definition as a new version; earlier versions
+	// stay available through GetParserVersion
 	UpdateParser(ctx context.Context, parser *models.Parser) error
 	DeleteParser(ctx context.Context, id string) error
+	ListParserVersions(ctx context.Context, parserID string) ([]*models.ParserVersion, error)
+	GetParserVersion(ctx context.Context, parserID string, version int) (*models.ParserVersion, error)
+
+	// Raw frames
+	WriteRawFrame(ctx context.Context, frame *models.RawFrame) error
+	// WriteRawFrames stores the frames in one transaction and sets their
+	// IDs once it commits; on error none are stored or given an ID
+	WriteRawFrames(ctx context.Context, frames []*models.RawFrame) error
+	GetRawFrame(ctx context.Context, id int64) (*models.RawFrame, error)
+	QueryRawFrames(ctx context.Context, connectionID string, start, end int64) ([]models.RawFrame, error)
+	// PruneRawFrames deletes a connection's frames older than before (unix
+	// milliseconds, 0 for no limit) and then the oldest frames beyond
+	// maxBytes of data (0 for no limit). It returns the number deleted.
+	PruneRawFrames(ctx context.Context, connectionID string, before int64, maxBytes int64) (int64, error)
+
+	// IsTransient reports whether a failed write may succeed when retried,
+	// e.g. because the database was briefly locked or unreachable
+	IsTransient(err error) bool
 
 	// Time-series data
 	WriteDataPoints(ctx context.Context, points []models.DataPoint) error
 	QueryData(ctx context.Context, sessionID string, deviceID string, start, end int64) ([]models.DataPoint, error)
+	// AggregateData summarises numeric top-level fields of the data per
+	// bucket. Buckets without data are omitted.
+	AggregateData(ctx context.Context, query models.AggregateQuery) ([]models.AggregateBucket, error)
+	// ApplyRetention rolls up and purges the data of every session with a
+	// retention policy, as of now (unix milliseconds). Implementations also
+	// run it periodically in the background.
+	ApplyRetention(ctx context.Context, now int64) (*models.RetentionReport, error)
 
 	// Close closes the storage connection
 	Close() error
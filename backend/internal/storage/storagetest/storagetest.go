@@ -0,0 +1,782 @@
+// Package storagetest is a conformance suite for storage.Storage
+// implementations, so every backend is held to the same behaviour.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/iotstudio/iotstudio/internal/storage"
+)
+
+// Run runs the suite as subtests of t. open must return a new, empty storage
+// for each subtest and close it when the subtest ends.
+func Run(t *testing.T, open func(t *testing.T) storage.Storage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s storage.Storage)
+	}{
+		{"Sessions", testSessions},
+		{"Connections", testConnections},
+		{"Devices", testDevices},
+		{"Parsers", testParsers},
+		{"RawFrames", testRawFrames},
+		{"DataPoints", testDataPoints},
+		{"DeleteSessionCascades", testDeleteSessionCascades},
+		{"DeleteConnectionCascades", testDeleteConnectionCascades},
+		{"ForeignKeys", testForeignKeys},
+		{"Concurrency", testConcurrency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, open(t))
+		})
+	}
+}
+
+// at returns a time the storages keep exactly: they store seconds
+func at(seconds int64) time.Time {
+	return time.Unix(1700000000+seconds, 0)
+}
+
+func wantNotFound(t *testing.T, what string, err error) {
+	t.Helper()
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("%s error = %v, want ErrNotFound", what, err)
+	}
+}
+
+func newSession(id string, created int64) *models.Session {
+	return &models.Session{
+		ID:        id,
+		Name:      "Session " + id,
+		Status:    "idle",
+		CreatedAt: at(created),
+		UpdatedAt: at(created),
+	}
+}
+
+func newConnection(id, sessionID string, created int64) *models.Connection {
+	return &models.Connection{
+		ID:        id,
+		SessionID: sessionID,
+		Type:      "tcp",
+		Name:      "Connection " + id,
+		Config:    `{"host":"192.0.2.1","port":502}`,
+		Framing:   "none",
+		Status:    "disconnected",
+		CreatedAt: at(created),
+		UpdatedAt: at(created),
+	}
+}
+
+func newDevice(id, sessionID, connectionID string) *models.Device {
+	return &models.Device{
+		ID:           id,
+		SessionID:    sessionID,
+		ConnectionID: connectionID,
+		Address:      "1",
+		Name:         "Device " + id,
+		CreatedAt:    at(0),
+		UpdatedAt:    at(0),
+	}
+}
+
+func newParser(id string, created int64) *models.Parser {
+	return &models.Parser{
+		ID:   id,
+		Name: "Parser " + id,
+		Type: "binary",
+		Fields: []models.ParserField{
+			{Name: "temperature", DataType: "int16", Offset: 0, Scale: 0.1, Endianness: "big"},
+			{Name: "humidity", DataType: "uint16", Offset: 2, Endianness: "big"},
+		},
+		Checksum:  &models.Checksum{Algorithm: "crc16_modbus"},
+		CreatedAt: at(created),
+		UpdatedAt: at(created),
+	}
+}
+
+// mustCreate stores the records in order, sessions and parsers first
+func mustCreate(t *testing.T, s storage.Storage, records ...interface{}) {
+	t.Helper()
+
+	ctx := context.Background()
+	for _, record := range records {
+		var err error
+		switch record := record.(type) {
+		case *models.Session:
+			err = s.CreateSession(ctx, record)
+		case *models.Parser:
+			err = s.CreateParser(ctx, record)
+		case *models.Connection:
+			err = s.CreateConnection(ctx, record)
+		case *models.Device:
+			err = s.CreateDevice(ctx, record)
+		case *models.RawFrame:
+			err = s.WriteRawFrame(ctx, record)
+		default:
+			t.Fatalf("cannot create %T", record)
+		}
+		if err != nil {
+			t.Fatalf("Failed to create %T: %v", record, err)
+		}
+	}
+}
+
+func testSessions(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	s1, s2 := newSession("s1", 0), newSession("s2", 10)
+	s1.Retention = &models.Retention{RawMaxAge: 3600, Rollups: []models.Rollup{{Bucket: 60, MaxAge: 86400}}}
+	mustCreate(t, s, s1, s2)
+
+	if err := s.CreateSession(ctx, newSession("s1", 20)); err == nil {
+		t.Error("CreateSession() accepted a duplicate ID")
+	}
+	if err := s.CreateSession(ctx, &models.Session{ID: "s3", Status: "idle"}); err == nil {
+		t.Error("CreateSession() accepted a session without a name")
+	}
+
+	got, err := s.GetSession(ctx, "s1")
+	if err != nil {
+		t.Fatalf("GetSession() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, s1) {
+		t.Errorf("GetSession() =\n%+v\nwant\n%+v", got, s1)
+	}
+	_, err = s.GetSession(ctx, "missing")
+	wantNotFound(t, "GetSession()", err)
+
+	// Newest first
+	sessions, err := s.ListSessions(ctx)
+	if err != nil {
+		t.Fatalf("ListSessions() error = %v", err)
+	}
+	if !reflect.DeepEqual(sessions, []*models.Session{s2, s1}) {
+		t.Errorf("ListSessions() =\n%+v\nwant s2, s1", sessions)
+	}
+
+	s1.Name = "Renamed"
+	s1.Status = "running"
+	s1.Retention = nil
+	if err := s.UpdateSession(ctx, s1); err != nil {
+		t.Fatalf("UpdateSession() error = %v", err)
+	}
+	got, err = s.GetSession(ctx, "s1")
+	if err != nil {
+		t.Fatalf("GetSession() error = %v", err)
+	}
+	if got.Name != "Renamed" || got.Status != "running" || got.Retention != nil ||
+		!got.CreatedAt.Equal(at(0)) || got.UpdatedAt.Unix() != s1.UpdatedAt.Unix() {
+		t.Errorf("GetSession() after update = %+v", got)
+	}
+	wantNotFound(t, "UpdateSession()", s.UpdateSession(ctx, newSession("missing", 0)))
+
+	if err := s.DeleteSession(ctx, "s2"); err != nil {
+		t.Fatalf("DeleteSession() error = %v", err)
+	}
+	_, err = s.GetSession(ctx, "s2")
+	wantNotFound(t, "GetSession() after delete", err)
+	wantNotFound(t, "DeleteSession() again", s.DeleteSession(ctx, "s2"))
+
+	if sessions, err := s.ListSessions(ctx); err != nil || len(sessions) != 1 || sessions[0].ID != "s1" {
+		t.Errorf("ListSessions() after delete = %+v, %v, want s1", sessions, err)
+	}
+}
+
+func testConnections(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	c1, c2, other := newConnection("c1", "s1", 0), newConnection("c2", "s1", 10), newConnection("c3", "s2", 0)
+	c1.ParserID = "p1"
+	c1.Framing = "delimiter"
+	c1.Delimiter = "\r\n"
+	c1.Capture = &models.Capture{MaxBytes: 1 << 20, MaxAge: 3600}
+	c2.Framing = "fixed"
+	c2.FixedSize = 8
+	mustCreate(t, s, newSession("s1", 0), newSession("s2", 0), newParser("p1", 0), c1, c2, other)
+
+	if err := s.CreateConnection(ctx, newConnection("c1", "s1", 20)); err == nil {
+		t.Error("CreateConnection() accepted a duplicate ID")
+	}
+
+	got, err := s.GetConnection(ctx, "c1")
+	if err != nil {
+		t.Fatalf("GetConnection() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, c1) {
+		t.Errorf("GetConnection() =\n%+v\nwant\n%+v", got, c1)
+	}
+	_, err = s.GetConnection(ctx, "missing")
+	wantNotFound(t, "GetConnection()", err)
+
+	// Newest first, only the session's own
+	conns, err := s.ListConnectionsBySession(ctx, "s1")
+	if err != nil {
+		t.Fatalf("ListConnectionsBySession() error = %v", err)
+	}
+	if !reflect.DeepEqual(conns, []*models.Connection{c2, c1}) {
+		t.Errorf("ListConnectionsBySession() =\n%+v\nwant c2, c1", conns)
+	}
+	if conns, err := s.ListConnectionsBySession(ctx, "missing"); err != nil || len(conns) != 0 {
+		t.Errorf("ListConnectionsBySession() of a missing session = %+v, %v, want none", conns, err)
+	}
+
+	c1.Name = "Renamed"
+	c1.Config = `{"host":"192.0.2.2","port":502}`
+	c1.Framing = "none"
+	c1.Delimiter = ""
+	c1.Status = "connected"
+	c1.Capture = nil
+	if err := s.UpdateConnection(ctx, c1); err != nil {
+		t.Fatalf("UpdateConnection() error = %v", err)
+	}
+	got, err = s.GetConnection(ctx, "c1")
+	if err != nil {
+		t.Fatalf("GetConnection() error = %v", err)
+	}
+	c1.UpdatedAt = time.Unix(c1.UpdatedAt.Unix(), 0)
+	if !reflect.DeepEqual(got, c1) {
+		t.Errorf("GetConnection() after update =\n%+v\nwant\n%+v", got, c1)
+	}
+	wantNotFound(t, "UpdateConnection()", s.UpdateConnection(ctx, newConnection("missing", "s1", 0)))
+
+	if err := s.DeleteConnection(ctx, "c2"); err != nil {
+		t.Fatalf("DeleteConnection() error = %v", err)
+	}
+	_, err = s.GetConnection(ctx, "c2")
+	wantNotFound(t, "GetConnection() after delete", err)
+	wantNotFound(t, "DeleteConnection() again", s.DeleteConnection(ctx, "c2"))
+}
+
+func testDevices(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	d1, d2, d3 := newDevice("d1", "s1", "c1"), newDevice("d2", "s1", "c2"), newDevice("d3", "s1", "c1")
+	d1.Name = "B"
+	d1.Description = "Boiler"
+	d1.ParserID = "p1"
+	d2.Name = "C"
+	d3.Name = "A"
+	d3.Address = ""
+	mustCreate(t, s,
+		newSession("s1", 0), newSession("s2", 0),
+		newConnection("c1", "s1", 0), newConnection("c2", "s1", 0), newConnection("c3", "s2", 0),
+		d1, d2, d3, newDevice("d4", "s2", "c3"))
+
+	if err := s.CreateDevice(ctx, newDevice("d1", "s1", "c1")); err == nil {
+		t.Error("CreateDevice() accepted a duplicate ID")
+	}
+	invalid := newDevice("d5", "s1", "c1")
+	invalid.Address = "300"
+	if err := s.CreateDevice(ctx, invalid); err == nil {
+		t.Error("CreateDevice() accepted an invalid address")
+	}
+
+	got, err := s.GetDevice(ctx, "d1")
+	if err != nil {
+		t.Fatalf("GetDevice() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, d1) {
+		t.Errorf("GetDevice() =\n%+v\nwant\n%+v", got, d1)
+	}
+	_, err = s.GetDevice(ctx, "missing")
+	wantNotFound(t, "GetDevice()", err)
+
+	// By name
+	devices, err := s.ListDevicesBySession(ctx, "s1")
+	if err != nil {
+		t.Fatalf("ListDevicesBySession() error = %v", err)
+	}
+	if !reflect.DeepEqual(devices, []*models.Device{d3, d1, d2}) {
+		t.Errorf("ListDevicesBySession() =\n%+v\nwant d3, d1, d2", devices)
+	}
+	devices, err = s.ListDevicesByConnection(ctx, "c1")
+	if err != nil {
+		t.Fatalf("ListDevicesByConnection() error = %v", err)
+	}
+	if !reflect.DeepEqual(devices, []*models.Device{d3, d1}) {
+		t.Errorf("ListDevicesByConnection() =\n%+v\nwant d3, d1", devices)
+	}
+
+	d1.Name = "Renamed"
+	d1.Description = ""
+	d1.ParserID = "p2"
+	if err := s.UpdateDevice(ctx, d1); err != nil {
+		t.Fatalf("UpdateDevice() error = %v", err)
+	}
+	got, err = s.GetDevice(ctx, "d1")
+	if err != nil {
+		t.Fatalf("GetDevice() error = %v", err)
+	}
+	d1.UpdatedAt = time.Unix(d1.UpdatedAt.Unix(), 0)
+	if !reflect.DeepEqual(got, d1) {
+		t.Errorf("GetDevice() after update =\n%+v\nwant\n%+v", got, d1)
+	}
+	wantNotFound(t, "UpdateDevice()", s.UpdateDevice(ctx, newDevice("missing", "s1", "c1")))
+
+	if err := s.DeleteDevice(ctx, "d2"); err != nil {
+		t.Fatalf("DeleteDevice() error = %v", err)
+	}
+	_, err = s.GetDevice(ctx, "d2")
+	wantNotFound(t, "GetDevice() after delete", err)
+	wantNotFound(t, "DeleteDevice() again", s.DeleteDevice(ctx, "d2"))
+}
+
+func testParsers(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	p1, p2 := newParser("p1", 0), newParser("p2", 10)
+	p2.Type = "javascript"
+	p2.Fields = nil
+	p2.Checksum = nil
+	p2.Script = "function parse(data) { return {}; }"
+	mustCreate(t, s, p1, p2)
+
+	if err := s.CreateParser(ctx, newParser("p1", 20)); err == nil {
+		t.Error("CreateParser() accepted a duplicate ID")
+	}
+	if p1.Version != 1 {
+		t.Errorf("Version after create = %d, want 1", p1.Version)
+	}
+
+	got, err := s.GetParser(ctx, "p1")
+	if err != nil {
+		t.Fatalf("GetParser() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, p1) {
+		t.Errorf("GetParser() =\n%+v\nwant\n%+v", got, p1)
+	}
+	_, err = s.GetParser(ctx, "missing")
+	wantNotFound(t, "GetParser()", err)
+
+	parsers, err := s.ListParsers(ctx)
+	if err != nil {
+		t.Fatalf("ListParsers() error = %v", err)
+	}
+	if !reflect.DeepEqual(parsers, []*models.Parser{p2, p1}) {
+		t.Errorf("ListParsers() =\n%+v\nwant p2, p1", parsers)
+	}
+
+	// Updates add versions; the first stays available
+	first := *p1
+	p1.Name = "Renamed"
+	p1.Fields = p1.Fields[:1]
+	if err := s.UpdateParser(ctx, p1); err != nil {
+		t.Fatalf("UpdateParser() error = %v", err)
+	}
+	if p1.Version != 2 {
+		t.Errorf("Version after update = %d, want 2", p1.Version)
+	}
+	got, err = s.GetParser(ctx, "p1")
+	if err != nil {
+		t.Fatalf("GetParser() error = %v", err)
+	}
+	if got.Name != "Renamed" || got.Version != 2 || len(got.Fields) != 1 {
+		t.Errorf("GetParser() after update = %+v", got)
+	}
+
+	versions, err := s.ListParserVersions(ctx, "p1")
+	if err != nil {
+		t.Fatalf("ListParserVersions() error = %v", err)
+	}
+	if len(versions) != 2 || versions[0].Version != 2 || versions[1].Version != 1 {
+		t.Fatalf("ListParserVersions() = %+v, want versions 2 and 1", versions)
+	}
+	version, err := s.GetParserVersion(ctx, "p1", 1)
+	if err != nil {
+		t.Fatalf("GetParserVersion() error = %v", err)
+	}
+	if version.ParserID != "p1" || version.Version != 1 || version.Parser.Name != first.Name ||
+		!reflect.DeepEqual(version.Parser.Fields, first.Fields) || !reflect.DeepEqual(version.Parser.Checksum, first.Checksum) {
+		t.Errorf("GetParserVersion(1) = %+v, want the definition as created", version)
+	}
+	_, err = s.GetParserVersion(ctx, "p1", 3)
+	wantNotFound(t, "GetParserVersion() of a missing version", err)
+	wantNotFound(t, "UpdateParser()", s.UpdateParser(ctx, newParser("missing", 0)))
+
+	// Not while data points record which version decoded them
+	mustCreate(t, s, newSession("s1", 0))
+	point := models.DataPoint{SessionID: "s1", DeviceID: "d1", Timestamp: 1000, Data: `{"temperature":21.5}`, ParserID: "p1", ParserVersion: 1}
+	if err := s.WriteDataPoints(ctx, []models.DataPoint{point}); err != nil {
+		t.Fatalf("WriteDataPoints() error = %v", err)
+	}
+	if err := s.DeleteParser(ctx, "p1"); !errors.Is(err, storage.ErrInUse) {
+		t.Errorf("DeleteParser() with data points error = %v, want ErrInUse", err)
+	}
+	if _, err := s.GetParserVersion(ctx, "p1", 1); err != nil {
+		t.Errorf("GetParserVersion() after refused delete error = %v", err)
+	}
+	if err := s.DeleteSession(ctx, "s1"); err != nil {
+		t.Fatalf("DeleteSession() error = %v", err)
+	}
+
+	// Deleting a parser deletes its history
+	if err := s.DeleteParser(ctx, "p1"); err != nil {
+		t.Fatalf("DeleteParser() error = %v", err)
+	}
+	_, err = s.GetParser(ctx, "p1")
+	wantNotFound(t, "GetParser() after delete", err)
+	_, err = s.GetParserVersion(ctx, "p1", 1)
+	wantNotFound(t, "GetParserVersion() after delete", err)
+	if versions, err := s.ListParserVersions(ctx, "p1"); err != nil || len(versions) != 0 {
+		t.Errorf("ListParserVersions() after delete = %+v, %v, want none", versions, err)
+	}
+	wantNotFound(t, "DeleteParser() again", s.DeleteParser(ctx, "p1"))
+}
+
+func testRawFrames(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	frames := []*models.RawFrame{
+		{ConnectionID: "c1", Timestamp: 1000, Direction: models.FrameSent, Data: []byte{0x01, 0x03}},
+		{ConnectionID: "c1", Timestamp: 2000, Direction: models.FrameReceived, Data: []byte{0x01, 0x03, 0x02}},
+		{ConnectionID: "c2", Timestamp: 2500, Direction: models.FrameReceived, Data: []byte{0xFF}},
+		{ConnectionID: "c1", Timestamp: 3000, Direction: models.FrameReceived, Data: []byte{0x01, 0x03, 0x02, 0x00}},
+	}
+	mustCreate(t, s, newSession("s1", 0), newConnection("c1", "s1", 0), newConnection("c2", "s1", 0))
+	for i, frame := range frames {
+		mustCreate(t, s, frame)
+		if frame.ID <= 0 || (i > 0 && frame.ID <= frames[i-1].ID) {
+			t.Errorf("frame %d ID = %d, want increasing positive IDs", i, frame.ID)
+		}
+	}
+
+	got, err := s.GetRawFrame(ctx, frames[1].ID)
+	if err != nil {
+		t.Fatalf("GetRawFrame() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, frames[1]) {
+		t.Errorf("GetRawFrame() = %+v, want %+v", got, frames[1])
+	}
+	_, err = s.GetRawFrame(ctx, frames[3].ID+1000)
+	wantNotFound(t, "GetRawFrame()", err)
+
+	// Both ends are included
+	inRange, err := s.QueryRawFrames(ctx, "c1", 1000, 2000)
+	if err != nil {
+		t.Fatalf("QueryRawFrames() error = %v", err)
+	}
+	if !reflect.DeepEqual(inRange, []models.RawFrame{*frames[0], *frames[1]}) {
+		t.Errorf("QueryRawFrames() = %+v, want the first two frames", inRange)
+	}
+
+	deleted, err := s.PruneRawFrames(ctx, "c1", 2000, 0)
+	if err != nil || deleted != 1 {
+		t.Errorf("PruneRawFrames() by age = %d, %v, want 1", deleted, err)
+	}
+	deleted, err = s.PruneRawFrames(ctx, "c1", 0, int64(len(frames[3].Data)))
+	if err != nil || deleted != 1 {
+		t.Errorf("PruneRawFrames() by size = %d, %v, want 1", deleted, err)
+	}
+	remaining, err := s.QueryRawFrames(ctx, "c1", 0, 10000)
+	if err != nil {
+		t.Fatalf("QueryRawFrames() error = %v", err)
+	}
+	if len(remaining) != 1 || remaining[0].ID != frames[3].ID {
+		t.Errorf("QueryRawFrames() after pruning = %+v, want the newest frame", remaining)
+	}
+	if _, err := s.GetRawFrame(ctx, frames[2].ID); err != nil {
+		t.Errorf("GetRawFrame() of another connection's frame error = %v", err)
+	}
+
+	batch := []*models.RawFrame{
+		{ConnectionID: "c1", Timestamp: 4000, Direction: models.FrameSent, Data: []byte{0x01}},
+		{ConnectionID: "c2", Timestamp: 4000, Direction: models.FrameReceived, Data: []byte{0x02}},
+	}
+	if err := s.WriteRawFrames(ctx, batch); err != nil {
+		t.Fatalf("WriteRawFrames() error = %v", err)
+	}
+	if batch[0].ID <= frames[3].ID || batch[1].ID <= batch[0].ID {
+		t.Errorf("WriteRawFrames() IDs = %d, %d, want increasing IDs after %d", batch[0].ID, batch[1].ID, frames[3].ID)
+	}
+	for _, frame := range batch {
+		got, err := s.GetRawFrame(ctx, frame.ID)
+		if err != nil || !reflect.DeepEqual(got, frame) {
+			t.Errorf("GetRawFrame(%d) = %+v, %v, want %+v", frame.ID, got, err, frame)
+		}
+	}
+}
+
+func testDataPoints(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	mustCreate(t, s, newSession("s1", 0), newSession("s2", 0))
+
+	// Written out of order, in several batches
+	batches := [][]models.DataPoint{
+		{
+			{SessionID: "s1", DeviceID: "d1", Timestamp: 3000, Data: `{"temp":23}`},
+			{SessionID: "s1", DeviceID: "d1", Timestamp: 1000, Data: `{"temp":21}`},
+			{SessionID: "s1", DeviceID: "d2", Timestamp: 2000, Data: `{"temp":99}`},
+		},
+		{
+			{SessionID: "s1", DeviceID: "d1", Timestamp: 2000, Data: `{"temp":22}`},
+			{SessionID: "s1", DeviceID: "d1", Timestamp: 2000, Data: `{"temp":22.5}`},
+			{SessionID: "s2", DeviceID: "d1", Timestamp: 2000, Data: `{"temp":-1}`},
+			{SessionID: "s1", DeviceID: "d1", Timestamp: 4000, Data: `{"temp":24}`},
+		},
+		nil,
+	}
+	for _, batch := range batches {
+		if err := s.WriteDataPoints(ctx, batch); err != nil {
+			t.Fatalf("WriteDataPoints() error = %v", err)
+		}
+	}
+
+	// Both ends are included; equal timestamps keep the write order
+	got, err := s.QueryData(ctx, "s1", "d1", 2000, 3000)
+	if err != nil {
+		t.Fatalf("QueryData() error = %v", err)
+	}
+	want := []models.DataPoint{batches[1][0], batches[1][1], batches[0][0]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("QueryData() =\n%+v\nwant\n%+v", got, want)
+	}
+
+	if got, err := s.QueryData(ctx, "s1", "d1", 0, 10000); err != nil || len(got) != 5 {
+		t.Errorf("QueryData() of all time returned %d points, %v, want 5", len(got), err)
+	}
+	if got, err := s.QueryData(ctx, "s1", "d1", 4001, 10000); err != nil || len(got) != 0 {
+		t.Errorf("QueryData() after the last point = %+v, %v, want none", got, err)
+	}
+	if got, err := s.QueryData(ctx, "s1", "missing", 0, 10000); err != nil || len(got) != 0 {
+		t.Errorf("QueryData() of a missing device = %+v, %v, want none", got, err)
+	}
+
+	if err := s.WriteDataPoints(ctx, []models.DataPoint{{SessionID: "s1", DeviceID: "d1", Timestamp: 5000, Data: `not json`}}); err == nil {
+		t.Error("WriteDataPoints() accepted invalid data")
+	}
+	if got, _ := s.QueryData(ctx, "s1", "d1", 5000, 5000); len(got) != 0 {
+		t.Errorf("QueryData() returned %+v from a failed write", got)
+	}
+}
+
+func testDeleteSessionCascades(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	frame, kept := &models.RawFrame{ConnectionID: "c1", Timestamp: 1000, Direction: models.FrameReceived, Data: []byte{0x01}},
+		&models.RawFrame{ConnectionID: "c2", Timestamp: 1000, Direction: models.FrameReceived, Data: []byte{0x02}}
+	mustCreate(t, s,
+		newSession("s1", 0), newSession("s2", 0),
+		newConnection("c1", "s1", 0), newConnection("c2", "s2", 0),
+		newDevice("d1", "s1", "c1"), newDevice("d2", "s2", "c2"),
+		frame, kept)
+	points := []models.DataPoint{
+		{SessionID: "s1", DeviceID: "d1", Timestamp: 1000, Data: `{"temp":21}`},
+		{SessionID: "s2", DeviceID: "d2", Timestamp: 1000, Data: `{"temp":22}`},
+	}
+	if err := s.WriteDataPoints(ctx, points); err != nil {
+		t.Fatalf("WriteDataPoints() error = %v", err)
+	}
+
+	if err := s.DeleteSession(ctx, "s1"); err != nil {
+		t.Fatalf("DeleteSession() error = %v", err)
+	}
+
+	_, err := s.GetConnection(ctx, "c1")
+	wantNotFound(t, "GetConnection() of the session's connection", err)
+	_, err = s.GetDevice(ctx, "d1")
+	wantNotFound(t, "GetDevice() of the session's device", err)
+	_, err = s.GetRawFrame(ctx, frame.ID)
+	wantNotFound(t, "GetRawFrame() of the session's frame", err)
+	if got, err := s.QueryData(ctx, "s1", "d1", 0, 10000); err != nil || len(got) != 0 {
+		t.Errorf("QueryData() of the deleted session = %+v, %v, want none", got, err)
+	}
+	buckets, err := s.AggregateData(ctx, models.AggregateQuery{
+		SessionID: "s1", DeviceID: "d1", End: 10000, Bucket: 10000, Aggregations: []string{models.AggregateCount},
+	})
+	if err != nil || len(buckets) != 0 {
+		t.Errorf("AggregateData() of the deleted session = %+v, %v, want none", buckets, err)
+	}
+
+	// The other session is untouched
+	if _, err := s.GetConnection(ctx, "c2"); err != nil {
+		t.Errorf("GetConnection() of another session error = %v", err)
+	}
+	if _, err := s.GetDevice(ctx, "d2"); err != nil {
+		t.Errorf("GetDevice() of another session error = %v", err)
+	}
+	if _, err := s.GetRawFrame(ctx, kept.ID); err != nil {
+		t.Errorf("GetRawFrame() of another session error = %v", err)
+	}
+	if got, err := s.QueryData(ctx, "s2", "d2", 0, 10000); err != nil || len(got) != 1 {
+		t.Errorf("QueryData() of another session returned %d points, %v, want 1", len(got), err)
+	}
+}
+
+func testDeleteConnectionCascades(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	frame := &models.RawFrame{ConnectionID: "c1", Timestamp: 1000, Direction: models.FrameReceived, Data: []byte{0x01}}
+	mustCreate(t, s,
+		newSession("s1", 0),
+		newConnection("c1", "s1", 0), newConnection("c2", "s1", 0),
+		newDevice("d1", "s1", "c1"), newDevice("d2", "s1", "c2"),
+		frame)
+
+	if err := s.DeleteConnection(ctx, "c1"); err != nil {
+		t.Fatalf("DeleteConnection() error = %v", err)
+	}
+
+	_, err := s.GetDevice(ctx, "d1")
+	wantNotFound(t, "GetDevice() of the connection's device", err)
+	_, err = s.GetRawFrame(ctx, frame.ID)
+	wantNotFound(t, "GetRawFrame() of the connection's frame", err)
+	if devices, err := s.ListDevicesBySession(ctx, "s1"); err != nil || len(devices) != 1 || devices[0].ID != "d2" {
+		t.Errorf("ListDevicesBySession() = %+v, %v, want d2", devices, err)
+	}
+	if _, err := s.GetSession(ctx, "s1"); err != nil {
+		t.Errorf("GetSession() error = %v", err)
+	}
+}
+
+func testForeignKeys(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	mustCreate(t, s, newSession("s1", 0), newParser("p1", 0), newConnection("c1", "s1", 0))
+
+	if err := s.CreateConnection(ctx, newConnection("c2", "missing", 0)); err == nil {
+		t.Error("CreateConnection() accepted a missing session")
+	}
+	withParser := newConnection("c3", "s1", 0)
+	withParser.ParserID = "missing"
+	if err := s.CreateConnection(ctx, withParser); err == nil {
+		t.Error("CreateConnection() accepted a missing parser")
+	}
+	if err := s.CreateDevice(ctx, newDevice("d1", "missing", "c1")); err == nil {
+		t.Error("CreateDevice() accepted a missing session")
+	}
+	if err := s.CreateDevice(ctx, newDevice("d2", "s1", "missing")); err == nil {
+		t.Error("CreateDevice() accepted a missing connection")
+	}
+	if err := s.WriteRawFrame(ctx, &models.RawFrame{ConnectionID: "missing", Timestamp: 1000, Direction: models.FrameReceived, Data: []byte{0x01}}); err == nil {
+		t.Error("WriteRawFrame() accepted a missing connection")
+	}
+	batch := []*models.RawFrame{
+		{ConnectionID: "c1", Timestamp: 1000, Direction: models.FrameReceived, Data: []byte{0x01}},
+		{ConnectionID: "missing", Timestamp: 1000, Direction: models.FrameReceived, Data: []byte{0x02}},
+	}
+	if err := s.WriteRawFrames(ctx, batch); err == nil {
+		t.Error("WriteRawFrames() accepted a missing connection")
+	}
+	if batch[0].ID != 0 {
+		t.Errorf("WriteRawFrames() gave ID %d to a frame it rolled back", batch[0].ID)
+	}
+	if frames, err := s.QueryRawFrames(ctx, "c1", 0, 10000); err != nil || len(frames) != 0 {
+		t.Errorf("QueryRawFrames() = %+v, %v, want nothing from the failed batch", frames, err)
+	}
+
+	// Nothing was stored by the failed writes
+	if conns, err := s.ListConnectionsBySession(ctx, "s1"); err != nil || len(conns) != 1 {
+		t.Errorf("ListConnectionsBySession() = %+v, %v, want c1 only", conns, err)
+	}
+	if devices, err := s.ListDevicesBySession(ctx, "s1"); err != nil || len(devices) != 0 {
+		t.Errorf("ListDevicesBySession() = %+v, %v, want none", devices, err)
+	}
+
+	// Data point device IDs are parser device keys, which need not be
+	// configured devices
+	if err := s.WriteDataPoints(ctx, []models.DataPoint{{SessionID: "s1", DeviceID: "unit-7", Timestamp: 1000, Data: `{"temp":21}`}}); err != nil {
+		t.Errorf("WriteDataPoints() for an unconfigured device error = %v", err)
+	}
+
+	// Connections outlive their parser
+	withParser.ID = "c4"
+	withParser.ParserID = "p1"
+	mustCreate(t, s, withParser)
+	if err := s.DeleteParser(ctx, "p1"); err != nil {
+		t.Fatalf("DeleteParser() error = %v", err)
+	}
+	conn, err := s.GetConnection(ctx, "c4")
+	if err != nil {
+		t.Fatalf("GetConnection() after deleting its parser error = %v", err)
+	}
+	if conn.ParserID != "" {
+		t.Errorf("ParserID after deleting the parser = %q, want none", conn.ParserID)
+	}
+}
+
+func testConcurrency(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	const (
+		workers = 8
+		batches = 20
+		points  = 10
+		updates = 5
+	)
+	mustCreate(t, s, newSession("s1", 0), newParser("p1", 0))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*(batches+updates+1))
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			device := fmt.Sprintf("d%d", w)
+			for b := 0; b < batches; b++ {
+				batch := make([]models.DataPoint, points)
+				for i := range batch {
+					batch[i] = models.DataPoint{
+						SessionID: "s1",
+						DeviceID:  device,
+						Timestamp: int64(b*points+i) * 1000,
+						Data:      fmt.Sprintf(`{"value":%d}`, b*points+i),
+					}
+				}
+				errs <- s.WriteDataPoints(ctx, batch)
+			}
+
+			errs <- s.CreateSession(ctx, newSession(fmt.Sprintf("w%d", w), int64(w)))
+
+			for u := 0; u < updates; u++ {
+				parser := newParser("p1", 0)
+				parser.Name = fmt.Sprintf("Worker %d update %d", w, u)
+				errs <- s.UpdateParser(ctx, parser)
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent write error = %v", err)
+		}
+	}
+
+	for w := 0; w < workers; w++ {
+		got, err := s.QueryData(ctx, "s1", fmt.Sprintf("d%d", w), 0, batches*points*1000)
+		if err != nil {
+			t.Fatalf("QueryData() error = %v", err)
+		}
+		if len(got) != batches*points {
+			t.Errorf("device %d has %d points, want %d", w, len(got), batches*points)
+		}
+	}
+	if sessions, err := s.ListSessions(ctx); err != nil || len(sessions) != workers+1 {
+		t.Errorf("ListSessions() returned %d sessions, %v, want %d", len(sessions), err, workers+1)
+	}
+
+	// Every update got a version of its own
+	versions, err := s.ListParserVersions(ctx, "p1")
+	if err != nil {
+		t.Fatalf("ListParserVersions() error = %v", err)
+	}
+	if len(versions) != workers*updates+1 {
+		t.Errorf("ListParserVersions() returned %d versions, want %d", len(versions), workers*updates+1)
+	}
+	for i, version := range versions {
+		if want := len(versions) - i; version.Version != want {
+			t.Errorf("versions[%d] = %d, want %d", i, version.Version, want)
+		}
+	}
+}
@@ -0,0 +1,472 @@
+// Package timeseries holds the SQL over data_points, samples and rollups
+// that the SQL storage backends share: aggregation and rolling up. Queries
+// are written with ? placeholders and in SQL both SQLite and PostgreSQL
+// accept; purging stays with each backend, as it measures what it frees
+// differently.
+package timeseries
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+)
+
+// Placeholders is how a backend writes query parameters
+type Placeholders int
+
+const (
+	// QuestionMarks keeps the ? placeholders, as in SQLite
+	QuestionMarks Placeholders = iota
+	// Numbered rewrites them to $1, $2 and so on, as in PostgreSQL
+	Numbered
+)
+
+// Queries runs the shared time-series SQL against a backend's database
+type Queries struct {
+	db           *sql.DB
+	placeholders Placeholders
+}
+
+func New(db *sql.DB, placeholders Placeholders) *Queries {
+	return &Queries{db: db, placeholders: placeholders}
+}
+
+// bind rewrites the ? placeholders of query for the backend
+func (q *Queries) bind(query string) string {
+	if q.placeholders != Numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		fmt.Fprintf(&b, "$%d", n)
+	}
+	return b.String()
+}
+
+// aggregateColumns maps aggregations to SQL over the partial aggregates of
+// one bucket and field: rollup rows, or raw samples as rollups of one.
+// first and last come from window columns of the inner query.
+var aggregateColumns = map[string]string{
+	models.AggregateMin:   "MIN(min_value)",
+	models.AggregateMax:   "MAX(max_value)",
+	models.AggregateAvg:   "SUM(sum_value) / CAST(SUM(sample_count) AS DOUBLE PRECISION)",
+	models.AggregateCount: "CAST(SUM(sample_count) AS DOUBLE PRECISION)",
+	models.AggregateFirst: "MAX(bucket_first)",
+	models.AggregateLast:  "MAX(bucket_last)",
+}
+
+// Aggregate reads from the largest rollup whose bucket divides the
+// requested one, up to where it reaches, and from the raw samples after
+// that. Ranges served by a rollup are widened to its buckets.
+func (q *Queries) Aggregate(ctx context.Context, query models.AggregateQuery) ([]models.AggregateBucket, error) {
+	if query.Bucket <= 0 {
+		return nil, fmt.Errorf("invalid bucket size: %d", query.Bucket)
+	}
+
+	var columns []string
+	windowed := false
+	for _, aggregation := range query.Aggregations {
+		column, ok := aggregateColumns[aggregation]
+		if !ok {
+			return nil, fmt.Errorf("unknown aggregation: %s", aggregation)
+		}
+		columns = append(columns, column)
+		windowed = windowed || aggregation == models.AggregateFirst || aggregation == models.AggregateLast
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no aggregations requested")
+	}
+
+	var rollupBucket, rolledUntil int64
+	err := q.db.QueryRowContext(ctx, q.bind(`
+		SELECT bucket_size, rolled_until FROM rollup_progress
+		WHERE session_id = ? AND ? % bucket_size = 0 AND rolled_until > ?
+		ORDER BY bucket_size DESC
+		LIMIT 1
+	`), query.SessionID, query.Bucket, query.Start).Scan(&rollupBucket, &rolledUntil)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to find rollups: %w", err)
+	}
+
+	sqlQuery, args := aggregateSQL(query, columns, windowed, rollupBucket, rolledUntil)
+	if sqlQuery == "" {
+		return nil, nil
+	}
+
+	rows, err := q.db.QueryContext(ctx, q.bind(sqlQuery), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate data: %w", err)
+	}
+	defer rows.Close()
+
+	var buckets []models.AggregateBucket
+
+	for rows.Next() {
+		var timestamp int64
+		var field string
+		values := make([]sql.NullFloat64, len(columns))
+		dest := []interface{}{&timestamp, &field}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("failed to scan aggregate: %w", err)
+		}
+
+		if len(buckets) == 0 || buckets[len(buckets)-1].Timestamp != timestamp {
+			buckets = append(buckets, models.AggregateBucket{
+				Timestamp: timestamp,
+				Values:    make(map[string]map[string]float64),
+			})
+		}
+		fieldValues := make(map[string]float64, len(columns))
+		for i, aggregation := range query.Aggregations {
+			if values[i].Valid {
+				fieldValues[aggregation] = values[i].Float64
+			}
+		}
+		buckets[len(buckets)-1].Values[field] = fieldValues
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating aggregates: %w", err)
+	}
+
+	return buckets, nil
+}
+
+// aggregateSQL builds the query for Aggregate, reading the rollup of
+// rollupBucket, if any, before rolledUntil. It returns no SQL if neither
+// the rollup nor the raw samples cover the range.
+func aggregateSQL(query models.AggregateQuery, columns []string, windowed bool, rollupBucket, rolledUntil int64) (string, []interface{}) {
+	var parts []string
+	var args []interface{}
+	fieldFilter := func(column string) {
+		if len(query.Fields) == 0 {
+			return
+		}
+		parts[len(parts)-1] += `
+			AND ` + column + ` IN (?` + strings.Repeat(", ?", len(query.Fields)-1) + `)`
+		for _, field := range query.Fields {
+			args = append(args, field)
+		}
+	}
+
+	rawStart := query.Start
+	if rollupBucket > 0 {
+		parts = append(parts, `
+			SELECT timestamp AS t, 0 AS seq, field, min_value, max_value, sum_value, sample_count, first_value, last_value
+			FROM rollups
+			WHERE session_id = ? AND device_id = ? AND bucket_size = ?
+				AND timestamp > ? AND timestamp <= ? AND timestamp < ?`)
+		args = append(args, query.SessionID, query.DeviceID, rollupBucket, query.Start-rollupBucket, query.End, rolledUntil)
+		fieldFilter("field")
+		rawStart = max(rawStart, rolledUntil)
+	}
+
+	// Only numeric samples are aggregated
+	if rawStart <= query.End {
+		raw := `
+			SELECT s.timestamp AS t, s.point_id AS seq, s.field AS field,
+				s.value AS min_value, s.value AS max_value, s.value AS sum_value, 1 AS sample_count,
+				s.value AS first_value, s.value AS last_value`
+		if len(query.Fields) > 0 {
+			// Served by the samples index on (session, device, field, timestamp)
+			parts = append(parts, raw+`
+			FROM samples s
+			WHERE s.session_id = ? AND s.device_id = ? AND s.timestamp BETWEEN ? AND ? AND s.value IS NOT NULL`)
+			args = append(args, query.SessionID, query.DeviceID, rawStart, query.End)
+			fieldFilter("s.field")
+		} else {
+			// All fields: find the points first, then their samples
+			parts = append(parts, raw+`
+			FROM data_points dp
+			JOIN samples s ON s.point_id = dp.id
+			WHERE dp.session_id = ? AND dp.device_id = ? AND dp.timestamp BETWEEN ? AND ?
+				AND s.value IS NOT NULL`)
+			args = append(args, query.SessionID, query.DeviceID, rawStart, query.End)
+		}
+	}
+	if len(parts) == 0 {
+		return "", nil
+	}
+
+	inner := `
+		SELECT t / ? * ? AS bucket, field, min_value, max_value, sum_value, sample_count`
+	args = append([]interface{}{query.Bucket, query.Bucket}, args...)
+	if windowed {
+		inner += `,
+			FIRST_VALUE(first_value) OVER w AS bucket_first,
+			LAST_VALUE(last_value) OVER w AS bucket_last`
+	}
+	inner += `
+		FROM (` + strings.Join(parts, `
+			UNION ALL`) + `
+		) AS parts`
+	if windowed {
+		inner += `
+		WINDOW w AS (
+			PARTITION BY t / ?, field
+			ORDER BY t, seq
+			ROWS BETWEEN UNBOUNDED PRECEDING AND UNBOUNDED FOLLOWING
+		)`
+		args = append(args, query.Bucket)
+	}
+
+	return `
+		SELECT bucket, field, ` + strings.Join(columns, ", ") + `
+		FROM (` + inner + `
+		) AS partials
+		GROUP BY bucket, field
+		ORDER BY bucket, field
+	`, args
+}
+
+// RollUp summarises a session's points per bucket milliseconds from where the
+// last run stopped until until, a bucket boundary, about batchSize points per
+// transaction. It returns how far the rollup now reaches and the number of
+// buckets written.
+func (q *Queries) RollUp(ctx context.Context, sessionID string, bucket, until int64, batchSize int) (int64, int64, error) {
+	// RollUpLate locks the progress row to wait for a running batch, so it
+	// must exist before the first one
+	if _, err := q.db.ExecContext(ctx, q.bind(`
+		INSERT INTO rollup_progress (session_id, bucket_size, rolled_until) VALUES (?, ?, 0)
+		ON CONFLICT (session_id, bucket_size) DO NOTHING
+	`), sessionID, bucket); err != nil {
+		return 0, 0, fmt.Errorf("failed to save rollup progress: %w", err)
+	}
+
+	var rolledUntil int64
+	err := q.db.QueryRowContext(ctx,
+		q.bind(`SELECT rolled_until FROM rollup_progress WHERE session_id = ? AND bucket_size = ?`),
+		sessionID, bucket).Scan(&rolledUntil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get rollup progress: %w", err)
+	}
+	if rolledUntil >= until {
+		return rolledUntil, 0, nil
+	}
+
+	var written int64
+	for rolledUntil < until {
+		// Skip ahead over time without points, and end the batch at the
+		// bucket holding the batch size'th point, but always take at least
+		// one whole bucket
+		end := until
+		var next sql.NullInt64
+		if err := q.db.QueryRowContext(ctx,
+			q.bind(`SELECT MIN(timestamp) FROM data_points WHERE session_id = ? AND timestamp >= ?`),
+			sessionID, rolledUntil).Scan(&next); err != nil {
+			return 0, 0, fmt.Errorf("failed to find points to roll up: %w", err)
+		}
+		if from := max(rolledUntil, next.Int64/bucket*bucket); next.Valid && from < until {
+			var last int64
+			err := q.db.QueryRowContext(ctx, q.bind(`
+				SELECT timestamp FROM data_points
+				WHERE session_id = ? AND timestamp >= ?
+				ORDER BY timestamp
+				LIMIT 1 OFFSET ?
+			`), sessionID, from, batchSize).Scan(&last)
+			switch {
+			case err == sql.ErrNoRows:
+			case err != nil:
+				return 0, 0, fmt.Errorf("failed to find points to roll up: %w", err)
+			default:
+				end = min(until, max(last/bucket*bucket, from+bucket))
+			}
+		}
+
+		// The batch covers any time skipped, in case points arrived there
+		// since
+		n, err := q.rollUpRange(ctx, sessionID, bucket, rolledUntil, end)
+		if err != nil {
+			return 0, 0, err
+		}
+		written += n
+		rolledUntil = end
+	}
+	return until, written, nil
+}
+
+// rollUpRange writes the buckets of points between start and end and records
+// the progress in one transaction
+func (q *Queries) rollUpRange(ctx context.Context, sessionID string, bucket, start, end int64) (int64, error) {
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Recording the progress first locks it: writers of points behind it
+	// wait for the batch, then add them to the rollup themselves, and
+	// points written before are read below
+	if err := q.saveRollupProgress(ctx, tx, sessionID, bucket, end); err != nil {
+		return 0, err
+	}
+
+	// The outer WHERE keeps SQLite from reading ON CONFLICT as a join
+	// constraint
+	result, err := tx.ExecContext(ctx, q.bind(`
+		INSERT INTO rollups (session_id, device_id, bucket_size, field, timestamp,
+			min_value, max_value, sum_value, sample_count, first_value, last_value,
+			first_timestamp, last_timestamp)
+		SELECT CAST(? AS TEXT), device_id, CAST(? AS BIGINT), field, bucket,
+			MIN(value), MAX(value), SUM(value), COUNT(value), MAX(first_value), MAX(last_value),
+			MIN(t), MAX(t)
+		FROM (
+			SELECT dp.device_id AS device_id, s.field AS field, dp.timestamp AS t,
+				dp.timestamp / CAST(? AS BIGINT) * CAST(? AS BIGINT) AS bucket, s.value AS value,
+				FIRST_VALUE(s.value) OVER w AS first_value,
+				LAST_VALUE(s.value) OVER w AS last_value
+			FROM data_points dp
+			JOIN samples s ON s.point_id = dp.id AND s.timestamp = dp.timestamp
+			WHERE dp.session_id = ? AND dp.timestamp >= ? AND dp.timestamp < ? AND s.value IS NOT NULL
+			WINDOW w AS (
+				PARTITION BY dp.device_id, s.field, dp.timestamp / CAST(? AS BIGINT)
+				ORDER BY dp.timestamp, dp.id
+				ROWS BETWEEN UNBOUNDED PRECEDING AND UNBOUNDED FOLLOWING
+			)
+		) AS points
+		WHERE true
+		GROUP BY device_id, field, bucket
+		ON CONFLICT (session_id, device_id, bucket_size, field, timestamp) DO UPDATE SET
+			min_value = excluded.min_value,
+			max_value = excluded.max_value,
+			sum_value = excluded.sum_value,
+			sample_count = excluded.sample_count,
+			first_value = excluded.first_value,
+			last_value = excluded.last_value,
+			first_timestamp = excluded.first_timestamp,
+			last_timestamp = excluded.last_timestamp
+	`), sessionID, bucket, bucket, bucket, sessionID, start, end, bucket)
+	if err != nil {
+		return 0, fmt.Errorf("failed to roll up data points: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	written, _ := result.RowsAffected()
+	return written, nil
+}
+
+// Sample is a numeric field of a data point being written
+type Sample struct {
+	SessionID string
+	DeviceID  string
+	Field     string
+	Timestamp int64
+	Value     float64
+}
+
+// RollUpLate adds samples written behind their session's rollups to the
+// buckets they fall in, as their raw points may already be gone. It runs in
+// the transaction writing them, after the points, and waits for a roll-up
+// of the session in progress.
+func (q *Queries) RollUpLate(ctx context.Context, tx *sql.Tx, samples []Sample) error {
+	type progress struct{ bucket, rolledUntil int64 }
+	rollups := make(map[string][]progress)
+	var sessions []string
+	for _, sample := range samples {
+		if _, ok := rollups[sample.SessionID]; !ok {
+			rollups[sample.SessionID] = nil
+			sessions = append(sessions, sample.SessionID)
+		}
+	}
+	// Locked in the same order by every writer
+	sort.Strings(sessions)
+
+	late := false
+	for _, sessionID := range sessions {
+		rows, err := tx.QueryContext(ctx, q.bind(`
+			UPDATE rollup_progress SET rolled_until = rolled_until
+			WHERE session_id = ?
+			RETURNING bucket_size, rolled_until
+		`), sessionID)
+		if err != nil {
+			return fmt.Errorf("failed to lock rollup progress: %w", err)
+		}
+		for rows.Next() {
+			var p progress
+			if err := rows.Scan(&p.bucket, &p.rolledUntil); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan rollup progress: %w", err)
+			}
+			rollups[sessionID] = append(rollups[sessionID], p)
+			late = late || p.rolledUntil > 0
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating rollup progress: %w", err)
+		}
+	}
+	if !late {
+		return nil
+	}
+
+	stmt, err := tx.PrepareContext(ctx, q.bind(`
+		INSERT INTO rollups (session_id, device_id, bucket_size, field, timestamp,
+			min_value, max_value, sum_value, sample_count, first_value, last_value,
+			first_timestamp, last_timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, 1, ?, ?, ?, ?)
+		ON CONFLICT (session_id, device_id, bucket_size, field, timestamp) DO UPDATE SET
+			min_value = CASE WHEN excluded.min_value < rollups.min_value
+				THEN excluded.min_value ELSE rollups.min_value END,
+			max_value = CASE WHEN excluded.max_value > rollups.max_value
+				THEN excluded.max_value ELSE rollups.max_value END,
+			sum_value = rollups.sum_value + excluded.sum_value,
+			sample_count = rollups.sample_count + excluded.sample_count,
+			first_value = CASE WHEN excluded.first_timestamp < rollups.first_timestamp
+				THEN excluded.first_value ELSE rollups.first_value END,
+			first_timestamp = CASE WHEN excluded.first_timestamp < rollups.first_timestamp
+				THEN excluded.first_timestamp ELSE rollups.first_timestamp END,
+			last_value = CASE WHEN excluded.last_timestamp >= rollups.last_timestamp
+				THEN excluded.last_value ELSE rollups.last_value END,
+			last_timestamp = CASE WHEN excluded.last_timestamp >= rollups.last_timestamp
+				THEN excluded.last_timestamp ELSE rollups.last_timestamp END
+	`))
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, sample := range samples {
+		for _, p := range rollups[sample.SessionID] {
+			if sample.Timestamp >= p.rolledUntil {
+				continue
+			}
+			if _, err := stmt.ExecContext(ctx,
+				sample.SessionID, sample.DeviceID, p.bucket, sample.Field, sample.Timestamp/p.bucket*p.bucket,
+				sample.Value, sample.Value, sample.Value, sample.Value, sample.Value,
+				sample.Timestamp, sample.Timestamp,
+			); err != nil {
+				return fmt.Errorf("failed to roll up late sample: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (q *Queries) saveRollupProgress(ctx context.Context, db execer, sessionID string, bucket, rolledUntil int64) error {
+	if _, err := db.ExecContext(ctx, q.bind(`
+		INSERT INTO rollup_progress (session_id, bucket_size, rolled_until) VALUES (?, ?, ?)
+		ON CONFLICT (session_id, bucket_size) DO UPDATE SET rolled_until = excluded.rolled_until
+	`), sessionID, bucket, rolledUntil); err != nil {
+		return fmt.Errorf("failed to save rollup progress: %w", err)
+	}
+	return nil
+}
@@ -8,6 +8,9 @@ type ConnectionType string
 const (
 	ModbusTCP ConnectionType = "modbus_tcp"
 	ModbusRTU ConnectionType = "modbus_rtu"
+	MQTT      ConnectionType = "mqtt"
+	TCP       ConnectionType = "tcp"
+	Replay    ConnectionType = "replay"
 )
 
 // ConnectionStatus represents the status of a connection
@@ -64,6 +67,45 @@ type ModbusRTUConfig struct {
 	RetryDelay int    `json:"retryDelay"` // in milliseconds
 }
 
+// TCPConfig is configuration for raw TCP client connections
+type TCPConfig struct {
+	ConnectionConfig
+	Host           string `json:"host"`
+	Port           int    `json:"port"`
+	Timeout        int    `json:"timeout"`        // in seconds
+	ReadBufferSize int    `json:"readBufferSize"` // in bytes
+}
+
+// ReplayConfig is configuration for connections that play back a recording
+type ReplayConfig struct {
+	ConnectionConfig
+	Path  string  `json:"path"`  // raw frame export (JSON) or pcapng file
+	Speed float64 `json:"speed"` // playback speed; 0 or 1 keeps the recorded timing
+	Loop  bool    `json:"loop"`
+}
+
+// MQTTConfig is configuration for MQTT client connections
+type MQTTConfig struct {
+	ConnectionConfig
+	Broker        string             `json:"broker"` // e.g. tcp://localhost:1883
+	ClientID      string             `json:"clientId"`
+	Username      string             `json:"username"`
+	Password      string             `json:"password"`
+	CleanSession  bool               `json:"cleanSession"`
+	KeepAlive     int                `json:"keepAlive"` // in seconds
+	Timeout       int                `json:"timeout"`   // in seconds
+	Subscriptions []MQTTSubscription `json:"subscriptions"`
+	PublishTopic  string             `json:"publishTopic"`
+	QueueSize     int                `json:"queueSize"`
+}
+
+// MQTTSubscription describes a topic filter and where the device key sits in matching topics
+type MQTTSubscription struct {
+	Topic         string `json:"topic"`
+	QoS           byte   `json:"qos"`
+	DeviceSegment *int   `json:"deviceSegment,omitempty"` // zero-based topic level holding the device key; defaults to the first wildcard
+}
+
 // ConnectionMetrics tracks connection performance metrics
 type ConnectionMetrics struct {
 	BytesRead      int64     `json:"bytesRead"`
@@ -71,17 +113,98 @@ type ConnectionMetrics struct {
 	ReadCount      int64     `json:"readCount"`
 	WriteCount     int64     `json:"writeCount"`
 	ErrorCount     int64     `json:"errorCount"`
+	ChecksumErrors int64     `json:"checksumErrors"`
+	UnknownDevices int64     `json:"unknownDevices"` // messages dropped for a device key matching no device
 	LastRead       time.Time `json:"lastRead"`
 	LastWrite      time.Time `json:"lastWrite"`
 	AverageLatency float64   `json:"averageLatency"` // in milliseconds
 }
 
+// IngestMetrics reports the queue between acquisition and storage. Counts
+// are data points unless named after frames; the queue and batches hold
+// both.
+type IngestMetrics struct {
+	QueueDepth          int     `json:"queueDepth"`
+	QueueSize           int     `json:"queueSize"`
+	Received            int64   `json:"received"`
+	Written             int64   `json:"written"`
+	Dropped             int64   `json:"dropped"` // queue full
+	Failed              int64   `json:"failed"`  // rejected by storage
+	Frames              int64   `json:"frames"`  // raw frames received
+	FramesWritten       int64   `json:"framesWritten"`
+	FramesDropped       int64   `json:"framesDropped"`
+	FramesFailed        int64   `json:"framesFailed"`
+	Retries             int64   `json:"retries"` // writes repeated after a transient failure
+	Batches             int64   `json:"batches"`
+	AverageBatchSize    float64 `json:"averageBatchSize"`
+	AverageBatchLatency float64 `json:"averageBatchLatency"` // time to write a batch, in milliseconds
+	MaxBatchLatency     float64 `json:"maxBatchLatency"`     // in milliseconds
+	SinkDropped         int64   `json:"sinkDropped"`         // not forwarded to a sink that fell behind
+}
+
+// GatewayMetrics reports the activity of the Modbus TCP gateway
+type GatewayMetrics struct {
+	ActiveClients int64                        `json:"activeClients"`
+	Requests      int64                        `json:"requests"`
+	Responses     int64                        `json:"responses"`
+	Exceptions    int64                        `json:"exceptions"` // generated by the gateway itself
+	Timeouts      int64                        `json:"timeouts"`
+	Rejected      int64                        `json:"rejected"` // queue full
+	Buses         map[string]GatewayBusMetrics `json:"buses"`
+}
+
+// GatewayBusMetrics reports the request queue of one upstream connection
+type GatewayBusMetrics struct {
+	QueueDepth     int     `json:"queueDepth"`
+	Requests       int64   `json:"requests"`
+	ErrorCount     int64   `json:"errorCount"`
+	AverageLatency float64 `json:"averageLatency"` // in milliseconds
+}
+
+// ModbusTransaction is one Modbus request and its response as seen on the
+// wire, for the traffic monitor
+type ModbusTransaction struct {
+	Timestamp    int64   `json:"timestamp"` // unix milliseconds when the request was sent
+	TxID         uint16  `json:"txId"`
+	UnitID       uint8   `json:"unitId"`
+	FunctionCode uint8   `json:"functionCode"`
+	Function     string  `json:"function"`
+	Address      uint16  `json:"address"`
+	Quantity     uint16  `json:"quantity"`
+	Request      string  `json:"request"`            // hex, including the MBAP header or RTU address and CRC
+	Response     string  `json:"response,omitempty"` // hex, as Request
+	Latency      float64 `json:"latency"`            // in milliseconds
+	Exception    uint8   `json:"exception,omitempty"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// TrafficFilter selects Modbus transactions; nil fields match everything
+type TrafficFilter struct {
+	UnitID       *uint8 `json:"unitId,omitempty"`
+	FunctionCode *uint8 `json:"functionCode,omitempty"`
+}
+
+// Matches reports whether the transaction passes the filter
+func (f TrafficFilter) Matches(tx ModbusTransaction) bool {
+	if f.UnitID != nil && *f.UnitID != tx.UnitID {
+		return false
+	}
+	if f.FunctionCode != nil && *f.FunctionCode != tx.FunctionCode {
+		return false
+	}
+	return true
+}
+
 // Message represents a WebSocket message
 type Message struct {
-	Type      string                 `json:"type"`
-	SessionID string                 `json:"sessionId,omitempty"`
-	DeviceID  string                 `json:"deviceId,omitempty"`
-	Timestamp int64                  `json:"timestamp"`
-	Data      map[string]interface{} `json:"data"`
-	Error     string                 `json:"error,omitempty"`
+	Type         string                 `json:"type"`
+	SessionID    string                 `json:"sessionId,omitempty"`
+	DeviceID     string                 `json:"deviceId,omitempty"`
+	ConnectionID string                 `json:"connectionId,omitempty"`
+	Timestamp    int64                  `json:"timestamp"`
+	Data         map[string]interface{} `json:"data"`
+	Quality      map[string]interface{} `json:"quality,omitempty"` // fields that did not decode cleanly
+	Filter       *TrafficFilter         `json:"filter,omitempty"`  // for traffic subscriptions
+	Transaction  *ModbusTransaction     `json:"transaction,omitempty"`
+	Error        string                 `json:"error,omitempty"`
 }
@@ -12,6 +12,7 @@ func TestConnectionTypeString(t *testing.T) {
 	}{
 		{"ModbusTCP", ModbusTCP, "modbus_tcp"},
 		{"ModbusRTU", ModbusRTU, "modbus_rtu"},
+		{"MQTT", MQTT, "mqtt"},
 	}
 
 	for _, tt := range tests {
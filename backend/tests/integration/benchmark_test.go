@@ -0,0 +1,116 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/iotstudio/iotstudio/internal/storage/sqlite"
+)
+
+// benchmarkBatch is the number of points per WriteDataPoints call, about
+// what the connection manager delivers per second for a busy session
+const benchmarkBatch = 1000
+
+func newBenchmarkStorage(b *testing.B) *sqlite.SQLiteStorage {
+	b.Helper()
+
+	storage, err := sqlite.NewSQLiteStorage(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatalf("Failed to create storage: %v", err)
+	}
+	b.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+// benchmarkPoints returns points one second apart with five numeric fields
+func benchmarkPoints(start, count int) []models.DataPoint {
+	points := make([]models.DataPoint, count)
+	for i := range points {
+		n := start + i
+		points[i] = models.DataPoint{
+			SessionID: "bench",
+			DeviceID:  fmt.Sprintf("device-%d", n%10),
+			Timestamp: int64(n) * 1000,
+			Data: fmt.Sprintf(`{"temperature":%d.5,"humidity":%d,"pressure":1013.%d,"voltage":%d,"current":%d}`,
+				n%40, n%100, n%10, 230+n%5, n%16),
+		}
+	}
+	return points
+}
+
+func BenchmarkWriteDataPoints(b *testing.B) {
+	storage := newBenchmarkStorage(b)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		points := benchmarkPoints(i*benchmarkBatch, benchmarkBatch)
+		b.StartTimer()
+
+		if err := storage.WriteDataPoints(ctx, points); err != nil {
+			b.Fatalf("Failed to write data points: %v", err)
+		}
+	}
+	b.ReportMetric(float64(b.N*benchmarkBatch)/time.Since(start).Seconds(), "points/s")
+}
+
+// seedBenchmark stores count points spread over ten devices
+func seedBenchmark(b *testing.B, storage *sqlite.SQLiteStorage, count int) {
+	b.Helper()
+
+	for written := 0; written < count; written += benchmarkBatch {
+		if err := storage.WriteDataPoints(context.Background(), benchmarkPoints(written, benchmarkBatch)); err != nil {
+			b.Fatalf("Failed to write data points: %v", err)
+		}
+	}
+}
+
+func BenchmarkQueryData(b *testing.B) {
+	storage := newBenchmarkStorage(b)
+	ctx := context.Background()
+	seedBenchmark(b, storage, 100000)
+
+	// One device's hour: 360 of its points
+	b.ResetTimer()
+	returned := 0
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		points, err := storage.QueryData(ctx, "bench", "device-3", 3600000, 7200000)
+		if err != nil {
+			b.Fatalf("Failed to query data: %v", err)
+		}
+		returned += len(points)
+	}
+	b.ReportMetric(float64(returned)/time.Since(start).Seconds(), "points/s")
+}
+
+func BenchmarkAggregateData(b *testing.B) {
+	storage := newBenchmarkStorage(b)
+	ctx := context.Background()
+	seedBenchmark(b, storage, 100000)
+
+	// One device's 10000 points in one-minute buckets
+	query := models.AggregateQuery{
+		SessionID:    "bench",
+		DeviceID:     "device-3",
+		End:          100000000,
+		Bucket:       60000,
+		Aggregations: []string{models.AggregateMin, models.AggregateMax, models.AggregateAvg},
+		Fields:       []string{"temperature"},
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		if _, err := storage.AggregateData(ctx, query); err != nil {
+			b.Fatalf("Failed to aggregate data: %v", err)
+		}
+	}
+	b.ReportMetric(float64(b.N*10000)/time.Since(start).Seconds(), "points/s")
+}
@@ -2,10 +2,18 @@ package integration
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/iotstudio/iotstudio/internal/models"
+	"github.com/iotstudio/iotstudio/internal/storage"
+	"github.com/iotstudio/iotstudio/internal/storage/postgres"
 	"github.com/iotstudio/iotstudio/internal/storage/sqlite"
 )
 
@@ -30,3 +38,512 @@ func TestSQLiteStorage(t *testing.T) {
 		t.Fatalf("Failed to create session: %v", err)
 	}
 }
+
+// createSession stores an empty session for data points to belong to
+func createSession(t *testing.T, storage storage.Storage, id string) {
+	t.Helper()
+
+	if err := storage.CreateSession(context.Background(), &models.Session{ID: id, Name: "Session " + id, Status: "idle"}); err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+}
+
+func TestAggregateData(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, storage storage.Storage) {
+		ctx := context.Background()
+		createSession(t, storage, "s1")
+
+		points := []models.DataPoint{
+			{SessionID: "s1", DeviceID: "d1", Timestamp: 1000, Data: `{"temp": 20, "state": "ok"}`},
+			{SessionID: "s1", DeviceID: "d1", Timestamp: 1500, Data: `{"temp": 24.5, "humidity": 40}`},
+			{SessionID: "s1", DeviceID: "d1", Timestamp: 1200, Data: `{"temp": 22}`},
+			{SessionID: "s1", DeviceID: "d1", Timestamp: 2100, Data: `{"temp": 30, "alarm": true}`},
+			{SessionID: "s1", DeviceID: "d2", Timestamp: 1100, Data: `{"temp": 99}`},
+			{SessionID: "s1", DeviceID: "d1", Timestamp: 5000, Data: `{"temp": 50}`},
+		}
+		if err := storage.WriteDataPoints(ctx, points); err != nil {
+			t.Fatalf("Failed to write data points: %v", err)
+		}
+
+		buckets, err := storage.AggregateData(ctx, models.AggregateQuery{
+			SessionID:    "s1",
+			DeviceID:     "d1",
+			Start:        0,
+			End:          3000,
+			Bucket:       1000,
+			Aggregations: []string{models.AggregateMin, models.AggregateMax, models.AggregateAvg, models.AggregateFirst, models.AggregateLast, models.AggregateCount},
+		})
+		if err != nil {
+			t.Fatalf("Failed to aggregate data: %v", err)
+		}
+
+		want := []models.AggregateBucket{
+			{Timestamp: 1000, Values: map[string]map[string]float64{
+				"temp":     {"min": 20, "max": 24.5, "avg": 22.166666666666668, "first": 20, "last": 24.5, "count": 3},
+				"humidity": {"min": 40, "max": 40, "avg": 40, "first": 40, "last": 40, "count": 1},
+			}},
+			{Timestamp: 2000, Values: map[string]map[string]float64{
+				"temp": {"min": 30, "max": 30, "avg": 30, "first": 30, "last": 30, "count": 1},
+			}},
+		}
+		if !reflect.DeepEqual(buckets, want) {
+			t.Errorf("AggregateData() =\n%+v\nwant\n%+v", buckets, want)
+		}
+
+		buckets, err = storage.AggregateData(ctx, models.AggregateQuery{
+			SessionID:    "s1",
+			DeviceID:     "d1",
+			Start:        0,
+			End:          10000,
+			Bucket:       10000,
+			Aggregations: []string{models.AggregateCount},
+			Fields:       []string{"humidity"},
+		})
+		if err != nil {
+			t.Fatalf("Failed to aggregate data: %v", err)
+		}
+		want = []models.AggregateBucket{
+			{Timestamp: 0, Values: map[string]map[string]float64{"humidity": {"count": 1}}},
+		}
+		if !reflect.DeepEqual(buckets, want) {
+			t.Errorf("AggregateData() with fields = %+v, want %+v", buckets, want)
+		}
+
+		if _, err := storage.AggregateData(ctx, models.AggregateQuery{Bucket: 1000, Aggregations: []string{"median"}}); err == nil {
+			t.Error("AggregateData() accepted an unknown aggregation")
+		}
+	})
+}
+
+func TestDataPointRoundTrip(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, storage storage.Storage) {
+		ctx := context.Background()
+		createSession(t, storage, "s1")
+
+		points := []models.DataPoint{
+			{
+				SessionID:     "s1",
+				DeviceID:      "d1",
+				Timestamp:     1000,
+				Data:          `{"alarm":true,"ch":[{"value":1},{"value":2}],"mode":"auto","temp":21.5}`,
+				Quality:       `{"temp":{"quality":"out_of_range","error":"21.5 above maximum 20"},"level":{"quality":"bad","error":"insufficient data for uint16"}}`,
+				ParserID:      "p1",
+				ParserVersion: 3,
+				FrameID:       42,
+			},
+			{SessionID: "s1", DeviceID: "d1", Timestamp: 2000, Data: `{}`},
+		}
+		if err := storage.WriteDataPoints(ctx, points); err != nil {
+			t.Fatalf("Failed to write data points: %v", err)
+		}
+
+		got, err := storage.QueryData(ctx, "s1", "d1", 0, 3000)
+		if err != nil {
+			t.Fatalf("Failed to query data: %v", err)
+		}
+		if !reflect.DeepEqual(got, points) {
+			t.Errorf("QueryData() =\n%+v\nwant\n%+v", got, points)
+		}
+	})
+}
+
+func TestSQLiteNormalizesLegacyDataPoints(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "legacy.db")
+
+	// Data points as stored before samples existed, some left behind by a
+	// deleted session
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for _, statement := range []string{
+		`CREATE TABLE sessions (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			status TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL
+		)`,
+		`INSERT INTO sessions (id, name, status, created_at, updated_at) VALUES ('s1', 'Legacy', 'idle', 0, 0)`,
+		`CREATE TABLE data_points (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			session_id TEXT NOT NULL,
+			device_id TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			data TEXT NOT NULL,
+			quality TEXT
+		)`,
+		`INSERT INTO data_points (session_id, device_id, timestamp, data, quality)
+			VALUES ('s1', 'd1', 1000, '{"temp": 21.5, "mode": "auto", "ok": false}', '{"temp":{"quality":"stale"}}')`,
+		`INSERT INTO data_points (session_id, device_id, timestamp, data) VALUES ('s1', 'd1', 2000, '{"temp": 23}')`,
+		`INSERT INTO data_points (session_id, device_id, timestamp, data) VALUES ('deleted', 'd1', 2000, '{"temp": 99}')`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("Failed to create legacy data: %v", err)
+		}
+	}
+	db.Close()
+
+	storage, err := sqlite.NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer storage.Close()
+
+	got, err := storage.QueryData(ctx, "s1", "d1", 0, 3000)
+	if err != nil {
+		t.Fatalf("Failed to query data: %v", err)
+	}
+	want := []models.DataPoint{
+		{SessionID: "s1", DeviceID: "d1", Timestamp: 1000, Data: `{"mode":"auto","ok":false,"temp":21.5}`, Quality: `{"temp":{"quality":"stale"}}`},
+		{SessionID: "s1", DeviceID: "d1", Timestamp: 2000, Data: `{"temp":23}`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("QueryData() =\n%+v\nwant\n%+v", got, want)
+	}
+
+	buckets, err := storage.AggregateData(ctx, models.AggregateQuery{
+		SessionID:    "s1",
+		DeviceID:     "d1",
+		End:          3000,
+		Bucket:       10000,
+		Aggregations: []string{models.AggregateMax},
+		Fields:       []string{"temp"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to aggregate data: %v", err)
+	}
+	if len(buckets) != 1 || buckets[0].Values["temp"]["max"] != 23 {
+		t.Errorf("AggregateData() = %+v, want max temp 23", buckets)
+	}
+
+	// Points of the deleted session are removed together with their samples
+	if got, err := storage.QueryData(ctx, "deleted", "d1", 0, 3000); err != nil || len(got) != 0 {
+		t.Errorf("QueryData() of a deleted session = %+v, %v, want nothing", got, err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, storage storage.Storage) {
+		ctx := context.Background()
+
+		retention := &models.Retention{
+			RawMaxAge: 3600,
+			Rollups:   []models.Rollup{{Bucket: 60, MaxAge: 86400}, {Bucket: 3600}},
+		}
+		for _, session := range []*models.Session{
+			{ID: "s1", Name: "Kept an hour", Status: "idle", Retention: retention},
+			{ID: "s2", Name: "Kept forever", Status: "idle"},
+		} {
+			if err := storage.CreateSession(ctx, session); err != nil {
+				t.Fatalf("Failed to create session: %v", err)
+			}
+		}
+		if session, err := storage.GetSession(ctx, "s1"); err != nil || !reflect.DeepEqual(session.Retention, retention) {
+			t.Fatalf("GetSession() retention = %+v, %v, want %+v", session.Retention, err, retention)
+		}
+
+		// Two hours of points every ten seconds, up to now
+		now := int64(1000 * 3600 * 1000)
+		var points []models.DataPoint
+		for ts, i := now-2*3600*1000, 0; ts <= now; ts, i = ts+10000, i+1 {
+			data := fmt.Sprintf(`{"temp": %d, "state": "ok"}`, i%50)
+			points = append(points,
+				models.DataPoint{SessionID: "s1", DeviceID: "d1", Timestamp: ts, Data: data},
+				models.DataPoint{SessionID: "s2", DeviceID: "d1", Timestamp: ts, Data: data})
+		}
+		if err := storage.WriteDataPoints(ctx, points); err != nil {
+			t.Fatalf("Failed to write data points: %v", err)
+		}
+
+		aggregate := func(session string, bucket int64) []models.AggregateBucket {
+			t.Helper()
+			buckets, err := storage.AggregateData(ctx, models.AggregateQuery{
+				SessionID:    session,
+				DeviceID:     "d1",
+				Start:        now - 2*3600*1000,
+				End:          now,
+				Bucket:       bucket,
+				Aggregations: []string{models.AggregateMin, models.AggregateMax, models.AggregateAvg, models.AggregateFirst, models.AggregateLast, models.AggregateCount},
+			})
+			if err != nil {
+				t.Fatalf("Failed to aggregate data: %v", err)
+			}
+			return buckets
+		}
+		hourly, minutely := aggregate("s1", 3600*1000), aggregate("s1", 60*1000)
+
+		report, err := storage.ApplyRetention(ctx, now)
+		if err != nil {
+			t.Fatalf("ApplyRetention() error = %v", err)
+		}
+		// Raw points of the first hour are covered by both rollups
+		if report.Sessions != 1 || report.DeletedPoints != 360 || report.DeletedRollups != 0 {
+			t.Errorf("report = %+v, want 1 session and 360 deleted points", report)
+		}
+		if report.Rollups != 119+1 {
+			t.Errorf("report.Rollups = %d, want 120", report.Rollups)
+		}
+
+		remaining, err := storage.QueryData(ctx, "s1", "d1", 0, now)
+		if err != nil {
+			t.Fatalf("Failed to query data: %v", err)
+		}
+		if len(remaining) != 361 || remaining[0].Timestamp != now-3600*1000 {
+			t.Errorf("QueryData() returned %d points, want the 361 of the last hour", len(remaining))
+		}
+		if kept, _ := storage.QueryData(ctx, "s2", "d1", 0, now); len(kept) != 721 {
+			t.Errorf("QueryData() without retention returned %d points, want 721", len(kept))
+		}
+
+		// The rollups answer for the purged points
+		if got := aggregate("s1", 3600*1000); !reflect.DeepEqual(got, hourly) {
+			t.Errorf("hourly aggregates after retention =\n%+v\nwant\n%+v", got, hourly)
+		}
+		if got := aggregate("s1", 60*1000); !reflect.DeepEqual(got, minutely) {
+			t.Errorf("minute aggregates after retention =\n%+v\nwant\n%+v", got, minutely)
+		}
+
+		// Two days later only the hourly rollups are left
+		report, err = storage.ApplyRetention(ctx, now+2*86400*1000)
+		if err != nil {
+			t.Fatalf("ApplyRetention() error = %v", err)
+		}
+		if report.DeletedPoints != 361 || report.DeletedRollups != 121 || report.ReclaimedBytes <= 0 {
+			t.Errorf("report = %+v, want 361 deleted points, 121 deleted rollups and reclaimed space", report)
+		}
+		if got := aggregate("s1", 3600*1000); !reflect.DeepEqual(got, hourly) {
+			t.Errorf("hourly aggregates after purging all raw data =\n%+v\nwant\n%+v", got, hourly)
+		}
+
+		// Points arriving late join the rollups they belong to, also once
+		// the raw points around them are gone, and are not rolled up again
+		var late []models.DataPoint
+		for _, ts := range []int64{now - 2*3600*1000 + 5000, now - 3600*1000 - 1, now - 1800*1000} {
+			late = append(late,
+				models.DataPoint{SessionID: "s1", DeviceID: "d1", Timestamp: ts, Data: `{"temp": 99}`},
+				models.DataPoint{SessionID: "s2", DeviceID: "d1", Timestamp: ts, Data: `{"temp": 99}`})
+		}
+		if err := storage.WriteDataPoints(ctx, late[:1]); err != nil {
+			t.Fatalf("Failed to write data points: %v", err)
+		}
+		if err := storage.WriteDataPoints(ctx, late[1:]); err != nil {
+			t.Fatalf("Failed to write data points: %v", err)
+		}
+		want := aggregate("s2", 3600*1000)
+		if got := aggregate("s1", 3600*1000); !reflect.DeepEqual(got, want) {
+			t.Errorf("hourly aggregates with late points =\n%+v\nwant\n%+v", got, want)
+		}
+		if _, err := storage.ApplyRetention(ctx, now+3*86400*1000); err != nil {
+			t.Fatalf("ApplyRetention() error = %v", err)
+		}
+		if got := aggregate("s1", 3600*1000); !reflect.DeepEqual(got, want) {
+			t.Errorf("hourly aggregates with late points after retention =\n%+v\nwant\n%+v", got, want)
+		}
+	})
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	storage, err := sqlite.NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	createSession(t, storage, "s1")
+	points := []models.DataPoint{
+		{SessionID: "s1", DeviceID: "d1", Timestamp: 1000, Data: `{"mode":"auto","temp":21.5}`},
+		{SessionID: "s1", DeviceID: "d1", Timestamp: 2000, Data: `{"ok":true,"temp":23}`},
+	}
+	if err := storage.WriteDataPoints(ctx, points); err != nil {
+		t.Fatalf("Failed to write data points: %v", err)
+	}
+	storage.Close()
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	schemaVersion := func() int {
+		t.Helper()
+		var version int
+		if err := db.QueryRow(`SELECT MAX(version) FROM schema_version`).Scan(&version); err != nil {
+			t.Fatalf("Failed to read schema version: %v", err)
+		}
+		return version
+	}
+	if got, want := schemaVersion(), sqlite.LatestSchemaVersion(); got != want {
+		t.Fatalf("schema version = %d, want %d", got, want)
+	}
+
+	// Down to before samples: the JSON data is restored
+	if err := sqlite.Migrate(path, 1); err != nil {
+		t.Fatalf("Migrate() down error = %v", err)
+	}
+	if got := schemaVersion(); got != 1 {
+		t.Errorf("schema version after downgrade = %d, want 1", got)
+	}
+	var data string
+	if err := db.QueryRow(`SELECT data FROM data_points WHERE timestamp = 1000`).Scan(&data); err != nil {
+		t.Fatalf("Failed to read data point: %v", err)
+	}
+	if data != `{"mode":"auto","temp":21.5}` {
+		t.Errorf("data after downgrade = %s", data)
+	}
+
+	// And up again on startup
+	storage, err = sqlite.NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	got, err := storage.QueryData(ctx, "s1", "d1", 0, 3000)
+	storage.Close()
+	if err != nil {
+		t.Fatalf("Failed to query data: %v", err)
+	}
+	if !reflect.DeepEqual(got, points) {
+		t.Errorf("QueryData() after upgrade =\n%+v\nwant\n%+v", got, points)
+	}
+
+	// A newer build's schema is refused
+	if _, err := db.Exec(`INSERT INTO schema_version (version, description, applied_at) VALUES (?, 'from the future', 0)`,
+		sqlite.LatestSchemaVersion()+1); err != nil {
+		t.Fatalf("Failed to record schema version: %v", err)
+	}
+	if _, err := sqlite.NewSQLiteStorage(path); !errors.Is(err, sqlite.ErrSchemaTooNew) {
+		t.Errorf("NewSQLiteStorage() with a newer schema error = %v, want ErrSchemaTooNew", err)
+	}
+}
+
+func TestPostgresMigrations(t *testing.T) {
+	ctx := context.Background()
+	dsn := postgresTestDSN(t)
+
+	storage, err := postgres.NewPostgresStorage(dsn, postgres.Options{})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	storage.Close()
+
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	tableExists := func(table string) bool {
+		t.Helper()
+		var exists bool
+		if err := db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists); err != nil {
+			t.Fatalf("Failed to look up table: %v", err)
+		}
+		return exists
+	}
+	if !tableExists("data_points") {
+		t.Fatal("data_points missing after migration")
+	}
+
+	// Down to nothing and up again on startup
+	if err := postgres.Migrate(dsn, 0); err != nil {
+		t.Fatalf("Migrate() down error = %v", err)
+	}
+	if tableExists("data_points") || tableExists("sessions") {
+		t.Error("tables left after migrating to version 0")
+	}
+
+	storage, err = postgres.NewPostgresStorage(dsn, postgres.Options{})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	createSession(t, storage, "s1")
+	points := []models.DataPoint{{SessionID: "s1", DeviceID: "d1", Timestamp: 1000, Data: `{"temp":21.5}`}}
+	if err := storage.WriteDataPoints(ctx, points); err != nil {
+		t.Fatalf("Failed to write data points: %v", err)
+	}
+	got, err := storage.QueryData(ctx, "s1", "d1", 0, 3000)
+	storage.Close()
+	if err != nil {
+		t.Fatalf("Failed to query data: %v", err)
+	}
+	if !reflect.DeepEqual(got, points) {
+		t.Errorf("QueryData() after upgrade =\n%+v\nwant\n%+v", got, points)
+	}
+
+	// A newer build's schema is refused
+	if _, err := db.Exec(`INSERT INTO schema_version (version, description, applied_at) VALUES ($1, 'from the future', 0)`,
+		postgres.LatestSchemaVersion()+1); err != nil {
+		t.Fatalf("Failed to record schema version: %v", err)
+	}
+	if _, err := postgres.NewPostgresStorage(dsn, postgres.Options{}); !errors.Is(err, postgres.ErrSchemaTooNew) {
+		t.Errorf("NewPostgresStorage() with a newer schema error = %v, want ErrSchemaTooNew", err)
+	}
+}
+
+func TestTimescaleDBHypertables(t *testing.T) {
+	if os.Getenv(timescaleDBEnv) == "" {
+		t.Skipf("%s not set", timescaleDBEnv)
+	}
+	ctx := context.Background()
+	dsn := postgresTestDSN(t)
+
+	// Points written before TimescaleDB is enabled move into chunks
+	storage, err := postgres.NewPostgresStorage(dsn, postgres.Options{})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	createSession(t, storage, "s1")
+	points := []models.DataPoint{{SessionID: "s1", DeviceID: "d1", Timestamp: 1000, Data: `{"temp":21.5}`}}
+	err = storage.WriteDataPoints(ctx, points)
+	storage.Close()
+	if err != nil {
+		t.Fatalf("Failed to write data points: %v", err)
+	}
+
+	storage, err = postgres.NewPostgresStorage(dsn, postgres.Options{TimescaleDB: true})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	storage.Close()
+
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	var hypertables []string
+	rows, err := db.Query(`
+		SELECT hypertable_name FROM timescaledb_information.hypertables
+		WHERE hypertable_schema = current_schema()
+		ORDER BY hypertable_name
+	`)
+	if err != nil {
+		t.Fatalf("Failed to list hypertables: %v", err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatalf("Failed to list hypertables: %v", err)
+		}
+		hypertables = append(hypertables, name)
+	}
+	rows.Close()
+	if want := []string{"data_points", "samples"}; !reflect.DeepEqual(hypertables, want) {
+		t.Errorf("hypertables = %v, want %v", hypertables, want)
+	}
+
+	// Enabling it again on the next start keeps the hypertables
+	storage, err = postgres.NewPostgresStorage(dsn, postgres.Options{TimescaleDB: true})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer storage.Close()
+	got, err := storage.QueryData(ctx, "s1", "d1", 0, 3000)
+	if err != nil {
+		t.Fatalf("Failed to query data: %v", err)
+	}
+	if !reflect.DeepEqual(got, points) {
+		t.Errorf("QueryData() from hypertables =\n%+v\nwant\n%+v", got, points)
+	}
+}
@@ -9,7 +9,7 @@ export interface Session {
 export interface Connection {
   id: string
   sessionId: string
-  type: 'modbus_tcp' | 'modbus_rtu'
+  type: 'modbus_tcp' | 'modbus_rtu' | 'mqtt' | 'tcp' | 'replay'
   name: string
   config: string
   status: 'disconnected' | 'connecting' | 'connected' | 'error'
@@ -47,7 +47,7 @@ export interface VisualRule {
   bitWidth: number
   endianness: string
   scale: number
-  offset: number
+  valueOffset: number
 }
 
 export interface DataPoint {